@@ -8,12 +8,22 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/engine"
 )
 
+// setNamespace scopes req to SCHEDULER_NAMESPACE, if set.
+func setNamespace(req *http.Request) {
+	if ns := os.Getenv("SCHEDULER_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Namespace", ns)
+	}
+}
+
 func postJSON(base string, path string, payload interface{}, out interface{}) error {
 	b, _ := json.Marshal(payload)
 	req, _ := http.NewRequest(http.MethodPost, base+path, bytes.NewBuffer(b))
 	req.Header.Set("Content-Type", "application/json")
+	setNamespace(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -27,6 +37,7 @@ func postJSON(base string, path string, payload interface{}, out interface{}) er
 
 func getJSON(base string, path string, out interface{}) error {
 	req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+	setNamespace(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -46,7 +57,7 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: cli <command> [args]")
-		fmt.Println("Commands: create")
+		fmt.Println("Commands: create, lint")
 		return
 	}
 
@@ -54,6 +65,8 @@ func main() {
 	switch cmd {
 	case "create":
 		handleCreate(base)
+	case "lint":
+		handleLint(os.Args[2:])
 	default:
 		fmt.Printf("Unknown command: %s\n", cmd)
 	}
@@ -121,7 +134,7 @@ func handleCreate(base string) {
 	if paramsJSON == "" {
 		paramsJSON = "{}"
 	}
-	var tResp map[string]string
+	var tResp map[string]interface{}
 	if err := postJSON(base, "/tasks", map[string]interface{}{
 		"FlowVersionID": verID,  // Use FlowVersionID explicitly
 		"FlowID":        flowID, // Fallback
@@ -130,13 +143,45 @@ func handleCreate(base string) {
 		fmt.Printf("Create Task failed: %v\n", err)
 		return
 	}
-	taskID := tResp["id"]
+	taskID, _ := tResp["id"].(string)
 	fmt.Printf("Created Task: %s\n", taskID)
 
 	// Poll for status
 	monitorTask(base, taskID)
 }
 
+// handleLint validates flow files (JSON or YAML) locally and prints their
+// issues. It exits with status 1 if any file has errors.
+func handleLint(files []string) {
+	if len(files) == 0 {
+		fmt.Println("Usage: cli lint <flow.json|flow.yaml>...")
+		os.Exit(2)
+	}
+	failed := false
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			fmt.Printf("%s: %v\n", f, err)
+			failed = true
+			continue
+		}
+		issues := engine.ValidateFlow(src)
+		for _, is := range issues {
+			sep := ": "
+			if is.Line > 0 {
+				sep = ":"
+			}
+			fmt.Printf("%s%s%s\n", f, sep, is)
+		}
+		if issues.HasErrors() {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
 func monitorTask(base, taskID string) {
 	fmt.Println("Monitoring task...")
 	for i := 0; i < 60; i++ { // Poll for 60 seconds
@@ -15,10 +15,18 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// setNamespace scopes req to SCHEDULER_NAMESPACE, if set.
+func setNamespace(req *http.Request) {
+	if ns := os.Getenv("SCHEDULER_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Namespace", ns)
+	}
+}
+
 func postJSON(base string, path string, payload interface{}, out interface{}) error {
 	b, _ := json.Marshal(payload)
 	req, _ := http.NewRequest(http.MethodPost, base+path, bytes.NewBuffer(b))
 	req.Header.Set("Content-Type", "application/json")
+	setNamespace(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -32,6 +40,7 @@ func postJSON(base string, path string, payload interface{}, out interface{}) er
 
 func getJSON(base string, path string, out interface{}) error {
 	req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+	setNamespace(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -249,9 +258,9 @@ func main() {
 		_ = postJSON(base, "/flows/version", map[string]interface{}{"FlowID": flowID, "Version": 1, "DefinitionJSON": definitionJSON, "Status": "published"}, &verResp)
 		params := deriveParams(def)
 		paramsStr, _ := json.Marshal(params)
-		var tResp map[string]string
+		var tResp map[string]interface{}
 		_ = postJSON(base, "/tasks", map[string]interface{}{"FlowID": flowID, "ParamsJSON": string(paramsStr)}, &tResp)
-		taskID := tResp["id"]
+		taskID, _ := tResp["id"].(string)
 		sigs := detectSignals(def)
 		if len(sigs) > 0 {
 			time.Sleep(300 * time.Millisecond)
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/backup"
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/crypt"
+	"github.com/nuknal/PocketFlowGo/pkg/store/backend"
+	"github.com/nuknal/PocketFlowGo/pkg/store/cryptstore"
+)
+
+func usage() {
+	fmt.Println("Usage: pfctl <command> [args]")
+	fmt.Println("Commands:")
+	fmt.Println("  migrate status            show applied and pending migrations")
+	fmt.Println("  migrate up [version]      apply pending migrations (up to version)")
+	fmt.Println("  migrate down [steps]      roll back the last steps migrations (default 1)")
+	fmt.Println("  backup <file>             write flows, tasks, workers, logs and blobs to file")
+	fmt.Println("  restore [-on-conflict=fail|skip] <file>")
+	fmt.Println("                            load a backup; fail (default) restores nothing if an ID")
+	fmt.Println("                            exists, skip keeps existing records")
+	fmt.Println("  keys new                  add a key to ENCRYPTION_KEY_FILE and make it current")
+	fmt.Println("  reencrypt                 encrypt all task data and blobs with the current key")
+	fmt.Println("The database is taken from SCHEDULER_DSN (or SCHEDULER_DB), blobs from")
+	fmt.Println("BLOB_DIR (default blobs) and task logs from logs/tasks. Backups hold task")
+	fmt.Println("data as stored, so encrypted fields stay encrypted.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "migrate":
+		err = handleMigrate(backend.DSNFromEnv(), os.Args[2:])
+	case "backup", "restore":
+		err = handleBackup(backend.DSNFromEnv(), os.Args[1], os.Args[2:])
+	case "keys", "reencrypt":
+		err = handleKeys(backend.DSNFromEnv(), os.Args[1], os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func handleMigrate(dsn string, args []string) error {
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+	n := 0
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid number %q", args[1])
+		}
+		n = v
+	}
+	m, err := backend.Migrator(dsn)
+	if err != nil {
+		return err
+	}
+	defer m.DB.Close()
+
+	switch args[0] {
+	case "status":
+		sts, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, st := range sts {
+			state := "pending"
+			if st.Applied {
+				state = "applied " + time.Unix(st.AppliedAt, 0).Format(time.RFC3339)
+			}
+			if st.Unknown {
+				state += " (unknown to this binary)"
+			}
+			fmt.Printf("%4d  %-50s %s\n", st.Version, st.Name, state)
+		}
+	case "up":
+		done, err := m.Up(n)
+		for _, mg := range done {
+			fmt.Printf("applied %d %s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("already up to date")
+		}
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		done, err := m.Down(n)
+		for _, mg := range done {
+			fmt.Printf("reverted %d %s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
+
+func handleBackup(dsn string, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	onConflict := fs.String("on-conflict", backup.OnConflictFail, "fail or skip")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	s, err := backend.Open(dsn)
+	if err != nil {
+		return err
+	}
+	blobDir := os.Getenv("BLOB_DIR")
+	if blobDir == "" {
+		blobDir = "blobs"
+	}
+	m := &backup.Manager{Store: s, BlobDir: blobDir}
+	var st backup.Stats
+	if cmd == "backup" {
+		st, err = m.Write(fs.Arg(0))
+	} else {
+		st, err = m.Restore(fs.Arg(0), *onConflict)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d flows, %d versions, %d retention policies, %d workers, %d tasks, %d files",
+		cmd, st.Flows, st.Versions, st.Policies, st.Workers, st.Tasks, st.Files)
+	if st.Skipped > 0 {
+		fmt.Printf(", %d skipped", st.Skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+func handleKeys(dsn string, cmd string, args []string) error {
+	path := os.Getenv("ENCRYPTION_KEY_FILE")
+	if path == "" {
+		return fmt.Errorf("ENCRYPTION_KEY_FILE is not set")
+	}
+	if cmd == "keys" {
+		if len(args) != 1 || args[0] != "new" {
+			usage()
+			os.Exit(2)
+		}
+		id, err := crypt.AddKey(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added key %s to %s; restart schedulers, then run pfctl reencrypt\n", id, path)
+		return nil
+	}
+	ring, err := crypt.LoadKeyFile(path)
+	if err != nil {
+		return err
+	}
+	s, err := backend.Open(dsn)
+	if err != nil {
+		return err
+	}
+	c := &crypt.Cipher{Keys: ring}
+	n, err := cryptstore.Rotate(s, c.Rotate)
+	fmt.Printf("reencrypt: %d tasks under key %s\n", n, ring.Current)
+	if err != nil {
+		return err
+	}
+	blobDir := os.Getenv("BLOB_DIR")
+	if blobDir == "" {
+		blobDir = "blobs"
+	}
+	n, err = (&blob.FS{Dir: blobDir, Sealer: c}).Rotate(c.Rotate)
+	fmt.Printf("reencrypt: %d blobs in %s under key %s\n", n, blobDir, ring.Current)
+	return err
+}
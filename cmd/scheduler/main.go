@@ -1,31 +1,83 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nuknal/PocketFlowGo/pkg/archive"
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/crypt"
 	"github.com/nuknal/PocketFlowGo/pkg/engine"
 	"github.com/nuknal/PocketFlowGo/pkg/server"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
-	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
+	"github.com/nuknal/PocketFlowGo/pkg/store/backend"
+	"github.com/nuknal/PocketFlowGo/pkg/store/cryptstore"
 	"github.com/nuknal/PocketFlowGo/ui"
 )
 
 func main() {
-	dbpath := os.Getenv("SCHEDULER_DB")
-	if dbpath == "" {
-		dbpath = "scheduler.db"
-	}
-	s, err := sqlstore.OpenSQLite(dbpath)
+	var s store.Store
+	raw, err := backend.Open(backend.DSNFromEnv())
 	if err != nil {
 		panic(err)
 	}
-	srv := &server.Server{Store: s}
+	s = raw
+	// Index the JSON paths task searches filter on, as a comma separated
+	// list such as $params.customer_id,$shared.order.id.
+	if v := os.Getenv("SEARCH_INDEX_PATHS"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			if err := raw.(store.JSONPathIndexer).IndexJSONPath(strings.TrimSpace(p)); err != nil {
+				panic(err)
+			}
+		}
+	}
+	blobDir := os.Getenv("BLOB_DIR")
+	if blobDir == "" {
+		blobDir = "blobs"
+	}
+	blobFS := &blob.FS{Dir: blobDir}
+	// Encrypt task params, shared state, node run data and blobs at rest.
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		ring, err := crypt.LoadKeyFile(path)
+		if err != nil {
+			panic(err)
+		}
+		c := &crypt.Cipher{Keys: ring}
+		s = cryptstore.New(raw, c)
+		blobFS.Sealer = c
+	}
+	archiveDir := os.Getenv("ARCHIVE_DIR")
+	if archiveDir == "" {
+		archiveDir = "archive"
+	}
+	// Archives get the stored form, so encrypted fields stay encrypted.
+	arch := &archive.Archiver{Store: raw, Dir: archiveDir}
+	blobs := &blob.Codec{Store: blobFS}
+	if v := os.Getenv("BLOB_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			blobs.Threshold = n
+		}
+	}
+	srv := &server.Server{Store: s, Archive: arch, Blobs: blobs}
+	// Default shared state limits for new tasks, in bytes; 0 is unlimited.
+	if v := os.Getenv("SHARED_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			srv.SharedLimits.MaxBytes = n
+		}
+	}
+	if v := os.Getenv("SHARED_MAX_KEY_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			srv.SharedLimits.MaxKeyBytes = n
+		}
+	}
 	mux := http.NewServeMux()
 	srv.RegisterRoutes(mux)
 
@@ -81,8 +133,26 @@ func main() {
 			time.Sleep(time.Duration(interval) * time.Second)
 		}
 	}()
+	go func() {
+		// Retention janitor: archive and delete tasks past their policy.
+		interval := int64(300)
+		if v := os.Getenv("RETENTION_INTERVAL_SEC"); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				interval = n
+			}
+		}
+		for {
+			if n, err := arch.Sweep(time.Now()); err != nil {
+				log.Printf("retention sweep: %v", err)
+			} else if n > 0 {
+				log.Printf("retention sweep archived %d tasks to %s", n, archiveDir)
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
 	go func() {
 		eng := engine.New(s)
+		eng.Blobs = blobs
 		eng.RegisterFunc("mul", engine.MulFunc)
 		eng.RegisterFunc("upper", engine.UpperFunc)
 		eng.RegisterFunc("log_result", engine.LogResultFunc)
@@ -120,22 +190,44 @@ func main() {
 			}
 			for {
 				_ = s.ExtendLease(t.ID, owner, ttl)
-				if err := eng.RunOnce(t.ID); err != nil {
-					// Check if it's a fatal/system error or just a regular execution failure.
-					// RunOnce normally handles node failures by updating status to failed (via finishNode).
-					// But if it returns an error here, it means something prevented it from finishing the node (e.g. panic, db error).
-					// We must mark it as failed to stop the loop.
-					// Note: ErrAsyncPending is handled inside RunOnce (suspends task), so RunOnce returns nil for it?
-					// Let's check executor.go: "return e.suspendTask(...)". suspendTask returns error.
-					// So if suspended, RunOnce returns error?
-					// suspendTask returns error only if DB update fails.
-					// So normally RunOnce returns nil even if suspended.
+				// A cancel request stops the step in flight instead of
+				// waiting for it to finish.
+				ctx, stop := eng.WatchCancel(context.Background(), t.ID, 500*time.Millisecond)
+				err := eng.RunOnce(ctx, t.ID)
+				interrupted := ctx.Err() != nil
+				stop()
+				if err != nil {
+					if errors.Is(err, store.ErrLeaseLost) {
+						// Another scheduler owns the task now; nothing was written.
+						log.Printf("RunOnce lost lease for task %s", t.ID)
+						break
+					}
+					if errors.Is(err, store.ErrConflict) {
+						// The task changed underneath us (e.g. a cancel); redo the step on fresh state.
+						log.Printf("RunOnce conflict for task %s, retrying", t.ID)
+						time.Sleep(100 * time.Millisecond)
+						continue
+					}
+					if interrupted {
+						// The step was stopped before it was recorded; the
+						// task is picked up again once the lease expires.
+						log.Printf("RunOnce interrupted for task %s: %v", t.ID, err)
+						break
+					}
+					// Anything else (a panic, a store error) kept RunOnce from
+					// finishing the step. Fail the task so it does not loop,
+					// but only while this scheduler still holds the lease.
 					log.Printf("RunOnce error for task %s: %v", t.ID, err)
-					_ = s.UpdateTaskStatus(t.ID, "failed")
+					if ferr := eng.FailTask(t.ID, err); ferr != nil {
+						log.Printf("failing task %s: %v", t.ID, ferr)
+					}
 					break
 				}
 				nt, _ := s.GetTask(t.ID)
-				if nt.Status == "completed" || nt.Status == "failed" || nt.Status == "waiting_queue" || nt.CurrentNodeKey == "" {
+				// A task waiting to retry, or to retry a compensation, gave
+				// up its lease; it is leased again once its backoff has
+				// passed.
+				if nt.Status == "completed" || nt.Status == "failed" || nt.Status == "waiting_queue" || nt.Status == "waiting_retry" || nt.LeaseOwner != owner || nt.CurrentNodeKey == "" {
 					break
 				}
 				time.Sleep(100 * time.Millisecond)
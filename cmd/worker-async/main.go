@@ -45,6 +45,7 @@ var (
 	workerID     = flag.String("id", "", "Worker ID (default: hostname-pid)")
 	services     = flag.String("services", "async-transform", "Comma-separated list of services")
 	logDir       = flag.String("log_dir", "./logs", "Directory to store execution logs")
+	namespace    = flag.String("namespace", "", "Namespace to register and poll in (default: default)")
 )
 
 func main() {
@@ -59,7 +60,7 @@ func main() {
 	log.Printf("Starting Async Worker %s polling %s for services: %v", *workerID, *schedulerURL, svcList)
 
 	// Register and Heartbeat
-	regClient := &f.RegistryClient{BaseURL: *schedulerURL + "/api"}
+	regClient := &f.RegistryClient{BaseURL: *schedulerURL + "/api", Namespace: *namespace}
 	go func() {
 		// Registration loop
 		for {
@@ -169,7 +170,7 @@ func updateStatus(runID string, status string) {
 		Status: status,
 	}
 	b, _ := json.Marshal(reqBody)
-	resp, err := client.Post(*schedulerURL+"/api/queue/update_run", "application/json", bytes.NewReader(b))
+	resp, err := post(client, "/api/queue/update_run", b)
 	if err != nil {
 		log.Printf("Failed to update status: %v", err)
 		return
@@ -177,13 +178,26 @@ func updateStatus(runID string, status string) {
 	defer resp.Body.Close()
 }
 
+// post sends a JSON body to the scheduler API in the worker's namespace.
+func post(client *http.Client, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, *schedulerURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *namespace != "" {
+		req.Header.Set("X-Namespace", *namespace)
+	}
+	return client.Do(req)
+}
+
 func poll(client *http.Client, services []string) (*QueueTask, error) {
 	reqBody := map[string]interface{}{
 		"worker_id": *workerID,
 		"services":  services,
 	}
 	b, _ := json.Marshal(reqBody)
-	resp, err := client.Post(*schedulerURL+"/api/queue/poll", "application/json", bytes.NewReader(b))
+	resp, err := post(client, "/api/queue/poll", b)
 	if err != nil {
 		return nil, err
 	}
@@ -229,11 +243,15 @@ func completeTask(client *http.Client, task *QueueTask, result interface{}, errS
 		RunID:   payload.RunID,
 	}
 	b, _ := json.Marshal(reqBody)
-	resp, err := client.Post(*schedulerURL+"/api/queue/complete", "application/json", bytes.NewReader(b))
+	resp, err := post(client, "/api/queue/complete", b)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		log.Printf("Task %s was revoked, result dropped", task.ID)
+		return nil
+	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("complete status %d", resp.StatusCode)
 	}
@@ -127,7 +127,7 @@ func main() {
 	if selfURL == "" {
 		selfURL = "http://localhost:8080"
 	}
-	client := &f.RegistryClient{BaseURL: regURL}
+	client := &f.RegistryClient{BaseURL: regURL, Namespace: os.Getenv("WORKER_NAMESPACE")}
 	id := fmt.Sprintf("worker-%d", time.Now().UnixNano())
 	mux := http.NewServeMux()
 	services := map[string]http.HandlerFunc{
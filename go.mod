@@ -3,7 +3,8 @@ module github.com/nuknal/PocketFlowGo
 go 1.20
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.32
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,298 @@
+// Package archive moves finished tasks past their retention period out of
+// the store into gzip-compressed JSONL files, and restores them on request.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// ErrNotArchived is returned by Restore for a task found in no archive.
+var ErrNotArchived = errors.New("task not archived")
+
+// Record is one archived task: a line in an archive file.
+type Record struct {
+	Task     store.Task        `json:"task"`
+	NodeRuns []store.NodeRun   `json:"node_runs"`
+	Events   []store.TaskEvent `json:"events"`
+	// Logs maps file paths relative to the task's log directory to their
+	// contents.
+	Logs       map[string][]byte `json:"logs,omitempty"`
+	ArchivedAt int64             `json:"archived_at"`
+}
+
+// Entry summarises an archived task for listing.
+type Entry struct {
+	TaskID     string `json:"task_id"`
+	Namespace  string `json:"namespace"`
+	FlowID     string `json:"flow_id"`
+	FlowName   string `json:"flow_name"`
+	Status     string `json:"status"`
+	UpdatedAt  int64  `json:"updated_at"`
+	ArchivedAt int64  `json:"archived_at"`
+	File       string `json:"file"`
+}
+
+// Archiver sweeps expired tasks from Store into Dir.
+type Archiver struct {
+	Store store.Store
+	// Dir holds the archive files. It is created on first use.
+	Dir string
+	// LogDir contains one directory of script logs per task ID; defaults
+	// to logs/tasks, where the local script executor writes them.
+	LogDir string
+	// Batch is the number of tasks per archive file; defaults to 100.
+	Batch int
+}
+
+func (a *Archiver) logDir() string {
+	if a.LogDir == "" {
+		return filepath.Join("logs", "tasks")
+	}
+	return a.LogDir
+}
+
+func (a *Archiver) batch() int {
+	if a.Batch <= 0 {
+		return 100
+	}
+	return a.Batch
+}
+
+// Sweep archives and deletes every task that has outlived its retention
+// policy as of now. Each batch is written and synced before its tasks are
+// deleted, so a crash can at worst archive a task twice. It returns the
+// number of tasks archived.
+func (a *Archiver) Sweep(now time.Time) (int, error) {
+	total := 0
+	for {
+		ts, err := a.Store.ListExpiredTasks(now.Unix(), a.batch())
+		if err != nil || len(ts) == 0 {
+			return total, err
+		}
+		recs := make([]Record, 0, len(ts))
+		for _, t := range ts {
+			runs, err := a.Store.ListNodeRuns(t.ID)
+			if err != nil {
+				return total, err
+			}
+			events, err := a.Store.ListTaskEvents(t.ID)
+			if err != nil {
+				return total, err
+			}
+			logs, err := a.readLogs(t.ID)
+			if err != nil {
+				return total, err
+			}
+			recs = append(recs, Record{Task: t, NodeRuns: runs, Events: events, Logs: logs, ArchivedAt: now.Unix()})
+		}
+		if err := a.write(now, recs); err != nil {
+			return total, err
+		}
+		ids := make([]string, len(ts))
+		for i, t := range ts {
+			ids[i] = t.ID
+		}
+		if err := a.Store.DeleteTasks(ids); err != nil {
+			return total, err
+		}
+		for _, id := range ids {
+			_ = os.RemoveAll(filepath.Join(a.logDir(), id))
+		}
+		total += len(ts)
+		if len(ts) < a.batch() {
+			return total, nil
+		}
+	}
+}
+
+func (a *Archiver) readLogs(taskID string) (map[string][]byte, error) {
+	root := filepath.Join(a.logDir(), taskID)
+	out := map[string][]byte{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		out[filepath.ToSlash(rel)] = b
+		return nil
+	})
+	if len(out) == 0 {
+		out = nil
+	}
+	return out, err
+}
+
+// write stores recs in a new archive file, renamed into place once synced.
+func (a *Archiver) write(now time.Time, recs []Record) error {
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("tasks-%s-%d.jsonl.gz", now.UTC().Format("20060102T150405Z"), time.Now().UnixNano())
+	tmp, err := os.CreateTemp(a.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(zw)
+	for _, r := range recs {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(a.Dir, name))
+}
+
+// files lists archive files, newest first.
+func (a *Archiver) files() ([]string, error) {
+	des, err := os.ReadDir(a.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, de := range des {
+		if !de.IsDir() && strings.HasSuffix(de.Name(), ".jsonl.gz") {
+			out = append(out, de.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(out)))
+	return out, nil
+}
+
+// scan calls fn for each record in file until fn returns false.
+func (a *Archiver) scan(file string, fn func(Record) bool) error {
+	f, err := os.Open(filepath.Join(a.Dir, file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	defer zr.Close()
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 1<<30)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if !fn(r) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+// List returns archived tasks, newest archive first. A non-empty flowID
+// limits the result to that flow. Archive files are read in full, so this
+// is meant for operators rather than hot paths.
+func (a *Archiver) List(flowID string) ([]Entry, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	out := []Entry{}
+	for _, file := range files {
+		err := a.scan(file, func(r Record) bool {
+			if flowID == "" || r.Task.FlowID == flowID {
+				out = append(out, Entry{TaskID: r.Task.ID, Namespace: store.Namespace(r.Task.Namespace), FlowID: r.Task.FlowID, FlowName: r.Task.FlowName, Status: r.Task.Status, UpdatedAt: r.Task.UpdatedAt, ArchivedAt: r.ArchivedAt, File: file})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Find returns the most recently archived copy of a task, or
+// ErrNotArchived.
+func (a *Archiver) Find(taskID string) (Record, error) {
+	files, err := a.files()
+	if err != nil {
+		return Record{}, err
+	}
+	for _, file := range files {
+		var rec *Record
+		err := a.scan(file, func(r Record) bool {
+			if r.Task.ID == taskID {
+				rec = &r
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return Record{}, err
+		}
+		if rec != nil {
+			return *rec, nil
+		}
+	}
+	return Record{}, ErrNotArchived
+}
+
+// Restore puts the most recently archived copy of a task back into the
+// store along with its node runs, journal and logs. The archive file is left as is.
+func (a *Archiver) Restore(taskID string) error {
+	rec, err := a.Find(taskID)
+	if err != nil {
+		return err
+	}
+	if err := a.Store.RestoreTask(rec.Task, rec.NodeRuns, rec.Events); err != nil {
+		return err
+	}
+	root := filepath.Join(a.logDir(), taskID)
+	for name, b := range rec.Logs {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
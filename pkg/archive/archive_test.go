@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/memstore"
+)
+
+func TestSweepAndRestore(t *testing.T) {
+	s := memstore.New()
+	dir := t.TempDir()
+	a := &Archiver{Store: s, Dir: filepath.Join(dir, "archive"), LogDir: filepath.Join(dir, "logs"), Batch: 2}
+
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	if err := s.SetRetentionPolicy(store.RetentionPolicy{FlowID: fid, Status: "completed", KeepSec: 60}); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, _ := s.CreateTask(vid, "{}", "", "a")
+		_ = s.UpdateTaskStatus(id, "completed")
+		ids = append(ids, id)
+	}
+	_ = s.SaveNodeRun(map[string]interface{}{"task_id": ids[0], "node_key": "a", "status": "ok"})
+	logPath := filepath.Join(a.LogDir, ids[0], "a_1.log")
+	_ = os.MkdirAll(filepath.Dir(logPath), 0755)
+	_ = os.WriteFile(logPath, []byte("hello\n"), 0644)
+	pending, _ := s.CreateTask(vid, "{}", "", "a")
+
+	if n, err := a.Sweep(time.Now()); err != nil || n != 0 {
+		t.Fatalf("early sweep: %d %v", n, err)
+	}
+	n, err := a.Sweep(time.Now().Add(2 * time.Minute))
+	if err != nil || n != 3 {
+		t.Fatalf("sweep: %d %v", n, err)
+	}
+	for _, id := range ids {
+		if _, err := s.GetTask(id); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("task %s not deleted: %v", id, err)
+		}
+	}
+	if _, err := s.GetTask(pending); err != nil {
+		t.Fatalf("pending task swept: %v", err)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Fatalf("log not removed: %v", err)
+	}
+	files, _ := a.files()
+	if len(files) != 2 {
+		t.Fatalf("want 2 archive files for batch 2, got %v", files)
+	}
+	es, err := a.List(fid)
+	if err != nil || len(es) != 3 {
+		t.Fatalf("list: %+v %v", es, err)
+	}
+	if es, _ := a.List("other"); len(es) != 0 {
+		t.Fatalf("flow filter: %+v", es)
+	}
+
+	if err := a.Restore(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	tk, err := s.GetTask(ids[0])
+	if err != nil || tk.Status != "completed" {
+		t.Fatalf("restored %+v %v", tk, err)
+	}
+	if runs, _ := s.ListNodeRuns(ids[0]); len(runs) != 1 {
+		t.Fatalf("runs %+v", runs)
+	}
+	if evs, _ := s.ListTaskEvents(ids[0]); len(evs) != 3 || evs[1].ToStatus != "completed" {
+		t.Fatalf("events %+v", evs)
+	}
+	if b, err := os.ReadFile(logPath); err != nil || string(b) != "hello\n" {
+		t.Fatalf("log %q %v", b, err)
+	}
+	if err := a.Restore(ids[0]); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("second restore: %v", err)
+	}
+	if err := a.Restore("missing"); !errors.Is(err, ErrNotArchived) {
+		t.Fatalf("missing: %v", err)
+	}
+}
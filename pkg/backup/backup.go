@@ -0,0 +1,603 @@
+// Package backup copies everything the scheduler keeps, from any
+// store.Store backend, into one portable archive and loads it back into
+// another, so data can move between backends without custom SQL.
+//
+// An archive is a gzip-compressed tar file. manifest.json comes first,
+// followed by one JSON file per flow (flows/<id>.json, with its versions),
+// retention.json, one file per worker and per task (tasks/<id>.json, with
+// its node runs, journal, node states and queue entries), and finally the
+// tasks' log files under logs/ and the blob store under blobs/.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// Format names the archive format in its manifest.
+const Format = "pocketflow-backup"
+
+// Version is the archive format version written by this package. Restore
+// rejects archives from newer versions.
+const Version = 1
+
+// What Restore does with a flow, flow version, task or queue entry whose
+// ID already exists in the target store.
+const (
+	// OnConflictFail checks the whole archive first and restores nothing
+	// if any ID is taken.
+	OnConflictFail = "fail"
+	// OnConflictSkip keeps the existing record and skips the archived one,
+	// together with everything that belongs to it.
+	OnConflictSkip = "skip"
+)
+
+// ErrConflict is wrapped by Restore errors for IDs that already exist.
+var ErrConflict = errors.New("backup conflicts with existing data")
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// FlowRecord is a flow and its versions.
+type FlowRecord struct {
+	Flow     store.Flow          `json:"flow"`
+	Versions []store.FlowVersion `json:"versions"`
+}
+
+// TaskRecord is a task and everything stored for it.
+type TaskRecord struct {
+	Task       store.Task        `json:"task"`
+	NodeRuns   []store.NodeRun   `json:"node_runs"`
+	Events     []store.TaskEvent `json:"events"`
+	NodeStates []store.NodeState `json:"node_states"`
+	Queue      []store.QueueTask `json:"queue"`
+}
+
+// Stats counts what a backup or restore copied. Skipped counts records
+// left out by OnConflictSkip.
+type Stats struct {
+	Flows    int `json:"flows"`
+	Versions int `json:"versions"`
+	Policies int `json:"policies"`
+	Workers  int `json:"workers"`
+	Tasks    int `json:"tasks"`
+	Files    int `json:"files"`
+	Skipped  int `json:"skipped"`
+}
+
+// Manager backs up and restores Store together with the files that go
+// with it.
+type Manager struct {
+	Store store.Store
+	// LogDir contains one directory of script logs per task ID; defaults
+	// to logs/tasks, where the local script executor writes them.
+	LogDir string
+	// BlobDir is the blob.FS directory. Blobs are skipped if it is empty.
+	BlobDir string
+	// Batch is the number of tasks read per page; defaults to 100.
+	Batch int
+}
+
+func (m *Manager) logDir() string {
+	if m.LogDir == "" {
+		return filepath.Join("logs", "tasks")
+	}
+	return m.LogDir
+}
+
+func (m *Manager) batch() int {
+	if m.Batch <= 0 {
+		return 100
+	}
+	return m.Batch
+}
+
+// Write backs up the store to file, which is replaced once the archive is
+// complete. Tasks are read page by page in creation order, so a backup
+// taken while the scheduler runs is consistent per task but not across
+// tasks.
+func (m *Manager) Write(file string) (Stats, error) {
+	var st Stats
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return st, err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return st, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := m.write(tmp, &st); err != nil {
+		tmp.Close()
+		return st, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return st, err
+	}
+	if err := tmp.Close(); err != nil {
+		return st, err
+	}
+	return st, os.Rename(tmp.Name(), file)
+}
+
+func (m *Manager) write(w io.Writer, st *Stats) error {
+	zw := gzip.NewWriter(w)
+	tw := &tarWriter{w: tar.NewWriter(zw), now: time.Now()}
+	if err := tw.json("manifest.json", Manifest{Format: Format, Version: Version, CreatedAt: tw.now.Unix()}); err != nil {
+		return err
+	}
+	flows, _, err := m.Store.ListFlows("", 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range flows {
+		vs, err := m.Store.ListFlowVersions(f.ID)
+		if err != nil {
+			return err
+		}
+		if err := tw.json("flows/"+f.ID+".json", FlowRecord{Flow: f, Versions: vs}); err != nil {
+			return err
+		}
+		st.Flows++
+		st.Versions += len(vs)
+	}
+	ps, err := m.Store.ListRetentionPolicies("")
+	if err != nil {
+		return err
+	}
+	if err := tw.json("retention.json", ps); err != nil {
+		return err
+	}
+	st.Policies = len(ps)
+	ws, err := m.Store.ListWorkers("", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, wk := range ws {
+		if err := tw.json("workers/"+wk.ID+".json", wk); err != nil {
+			return err
+		}
+		st.Workers++
+	}
+	ids := []string{}
+	q := store.TaskQuery{Sort: "created_at", Limit: m.batch()}
+	for {
+		pg, err := m.Store.SearchTasks(q)
+		if err != nil {
+			return err
+		}
+		for _, t := range pg.Tasks {
+			rec, err := m.taskRecord(t)
+			if err != nil {
+				return err
+			}
+			if err := tw.json("tasks/"+t.ID+".json", rec); err != nil {
+				return err
+			}
+			ids = append(ids, t.ID)
+			st.Tasks++
+		}
+		if pg.NextCursor == "" {
+			break
+		}
+		q.Cursor = pg.NextCursor
+	}
+	for _, id := range ids {
+		n, err := tw.dir(filepath.Join(m.logDir(), id), "logs/"+id)
+		if err != nil {
+			return err
+		}
+		st.Files += n
+	}
+	if m.BlobDir != "" {
+		n, err := tw.dir(m.BlobDir, "blobs")
+		if err != nil {
+			return err
+		}
+		st.Files += n
+	}
+	if err := tw.w.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (m *Manager) taskRecord(t store.Task) (TaskRecord, error) {
+	rec := TaskRecord{Task: t}
+	var err error
+	if rec.NodeRuns, err = m.Store.ListNodeRuns(t.ID); err != nil {
+		return rec, err
+	}
+	if rec.Events, err = m.Store.ListTaskEvents(t.ID); err != nil {
+		return rec, err
+	}
+	if rec.NodeStates, err = m.Store.ListNodeStates(t.ID); err != nil {
+		return rec, err
+	}
+	rec.Queue, err = m.Store.ListQueueTasks(t.ID)
+	return rec, err
+}
+
+type tarWriter struct {
+	w   *tar.Writer
+	now time.Time
+}
+
+func (tw *tarWriter) file(name string, b []byte) error {
+	if err := tw.w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: tw.now, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := tw.w.Write(b)
+	return err
+}
+
+func (tw *tarWriter) json(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tw.file(name, b)
+}
+
+// dir adds the regular files under root as prefix/<relative path>. A
+// missing root adds nothing.
+func (tw *tarWriter) dir(root, prefix string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		n++
+		return tw.file(prefix+"/"+filepath.ToSlash(rel), b)
+	})
+	return n, err
+}
+
+// Restore loads the archive in file into the store. onConflict is
+// OnConflictFail (the default when empty) or OnConflictSkip. Workers and
+// retention policies are only added where the store has none with the same
+// ID or flow and status; they never conflict. Restored tasks lose their
+// lease, so any scheduler can pick them up.
+func (m *Manager) Restore(file string, onConflict string) (Stats, error) {
+	switch onConflict {
+	case "":
+		onConflict = OnConflictFail
+	case OnConflictFail, OnConflictSkip:
+	default:
+		return Stats{}, fmt.Errorf("unknown conflict mode %q", onConflict)
+	}
+	if onConflict == OnConflictFail {
+		if err := m.scan(file, m.check()); err != nil {
+			return Stats{}, err
+		}
+	}
+	r := &restorer{m: m, fail: onConflict == OnConflictFail, tasks: map[string]bool{}}
+	if err := r.init(); err != nil {
+		return Stats{}, err
+	}
+	err := m.scan(file, r.entry)
+	return r.st, err
+}
+
+// scan calls fn for each archive entry after the manifest.
+func (m *Manager) scan(file string, fn func(name string, body io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	first := true
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			if first {
+				return errors.New("backup: empty archive")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			if h.Name != "manifest.json" {
+				return errors.New("backup: manifest missing")
+			}
+			var mf Manifest
+			if err := json.NewDecoder(tr).Decode(&mf); err != nil {
+				return fmt.Errorf("backup: manifest: %w", err)
+			}
+			if mf.Format != Format {
+				return fmt.Errorf("backup: not a %s archive", Format)
+			}
+			if mf.Version > Version {
+				return fmt.Errorf("backup: archive version %d is newer than supported version %d", mf.Version, Version)
+			}
+			first = false
+			continue
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(h.Name, tr); err != nil {
+			return fmt.Errorf("%s: %w", h.Name, err)
+		}
+	}
+}
+
+// check returns a scan callback failing with ErrConflict on the first
+// archived flow, version or task whose ID the store already has.
+func (m *Manager) check() func(string, io.Reader) error {
+	var flows map[string]bool
+	return func(name string, body io.Reader) error {
+		switch {
+		case strings.HasPrefix(name, "flows/"):
+			if flows == nil {
+				all, _, err := m.Store.ListFlows("", 0, 0)
+				if err != nil {
+					return err
+				}
+				flows = map[string]bool{}
+				for _, f := range all {
+					flows[f.ID] = true
+				}
+			}
+			var rec FlowRecord
+			if err := json.NewDecoder(body).Decode(&rec); err != nil {
+				return err
+			}
+			if flows[rec.Flow.ID] {
+				return fmt.Errorf("%w: flow %s", ErrConflict, rec.Flow.ID)
+			}
+			for _, v := range rec.Versions {
+				if err := exists(m.Store.GetFlowVersionByID(v.ID)); err != nil {
+					return fmt.Errorf("flow version %s: %w", v.ID, err)
+				}
+			}
+		case strings.HasPrefix(name, "tasks/"):
+			var rec TaskRecord
+			if err := json.NewDecoder(body).Decode(&rec); err != nil {
+				return err
+			}
+			if err := exists(m.Store.GetTask(rec.Task.ID)); err != nil {
+				return fmt.Errorf("task %s: %w", rec.Task.ID, err)
+			}
+		}
+		return nil
+	}
+}
+
+// exists turns the result of a lookup by ID into ErrConflict if it found
+// something.
+func exists(_ interface{}, err error) error {
+	if err == nil {
+		return ErrConflict
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+type restorer struct {
+	m       *Manager
+	fail    bool
+	st      Stats
+	workers map[string]bool
+	// tasks holds the IDs of restored tasks, whose logs are restored too.
+	tasks map[string]bool
+}
+
+func (r *restorer) init() error {
+	ws, err := r.m.Store.ListWorkers("", "", 0)
+	if err != nil {
+		return err
+	}
+	r.workers = map[string]bool{}
+	for _, w := range ws {
+		r.workers[w.ID] = true
+	}
+	return nil
+}
+
+// conflict decides what a write that returned err means for the restore.
+// It reports whether the record was written.
+func (r *restorer) conflict(err error, what string) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, store.ErrConflict) {
+		return false, err
+	}
+	if r.fail {
+		return false, fmt.Errorf("%w: %s", ErrConflict, what)
+	}
+	r.st.Skipped++
+	return false, nil
+}
+
+func (r *restorer) entry(name string, body io.Reader) error {
+	dir, rest, _ := strings.Cut(name, "/")
+	switch {
+	case name == "retention.json":
+		return r.policies(body)
+	case dir == "flows":
+		return r.flow(body)
+	case dir == "workers":
+		return r.worker(body)
+	case dir == "tasks":
+		return r.task(body)
+	case dir == "logs":
+		return r.log(rest, body)
+	case dir == "blobs":
+		return r.blob(rest, body)
+	}
+	return nil
+}
+
+func (r *restorer) flow(body io.Reader) error {
+	var rec FlowRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return err
+	}
+	ok, err := r.conflict(r.m.Store.RestoreFlow(rec.Flow), "flow "+rec.Flow.ID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		r.st.Flows++
+	}
+	for _, v := range rec.Versions {
+		ok, err := r.conflict(r.m.Store.RestoreFlowVersion(v), "flow version "+v.ID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			r.st.Versions++
+		}
+	}
+	return nil
+}
+
+func (r *restorer) policies(body io.Reader) error {
+	var ps []store.RetentionPolicy
+	if err := json.NewDecoder(body).Decode(&ps); err != nil {
+		return err
+	}
+	cur, err := r.m.Store.ListRetentionPolicies("")
+	if err != nil {
+		return err
+	}
+	have := map[[3]string]bool{}
+	for _, p := range cur {
+		have[[3]string{p.Namespace, p.FlowID, p.Status}] = true
+	}
+	for _, p := range ps {
+		// Backups from before policies had a namespace restore into the
+		// default one.
+		if have[[3]string{store.Namespace(p.Namespace), p.FlowID, p.Status}] {
+			continue
+		}
+		if err := r.m.Store.SetRetentionPolicy(p); err != nil {
+			return err
+		}
+		r.st.Policies++
+	}
+	return nil
+}
+
+func (r *restorer) worker(body io.Reader) error {
+	var w store.WorkerInfo
+	if err := json.NewDecoder(body).Decode(&w); err != nil {
+		return err
+	}
+	if r.workers[w.ID] {
+		return nil
+	}
+	if err := r.m.Store.RegisterWorker(w); err != nil {
+		return err
+	}
+	r.st.Workers++
+	return nil
+}
+
+func (r *restorer) task(body io.Reader) error {
+	var rec TaskRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return err
+	}
+	ok, err := r.conflict(r.m.Store.RestoreTask(rec.Task, rec.NodeRuns, rec.Events), "task "+rec.Task.ID)
+	if err != nil || !ok {
+		return err
+	}
+	for _, ns := range rec.NodeStates {
+		if err := r.m.Store.RestoreNodeState(ns); err != nil {
+			return err
+		}
+	}
+	for _, q := range rec.Queue {
+		if _, err := r.conflict(r.m.Store.RestoreQueueTask(q), "queue entry "+q.ID); err != nil {
+			return err
+		}
+	}
+	r.tasks[rec.Task.ID] = true
+	r.st.Tasks++
+	return nil
+}
+
+// log writes a task's log file if the task was restored by this run.
+func (r *restorer) log(name string, body io.Reader) error {
+	id, rel, ok := strings.Cut(name, "/")
+	if !ok || !r.tasks[id] {
+		return nil
+	}
+	root := filepath.Join(r.m.logDir(), id)
+	p := filepath.Join(root, filepath.FromSlash(path.Clean("/"+rel)))
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		return err
+	}
+	r.st.Files++
+	return nil
+}
+
+// blob adds a blob file to BlobDir as it was stored, encrypted or not.
+// Its name is its reference, so existing ones are never conflicts.
+func (r *restorer) blob(name string, body io.Reader) error {
+	if r.m.BlobDir == "" {
+		return nil
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err := (&blob.FS{Dir: r.m.BlobDir}).Import(name, b); err != nil {
+		return err
+	}
+	r.st.Files++
+	return nil
+}
@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/memstore"
+	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
+)
+
+func TestBackupRestoreAcrossBackends(t *testing.T) {
+	dir := t.TempDir()
+	src := memstore.New()
+	from := &Manager{Store: src, LogDir: filepath.Join(dir, "src", "logs"), BlobDir: filepath.Join(dir, "src", "blobs"), Batch: 1}
+
+	fid, _ := src.CreateFlow("", "f", "desc")
+	vid, _ := src.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	_ = src.SetRetentionPolicy(store.RetentionPolicy{FlowID: fid, Status: "completed", KeepSec: 60})
+	_ = src.RegisterWorker(store.WorkerInfo{ID: "w1", URL: "http://w1", Services: []string{"svc"}, Type: "http"})
+	tid, _ := src.CreateTask(vid, `{"p":1}`, "", "a")
+	if err := src.TransitionTask(tid, "", store.TaskTransition{Status: "waiting_queue", CurrentNode: "a", SharedJSON: `{"k":"v"}`, StepCount: 1,
+		NodeRuns:   []map[string]interface{}{{"task_id": tid, "node_key": "a", "status": "ok"}},
+		NodeStates: []store.NodeState{{NodeKey: "a", Kind: "parallel", Version: 1, StateJSON: `{"done":{}}`}}}); err != nil {
+		t.Fatal(err)
+	}
+	qid, _ := src.EnqueueTask(tid, "a", "svc", "{}")
+	done, _ := src.CreateTask(vid, "{}", "", "a")
+	_ = src.UpdateTaskStatus(done, "completed")
+	logPath := filepath.Join(from.LogDir, tid, "a_1.log")
+	_ = os.MkdirAll(filepath.Dir(logPath), 0755)
+	_ = os.WriteFile(logPath, []byte("hello\n"), 0644)
+	ref, err := (&blob.FS{Dir: from.BlobDir}).Put([]byte(`"big"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "backup.tar.gz")
+	st, err := from.Write(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Flows != 1 || st.Versions != 1 || st.Policies != 1 || st.Workers != 1 || st.Tasks != 2 || st.Files != 2 {
+		t.Fatalf("backup stats %+v", st)
+	}
+
+	dst, err := sqlstore.OpenSQLite(filepath.Join(dir, "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := &Manager{Store: dst, LogDir: filepath.Join(dir, "dst", "logs"), BlobDir: filepath.Join(dir, "dst", "blobs")}
+	st, err = to.Restore(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Flows != 1 || st.Versions != 1 || st.Policies != 1 || st.Workers != 1 || st.Tasks != 2 || st.Files != 2 || st.Skipped != 0 {
+		t.Fatalf("restore stats %+v", st)
+	}
+	task, err := dst.GetTask(tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.FlowID != fid || task.FlowVersionID != vid || task.Status != "waiting_queue" || task.SharedJSON != `{"k":"v"}` || task.ParamsJSON != `{"p":1}` {
+		t.Fatalf("task %+v", task)
+	}
+	if runs, _ := dst.ListNodeRuns(tid); len(runs) != 1 {
+		t.Fatalf("runs %+v", runs)
+	}
+	if ns, err := dst.GetNodeState(tid, "a"); err != nil || ns.StateJSON != `{"done":{}}` {
+		t.Fatalf("node state %+v %v", ns, err)
+	}
+	if qs, _ := dst.ListQueueTasks(tid); len(qs) != 1 || qs[0].ID != qid {
+		t.Fatalf("queue %+v", qs)
+	}
+	if ws, _ := dst.ListWorkers("", "svc", 0); len(ws) != 1 || ws[0].URL != "http://w1" {
+		t.Fatalf("workers %+v", ws)
+	}
+	if b, err := os.ReadFile(filepath.Join(to.LogDir, tid, "a_1.log")); err != nil || string(b) != "hello\n" {
+		t.Fatalf("log %q %v", b, err)
+	}
+	if b, err := (&blob.FS{Dir: to.BlobDir}).Get(ref); err != nil || string(b) != `"big"` {
+		t.Fatalf("blob %q %v", b, err)
+	}
+
+	// Everything is there now: fail mode refuses up front, skip mode
+	// leaves the store as it is.
+	_ = dst.UpdateTaskStatus(done, "failed")
+	if _, err := to.Restore(file, OnConflictFail); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want conflict, got %v", err)
+	}
+	st, err = to.Restore(file, OnConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Flows+st.Versions+st.Tasks+st.Policies+st.Workers != 0 || st.Skipped != 4 {
+		t.Fatalf("skip stats %+v", st)
+	}
+	if got, _ := dst.GetTask(done); got.Status != "failed" {
+		t.Fatalf("existing task overwritten: %+v", got)
+	}
+	if _, err := to.Restore(file, "merge"); err == nil {
+		t.Fatal("unknown conflict mode accepted")
+	}
+}
+
+func TestRestoreRejectsNewerVersion(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "b.tar.gz")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	tw := &tarWriter{w: tar.NewWriter(zw), now: time.Now()}
+	if err := tw.json("manifest.json", Manifest{Format: Format, Version: Version + 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = tw.w.Close()
+	_ = zw.Close()
+	f.Close()
+	m := &Manager{Store: memstore.New()}
+	if _, err := m.Restore(file, ""); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("want version error, got %v", err)
+	}
+}
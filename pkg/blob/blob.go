@@ -0,0 +1,390 @@
+// Package blob keeps large JSON values out of task rows. Values are stored
+// by content hash and replaced in shared state and node runs by a small
+// reference object: {"$blob": "sha256:<hex>", "size": <bytes>}. Encrypted
+// blobs are addressed by a keyed hash instead, "hmac-sha256:<key id>:<hex>".
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by Store.Get for an unknown reference.
+var ErrNotFound = errors.New("blob not found")
+
+// DefaultThreshold is the encoded size in bytes above which a Codec
+// offloads a value when Threshold is not set.
+const DefaultThreshold = 64 << 10
+
+// RefKey is the member naming the blob in a reference object.
+const RefKey = "$blob"
+
+// Store holds immutable blobs addressed by the hash of their content.
+type Store interface {
+	// Put stores data and returns its reference. Storing the same data
+	// twice returns the same reference.
+	Put(data []byte) (string, error)
+	Get(ref string) ([]byte, error)
+}
+
+// Sealer encrypts blob files. *crypt.Cipher implements it.
+type Sealer interface {
+	Encode(plain string) (string, error)
+	// Decode returns content that was never encoded unchanged.
+	Decode(stored string) (string, error)
+	// Digest returns a keyed hash of data as "<key id>:<hex>".
+	Digest(data []byte) (string, error)
+}
+
+// FS stores blobs as files under Dir, fanned out by the first two hex
+// digits of their hash.
+type FS struct {
+	Dir string
+	// Sealer, when set, encrypts the files and names them by a keyed hash
+	// of their content, so neither the files nor the references reveal
+	// the data. Unencrypted files written before are still read.
+	Sealer Sealer
+}
+
+func (s *FS) path(ref string) (string, bool) {
+	var sum string
+	switch {
+	case strings.HasPrefix(ref, "sha256:"):
+		sum = strings.TrimPrefix(ref, "sha256:")
+	case strings.HasPrefix(ref, "hmac-sha256:"):
+		_, sum, _ = strings.Cut(strings.TrimPrefix(ref, "hmac-sha256:"), ":")
+	}
+	if len(sum) != sha256.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", false
+	}
+	return filepath.Join(s.Dir, sum[:2], sum), true
+}
+
+func (s *FS) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := "sha256:" + hex.EncodeToString(sum[:])
+	if s.Sealer != nil {
+		d, err := s.Sealer.Digest(data)
+		if err != nil {
+			return "", err
+		}
+		ref = "hmac-sha256:" + d
+	}
+	p, ok := s.path(ref)
+	if !ok {
+		return "", fmt.Errorf("bad blob reference %q", ref)
+	}
+	if _, err := os.Stat(p); err == nil {
+		return ref, nil
+	}
+	if s.Sealer != nil {
+		enc, err := s.Sealer.Encode(string(data))
+		if err != nil {
+			return "", err
+		}
+		data = []byte(enc)
+	}
+	return ref, writeFile(p, data)
+}
+
+// writeFile writes data to p atomically, creating its directory.
+func writeFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *FS) Get(ref string) ([]byte, error) {
+	p, ok := s.path(ref)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil || s.Sealer == nil {
+		return b, err
+	}
+	plain, err := s.Sealer.Decode(string(b))
+	return []byte(plain), err
+}
+
+// Import writes a file as it was stored, e.g. by a backup, at the path
+// name relative to Dir. An existing file is kept, as blobs never change
+// content.
+func (s *FS) Import(name string, data []byte) error {
+	dir, sum := path.Split(name)
+	p, ok := s.path("sha256:" + sum)
+	if !ok || dir != sum[:2]+"/" {
+		return fmt.Errorf("bad blob file name %q", name)
+	}
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	return writeFile(p, data)
+}
+
+// Rotate passes the content of every file to fn and writes back what it
+// returns if that differs, e.g. to seal files under a new key. Names and so
+// references are kept. It returns the number of files rewritten.
+func (s *FS) Rotate(fn func(stored string) (string, error)) (int, error) {
+	n := 0
+	err := filepath.WalkDir(s.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		out, err := fn(string(b))
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if out == string(b) {
+			return nil
+		}
+		n++
+		return writeFile(p, []byte(out))
+	})
+	return n, err
+}
+
+// RefOf reports the blob reference v stands for, if it is a reference
+// object.
+func RefOf(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) > 2 {
+		return "", false
+	}
+	ref, ok := m[RefKey].(string)
+	return ref, ok
+}
+
+// Codec swaps JSON values larger than Threshold for references into Store
+// and back. A nil Codec leaves values untouched.
+type Codec struct {
+	Store     Store
+	Threshold int
+}
+
+func (c *Codec) threshold() int {
+	if c.Threshold <= 0 {
+		return DefaultThreshold
+	}
+	return c.Threshold
+}
+
+// Offload replaces every value in v that encodes to more than Threshold
+// bytes with a reference. Children are offloaded before their parents, so
+// a large list of small items becomes one blob while a list holding a few
+// large items keeps the list inline. v itself is not modified.
+func (c *Codec) Offload(v interface{}) (interface{}, error) {
+	if c == nil {
+		return v, nil
+	}
+	v, err := c.offloadChildren(v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= c.threshold() {
+		return v, nil
+	}
+	ref, err := c.Store.Put(b)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{RefKey: ref, "size": len(b)}, nil
+}
+
+func (c *Codec) offloadChildren(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if _, ok := RefOf(x); ok {
+			return x, nil
+		}
+		out := make(map[string]interface{}, len(x))
+		for k, cv := range x {
+			nv, err := c.Offload(cv)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = nv
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, cv := range x {
+			nv, err := c.Offload(cv)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = nv
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// Resolve replaces every reference in v, including those inside blobs, by
+// the value it stands for. Maps and slices in v are updated in place.
+func (c *Codec) Resolve(v interface{}) (interface{}, error) {
+	if c == nil {
+		return v, nil
+	}
+	if ref, ok := RefOf(v); ok {
+		b, err := c.Store.Get(ref)
+		if err != nil {
+			return nil, err
+		}
+		var nv interface{}
+		if err := json.Unmarshal(b, &nv); err != nil {
+			return nil, err
+		}
+		return c.Resolve(nv)
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range x {
+			nv, err := c.Resolve(cv)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = nv
+		}
+	case []interface{}:
+		for i, cv := range x {
+			nv, err := c.Resolve(cv)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = nv
+		}
+	}
+	return v, nil
+}
+
+// Reaches reports whether v refers to ref, directly or through the blobs
+// it refers to.
+func (c *Codec) Reaches(v interface{}, ref string) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	return c.reaches(v, ref, map[string]bool{})
+}
+
+func (c *Codec) reaches(v interface{}, ref string, seen map[string]bool) (bool, error) {
+	if r, ok := RefOf(v); ok {
+		if r == ref {
+			return true, nil
+		}
+		if seen[r] {
+			return false, nil
+		}
+		seen[r] = true
+		b, err := c.Store.Get(r)
+		if err != nil {
+			return false, err
+		}
+		var nv interface{}
+		if err := json.Unmarshal(b, &nv); err != nil {
+			return false, err
+		}
+		return c.reaches(nv, ref, seen)
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, cv := range x {
+			if ok, err := c.reaches(cv, ref, seen); ok || err != nil {
+				return ok, err
+			}
+		}
+	case []interface{}:
+		for _, cv := range x {
+			if ok, err := c.reaches(cv, ref, seen); ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// OffloadJSON is Offload for an encoded value. A top-level object is kept
+// inline and only its members are offloaded, so shared state stays
+// searchable by key.
+func (c *Codec) OffloadJSON(js string) (string, error) {
+	if c == nil || len(js) <= c.threshold() {
+		return js, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(js), &v); err != nil {
+		return "", err
+	}
+	var err error
+	if _, ok := v.(map[string]interface{}); ok {
+		v, err = c.offloadChildren(v)
+	} else {
+		v, err = c.Offload(v)
+	}
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// ResolveJSON is Resolve for an encoded value.
+func (c *Codec) ResolveJSON(js string) (string, error) {
+	if c == nil || !strings.Contains(js, `"`+RefKey+`"`) {
+		return js, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(js), &v); err != nil {
+		return "", err
+	}
+	v, err := c.Resolve(v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
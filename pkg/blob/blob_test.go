@@ -0,0 +1,94 @@
+package blob
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFSPutGet(t *testing.T) {
+	s := &FS{Dir: t.TempDir()}
+	ref, err := s.Put([]byte(`"hello"`))
+	if err != nil || !strings.HasPrefix(ref, "sha256:") {
+		t.Fatalf("put: %q %v", ref, err)
+	}
+	if again, _ := s.Put([]byte(`"hello"`)); again != ref {
+		t.Fatalf("same content, different ref: %s %s", ref, again)
+	}
+	if b, err := s.Get(ref); err != nil || string(b) != `"hello"` {
+		t.Fatalf("get: %q %v", b, err)
+	}
+	for _, bad := range []string{"sha256:" + strings.Repeat("0", 64), "sha256:../x", "nope"} {
+		if _, err := s.Get(bad); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("get %q: %v", bad, err)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	c := &Codec{Store: &FS{Dir: t.TempDir()}, Threshold: 120}
+	long := strings.Repeat("a", 200)
+	items := []interface{}{}
+	for i := 0; i < 50; i++ {
+		items = append(items, float64(i))
+	}
+	in := toJSON(map[string]interface{}{
+		"small": "x",
+		"long":  long,
+		"items": items,
+		"mixed": []interface{}{"y", long},
+	})
+	out, err := c.OffloadJSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	_ = json.Unmarshal([]byte(out), &v)
+	if v["small"] != "x" {
+		t.Fatalf("small value offloaded: %s", out)
+	}
+	for _, k := range []string{"long", "items"} {
+		if _, ok := RefOf(v[k]); !ok {
+			t.Fatalf("%s not offloaded: %s", k, out)
+		}
+	}
+	if mixed, _ := v["mixed"].([]interface{}); len(mixed) != 2 || mixed[0] != "y" {
+		t.Fatalf("list with one large item should stay inline: %s", out)
+	} else if _, ok := RefOf(mixed[1]); !ok {
+		t.Fatalf("large list item not offloaded: %s", out)
+	}
+	back, err := c.ResolveJSON(out)
+	if err != nil || back != in {
+		t.Fatalf("resolve: %s %v", back, err)
+	}
+
+	var nilCodec *Codec
+	if s, _ := nilCodec.OffloadJSON(in); s != in {
+		t.Fatalf("nil codec changed value")
+	}
+}
+
+func TestCodecReaches(t *testing.T) {
+	c := &Codec{Store: &FS{Dir: t.TempDir()}, Threshold: 50}
+	long := strings.Repeat("a", 60)
+	// The inner string is offloaded first, then the list holding its
+	// reference and enough padding to pass the threshold.
+	v, err := c.Offload([]interface{}{long, strings.Repeat("b", 40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, ok := RefOf(v)
+	if !ok {
+		t.Fatalf("list not offloaded: %v", v)
+	}
+	inner, _ := c.Store.Put([]byte(toJSON(long)))
+	other, _ := c.Store.Put([]byte(`"unrelated"`))
+	for ref, want := range map[string]bool{outer: true, inner: true, other: false} {
+		if got, err := c.Reaches(map[string]interface{}{"k": v}, ref); err != nil || got != want {
+			t.Fatalf("reaches %s: %v %v, want %v", ref, got, err, want)
+		}
+	}
+}
+
+func toJSON(v interface{}) string { b, _ := json.Marshal(v); return string(b) }
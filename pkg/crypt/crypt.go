@@ -0,0 +1,235 @@
+// Package crypt encrypts stored task data with envelope encryption. Every
+// value is sealed with a fresh data key, and the data key is stored next to
+// it wrapped by a key encryption key (KEK) from a KeyProvider. Rotating the
+// KEK only rewraps data keys; the data itself is not re-encrypted.
+//
+// A sealed value is a JSON string
+//
+//	"pfenc:v1:<key id>:<wrapped data key>:<ciphertext>"
+//
+// so columns holding JSON stay valid JSON. Values without the prefix are
+// plaintext written before encryption was turned on and are returned as is.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Prefix starts every sealed value inside its JSON string.
+const Prefix = "pfenc:v1:"
+
+// KeySize is the size in bytes of key encryption and data keys (AES-256).
+const KeySize = 32
+
+// ErrUnknownKey is wrapped by errors for a key ID the provider does not
+// have.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrCorrupt is wrapped by errors for sealed values that cannot be opened.
+var ErrCorrupt = errors.New("corrupt encrypted value")
+
+// KeyProvider supplies key encryption keys.
+type KeyProvider interface {
+	// CurrentKey returns the ID of the key new values are sealed with.
+	CurrentKey() (string, error)
+	// Key returns the key with the given ID, or an error wrapping
+	// ErrUnknownKey.
+	Key(id string) ([]byte, error)
+}
+
+// Cipher seals and opens JSON values. It implements store.ValueCodec.
+type Cipher struct {
+	Keys KeyProvider
+}
+
+var b64 = base64.RawURLEncoding
+
+// sealed is a parsed sealed value.
+type sealed struct {
+	keyID   string
+	wrapped []byte
+	data    []byte
+}
+
+// parse splits a stored value; ok is false for plaintext.
+func parse(stored string) (sealed, bool, error) {
+	if !strings.HasPrefix(stored, `"`+Prefix) {
+		return sealed{}, false, nil
+	}
+	var tok string
+	if err := json.Unmarshal([]byte(stored), &tok); err != nil {
+		return sealed{}, true, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	parts := strings.Split(strings.TrimPrefix(tok, Prefix), ":")
+	if len(parts) != 3 || parts[0] == "" {
+		return sealed{}, true, fmt.Errorf("%w: want 3 fields", ErrCorrupt)
+	}
+	s := sealed{keyID: parts[0]}
+	var err error
+	if s.wrapped, err = b64.DecodeString(parts[1]); err != nil {
+		return sealed{}, true, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if s.data, err = b64.DecodeString(parts[2]); err != nil {
+		return sealed{}, true, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return s, true, nil
+}
+
+func (s sealed) String() string {
+	b, _ := json.Marshal(Prefix + s.keyID + ":" + b64.EncodeToString(s.wrapped) + ":" + b64.EncodeToString(s.data))
+	return string(b)
+}
+
+// KeyOf returns the ID of the key stored was sealed with, or false if it
+// is plaintext.
+func KeyOf(stored string) (string, bool) {
+	s, ok, err := parse(stored)
+	if !ok || err != nil {
+		return "", false
+	}
+	return s.keyID, true
+}
+
+// Encode seals plain with a new data key wrapped by the current key.
+func (c *Cipher) Encode(plain string) (string, error) {
+	id, kek, err := c.current()
+	if err != nil {
+		return "", err
+	}
+	dek := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	s := sealed{keyID: id}
+	if s.wrapped, err = seal(kek, dek, []byte(id)); err != nil {
+		return "", err
+	}
+	if s.data, err = seal(dek, []byte(plain), nil); err != nil {
+		return "", err
+	}
+	return s.String(), nil
+}
+
+// Decode opens a sealed value. Plaintext is returned unchanged.
+func (c *Cipher) Decode(stored string) (string, error) {
+	s, ok, err := parse(stored)
+	if !ok || err != nil {
+		return stored, err
+	}
+	dek, err := c.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(dek, s.data, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Rotate returns stored sealed under the current key: plaintext is sealed,
+// values under another key have their data key rewrapped, and values
+// already under the current key are returned unchanged.
+func (c *Cipher) Rotate(stored string) (string, error) {
+	s, ok, err := parse(stored)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return c.Encode(stored)
+	}
+	id, kek, err := c.current()
+	if err != nil || s.keyID == id {
+		return stored, err
+	}
+	dek, err := c.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	s.keyID = id
+	if s.wrapped, err = seal(kek, dek, []byte(id)); err != nil {
+		return "", err
+	}
+	return s.String(), nil
+}
+
+// Digest returns a keyed hash of data under the current key as
+// "<key id>:<hex>". Equal data has equal digests while the current key
+// stays the same, but without the key a digest cannot be matched against a
+// guess of the data. It lets encrypted content be addressed by its value.
+func (c *Cipher) Digest(data []byte) (string, error) {
+	id, kek, err := c.current()
+	if err != nil {
+		return "", err
+	}
+	// Derive a separate key so the KEK is only ever used for wrapping.
+	dk := hmac.New(sha256.New, kek)
+	dk.Write([]byte("pocketflow digest"))
+	m := hmac.New(sha256.New, dk.Sum(nil))
+	m.Write(data)
+	return id + ":" + hex.EncodeToString(m.Sum(nil)), nil
+}
+
+func (c *Cipher) current() (string, []byte, error) {
+	id, err := c.Keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	kek, err := c.Keys.Key(id)
+	return id, kek, err
+}
+
+func (c *Cipher) unwrap(s sealed) ([]byte, error) {
+	kek, err := c.Keys.Key(s.keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, s.wrapped, []byte(s.keyID))
+}
+
+func gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with AES-GCM under key, prefixed with the nonce.
+func seal(key, plain, ad []byte) ([]byte, error) {
+	g, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, g.NonceSize(), g.NonceSize()+len(plain)+g.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return g.Seal(nonce, nonce, plain, ad), nil
+}
+
+func open(key, box, ad []byte) ([]byte, error) {
+	g, err := gcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < g.NonceSize() {
+		return nil, fmt.Errorf("%w: too short", ErrCorrupt)
+	}
+	plain, err := g.Open(nil, box[:g.NonceSize()], box[g.NonceSize():], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return plain, nil
+}
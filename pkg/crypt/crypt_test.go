@@ -0,0 +1,99 @@
+package crypt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealOpenRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	k1, err := AddKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v", fi.Mode())
+	}
+	ring, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Cipher{Keys: ring}
+
+	const plain = `{"card":"4242"}`
+	enc, err := c.Encode(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(enc, "4242") || !strings.HasPrefix(enc, `"`+Prefix+k1+":") {
+		t.Fatalf("sealed %s", enc)
+	}
+	if again, _ := c.Encode(plain); again == enc {
+		t.Fatal("same ciphertext twice")
+	}
+	if got, err := c.Decode(enc); err != nil || got != plain {
+		t.Fatalf("decode %q %v", got, err)
+	}
+	if got, err := c.Decode(plain); err != nil || got != plain {
+		t.Fatalf("plaintext passthrough %q %v", got, err)
+	}
+	if got, err := c.Rotate(enc); err != nil || got != enc {
+		t.Fatalf("rotate under current key changed value: %v", err)
+	}
+
+	k2, err := AddKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = LoadKeyFile(path); err != nil || ring.Current != k2 || len(ring.Keys) != 2 {
+		t.Fatalf("ring %+v %v", ring, err)
+	}
+	c.Keys = ring
+	rot, err := c.Rotate(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := KeyOf(rot); !ok || id != k2 {
+		t.Fatalf("rotated to %q", id)
+	}
+	if got, err := c.Decode(rot); err != nil || got != plain {
+		t.Fatalf("decode rotated %q %v", got, err)
+	}
+	if rp, _ := c.Rotate(plain); !strings.HasPrefix(rp, `"`+Prefix+k2) {
+		t.Fatalf("plaintext not sealed by rotate: %s", rp)
+	}
+
+	delete(ring.Keys, k1)
+	if _, err := c.Decode(enc); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("want unknown key, got %v", err)
+	}
+	tampered := rot[:len(rot)-3] + "AA\""
+	if _, err := c.Decode(tampered); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want corrupt, got %v", err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	k1, _ := AddKey(path)
+	ring, _ := LoadKeyFile(path)
+	c := &Cipher{Keys: ring}
+	d1, err := c.Digest([]byte("data"))
+	if err != nil || !strings.HasPrefix(d1, k1+":") || len(d1) != len(k1)+1+64 {
+		t.Fatalf("digest %q %v", d1, err)
+	}
+	if again, _ := c.Digest([]byte("data")); again != d1 {
+		t.Fatalf("digest not stable: %s %s", d1, again)
+	}
+	if other, _ := c.Digest([]byte("datb")); other == d1 {
+		t.Fatal("different data, same digest")
+	}
+	k2, _ := AddKey(path)
+	c.Keys, _ = LoadKeyFile(path)
+	if d2, _ := c.Digest([]byte("data")); !strings.HasPrefix(d2, k2+":") || d2[len(k2):] == d1[len(k1):] {
+		t.Fatalf("digest under new key %s", d2)
+	}
+}
@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyRing is a set of key encryption keys, one of which is current. It is
+// the content of a key file:
+//
+//	{"current": "k1a2b3c4", "keys": {"k1a2b3c4": "<base64 of 32 bytes>"}}
+type KeyRing struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+func (r *KeyRing) CurrentKey() (string, error) {
+	if r.Current == "" {
+		return "", fmt.Errorf("%w: no current key", ErrUnknownKey)
+	}
+	return r.Current, nil
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	k, ok := r.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return k, nil
+}
+
+// LoadKeyFile reads a key ring from path.
+func LoadKeyFile(path string) (*KeyRing, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r KeyRing
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for id, k := range r.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("%s: bad key id %q", path, id)
+		}
+		if len(k) != KeySize {
+			return nil, fmt.Errorf("%s: key %q is %d bytes, want %d", path, id, len(k), KeySize)
+		}
+	}
+	if _, ok := r.Keys[r.Current]; !ok {
+		return nil, fmt.Errorf("%s: current key %q not in file", path, r.Current)
+	}
+	return &r, nil
+}
+
+// AddKey generates a key, adds it to the key file at path (creating the
+// file if needed) and makes it current. Older keys stay in the file so
+// values sealed with them can still be opened. It returns the new key's
+// ID.
+func AddKey(path string) (string, error) {
+	r := &KeyRing{Keys: map[string][]byte{}}
+	if _, err := os.Stat(path); err == nil {
+		if r, err = LoadKeyFile(path); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	key := make([]byte, KeySize)
+	idb := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(rand.Reader, idb); err != nil {
+			return "", err
+		}
+		if _, dup := r.Keys["k"+hex.EncodeToString(idb)]; !dup {
+			break
+		}
+	}
+	id := "k" + hex.EncodeToString(idb)
+	r.Keys[id] = key
+	r.Current = id
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp.Name(), path)
+}
@@ -1,13 +1,10 @@
 package engine
 
-func (e *Engine) runApproval(in NodeRunInput) error {
+import "context"
+
+func (e *Engine) runApproval(ctx context.Context, in NodeRunInput) error {
 	// Initialize runtime state for approval if not exists
-	rt, _ := in.Shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "ap:" + in.NodeKey
-	ap, _ := rt[key].(map[string]interface{})
+	ap := in.State
 	if ap == nil {
 		ap = map[string]interface{}{}
 	}
@@ -46,31 +43,14 @@ func (e *Engine) runApproval(in NodeRunInput) error {
 	// If decided, proceed to next step
 	if decided {
 		if in.Node.Post.OutputKey != "" {
-			in.Shared[in.Node.Post.OutputKey] = val
-		}
-		// Cleanup runtime state
-		delete(rt, key)
-		if len(rt) == 0 {
-			delete(in.Shared, "_rt")
-		} else {
-			in.Shared["_rt"] = rt
+			if err := setByPath(in.Shared, in.Node.Post.OutputKey, val); err != nil {
+				return e.failNode(in.Task, in.FlowDef, in.NodeKey, in.Shared, in.Input, err)
+			}
 		}
-		e.recordRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"approval_key": approvalKey}, in.Input, val, "", action, "", "", "")
-		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil)
+		run := nodeRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"approval_key": approvalKey}, in.Input, val, "", action, "", "", "")
+		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil, run)
 	}
 
 	// If not decided, suspend execution and wait
-	rt[key] = ap
-	in.Shared["_rt"] = rt
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(in.Task.ID, e.Owner, "running")
-	} else {
-		_ = e.Store.UpdateTaskStatus(in.Task.ID, "running")
-	}
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskProgressOwned(in.Task.ID, e.Owner, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskProgress(in.Task.ID, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	}
-	return nil
+	return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("approval", in.NodeKey, ap))
 }
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"errors"
+	"regexp"
+)
+
+// ErrorEdge routes a failed node to To. It matches errors whose code is
+// Code and whose message matches the regular expression Match; an empty
+// field matches anything. The caught error is written to shared state
+// under ErrorKey ("error" by default) as {node, code, message} plus
+// details of the failure, if any.
+type ErrorEdge struct {
+	Code     string `json:"code"`
+	Match    string `json:"match"`
+	To       string `json:"to"`
+	ErrorKey string `json:"error_key"`
+}
+
+func (h ErrorEdge) matches(err error) bool {
+	if h.To == "" {
+		return false
+	}
+	if h.Code != "" && h.Code != errorCode(err) {
+		return false
+	}
+	if h.Match != "" {
+		re, rerr := regexp.Compile(h.Match)
+		if rerr != nil || !re.MatchString(err.Error()) {
+			return false
+		}
+	}
+	return true
+}
+
+// catchError finds where the failure of node curr goes: the first of the
+// node's on_error edges that matches, else the first matching entry of the
+// flow's catch. A catch entry never routes its own target back to itself.
+func catchError(def FlowDef, curr string, err error) (ErrorEdge, bool) {
+	for _, h := range def.Nodes[curr].OnError {
+		if h.matches(err) {
+			return h, true
+		}
+	}
+	for _, h := range def.Catch {
+		if h.To != curr && h.matches(err) {
+			return h, true
+		}
+	}
+	return ErrorEdge{}, false
+}
+
+// caughtError is what a caught error of node curr leaves in shared state.
+func caughtError(curr string, err error) map[string]interface{} {
+	v := map[string]interface{}{"node": curr, "code": errorCode(err), "message": err.Error()}
+	var ee *ExecError
+	if errors.As(err, &ee) {
+		for k, d := range ee.Details {
+			v[k] = d
+		}
+	}
+	return v
+}
+
+// branchError is the failure of a parallel or foreach node whose branches
+// failed with errs.
+func branchError(msg string, errs map[string]interface{}) error {
+	return &ExecError{Code: CodeBranchError, Msg: msg, Details: map[string]interface{}{"branches": errs}}
+}
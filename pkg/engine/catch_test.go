@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func runCatchFlow(t *testing.T, def string) map[string]interface{} {
+	t.Helper()
+	s := openTestStore(t)
+	e := New(s)
+	e.RegisterFunc("ok", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return "handled", nil
+	})
+	e.RegisterFunc("declined", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return nil, &ExecError{Code: "declined", Msg: "card declined"}
+	})
+	e.RegisterFunc("quota", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return nil, errors.New("quota exceeded for key")
+	})
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	for i := 0; i < 5; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		if tk, _ := s.GetTask(tid); tk.Status == "completed" || tk.Status == "failed" {
+			break
+		}
+	}
+	tk, _ := s.GetTask(tid)
+	shared := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+	shared["_status"] = tk.Status
+	return shared
+}
+
+func TestOnErrorEdges(t *testing.T) {
+	handler := `"h":{"kind":"executor","exec_type":"local_func","func":"ok","post":{"output_key":"handled"}}`
+	cases := []struct {
+		name   string
+		def    string
+		status string
+		key    string
+		node   string
+		code   string
+	}{
+		{"by code", `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"declined","on_error":[{"code":"timeout","to":"x"},{"code":"declined","to":"h","error_key":"err"}]},` + handler + `},"edges":[]}`, "completed", "err", "a", "declined"},
+		{"by message", `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"quota","on_error":[{"match":"^quota","to":"h"}]},` + handler + `},"edges":[]}`, "completed", "error", "a", "func_error"},
+		{"flow catch", `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"ok"},"b":{"kind":"executor","exec_type":"local_func","func":"quota","on_error":[{"code":"declined","to":"x"}]},` + handler + `},"edges":[{"from":"a","action":"default","to":"b"}],"catch":[{"to":"h"}]}`, "completed", "error", "b", "func_error"},
+		{"parallel fail_fast", `{"start":"a","nodes":{"a":{"kind":"parallel","parallel_mode":"concurrent","failure_strategy":"fail_fast","parallel_execs":[{"exec_type":"local_func","func":"ok"},{"exec_type":"local_func","func":"declined"}]},` + handler + `},"edges":[],"catch":[{"code":"branch_error","to":"h"}]}`, "completed", "error", "a", "branch_error"},
+		{"uncaught", `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"quota","on_error":[{"code":"declined","to":"h"}]},` + handler + `},"edges":[]}`, "failed", "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			shared := runCatchFlow(t, c.def)
+			if shared["_status"] != c.status {
+				t.Fatalf("status %v, shared %v", shared["_status"], shared)
+			}
+			if c.key == "" {
+				if _, ok := shared["error"]; ok {
+					t.Fatalf("uncaught error written: %v", shared)
+				}
+				return
+			}
+			caught, _ := shared[c.key].(map[string]interface{})
+			if caught["node"] != c.node || caught["code"] != c.code || caught["message"] == "" || shared["handled"] != "handled" {
+				t.Fatalf("shared %v", shared)
+			}
+			if c.code == "branch_error" && caught["branches"] == nil {
+				t.Fatalf("branch errors missing: %v", caught)
+			}
+		})
+	}
+}
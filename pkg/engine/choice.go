@@ -1,14 +1,29 @@
 package engine
 
+import (
+	"context"
+	"fmt"
+)
+
 // runChoice executes a node of kind 'choice'.
 // It evaluates conditions to determine the next path in the flow.
-func (e *Engine) runChoice(in NodeRunInput) error {
+func (e *Engine) runChoice(ctx context.Context, in NodeRunInput) error {
 	action := ""
 
 	// Evaluate choice cases in order
 	if len(in.Node.ChoiceCases) > 0 {
-		for _, cc := range in.Node.ChoiceCases {
-			if evalExpr(cc.Expr, in.Shared, in.Params, in.Input) {
+		for i, cc := range in.Node.ChoiceCases {
+			var matched bool
+			var err error
+			if cc.When != "" {
+				matched, err = evalCond(cc.When, map[string]interface{}{"shared": in.Shared, "params": in.Params, "input": in.Input})
+			} else {
+				matched = evalExpr(cc.Expr, in.Shared, in.Params, in.Input)
+			}
+			if err != nil {
+				return e.failNode(in.Task, in.FlowDef, in.NodeKey, in.Shared, in.Input, fmt.Errorf("choice case %d: %w", i, err))
+			}
+			if matched {
 				action = cc.Action
 				break
 			}
@@ -34,10 +49,12 @@ func (e *Engine) runChoice(in NodeRunInput) error {
 
 	// Store output if configured
 	if in.Node.Post.OutputKey != "" {
-		in.Shared[in.Node.Post.OutputKey] = in.Input
+		if err := setByPath(in.Shared, in.Node.Post.OutputKey, in.Input); err != nil {
+			return e.failNode(in.Task, in.FlowDef, in.NodeKey, in.Shared, in.Input, err)
+		}
 	}
 
 	e.logf("task=%s node=%s kind=choice action=%s", in.Task.ID, in.NodeKey, action)
-	e.recordRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"input_key": in.Node.Prep.InputKey}, in.Input, nil, "", action, "", "", "")
-	return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil)
+	run := nodeRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"input_key": in.Node.Prep.InputKey}, in.Input, nil, "", action, "", "", "")
+	return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil, run)
 }
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// actionCompensate is the action that makes a node start compensating the
+// task instead of following an edge.
+const actionCompensate = "compensate"
+
+// Compensation is the executor that undoes a node's side effects, e.g. a
+// refund for a charge. It gets {"input", "output"} of the node run it
+// undoes, and params merged over the node's and the task's. Failed
+// attempts are retried as Retry says; by default they are not.
+type Compensation struct {
+	ExecSpec
+	Retry *RetryPolicy `json:"retry"`
+}
+
+func hasCompensations(def FlowDef) bool {
+	for _, n := range def.Nodes {
+		if n.Compensate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// compensationStatus is the status a task gets once node curr fails with
+// execErr and has nowhere to go, or picks action compensate (execErr is
+// nil then). It is compensating if a completed node, curr included, has a
+// compensation to run, compensated if there is none but it was asked for,
+// and empty if the task simply fails.
+func (e *Engine) compensationStatus(t store.Task, def FlowDef, curr string, execErr error) (string, error) {
+	explicit := execErr == nil
+	if !hasCompensations(def) {
+		return ternary(explicit, "compensated", ""), nil
+	}
+	if explicit && def.Nodes[curr].Compensate != nil {
+		return "compensating", nil
+	}
+	pending, _, err := e.compensable(t.ID, def)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(pending) > 0:
+		return "compensating", nil
+	case explicit:
+		return "compensated", nil
+	}
+	return "", nil
+}
+
+// compensable returns the successful runs of nodes with a compensation
+// that has not succeeded yet, latest first, and the failed compensation
+// attempts so far of each by run ID.
+func (e *Engine) compensable(taskID string, def FlowDef) ([]store.NodeRun, map[string]int, error) {
+	runs, err := e.Store.ListNodeRuns(taskID)
+	if err != nil {
+		return nil, nil, err
+	}
+	undone := map[string]bool{}
+	failed := map[string]int{}
+	for _, r := range runs {
+		if r.SubStatus != "compensate" {
+			continue
+		}
+		if r.Status == "ok" {
+			undone[r.BranchID] = true
+		} else {
+			failed[r.BranchID]++
+		}
+	}
+	var pending []store.NodeRun
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		if r.Status == "ok" && r.SubStatus == "" && !undone[r.ID] && def.Nodes[r.NodeKey].Compensate != nil {
+			pending = append(pending, r)
+		}
+	}
+	return pending, failed, nil
+}
+
+// runCompensation runs one attempt of the next compensation of a
+// compensating task. Each attempt is recorded as a run of the compensated
+// node with sub_status compensate and the undone run's ID as branch_id.
+// The task ends compensated once all have succeeded, or
+// compensation_failed, without running the rest, once one has run out of
+// attempts.
+func (e *Engine) runCompensation(ctx context.Context, t store.Task, def FlowDef) error {
+	pending, failed, err := e.compensable(t.ID, def)
+	if err != nil {
+		return err
+	}
+	shared, err := e.taskShared(t)
+	if err != nil {
+		return err
+	}
+	tr := store.TaskTransition{Status: "compensated", LastAction: t.LastAction, StepCount: t.StepCount + 1, RetryStateJSON: "{}"}
+	if len(pending) == 0 {
+		return e.endTask(t, def, tr, shared, nil)
+	}
+	r := pending[0]
+	node := def.Nodes[r.NodeKey]
+	comp := node.Compensate
+	attempt := failed[r.ID] + 1
+
+	var in, out interface{}
+	_ = json.Unmarshal([]byte(r.ExecInputJSON), &in)
+	_ = json.Unmarshal([]byte(r.ExecOutputJSON), &out)
+	input := map[string]interface{}{"input": in, "output": out}
+	if _, err := e.Blobs.Resolve(input); err != nil {
+		return err
+	}
+	params := map[string]interface{}{}
+	for k, v := range node.Params {
+		params[k] = v
+	}
+	var taskParams map[string]interface{}
+	_ = json.Unmarshal([]byte(t.ParamsJSON), &taskParams)
+	for k, v := range taskParams {
+		params[k] = v
+	}
+	sp, err := tmplScope{shared: shared, params: params, input: input, hasInput: true}.renderSpec(comp.ExecSpec)
+	for k, v := range sp.Params {
+		params[k] = v
+	}
+
+	use := DefNode{Service: sp.Service, ExecType: sp.ExecType, Func: sp.Func, Script: sp.Script}
+	var res ExecutorResult
+	if err != nil {
+		res = ExecutorResult{Error: err}
+	} else if use.ExecType == "queue" {
+		// A queue job would be mistaken for the node's own.
+		res = ExecutorResult{Error: codedError(CodeFatal, "queue compensation unsupported")}
+	} else {
+		res = e.execExecutor(ctx, ExecutorInput{Task: t, Node: use, NodeKey: r.NodeKey, Input: input, Params: params, Attempt: attempt})
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	run := nodeRunDetailed(t, r.NodeKey, attempt, ternary(res.Error == nil, "ok", "error"), "compensate", r.ID, map[string]interface{}{"compensates": r.ID}, input, res.Result, errString(res.Error), "", res.WorkerID, res.WorkerURL, res.LogPath)
+
+	p := retryPolicy(DefNode{Retry: comp.Retry})
+	switch {
+	case res.Error == nil && len(pending) > 1:
+		tr.Status, tr.CurrentNode = "compensating", t.CurrentNodeKey
+	case res.Error != nil && p.retries(attempt, res.Error):
+		tr.Status, tr.CurrentNode, tr.StepCount = "compensating", t.CurrentNodeKey, t.StepCount
+		tr.NextRunAt = time.Now().Add(p.delay(attempt)).UnixMilli()
+	case res.Error != nil:
+		tr.Status = "compensation_failed"
+	}
+	e.logf("task=%s node=%s compensate run=%s attempt=%d status=%s", t.ID, r.NodeKey, r.ID, attempt, tr.Status)
+	if tr.Status != "compensating" {
+		return e.endTask(t, def, tr, shared, res.Error, run)
+	}
+	return e.transition(t, tr, run)
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func runSaga(t *testing.T, def string, refundFails bool) (store.Task, []store.NodeRun, []string) {
+	t.Helper()
+	s := openTestStore(t)
+	e := New(s)
+	var calls []string
+	step := func(name string, fail bool) func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+		return func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+			calls = append(calls, name)
+			if fail {
+				return nil, errors.New(name + " failed")
+			}
+			if m, ok := in.(map[string]interface{}); ok {
+				if out, ok := m["output"].(map[string]interface{}); ok {
+					return map[string]interface{}{"undid": out["id"]}, nil
+				}
+			}
+			return map[string]interface{}{"id": name + "-1"}, nil
+		}
+	}
+	e.RegisterFunc("charge", step("charge", false))
+	e.RegisterFunc("reserve", step("reserve", false))
+	e.RegisterFunc("ship", step("ship", true))
+	e.RegisterFunc("refund", step("refund", refundFails))
+	e.RegisterFunc("release", step("release", false))
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	for i := 0; i < 10; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		tk, _ := s.GetTask(tid)
+		if tk.CurrentNodeKey == "" {
+			break
+		}
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	return tk, runs, calls
+}
+
+const sagaNodes = `"a":{"kind":"executor","exec_type":"local_func","func":"charge","compensate":{"exec_type":"local_func","func":"refund","retry":{"max_attempts":2}}},
+	"b":{"kind":"executor","exec_type":"local_func","func":"reserve","compensate":{"exec_type":"local_func","func":"release"}}`
+
+func TestCompensateOnFailure(t *testing.T) {
+	def := `{"start":"a","nodes":{` + sagaNodes + `,"c":{"kind":"executor","exec_type":"local_func","func":"ship"}},
+		"edges":[{"from":"a","action":"default","to":"b"},{"from":"b","action":"default","to":"c"}]}`
+	tk, runs, calls := runSaga(t, def, false)
+	if tk.Status != "compensated" || strings.Join(calls, ",") != "charge,reserve,ship,release,refund" {
+		t.Fatalf("status %s calls %v", tk.Status, calls)
+	}
+	var comp []store.NodeRun
+	for _, r := range runs {
+		if r.SubStatus == "compensate" {
+			comp = append(comp, r)
+		}
+	}
+	if len(comp) != 2 || comp[0].NodeKey != "b" || comp[1].NodeKey != "a" || comp[1].Status != "ok" || comp[1].ExecOutputJSON != `{"undid":"charge-1"}` {
+		t.Fatalf("compensation runs %+v", comp)
+	}
+	if comp[1].BranchID != runs[0].ID {
+		t.Fatalf("compensation of %s, want %s", comp[1].BranchID, runs[0].ID)
+	}
+}
+
+func TestCompensationFails(t *testing.T) {
+	def := `{"start":"a","nodes":{` + sagaNodes + `,"c":{"kind":"executor","exec_type":"local_func","func":"ship"}},
+		"edges":[{"from":"a","action":"default","to":"b"},{"from":"b","action":"default","to":"c"}]}`
+	tk, runs, calls := runSaga(t, def, true)
+	if tk.Status != "compensation_failed" || strings.Join(calls, ",") != "charge,reserve,ship,release,refund,refund" {
+		t.Fatalf("status %s calls %v", tk.Status, calls)
+	}
+	last := runs[len(runs)-1]
+	if last.SubStatus != "compensate" || last.AttemptNo != 2 || last.ErrorText != "refund failed" {
+		t.Fatalf("last run %+v", last)
+	}
+}
+
+func TestCompensateAction(t *testing.T) {
+	def := `{"start":"a","nodes":{` + sagaNodes + `},
+		"edges":[{"from":"a","action":"default","to":"b"},{"from":"b","action":"compensate","to":"a"}]}`
+	def = strings.Replace(def, `"func":"reserve",`, `"func":"reserve","post":{"action_static":"compensate"},`, 1)
+	tk, _, calls := runSaga(t, def, false)
+	if tk.Status != "compensated" || strings.Join(calls, ",") != "charge,reserve,release,refund" {
+		t.Fatalf("status %s calls %v", tk.Status, calls)
+	}
+}
+
+func TestFailureWithNothingToCompensate(t *testing.T) {
+	def := `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"ship"},
+		"b":{"kind":"executor","exec_type":"local_func","func":"reserve","compensate":{"exec_type":"local_func","func":"release"}}},
+		"edges":[{"from":"b","action":"default","to":"a"}]}`
+	tk, _, calls := runSaga(t, def, false)
+	if tk.Status != "failed" || strings.Join(calls, ",") != "ship" {
+		t.Fatalf("status %s calls %v", tk.Status, calls)
+	}
+}
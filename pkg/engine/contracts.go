@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nuknal/PocketFlowGo/pkg/schema"
+)
+
+// validateValue checks what, a node's input or output, against s. A
+// mismatch has code schema_error.
+func validateValue(what string, s *schema.Schema, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+	if err := s.Validate(v); err != nil {
+		return codedError(CodeSchemaError, fmt.Sprintf("%s does not match schema: %v", what, err))
+	}
+	return nil
+}
+
+// PrepareParams fills in the defaults of def's params schema that
+// paramsJSON leaves out and validates the result against the schema. It
+// returns the params a new task is created with; a mismatch is returned
+// as schema.Errors.
+func PrepareParams(def FlowDef, paramsJSON string) (string, error) {
+	if def.ParamsSchema == nil {
+		return paramsJSON, nil
+	}
+	var params interface{}
+	if err := json.Unmarshal([]byte(paramsJSON), &params); err != nil {
+		return "", err
+	}
+	if m, ok := params.(map[string]interface{}); ok {
+		def.ParamsSchema.ApplyDefaults(m)
+	}
+	if err := def.ParamsSchema.Validate(params); err != nil {
+		return "", err
+	}
+	return toJSON(params), nil
+}
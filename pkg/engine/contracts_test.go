@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNodeSchemas(t *testing.T) {
+	s := openTestStore(t)
+	e := New(s)
+	e.RegisterFunc("charge", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"status": p["status"]}, nil
+	})
+	def := `{"start":"a","nodes":{
+		"a":{"kind":"executor","exec_type":"local_func","func":"charge",
+			"prep":{"input_map":{"amount":"$params.amount"}},
+			"input_schema":{"type":"object","required":["amount"],"properties":{"amount":{"type":"number","minimum":1}}},
+			"output_schema":{"type":"object","properties":{"status":{"enum":["ok","declined"]}}},
+			"post":{"output_key":"charge"}},
+		"failed":{"kind":"executor","exec_type":"local_func","func":"charge","params":{"status":"ok"}}},
+		"edges":[],"catch":[{"code":"schema_error","to":"failed"}]}`
+	if err := CheckFlow(mustDef(t, def)); err != nil {
+		t.Fatal(err)
+	}
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	cases := []struct {
+		params string
+		err    string
+	}{
+		{`{"amount":5,"status":"ok"}`, ""},
+		{`{"amount":0,"status":"ok"}`, "input does not match schema: amount: 0 is less than 1"},
+		{`{"amount":5,"status":"pending"}`, `output does not match schema: status: "pending" is not one of ["ok","declined"]`},
+	}
+	for _, c := range cases {
+		tid, _ := s.CreateTask(vid, c.params, "", "a")
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		tk, _ := s.GetTask(tid)
+		runs, _ := s.ListNodeRuns(tid)
+		shared := map[string]interface{}{}
+		_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+		if c.err == "" {
+			if tk.Status != "completed" || !hasKey(shared, "charge") {
+				t.Fatalf("%s: task %s shared %v", c.params, tk.Status, shared)
+			}
+			continue
+		}
+		if tk.CurrentNodeKey != "failed" || len(runs) != 1 || runs[0].ErrorText != c.err || hasKey(shared, "charge") {
+			t.Fatalf("%s: task at %q runs %+v shared %v", c.params, tk.CurrentNodeKey, runs, shared)
+		}
+	}
+}
+
+func TestPrepareParams(t *testing.T) {
+	def := mustDef(t, `{"start":"a","nodes":{},"params_schema":{"type":"object","additionalProperties":false,
+		"properties":{"limit":{"type":"integer","default":10},"mode":{"enum":["fast","safe"],"default":"safe"}}}}`)
+	got, err := PrepareParams(def, `{"limit":3}`)
+	if err != nil || got != `{"limit":3,"mode":"safe"}` {
+		t.Fatalf("got %s, %v", got, err)
+	}
+	if _, err := PrepareParams(def, `{"limt":3}`); err == nil || err.Error() != "limt: unknown property" {
+		t.Fatalf("err %v", err)
+	}
+	if got, err := PrepareParams(FlowDef{}, `{"x":1}`); err != nil || got != `{"x":1}` {
+		t.Fatalf("no schema: %s, %v", got, err)
+	}
+	bad := mustDef(t, `{"start":"a","nodes":{"a":{"kind":"executor","output_schema":{"type":"obj"}}},"params_schema":{"$ref":"#/x"}}`)
+	err = CheckFlow(bad)
+	if err == nil || !strings.Contains(err.Error(), "params_schema: $ref: unsupported keyword") ||
+		!strings.Contains(err.Error(), `nodes.a.output_schema: type: unknown type "obj"`) {
+		t.Fatalf("check: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,12 +11,21 @@ import (
 	"strings"
 	"time"
 
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 var ErrAsyncPending = errors.New("async task pending")
 var ErrFatal = errors.New("fatal error")
 
+// nodeStateVersion is the format of the runtime state nodes save. Bump it
+// when a node kind changes what it keeps.
+const nodeStateVersion = 1
+
+// legacyStatePrefixes are the shared._rt keys node state was kept under
+// before it moved to its own table.
+var legacyStatePrefixes = []string{"pl:", "fe:", "sf:", "tm:", "we:", "ap:"}
+
 // Engine represents the core workflow execution engine.
 // It manages task execution, state transitions, and integration with the store.
 type Engine struct {
@@ -24,6 +34,9 @@ type Engine struct {
 	Log        *log.Logger
 	Owner      string
 	LocalFuncs map[string]func(context.Context, interface{}, map[string]interface{}) (interface{}, error)
+	// Blobs, when set, moves large values in shared state and node runs
+	// out of the store and resolves them again when a task is loaded.
+	Blobs *blob.Codec
 }
 
 // New creates a new Engine instance with the provided store.
@@ -32,6 +45,8 @@ func New(s store.Store) *Engine {
 }
 
 // RegisterFunc registers a local function that can be called by executors.
+// The context fn gets is canceled when the task is, and fn should return
+// soon after.
 func (e *Engine) RegisterFunc(name string, fn func(context.Context, interface{}, map[string]interface{}) (interface{}, error)) {
 	if e.LocalFuncs == nil {
 		e.LocalFuncs = map[string]func(context.Context, interface{}, map[string]interface{}) (interface{}, error){}
@@ -45,79 +60,253 @@ func (e *Engine) logf(format string, args ...interface{}) {
 	}
 }
 
-func (e *Engine) buildInput(node DefNode, shared map[string]interface{}, params map[string]interface{}) interface{} {
+// buildInput builds the node's input from prep. An input_map value is an
+// "=expr" expression, a ${...} template, a $params./$shared. reference or
+// a literal.
+func (e *Engine) buildInput(node DefNode, shared map[string]interface{}, params map[string]interface{}) (interface{}, error) {
 	if node.Prep.InputMap != nil {
+		sc := tmplScope{shared: shared, params: params}
 		m := make(map[string]interface{})
 		for k, path := range node.Prep.InputMap {
-			if strings.HasPrefix(path, "$") {
+			if src, ok := mappingExpr(path); ok {
+				v, err := evalValue(src, map[string]interface{}{"shared": shared, "params": params})
+				if err != nil {
+					return nil, err
+				}
+				m[k] = v
+				continue
+			}
+			switch {
+			case strings.Contains(path, "${"):
+				v, err := sc.render(path)
+				if err != nil {
+					return nil, err
+				}
+				m[k] = v
+			case strings.HasPrefix(path, "$"):
 				m[k] = resolveRef(path, shared, params, nil)
-			} else {
+			default:
 				m[k] = path //getByPath(shared, path)
 			}
 		}
-		return m
+		return m, nil
 	}
 	if node.Prep.InputKey != "" {
 		if strings.HasPrefix(node.Prep.InputKey, "$") {
-			return resolveRef(node.Prep.InputKey, shared, params, nil)
+			return resolveRef(node.Prep.InputKey, shared, params, nil), nil
 		}
-		return getByPath(shared, node.Prep.InputKey)
+		return getByPath(shared, node.Prep.InputKey), nil
 	}
-	return nil
+	return nil, nil
 }
 
+// cancelTask revokes the task's outstanding queue jobs, runs the flow's
+// finally hooks and marks it canceled.
 func (e *Engine) cancelTask(t store.Task) error {
+	if n, err := e.Store.RevokeQueueTasks(t.ID); err != nil {
+		return err
+	} else if n > 0 {
+		e.logf("task=%s revoked %d queue jobs", t.ID, n)
+	}
 	shared := map[string]interface{}{}
 	_ = json.Unmarshal([]byte(t.SharedJSON), &shared)
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "canceled")
-		_ = e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, "", "canceled", toJSON(shared), t.StepCount)
-	} else {
-		_ = e.Store.UpdateTaskStatus(t.ID, "canceled")
-		_ = e.Store.UpdateTaskProgress(t.ID, "", "canceled", toJSON(shared), t.StepCount)
+	def, err := e.loadDef(t)
+	if err != nil {
+		return err
 	}
-	e.logf("task=%s canceled node=%s", t.ID, t.CurrentNodeKey)
-	nr := map[string]interface{}{
-		"task_id":          t.ID,
-		"node_key":         t.CurrentNodeKey,
-		"attempt_no":       0,
-		"status":           "canceled",
-		"prep_json":        toJSON(map[string]interface{}{}),
-		"exec_input_json":  toJSON(nil),
-		"exec_output_json": toJSON(nil),
-		"error_text":       "",
-		"action":           "canceled",
-		"started_at":       time.Now().Unix(),
-		"finished_at":      time.Now().Unix(),
-		"worker_id":        "",
-		"worker_url":       "",
+	run := nodeRun(t, t.CurrentNodeKey, 0, "canceled", map[string]interface{}{}, nil, nil, "", "canceled", "", "", "")
+	tr := store.TaskTransition{Status: "canceled", LastAction: "canceled", SharedJSON: toJSON(shared), StepCount: t.StepCount, RetryStateJSON: "{}", NodeStates: []store.NodeState{{NodeKey: t.CurrentNodeKey}}}
+	if err := e.endTask(t, def, tr, shared, nil, run); err != nil {
+		return err
 	}
-	return e.Store.SaveNodeRun(nr)
+	e.logf("task=%s canceled node=%s", t.ID, t.CurrentNodeKey)
+	return nil
 }
 
-func (e *Engine) suspendTask(t store.Task, status string, shared map[string]interface{}) error {
+// suspendTask parks the task in status without moving the cursor. Shared
+// state and ns, the node's state if not nil, are saved because they may
+// hold partial results (e.g. parallel/foreach). The step is not finished,
+// so StepCount stays the same.
+func (e *Engine) suspendTask(t store.Task, status string, shared map[string]interface{}, ns *store.NodeState, runs ...map[string]interface{}) error {
 	e.logf("task=%s suspended status=%s", t.ID, status)
-	// We need to save shared state because it might contain partial execution results (e.g. in parallel/foreach)
-	// UpdateTaskStatusOwned only updates status. We need UpdateTaskProgressOwned-like behavior but without moving the cursor.
-	// We can reuse UpdateTaskProgressOwned but keep current_node and last_action same.
+	return e.transition(t, withState(store.TaskTransition{Status: status, CurrentNode: t.CurrentNodeKey, LastAction: t.LastAction, SharedJSON: toJSON(shared), StepCount: t.StepCount}, ns), runs...)
+}
 
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, status)
-		// Persist shared state. StepCount stays same? Or increment?
-		// If we suspend, we haven't finished the step. So StepCount stays.
-		// CurrentNode stays same.
-		return e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, t.CurrentNodeKey, t.LastAction, toJSON(shared), t.StepCount)
-	}
-	_ = e.Store.UpdateTaskStatus(t.ID, status)
-	return e.Store.UpdateTaskProgress(t.ID, t.CurrentNodeKey, t.LastAction, toJSON(shared), t.StepCount)
+// nodeState wraps the runtime state of node curr for saving with a
+// transition.
+func nodeState(kind string, curr string, state map[string]interface{}) *store.NodeState {
+	return &store.NodeState{NodeKey: curr, Kind: kind, Version: nodeStateVersion, StateJSON: toJSON(state)}
+}
+
+func withState(tr store.TaskTransition, ns *store.NodeState) store.TaskTransition {
+	if ns != nil {
+		tr.NodeStates = append(tr.NodeStates, *ns)
+	}
+	return tr
+}
+
+// loadState returns the saved runtime state of node curr, or nil. State
+// that a task started before node_states existed still keeps in shared._rt
+// is moved out of shared and returned instead.
+func (e *Engine) loadState(t store.Task, curr string, shared map[string]interface{}) (map[string]interface{}, error) {
+	var legacy map[string]interface{}
+	if rt, ok := shared["_rt"].(map[string]interface{}); ok {
+		for _, p := range legacyStatePrefixes {
+			if v, ok := rt[p+curr].(map[string]interface{}); ok {
+				legacy = v
+				delete(rt, p+curr)
+			}
+		}
+		if len(rt) == 0 {
+			delete(shared, "_rt")
+		}
+	}
+	ns, err := e.Store.GetNodeState(t.ID, curr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return legacy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ns.Version != nodeStateVersion {
+		return nil, fmt.Errorf("node %s: unsupported %s state version %d", curr, ns.Kind, ns.Version)
+	}
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(ns.StateJSON), &state); err != nil {
+		return nil, err
+	}
+	if _, err := e.Blobs.Resolve(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// transition writes one task step and its node runs atomically. When the
+// engine has an Owner the write only happens while the lease is held, and
+// it fails with store.ErrConflict if the task changed since t was read.
+// Only the shared keys that differ from t are written, so keys set
+// meanwhile by others (e.g. signals) survive. A step that would exceed the
+// task's shared state limits fails the task instead.
+func (e *Engine) transition(t store.Task, tr store.TaskTransition, runs ...map[string]interface{}) error {
+	_, err := e.commit(t, tr, runs...)
+	return err
+}
+
+// commit is transition returning the status written, which is failed if
+// the shared state limits were exceeded.
+func (e *Engine) commit(t store.Task, tr store.TaskTransition, runs ...map[string]interface{}) (string, error) {
+	tr.Revision = t.Revision
+	if tr.SharedJSON != "" {
+		js, err := e.Blobs.OffloadJSON(tr.SharedJSON)
+		if err != nil {
+			return "", err
+		}
+		ops, err := store.DiffShared(t.SharedJSON, js)
+		if err != nil {
+			return "", err
+		}
+		tr.SharedJSON, tr.Shared = "", append(ops, tr.Shared...)
+	}
+	var err error
+	for i := range tr.NodeStates {
+		if tr.NodeStates[i].StateJSON, err = e.Blobs.OffloadJSON(tr.NodeStates[i].StateJSON); err != nil {
+			return "", err
+		}
+	}
+	for _, r := range runs {
+		if r != nil {
+			if err := e.offloadRun(r); err != nil {
+				return "", err
+			}
+			tr.NodeRuns = append(tr.NodeRuns, r)
+		}
+	}
+	err = e.Store.TransitionTask(t.ID, e.Owner, tr)
+	if errors.Is(err, store.ErrSharedLimit) {
+		return "failed", e.failStep(t, tr, err)
+	}
+	if err != nil {
+		e.logf("task=%s transition status=%s failed: %v", t.ID, tr.Status, err)
+		return "", err
+	}
+	return tr.Status, nil
+}
+
+// failStep fails t in place of step tr, which could not be written or
+// finished because of cause, and runs the end hooks. The step's node runs
+// are kept, followed by one explaining the failure; shared state is left
+// as it was.
+func (e *Engine) failStep(t store.Task, tr store.TaskTransition, cause error) error {
+	e.logf("task=%s node=%s %v", t.ID, t.CurrentNodeKey, cause)
+	run := nodeRun(t, t.CurrentNodeKey, 1, "error", map[string]interface{}{}, nil, nil, cause.Error(), "", "", "", "")
+	err := e.Store.TransitionTask(t.ID, e.Owner, store.TaskTransition{
+		Revision:       t.Revision,
+		Status:         "failed",
+		CurrentNode:    t.CurrentNodeKey,
+		LastAction:     t.LastAction,
+		StepCount:      t.StepCount + 1,
+		RetryStateJSON: "{}",
+		NodeRuns:       append(tr.NodeRuns, run),
+		NodeStates:     []store.NodeState{{NodeKey: t.CurrentNodeKey}},
+	})
+	if err != nil {
+		return err
+	}
+	return e.failedHooks(t, cause)
+}
+
+// failedHooks runs the end hooks of t, which has just been failed by
+// cause outside of a regular step.
+func (e *Engine) failedHooks(t store.Task, cause error) error {
+	def, err := e.loadDef(t)
+	if err != nil {
+		return err
+	}
+	shared, err := e.taskShared(t)
+	if err != nil {
+		return err
+	}
+	e.endHooks(t, def, "failed", shared, cause)
+	return nil
+}
+
+// FailTask fails task taskID because of cause, an error that kept RunOnce
+// from finishing a step, and runs the flow's on_failure and finally hooks.
+// The write is checked like a step's: it returns store.ErrLeaseLost unless
+// the engine's Owner still holds the lease. A finished task is left alone.
+func (e *Engine) FailTask(taskID string, cause error) error {
+	t, err := e.Store.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	if store.Finished(t.Status) {
+		return nil
+	}
+	return e.failStep(t, store.TaskTransition{}, cause)
+}
+
+// offloadRun moves large executor inputs and outputs of run into blobs.
+func (e *Engine) offloadRun(run map[string]interface{}) error {
+	for _, k := range []string{"exec_input_json", "exec_output_json"} {
+		js, ok := run[k].(string)
+		if !ok {
+			continue
+		}
+		js, err := e.Blobs.OffloadJSON(js)
+		if err != nil {
+			return err
+		}
+		run[k] = js
+	}
+	return nil
 }
 
-func (e *Engine) recordRun(t store.Task, curr string, attempt int, status string, prep map[string]interface{}, input interface{}, output interface{}, errText string, action string, workerID string, workerURL string, logPath string) {
-	e.recordRunDetailed(t, curr, attempt, status, "", "", prep, input, output, errText, action, workerID, workerURL, logPath)
+func nodeRun(t store.Task, curr string, attempt int, status string, prep map[string]interface{}, input interface{}, output interface{}, errText string, action string, workerID string, workerURL string, logPath string) map[string]interface{} {
+	return nodeRunDetailed(t, curr, attempt, status, "", "", prep, input, output, errText, action, workerID, workerURL, logPath)
 }
 
-func (e *Engine) recordRunDetailed(t store.Task, curr string, attempt int, status string, subStatus string, branchID string, prep map[string]interface{}, input interface{}, output interface{}, errText string, action string, workerID string, workerURL string, logPath string) {
-	nr := map[string]interface{}{
+func nodeRunDetailed(t store.Task, curr string, attempt int, status string, subStatus string, branchID string, prep map[string]interface{}, input interface{}, output interface{}, errText string, action string, workerID string, workerURL string, logPath string) map[string]interface{} {
+	return map[string]interface{}{
 		"task_id":          t.ID,
 		"node_key":         curr,
 		"attempt_no":       attempt,
@@ -135,51 +324,66 @@ func (e *Engine) recordRunDetailed(t store.Task, curr string, attempt int, statu
 		"worker_url":       workerURL,
 		"log_path":         logPath,
 	}
-	_ = e.Store.SaveNodeRun(nr)
 }
 
-func (e *Engine) finishNode(t store.Task, def FlowDef, curr string, action string, shared map[string]interface{}, stepCount int, execErr error) error {
-	next := findNext(def.Edges, curr, action)
+// failNode ends the step of node curr with err, which is recorded in a
+// run after runs.
+func (e *Engine) failNode(t store.Task, def FlowDef, curr string, shared map[string]interface{}, input interface{}, err error, runs ...map[string]interface{}) error {
+	e.logf("task=%s node=%s %v", t.ID, curr, err)
+	runs = append(runs, nodeRun(t, curr, 1, "error", map[string]interface{}{}, input, nil, err.Error(), "", "", "", ""))
+	return e.finishNode(t, def, curr, "", shared, t.StepCount+1, err, runs...)
+}
+
+// finishNode moves the cursor along the edge matching action, drops the
+// node's runtime state and records runs in the same write. A failure
+// caught by the node's on_error edges or the flow's catch goes to their
+// target instead, with the error written to shared state and action
+// "error". An uncaught failure with no successor edge, or action
+// compensate, starts compensating the task if there is anything to undo.
+// A task that ends runs the flow's hooks once the step is written.
+func (e *Engine) finishNode(t store.Task, def FlowDef, curr string, action string, shared map[string]interface{}, stepCount int, execErr error, runs ...map[string]interface{}) error {
+	next := findNext(def.Edges, curr, action, e.edgeGuard(t.ID, shared, e.guardParams(t, def.Nodes[curr]), action))
+	if execErr != nil {
+		if h, ok := catchError(def, curr, execErr); ok {
+			shared[ternary(h.ErrorKey == "", "error", h.ErrorKey)] = caughtError(curr, execErr)
+			next, action = h.To, "error"
+			e.logf("task=%s node=%s error caught code=%s to=%s", t.ID, curr, errorCode(execErr), next)
+		}
+	}
 	st := ternary(execErr == nil, "ok", "error")
-	if execErr == nil {
-		if next == "" {
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "completed")
-			} else {
-				_ = e.Store.UpdateTaskStatus(t.ID, "completed")
-			}
-		} else {
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "running")
-			} else {
-				_ = e.Store.UpdateTaskStatus(t.ID, "running")
-			}
+	status := "running"
+	if next == "" {
+		status = ternary(execErr == nil, "completed", "failed")
+	}
+	if (execErr != nil && next == "") || action == actionCompensate {
+		st, err := e.compensationStatus(t, def, curr, execErr)
+		if err != nil {
+			return err
 		}
-	} else {
-		if next == "" {
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "failed")
-			} else {
-				_ = e.Store.UpdateTaskStatus(t.ID, "failed")
-			}
-		} else {
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "running")
-			} else {
-				_ = e.Store.UpdateTaskStatus(t.ID, "running")
-			}
+		if st != "" {
+			status, next = st, ternary(st == "compensating", curr, "")
 		}
 	}
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, next, action, toJSON(shared), stepCount)
+	tr := store.TaskTransition{Status: status, CurrentNode: next, LastAction: action, SharedJSON: toJSON(shared), StepCount: stepCount, RetryStateJSON: "{}", NodeStates: []store.NodeState{{NodeKey: curr}}}
+	var err error
+	if next == "" {
+		err = e.endTask(t, def, tr, shared, execErr, runs...)
 	} else {
-		_ = e.Store.UpdateTaskProgress(t.ID, next, action, toJSON(shared), stepCount)
+		err = e.transition(t, tr, runs...)
+	}
+	if err != nil {
+		return err
 	}
 	e.logf("task=%s node=%s finish action=%s next=%s status=%s", t.ID, curr, action, next, st)
 	return nil
 }
 
-func (e *Engine) RunOnce(taskID string) error {
+// RunOnce runs one step of task taskID. Canceling ctx stops the step's
+// executors in flight: HTTP calls are aborted and script process groups
+// killed. An interrupted step records nothing; if the task is canceling by
+// then it is canceled, otherwise ctx's error is returned and the step runs
+// again later.
+func (e *Engine) RunOnce(ctx context.Context, taskID string) error {
 	// 1. Fetch task and validate lease
 	t, err := e.Store.GetTask(taskID)
 	if err != nil {
@@ -198,14 +402,24 @@ func (e *Engine) RunOnce(taskID string) error {
 	if t.Status == "canceling" {
 		return e.cancelTask(t)
 	}
+	// A finished task has no step left; running it again would fail it
+	// and repeat its end hooks.
+	if store.Finished(t.Status) {
+		return nil
+	}
 
 	// 3. Load flow definition
-	fv, err := e.Store.GetFlowVersionByID(t.FlowVersionID)
+	def, err := e.loadDef(t)
 	if err != nil {
 		return err
 	}
-	var def FlowDef
-	if err := json.Unmarshal([]byte(fv.DefinitionJSON), &def); err != nil {
+
+	// Undo completed nodes of a compensating task
+	if t.Status == "compensating" {
+		err = e.runCompensation(ctx, t, def)
+		if err != nil && ctx.Err() != nil {
+			return e.interrupted(ctx, taskID)
+		}
 		return err
 	}
 
@@ -214,6 +428,16 @@ func (e *Engine) RunOnce(taskID string) error {
 	node := def.Nodes[curr]
 	shared := map[string]interface{}{}
 	_ = json.Unmarshal([]byte(t.SharedJSON), &shared)
+	if _, err := e.Blobs.Resolve(shared); err != nil {
+		return err
+	}
+	state, err := e.loadState(t, curr, shared)
+	if err != nil {
+		return err
+	}
+	if err := e.startHooks(t, def, shared); err != nil {
+		return err
+	}
 	params := map[string]interface{}{}
 	// 1. Load Node defaults first
 	for k, v := range node.Params {
@@ -225,10 +449,13 @@ func (e *Engine) RunOnce(taskID string) error {
 	for k, v := range taskParams {
 		params[k] = v
 	}
-	input := e.buildInput(node, shared, params)
-
-	fmt.Println("input:", input)
-	fmt.Println("params:", params)
+	input, node, err := e.renderTemplates(node, shared, params, taskParams)
+	if err != nil {
+		return e.failNode(t, def, curr, shared, nil, err)
+	}
+	if err := validateValue("input", node.InputSchema, input); err != nil {
+		return e.failNode(t, def, curr, shared, input, err)
+	}
 
 	// 5. Dispatch based on node kind
 	runInput := NodeRunInput{
@@ -239,26 +466,123 @@ func (e *Engine) RunOnce(taskID string) error {
 		Shared:  shared,
 		Params:  params,
 		Input:   input,
+		State:   state,
 	}
 
 	switch {
 	case node.Kind == "choice":
-		return e.runChoice(runInput)
+		err = e.runChoice(ctx, runInput)
 	case node.Kind == "parallel":
-		return e.runParallel(runInput)
+		err = e.runParallel(ctx, runInput)
 	case node.Kind == "subflow" && node.Subflow != nil:
-		return e.runSubflow(runInput)
+		err = e.runSubflow(ctx, runInput)
 	case node.Kind == "timer":
-		return e.runTimer(runInput)
+		err = e.runTimer(ctx, runInput)
 	case node.Kind == "foreach":
-		return e.runForeach(runInput)
+		err = e.runForeach(ctx, runInput)
 	case node.Kind == "wait_event":
-		return e.runWaitEvent(runInput)
+		err = e.runWaitEvent(ctx, runInput)
 	case node.Kind == "approval":
-		return e.runApproval(runInput)
+		err = e.runApproval(ctx, runInput)
 	case node.Kind == "executor" || node.Kind == "remote":
-		return e.runExecutorNode(runInput)
+		err = e.runExecutorNode(ctx, runInput)
 	default:
-		return e.runExecutorNode(runInput)
+		err = e.runExecutorNode(ctx, runInput)
+	}
+	if err != nil && ctx.Err() != nil {
+		return e.interrupted(ctx, taskID)
+	}
+	return err
+}
+
+// renderTemplates interpolates the node's params that the task does not
+// override, in place, builds its input and renders the rest of its
+// templates, which may also refer to the input.
+func (e *Engine) renderTemplates(node DefNode, shared, params, taskParams map[string]interface{}) (interface{}, DefNode, error) {
+	sc := tmplScope{shared: shared, params: params}
+	rendered := map[string]interface{}{}
+	for k, v := range node.Params {
+		if _, ok := taskParams[k]; ok {
+			continue
+		}
+		r, err := sc.renderValue(v)
+		if err != nil {
+			return nil, node, err
+		}
+		rendered[k] = r
+	}
+	for k, v := range rendered {
+		params[k] = v
+	}
+	input, err := e.buildInput(node, shared, params)
+	if err != nil {
+		return nil, node, err
 	}
+	sc.input, sc.hasInput = input, true
+	node, err = sc.renderNode(node)
+	return input, node, err
+}
+
+// guardParams are the params edge conditions see: the task's over the
+// node's.
+func (e *Engine) guardParams(t store.Task, node DefNode) map[string]interface{} {
+	params := map[string]interface{}{}
+	for k, v := range node.Params {
+		params[k] = v
+	}
+	var taskParams map[string]interface{}
+	_ = json.Unmarshal([]byte(t.ParamsJSON), &taskParams)
+	for k, v := range taskParams {
+		params[k] = v
+	}
+	return params
+}
+
+// loadDef reads the definition of t's flow version.
+func (e *Engine) loadDef(t store.Task) (FlowDef, error) {
+	var def FlowDef
+	fv, err := e.Store.GetFlowVersionByID(t.FlowVersionID)
+	if err != nil {
+		return def, err
+	}
+	err = json.Unmarshal([]byte(fv.DefinitionJSON), &def)
+	return def, err
+}
+
+// interrupted ends a step whose context was canceled before it was
+// recorded.
+func (e *Engine) interrupted(ctx context.Context, taskID string) error {
+	t, err := e.Store.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	if t.Status == "canceling" {
+		return e.cancelTask(t)
+	}
+	return ctx.Err()
+}
+
+// WatchCancel returns a context derived from parent that is canceled once
+// task taskID is set to canceling, checking every interval. Pass it to
+// RunOnce so a cancel request stops the step in flight. Call stop when the
+// step is over.
+func (e *Engine) WatchCancel(parent context.Context, taskID string, interval time.Duration) (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			if t, err := e.Store.GetTask(taskID); err == nil && t.Status == "canceling" {
+				e.logf("task=%s cancel requested, stopping step", taskID)
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
 }
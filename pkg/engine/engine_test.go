@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/memstore"
 	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
 )
 
@@ -85,12 +91,29 @@ func startWorker(t *testing.T, s store.Store) *httptest.Server {
 	return srv
 }
 
+// onSQLite makes openTestStore open SQLite databases instead of in-memory
+// stores. TestMain sets it for a second run of every test.
+var onSQLite bool
+
+// TestMain runs the engine tests on the in-memory store and then, unless
+// -short is given, again on SQLite.
+func TestMain(m *testing.M) {
+	if code := m.Run(); code != 0 || testing.Short() {
+		os.Exit(code)
+	}
+	onSQLite = true
+	os.Exit(m.Run())
+}
+
 func openTestStore(t *testing.T) store.Store {
-	p := t.TempDir() + "/test.db"
-	s, err := sqlstore.OpenSQLite(p)
+	if !onSQLite {
+		return memstore.New()
+	}
+	s, err := sqlstore.OpenSQLite(t.TempDir() + "/test.db")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
+	t.Cleanup(func() { s.DB.Close() })
 	return s
 }
 
@@ -109,7 +132,7 @@ func TestChoiceNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f1", "")
+	fid, err := s.CreateFlow("", "f1", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -157,7 +180,7 @@ func TestChoiceNode(t *testing.T) {
 	_ = s.UpdateTaskProgress(tsk.ID, tsk.CurrentNodeKey, "", string(shb), tsk.StepCount)
 	e := New(s)
 	for i := 0; i < 10; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -171,7 +194,7 @@ func TestParallelNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f2", "")
+	fid, err := s.CreateFlow("", "f2", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -210,7 +233,7 @@ func TestParallelNode(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -224,7 +247,7 @@ func TestSubflowNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f3", "")
+	fid, err := s.CreateFlow("", "f3", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -283,7 +306,7 @@ func TestSubflowNode(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -299,7 +322,7 @@ func TestExecutorWeightedByLoad(t *testing.T) {
 	srvBad := startBadWorker(t, s)
 	defer srv.Close()
 	defer srvBad.Close()
-	fid, err := s.CreateFlow("f4", "")
+	fid, err := s.CreateFlow("", "f4", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -330,7 +353,7 @@ func TestExecutorWeightedByLoad(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 20; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			runs, _ := s.ListNodeRuns(tid)
@@ -351,7 +374,7 @@ func TestCancelingTask(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f5", "")
+	fid, err := s.CreateFlow("", "f5", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -381,7 +404,7 @@ func TestCancelingTask(t *testing.T) {
 	}
 	_ = s.UpdateTaskStatus(tid, "canceling")
 	e := New(s)
-	_ = e.RunOnce(tid)
+	_ = e.RunOnce(context.Background(), tid)
 	nt, _ := s.GetTask(tid)
 	if nt.Status != "canceled" {
 		t.Fatalf("not canceled")
@@ -396,7 +419,7 @@ func TestChoiceExprComplex(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f6", "")
+	fid, err := s.CreateFlow("", "f6", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -446,7 +469,7 @@ func TestChoiceExprComplex(t *testing.T) {
 	_ = s.UpdateTaskProgress(tsk.ID, tsk.CurrentNodeKey, "", string(shb), tsk.StepCount)
 	e := New(s)
 	for i := 0; i < 20; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -462,7 +485,7 @@ func TestParallelFailFast(t *testing.T) {
 	srvBad := startBadWorker(t, s)
 	defer srv.Close()
 	defer srvBad.Close()
-	fid, err := s.CreateFlow("f7", "")
+	fid, err := s.CreateFlow("", "f7", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -503,7 +526,7 @@ func TestParallelFailFast(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -517,7 +540,7 @@ func TestParallelMixedExecTypes(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("pm1", "")
+	fid, err := s.CreateFlow("", "pm1", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -566,7 +589,7 @@ func TestParallelMixedExecTypes(t *testing.T) {
 		return f * m, nil
 	})
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			var sh map[string]interface{}
@@ -600,7 +623,7 @@ func TestTimerNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f8", "")
+	fid, err := s.CreateFlow("", "f8", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -625,7 +648,7 @@ func TestTimerNode(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -639,7 +662,7 @@ func TestForeachNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f9", "")
+	fid, err := s.CreateFlow("", "f9", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -668,7 +691,7 @@ func TestForeachNode(t *testing.T) {
 	_ = s.UpdateTaskProgress(tsk.ID, tsk.CurrentNodeKey, "", string(shb), tsk.StepCount)
 	e := New(s)
 	for i := 0; i < 100; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -682,7 +705,7 @@ func TestWaitEventNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f10", "")
+	fid, err := s.CreateFlow("", "f10", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -707,7 +730,7 @@ func TestWaitEventNode(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 5; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		time.Sleep(10 * time.Millisecond)
 	}
 	nt, _ := s.GetTask(tid)
@@ -715,7 +738,7 @@ func TestWaitEventNode(t *testing.T) {
 	shb, _ := json.Marshal(sh)
 	_ = s.UpdateTaskProgress(nt.ID, nt.CurrentNodeKey, "", string(shb), nt.StepCount)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt2, _ := s.GetTask(tid)
 		if nt2.Status == "completed" || nt2.CurrentNodeKey == "" {
 			return
@@ -729,7 +752,7 @@ func TestApprovalNode(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("f11", "")
+	fid, err := s.CreateFlow("", "f11", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -754,7 +777,7 @@ func TestApprovalNode(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 5; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		time.Sleep(10 * time.Millisecond)
 	}
 	nt, _ := s.GetTask(tid)
@@ -762,7 +785,7 @@ func TestApprovalNode(t *testing.T) {
 	shb, _ := json.Marshal(sh)
 	_ = s.UpdateTaskProgress(nt.ID, nt.CurrentNodeKey, "", string(shb), nt.StepCount)
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt2, _ := s.GetTask(tid)
 		if nt2.Status == "completed" || nt2.CurrentNodeKey == "" {
 			return
@@ -774,7 +797,7 @@ func TestApprovalNode(t *testing.T) {
 
 func TestLocalFuncExecutor(t *testing.T) {
 	s := openTestStore(t)
-	fid, err := s.CreateFlow("lf1", "")
+	fid, err := s.CreateFlow("", "lf1", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -816,7 +839,7 @@ func TestLocalFuncExecutor(t *testing.T) {
 		return f * m, nil
 	})
 	for i := 0; i < 10; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -828,7 +851,7 @@ func TestLocalFuncExecutor(t *testing.T) {
 
 func TestLocalScriptExecutor(t *testing.T) {
 	s := openTestStore(t)
-	fid, err := s.CreateFlow("ls1", "")
+	fid, err := s.CreateFlow("", "ls1", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -859,7 +882,7 @@ func TestLocalScriptExecutor(t *testing.T) {
 	}
 	e := New(s)
 	for i := 0; i < 20; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			return
@@ -871,7 +894,7 @@ func TestLocalScriptExecutor(t *testing.T) {
 
 func TestForeachLocalFunc(t *testing.T) {
 	s := openTestStore(t)
-	fid, err := s.CreateFlow("fe_local", "")
+	fid, err := s.CreateFlow("", "fe_local", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -911,7 +934,7 @@ func TestForeachLocalFunc(t *testing.T) {
 		return f * m, nil
 	})
 	for i := 0; i < 100; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			var sh map[string]interface{}
@@ -939,7 +962,7 @@ func TestSubflowExecOverride(t *testing.T) {
 	s := openTestStore(t)
 	srv := startWorker(t, s)
 	defer srv.Close()
-	fid, err := s.CreateFlow("sfov", "")
+	fid, err := s.CreateFlow("", "sfov", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -983,7 +1006,7 @@ func TestSubflowExecOverride(t *testing.T) {
 		return f * m, nil
 	})
 	for i := 0; i < 50; i++ {
-		_ = e.RunOnce(tid)
+		_ = e.RunOnce(context.Background(), tid)
 		nt, _ := s.GetTask(tid)
 		if nt.Status == "completed" || nt.CurrentNodeKey == "" {
 			var sh map[string]interface{}
@@ -999,3 +1022,274 @@ func TestSubflowExecOverride(t *testing.T) {
 	}
 	t.Fatalf("not completed")
 }
+
+func TestLeaseLostDuringNode(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "lease", "")
+	def := `{"start":"x","nodes":{"x":{"kind":"executor","exec_type":"local_func","func":"expire","post":{"output_key":"out"}}},"edges":[]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, err := s.CreateTask(vid, "{}", "", "x")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	e := New(s)
+	e.Owner = "tester"
+	if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The lease runs out while the node is executing.
+	e.RegisterFunc("expire", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		return "late", s.ExtendLease(tid, "tester", -10)
+	})
+	if err := e.RunOnce(context.Background(), tid); !errors.Is(err, store.ErrLeaseLost) {
+		t.Fatalf("RunOnce err=%v want ErrLeaseLost", err)
+	}
+	nt, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if nt.Status != "running" || nt.CurrentNodeKey != "x" || nt.SharedJSON != "{}" || len(runs) != 0 {
+		t.Fatalf("partial write after lost lease: %+v runs=%d", nt, len(runs))
+	}
+}
+
+func TestConcurrentSignalNotLost(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "cas", "")
+	def := `{"start":"x","nodes":{"x":{"kind":"executor","exec_type":"local_func","func":"slow","post":{"output_key":"out"}}},"edges":[]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, err := s.CreateTask(vid, "{}", "", "x")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	e := New(s)
+	signaled := false
+	// A signal lands while the node is executing.
+	e.RegisterFunc("slow", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		if !signaled {
+			signaled = true
+			return "v", s.UpdateTaskShared(tid, 0, `{"sig":"go"}`, store.TaskEvent{Type: "signal"})
+		}
+		return "v", nil
+	})
+	if err := e.RunOnce(context.Background(), tid); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("RunOnce err=%v want ErrConflict", err)
+	}
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	nt, _ := s.GetTask(tid)
+	var shared map[string]interface{}
+	_ = json.Unmarshal([]byte(nt.SharedJSON), &shared)
+	if nt.Status != "completed" || shared["sig"] != "go" || shared["out"] != "v" {
+		t.Fatalf("signal or output lost: %+v", nt)
+	}
+}
+
+func TestSharedPatchDuringStepKept(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "patch", "")
+	def := `{"start":"x","nodes":{"x":{"kind":"executor","exec_type":"local_func","func":"slow","post":{"output_key":"out"}}},"edges":[]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "x")
+	e := New(s)
+	// A per-key patch lands while the node is executing; the step writes
+	// only its own key, so neither conflicts nor clobbers the other.
+	e.RegisterFunc("slow", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		return "v", s.PatchTaskShared(tid, []store.SharedOp{{Op: "set", Key: "sig", Value: []byte(`"go"`)}}, store.TaskEvent{Type: "signal"})
+	})
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	nt, _ := s.GetTask(tid)
+	if nt.Status != "completed" || nt.SharedJSON != `{"out":"v","sig":"go"}` {
+		t.Fatalf("signal or output lost: %+v", nt)
+	}
+}
+
+func TestSharedLimitFailsTask(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "limit", "")
+	def := `{"start":"x","nodes":{"x":{"kind":"executor","exec_type":"local_func","func":"big","post":{"output_key":"out","action_static":"next"}},"y":{"kind":"executor","exec_type":"local_func","func":"big"}},"edges":[{"from":"x","action":"next","to":"y"}]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "x")
+	if err := s.SetSharedLimits(tid, store.SharedLimits{MaxKeyBytes: 16}); err != nil {
+		t.Fatal(err)
+	}
+	e := New(s)
+	e.RegisterFunc("big", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		return strings.Repeat("x", 32), nil
+	})
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	nt, _ := s.GetTask(tid)
+	if nt.Status != "failed" || nt.CurrentNodeKey != "x" || nt.SharedJSON != "{}" {
+		t.Fatalf("task not failed in place: %+v", nt)
+	}
+	runs, _ := s.ListNodeRuns(tid)
+	if len(runs) != 2 || runs[0].Status != "ok" || runs[1].Status != "error" || !strings.Contains(runs[1].ErrorText, `key "out" would be 34 bytes, limit 16`) {
+		t.Fatalf("runs: %+v", runs)
+	}
+}
+
+func TestLargeValuesOffloadedToBlobs(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "blobs", "")
+	def := `{"start":"gen","nodes":{
+		"gen":{"kind":"executor","exec_type":"local_func","func":"gen","post":{"output_key":"big","action_static":"next"}},
+		"size":{"kind":"executor","exec_type":"local_func","func":"size","prep":{"input_key":"$shared.big"},"post":{"output_key":"n"}}},
+		"edges":[{"from":"gen","action":"next","to":"size"}]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "gen")
+	e := New(s)
+	e.Blobs = &blob.Codec{Store: &blob.FS{Dir: t.TempDir()}, Threshold: 100}
+	big := strings.Repeat("x", 1000)
+	e.RegisterFunc("gen", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		return big, nil
+	})
+	e.RegisterFunc("size", func(ctx context.Context, input interface{}, params map[string]interface{}) (interface{}, error) {
+		s, _ := input.(string)
+		return len(s), nil
+	})
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	nt, _ := s.GetTask(tid)
+	if len(nt.SharedJSON) > 200 || !strings.Contains(nt.SharedJSON, blob.RefKey) {
+		t.Fatalf("shared not offloaded: %s", nt.SharedJSON)
+	}
+	runs, _ := s.ListNodeRuns(tid)
+	if len(runs) != 1 || len(runs[0].ExecOutputJSON) > 200 {
+		t.Fatalf("run output not offloaded: %+v", runs)
+	}
+	if out, err := e.Blobs.ResolveJSON(runs[0].ExecOutputJSON); err != nil || out != toJSON(big) {
+		t.Fatalf("resolve output: %v", err)
+	}
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	nt, _ = s.GetTask(tid)
+	var shared map[string]interface{}
+	_ = json.Unmarshal([]byte(nt.SharedJSON), &shared)
+	if nt.Status != "completed" || shared["n"] != 1000.0 {
+		t.Fatalf("blob not resolved for next node: %+v", nt)
+	}
+}
+
+func TestNodeStateKeptOutOfShared(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "state", "")
+	def := `{"start":"t","nodes":{"t":{"kind":"timer","params":{"delay_ms":60000}}},"edges":[]}`
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "t")
+	_ = s.UpdateTaskShared(tid, 0, `{"_rt":"user value"}`, store.TaskEvent{})
+	e := New(s)
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	nt, _ := s.GetTask(tid)
+	if nt.Status != "running" || nt.SharedJSON != `{"_rt":"user value"}` {
+		t.Fatalf("shared touched by timer: %+v", nt)
+	}
+	if ns, err := s.GetNodeState(tid, "t"); err != nil || ns.Kind != "timer" || !strings.Contains(ns.StateJSON, "start") {
+		t.Fatalf("timer state: %+v %v", ns, err)
+	}
+	_ = s.UpdateTaskStatus(tid, "canceling")
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	if states, _ := s.ListNodeStates(tid); len(states) != 0 {
+		t.Fatalf("state left after cancel: %+v", states)
+	}
+
+	// A task started before node_states existed keeps its timer in shared._rt.
+	legacy, _ := s.CreateTask(vid, "{}", "", "t")
+	_ = s.UpdateTaskShared(legacy, 0, `{"k":1,"_rt":{"tm:t":{"start":1}}}`, store.TaskEvent{})
+	if err := e.RunOnce(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+	nt, _ = s.GetTask(legacy)
+	if nt.Status != "completed" || nt.SharedJSON != `{"k":1}` {
+		t.Fatalf("legacy state not migrated: %+v", nt)
+	}
+}
+
+func TestExecHTTPStaysInNamespace(t *testing.T) {
+	s := openTestStore(t)
+	srv := startWorker(t, s)
+	defer srv.Close()
+	e := New(s)
+	in := ExecutorInput{Task: store.Task{Namespace: "acme"}, Node: DefNode{Service: "transform"}, Input: 2.0, Params: map[string]interface{}{"mul": 2.0}}
+	if res := e.execHTTP(context.Background(), in); res.Error == nil || res.Error.Error() != "no worker" {
+		t.Fatalf("used a worker of another namespace: %+v", res)
+	}
+	_ = s.RegisterWorker(store.WorkerInfo{ID: "w-acme", Namespace: "acme", URL: srv.URL, Services: []string{"transform"}, Status: "online"})
+	res := e.execHTTP(context.Background(), in)
+	if res.Error != nil || res.WorkerID != "w-acme" || res.Result != 4.0 {
+		t.Fatalf("acme worker: %+v", res)
+	}
+}
+
+// cancelInFlight runs a step of tid, asks for it to be canceled once
+// started is closed and returns the step's error. It fails t if the step
+// does not stop soon after.
+func cancelInFlight(t *testing.T, s store.Store, e *Engine, tid string, started <-chan struct{}) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		ctx, stop := e.WatchCancel(context.Background(), tid, 20*time.Millisecond)
+		defer stop()
+		done <- e.RunOnce(ctx, tid)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("step did not start")
+	}
+	if err := s.SetTaskStatus(tid, "canceling", store.TaskEvent{Type: "cancel", Actor: "tester"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("step kept running after cancel")
+		return nil
+	}
+}
+
+func TestCancelAbortsHTTPCall(t *testing.T) {
+	s := openTestStore(t)
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read.
+		_, _ = io.Copy(io.Discard, r.Body)
+		close(started)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer srv.Close()
+	_ = s.RegisterWorker(store.WorkerInfo{ID: "slow", URL: srv.URL, Services: []string{"slow"}, LastHeartbeat: time.Now().Unix(), Status: "online"})
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","service":"slow","max_retries":3}},"edges":[]}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	e := New(s)
+	e.Owner = "tester"
+	if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cancelInFlight(t, s, e, tid, started); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("worker request not aborted")
+	}
+	nt, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if nt.Status != "canceled" || len(runs) != 1 || runs[0].Status != "canceled" {
+		t.Fatalf("task %s runs %+v", nt.Status, runs)
+	}
+}
@@ -1,77 +1,66 @@
 package engine
 
 import (
+	"context"
 	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 // runExecutorNode executes a node of kind 'executor'.
-// It handles retries, input/output mapping, and transitions.
-func (e *Engine) runExecutorNode(in NodeRunInput) error {
-	var execRes interface{}
-	var workerID, workerURL, logPath string
-	var execErr error
+// It runs one attempt per step. A failure the node's retry policy covers
+// parks the task in waiting_retry until the backoff has passed, with the
+// attempt count kept in the task's retry state; otherwise the node
+// finishes with the error.
+func (e *Engine) runExecutorNode(ctx context.Context, in NodeRunInput) error {
+	rs := loadRetryState(in.Task.RetryStateJSON, in.NodeKey)
+	attempt := rs.Attempt + 1
 	action := ""
-	attempts := 0
-
-	// Loop for retries
-	for {
-		attempts++
-		// Execute the logic
-		execIn := ExecutorInput{
-			Task:    in.Task,
-			Node:    in.Node,
-			NodeKey: in.NodeKey,
-			Input:   in.Input,
-			Params:  in.Params,
-		}
-		var res ExecutorResult
-		res = e.execExecutor(execIn)
-
-		execRes = res.Result
-		workerID = res.WorkerID
-		workerURL = res.WorkerURL
-		logPath = res.LogPath
-		execErr = res.Error
-
-		// Handle Async Queue suspension
-		if execErr == ErrAsyncPending {
-			return e.suspendTask(in.Task, "waiting_queue", in.Shared)
-		}
 
-		// Log and record execution attempt
-		e.logf("task=%s node=%s kind=executor attempt=%d worker=%s status=%s", in.Task.ID, in.NodeKey, attempts, workerID, ternary(execErr == nil, "ok", "error"))
-		if !res.SkipRecord {
-			e.recordRun(in.Task, in.NodeKey, attempts, ternary(execErr == nil, "ok", "error"), map[string]interface{}{"input_key": in.Node.Prep.InputKey}, in.Input, execRes, errString(execErr), action, workerID, workerURL, logPath)
-		}
+	// Execute the logic
+	execIn := ExecutorInput{
+		Task:    in.Task,
+		Node:    in.Node,
+		NodeKey: in.NodeKey,
+		Input:   in.Input,
+		Params:  in.Params,
+		Attempt: attempt,
+	}
+	res := e.execExecutor(ctx, execIn)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	execRes := res.Result
+	execErr := res.Error
 
-		if execErr == nil {
-			break
-		}
+	// Handle Async Queue suspension
+	if execErr == ErrAsyncPending {
+		return e.suspendTask(in.Task, "waiting_queue", in.Shared, nil)
+	}
 
-		// Check retry limits
-		if execErr == ErrFatal || attempts > in.Node.MaxRetries {
-			break
-		}
+	// Log and record execution attempt
+	e.logf("task=%s node=%s kind=executor attempt=%d worker=%s status=%s", in.Task.ID, in.NodeKey, attempt, res.WorkerID, ternary(execErr == nil, "ok", "error"))
+	var run map[string]interface{}
+	if !res.SkipRecord {
+		run = nodeRun(in.Task, in.NodeKey, attempt, ternary(execErr == nil, "ok", "error"), map[string]interface{}{"input_key": in.Node.Prep.InputKey}, in.Input, execRes, errString(execErr), action, res.WorkerID, res.WorkerURL, res.LogPath)
+	}
 
-		// Wait before retry
-		if in.Node.WaitMillis > 0 {
-			time.Sleep(time.Duration(in.Node.WaitMillis) * time.Millisecond)
+	if execErr != nil {
+		if p := retryPolicy(in.Node); p.retries(attempt, execErr) {
+			return e.scheduleRetry(in, p, attempt, execErr, run)
 		}
 	}
 
 	// If execution succeeded, handle outputs and determine next action
 	if execErr == nil {
-		if in.Node.Post.OutputMap != nil {
-			if mm, ok := execRes.(map[string]interface{}); ok {
-				for toKey, fromField := range in.Node.Post.OutputMap {
-					in.Shared[toKey] = mm[fromField]
-				}
+		if err := writeOutputs(in.Node, execRes, in.Shared, in.Params, in.Input); err != nil {
+			execErr = err
+			if run != nil {
+				run["status"], run["error_text"] = "error", err.Error()
 			}
 		}
-		if in.Node.Post.OutputKey != "" {
-			in.Shared[in.Node.Post.OutputKey] = execRes
-		}
-
+	}
+	if execErr == nil {
 		// Determine transition
 		if in.Node.Post.ActionStatic != "" {
 			action = in.Node.Post.ActionStatic
@@ -79,25 +68,48 @@ func (e *Engine) runExecutorNode(in NodeRunInput) error {
 			action = pickAction(execRes, in.Node.Post.ActionKey)
 		}
 	}
-	return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, execErr)
+	return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, execErr, run)
+}
+
+// scheduleRetry records the failed attempt and parks the task until the
+// policy's backoff has passed. The lease is given up meanwhile, so no
+// scheduler waits for it.
+func (e *Engine) scheduleRetry(in NodeRunInput, p RetryPolicy, attempt int, execErr error, run map[string]interface{}) error {
+	next := time.Now().Add(p.delay(attempt)).UnixMilli()
+	rs := retryState{Node: in.NodeKey, Attempt: attempt, NextRunAt: next, LastError: errString(execErr), LastCode: errorCode(execErr)}
+	tr := store.TaskTransition{
+		Status:         "waiting_retry",
+		CurrentNode:    in.NodeKey,
+		LastAction:     in.Task.LastAction,
+		SharedJSON:     toJSON(in.Shared),
+		StepCount:      in.Task.StepCount,
+		RetryStateJSON: toJSON(rs),
+		NextRunAt:      next,
+	}
+	if err := e.transition(in.Task, tr, run); err != nil {
+		return err
+	}
+	e.logf("task=%s node=%s retry attempt=%d code=%s at=%d", in.Task.ID, in.NodeKey, attempt+1, rs.LastCode, next)
+	return nil
 }
 
 // execExecutor dispatches execution to the appropriate handler based on ExecType.
-func (e *Engine) execExecutor(in ExecutorInput) ExecutorResult {
+// Handlers stop when ctx is canceled and return its error.
+func (e *Engine) execExecutor(ctx context.Context, in ExecutorInput) ExecutorResult {
 	et := in.Node.ExecType
 	if et == "" {
 		et = "http"
 	}
 	switch et {
 	case "http":
-		return e.execHTTP(in)
+		return e.execHTTP(ctx, in)
 	case "local_func":
-		return e.execLocalFunc(in)
+		return e.execLocalFunc(ctx, in)
 	case "local_script":
-		return e.execLocalScript(in)
+		return e.execLocalScript(ctx, in)
 	case "queue":
-		return e.execQueue(in)
+		return e.execQueue(ctx, in)
 	default:
-		return ExecutorResult{Error: errorString("unsupported exec")}
+		return ExecutorResult{Error: codedError(CodeFatal, "unsupported exec")}
 	}
 }
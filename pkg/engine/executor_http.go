@@ -1,21 +1,22 @@
 package engine
 
 import (
-    "bytes"
-    "context"
-    "encoding/json"
-    "net/http"
-    "sort"
-    "time"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
 
-    "github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 // execHTTP executes an HTTP request to a worker service.
 // It performs service discovery, load balancing, and retries across available workers.
-func (e *Engine) execHTTP(in ExecutorInput) ExecutorResult {
-	// 1. Discover available workers
-	lst, _ := e.Store.ListWorkers(in.Node.Service, 15)
+// Canceling ctx aborts the request in flight.
+func (e *Engine) execHTTP(ctx context.Context, in ExecutorInput) ExecutorResult {
+	// 1. Discover available workers in the task's namespace
+	lst, _ := e.Store.ListWorkers(store.Namespace(in.Task.Namespace), in.Node.Service, 15)
 
 	// Filter for HTTP workers only
 	var httpWorkers []store.WorkerInfo
@@ -27,7 +28,7 @@ func (e *Engine) execHTTP(in ExecutorInput) ExecutorResult {
 	lst = httpWorkers
 
 	if len(lst) == 0 {
-		return ExecutorResult{Error: errorString("no worker")}
+		return ExecutorResult{Error: codedError(CodeNoWorker, "no worker")}
 	}
 
 	// 2. Load balance (optionally weighted by load)
@@ -37,36 +38,50 @@ func (e *Engine) execHTTP(in ExecutorInput) ExecutorResult {
 
 	payload := map[string]interface{}{"input": in.Input, "params": in.Params}
 	b, _ := json.Marshal(payload)
-	attempts := 0
 
 	// 3. Try execution on workers
 	for _, w := range lst {
-		attempts++
-		endpoint := w.URL + "/exec/" + in.Node.Service
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(b))
-		if err != nil {
-			cancel()
-			continue
+		res, ok := e.callWorker(ctx, w, in.Node.Service, b)
+		if err := ctx.Err(); err != nil {
+			return ExecutorResult{WorkerID: w.ID, WorkerURL: w.URL, Error: err}
 		}
-		req.Header.Set("Content-Type", "application/json")
-		resp, err := e.HTTP.Do(req)
-		if err != nil {
-			cancel()
-			continue
+		if ok {
+			return res
 		}
-		var out struct {
-			Result interface{} `json:"result"`
-			Error  string      `json:"error"`
-		}
-		if json.NewDecoder(resp.Body).Decode(&out) == nil {
-			resp.Body.Close()
-			if out.Error != "" {
-				return ExecutorResult{WorkerID: w.ID, WorkerURL: w.URL, Error: errorString(out.Error)}
-			}
-			return ExecutorResult{Result: out.Result, WorkerID: w.ID, WorkerURL: w.URL}
+	}
+	return ExecutorResult{Error: codedError(CodeUnavailable, "all workers failed")}
+}
+
+// callWorker posts body to service on worker w. ok is false if the worker
+// could not be reached or gave no readable answer, so the next one should
+// be tried. An error the worker reports carries its code, worker_error if
+// it gave none.
+func (e *Engine) callWorker(ctx context.Context, w store.WorkerInfo, service string, body []byte) (ExecutorResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL+"/exec/"+service, bytes.NewReader(body))
+	if err != nil {
+		return ExecutorResult{}, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.HTTP.Do(req)
+	if err != nil {
+		return ExecutorResult{}, false
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+		Code   string      `json:"code"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&out) != nil {
+		return ExecutorResult{}, false
+	}
+	if out.Error != "" {
+		if out.Code == "" {
+			out.Code = CodeWorkerError
 		}
-		resp.Body.Close()
+		return ExecutorResult{WorkerID: w.ID, WorkerURL: w.URL, Error: codedError(out.Code, out.Error)}, true
 	}
-	return ExecutorResult{Error: errorString("all workers failed")}
+	return ExecutorResult{Result: out.Result, WorkerID: w.ID, WorkerURL: w.URL}, true
 }
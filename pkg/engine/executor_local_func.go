@@ -7,31 +7,27 @@ import (
 
 // execLocalFunc executes a registered local Go function.
 // It is useful for lightweight tasks that don't require a separate worker service.
-func (e *Engine) execLocalFunc(in ExecutorInput) ExecutorResult {
-	attempts := 0
+// The function gets a context derived from ctx and is expected to return
+// when it is canceled. It can return an *ExecError to pick the code retry
+// policies see; other errors are func_error.
+func (e *Engine) execLocalFunc(ctx context.Context, in ExecutorInput) ExecutorResult {
 	fn := e.LocalFuncs[in.Node.Func]
 	if fn == nil {
 		return ExecutorResult{Error: ErrFatal}
 	}
 
-	// Retry loop
-	for {
-		attempts++
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		res, err := fn(ctx, in.Input, in.Params)
-		cancel()
-
-		if err != nil {
-			if in.Node.AttemptDelayMillis > 0 {
-				time.Sleep(time.Duration(in.Node.AttemptDelayMillis) * time.Millisecond)
-			}
-			if in.Node.MaxAttempts == 0 || (in.Node.MaxAttempts > 0 && attempts >= in.Node.MaxAttempts) {
-				break
-			}
-
-			continue
+	fctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	res, err := fn(fctx, in.Input, in.Params)
+	cancel()
+	if ctx.Err() != nil {
+		return ExecutorResult{WorkerID: "local-func:" + in.Node.Func, WorkerURL: "local", Error: ctx.Err()}
+	}
+	if err != nil {
+		code := errorCode(err)
+		if code == CodeError {
+			code = CodeFuncError
 		}
-		return ExecutorResult{Result: res, WorkerID: "local-func:" + in.Node.Func, WorkerURL: "local"}
+		return ExecutorResult{WorkerID: "local-func:" + in.Node.Func, WorkerURL: "local", Error: codedError(code, err.Error())}
 	}
-	return ExecutorResult{WorkerID: "local-func:" + in.Node.Func, WorkerURL: "local", Error: errorString("failed")}
+	return ExecutorResult{Result: res, WorkerID: "local-func:" + in.Node.Func, WorkerURL: "local"}
 }
@@ -1,7 +1,13 @@
 package engine
 
 import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
@@ -30,7 +36,7 @@ print(json.dumps({"msg": "hello from python"}))
 		NodeKey: "test-node",
 	}
 
-	res := e.execLocalScript(input)
+	res := e.execLocalScript(context.Background(), input)
 	if res.Error != nil {
 		t.Fatalf("Python execution failed: %v", res.Error)
 	}
@@ -58,7 +64,7 @@ echo "hello from bash"
 		NodeKey: "test-node-sh",
 	}
 
-	resSh := e.execLocalScript(inputSh)
+	resSh := e.execLocalScript(context.Background(), inputSh)
 	if resSh.Error != nil {
 		t.Fatalf("Bash execution failed: %v", resSh.Error)
 	}
@@ -71,3 +77,61 @@ echo "hello from bash"
 		t.Errorf("Unexpected result: %q", resStr)
 	}
 }
+
+func TestCancelKillsScriptProcessGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("needs /proc")
+	}
+	s := openTestStore(t)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	def, _ := json.Marshal(map[string]interface{}{
+		"start": "a",
+		"nodes": map[string]interface{}{"a": map[string]interface{}{
+			"kind": "executor", "exec_type": "local_script",
+			"script": map[string]interface{}{"language": "bash", "timeout_ms": 60000, "code": "sleep 60 &\necho $! > " + pidFile + "\nwait\n"},
+		}},
+		"edges": []interface{}{},
+	})
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, string(def), "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	e := New(s)
+	e.Owner = "tester"
+	if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Join("logs", "tasks", tid)) })
+
+	started := make(chan struct{})
+	go func() {
+		for {
+			if b, _ := os.ReadFile(pidFile); len(b) > 0 && b[len(b)-1] == '\n' {
+				close(started)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if err := cancelInFlight(t, s, e, tid, started); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if nt, _ := s.GetTask(tid); nt.Status != "canceled" {
+		t.Fatalf("status %s", nt.Status)
+	}
+
+	// The script's child was killed with it (a zombie waiting to be reaped
+	// counts as gone).
+	b, _ := os.ReadFile(pidFile)
+	pid := strings.TrimSpace(string(b))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, err := os.ReadFile("/proc/" + pid + "/stat")
+		if err != nil || strings.Contains(string(st), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child %s still running: %s", pid, st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
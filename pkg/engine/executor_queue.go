@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -8,17 +9,23 @@ import (
 )
 
 // execQueue handles execution via the persistent task queue (Pull Mode).
-func (e *Engine) execQueue(in ExecutorInput) ExecutorResult {
+// Each attempt of the node gets its own queue job and node run.
+func (e *Engine) execQueue(ctx context.Context, in ExecutorInput) ExecutorResult {
 	// 1. Check if we already have a completed run for this node
 	// If the task was in "waiting_queue" and we are here, it means the scheduler picked it up.
 	// We need to check if there is a successful node_run for this node_key that happened AFTER the task was last updated (or just the latest one).
 
+	attempt := in.Attempt
+	if attempt < 1 {
+		attempt = 1
+	}
 	runs, err := e.Store.ListNodeRuns(in.Task.ID)
 	if err == nil && len(runs) > 0 {
-		// Look for the latest run for this node
+		// Look for the latest run of this attempt, skipping the hook and
+		// compensation runs recorded under the same node key
 		var lastRun *store.NodeRun
 		for i := len(runs) - 1; i >= 0; i-- {
-			if runs[i].NodeKey == in.NodeKey {
+			if runs[i].NodeKey == in.NodeKey && runs[i].AttemptNo == attempt && runs[i].SubStatus == "" {
 				lastRun = &runs[i]
 				break
 			}
@@ -31,11 +38,15 @@ func (e *Engine) execQueue(in ExecutorInput) ExecutorResult {
 				if err := json.Unmarshal([]byte(lastRun.ExecOutputJSON), &res); err != nil {
 					return ExecutorResult{WorkerID: "queue", WorkerURL: "queue", Error: errorString("failed to parse result")}
 				}
+				res, err = e.Blobs.Resolve(res)
+				if err != nil {
+					return ExecutorResult{WorkerID: "queue", WorkerURL: "queue", Error: err}
+				}
 				return ExecutorResult{Result: res, WorkerID: lastRun.WorkerID, WorkerURL: "queue", LogPath: lastRun.LogPath, SkipRecord: true}
 			}
 
 			if lastRun.Status == "error" {
-				return ExecutorResult{WorkerID: lastRun.WorkerID, WorkerURL: "queue", LogPath: lastRun.LogPath, Error: errorString(lastRun.ErrorText), SkipRecord: true}
+				return ExecutorResult{WorkerID: lastRun.WorkerID, WorkerURL: "queue", LogPath: lastRun.LogPath, Error: codedError(CodeWorkerError, lastRun.ErrorText), SkipRecord: true}
 			}
 
 			// If already running or queued, don't re-enqueue
@@ -54,7 +65,7 @@ func (e *Engine) execQueue(in ExecutorInput) ExecutorResult {
 		"id":               runID,
 		"task_id":          in.Task.ID,
 		"node_key":         in.NodeKey,
-		"attempt_no":       1,
+		"attempt_no":       attempt,
 		"status":           "queued",
 		"prep_json":        toJSON(map[string]interface{}{"input_key": in.Node.Prep.InputKey}),
 		"exec_input_json":  toJSON(in.Input),
@@ -67,6 +78,9 @@ func (e *Engine) execQueue(in ExecutorInput) ExecutorResult {
 		"worker_url":       "queue",
 		"log_path":         "",
 	}
+	if err := e.offloadRun(nr); err != nil {
+		return ExecutorResult{Error: err}
+	}
 	if err := e.Store.CreateNodeRun(nr); err != nil {
 		e.logf("failed to create queued node_run: %v", err)
 	}
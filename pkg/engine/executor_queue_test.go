@@ -1,23 +1,17 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
-	"os"
+	"errors"
 	"testing"
 	"time"
 
-	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 func TestExecutorQueue_Basic(t *testing.T) {
-	// Setup DB
-	dbPath := "test_queue_basic.db"
-	os.Remove(dbPath)
-	defer os.Remove(dbPath)
-	s, err := sqlstore.OpenSQLite(dbPath)
-	if err != nil {
-		t.Fatal(err)
-	}
+	s := openTestStore(t)
 
 	// Setup Engine
 	eng := New(s)
@@ -42,7 +36,7 @@ func TestExecutorQueue_Basic(t *testing.T) {
 	}`
 
 	// Create Flow & Version
-	fid, _ := s.CreateFlow("queue-flow", "desc")
+	fid, _ := s.CreateFlow("", "queue-flow", "desc")
 	vid, _ := s.CreateFlowVersion(fid, 1, flowDef, "published")
 
 	// Create Task
@@ -58,7 +52,7 @@ func TestExecutorQueue_Basic(t *testing.T) {
 	}
 
 	// 1. First Run: Should suspend
-	err = eng.RunOnce(tid)
+	err = eng.RunOnce(context.Background(), tid)
 	if err != nil {
 		t.Fatalf("RunOnce failed: %v", err)
 	}
@@ -69,7 +63,7 @@ func TestExecutorQueue_Basic(t *testing.T) {
 	}
 
 	// Verify Task Queue entry
-	qTask, err := s.PollQueue("w1", []string{"async-worker"}, 60)
+	qTask, err := s.PollQueue("", "w1", []string{"async-worker"}, 60)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,7 +114,7 @@ func TestExecutorQueue_Basic(t *testing.T) {
 	// The lease owner is still "tester".
 
 	// 3. Second Run: Should Resume and Finish
-	err = eng.RunOnce(tid)
+	err = eng.RunOnce(context.Background(), tid)
 	if err != nil {
 		t.Fatalf("RunOnce failed: %v", err)
 	}
@@ -142,3 +136,41 @@ func TestExecutorQueue_Basic(t *testing.T) {
 	// Since node2 is not defined, next run would fail or stop. But we just wanted to verify node1 completion.
 	// Let's verify shared state has output if we mapped it (we didn't in this test).
 }
+
+func TestCancelRevokesQueueJob(t *testing.T) {
+	s := openTestStore(t)
+	eng := New(s)
+	eng.Owner = "tester"
+	fid, _ := s.CreateFlow("", "queue-flow", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"queue","service":"async-worker"}},"edges":[]}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	if _, err := s.LeaseNextTask(eng.Owner, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	q, err := s.PollQueue("", "w1", []string{"async-worker"}, 60)
+	if err != nil || q.TaskID != tid {
+		t.Fatalf("queue entry %+v %v", q, err)
+	}
+
+	// The task is canceled while it waits; a scheduler picks it up
+	// once the old lease is gone.
+	if err := s.SetTaskStatus(tid, "canceling", store.TaskEvent{Type: "cancel"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.ExtendLease(tid, eng.Owner, -10)
+	if leased, err := s.LeaseNextTask(eng.Owner, 10); err != nil || leased.ID != tid {
+		t.Fatalf("canceling task not leased: %+v %v", leased, err)
+	}
+	if err := eng.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	if task, _ := s.GetTask(tid); task.Status != "canceled" {
+		t.Fatalf("status %s", task.Status)
+	}
+	if _, err := s.CompleteQueueTask(q.ID); !errors.Is(err, store.ErrRevoked) {
+		t.Fatalf("complete after cancel err=%v want ErrRevoked", err)
+	}
+}
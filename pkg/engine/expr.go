@@ -116,31 +116,21 @@ func resolveVal(v interface{}, shared map[string]interface{}, params map[string]
 	return v
 }
 
-// resolveRef resolves a variable reference path from params, shared state, or input.
+// resolveRef resolves a variable reference path from params, shared state, or input,
+// such as "$shared.items[0].id" or "$params[\"a.b\"]". Other strings are returned as is.
 func resolveRef(path string, shared map[string]interface{}, params map[string]interface{}, input interface{}) interface{} {
-	if strings.HasPrefix(path, "$params.") {
-		k := strings.TrimPrefix(path, "$params.")
-		if k != "" && k[0] == '.' {
-			k = k[1:]
+	for _, r := range []struct {
+		root string
+		v    interface{}
+	}{{"$params", params}, {"$shared", shared}, {"$input", input}} {
+		rest := strings.TrimPrefix(path, r.root)
+		if len(rest) == len(path) || rest != "" && rest[0] != '.' && rest[0] != '[' {
+			continue
 		}
-		return getByPath(params, k)
-	}
-	if strings.HasPrefix(path, "$shared.") {
-		k := strings.TrimPrefix(path, "$shared.")
-		if k != "" && k[0] == '.' {
-			k = k[1:]
-		}
-		return getByPath(shared, k)
-	}
-	if strings.HasPrefix(path, "$input") {
-		p := strings.TrimPrefix(path, "$input")
-		if p == "" {
-			return input
-		}
-		if p[0] == '.' {
-			p = p[1:]
+		if rest == "" {
+			return r.v
 		}
-		return getByPath(input, p)
+		return getByPath(r.v, rest)
 	}
 	return path
 }
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuknal/PocketFlowGo/pkg/expr"
+)
+
+// Variables expressions can use, by where they appear.
+var (
+	// choice_cases[].when
+	condVars = map[string]expr.Type{"shared": expr.Any, "params": expr.Any, "input": expr.Any}
+	// edges[].when; action is the one the node picked.
+	guardVars = map[string]expr.Type{"shared": expr.Any, "params": expr.Any, "action": expr.String}
+	// "=..." values of prep.input_map
+	inputMapVars = map[string]expr.Type{"shared": expr.Any, "params": expr.Any}
+	// "=..." values of post.output_map; output is the node's result.
+	outputMapVars = map[string]expr.Type{"shared": expr.Any, "params": expr.Any, "input": expr.Any, "output": expr.Any}
+)
+
+// programs caches parsed expressions by source.
+var programs sync.Map
+
+func compileExpr(src string) (*expr.Program, error) {
+	if p, ok := programs.Load(src); ok {
+		return p.(*expr.Program), nil
+	}
+	p, err := expr.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	programs.Store(src, p)
+	return p, nil
+}
+
+// evalValue evaluates src in env. Errors have code expr_error.
+func evalValue(src string, env map[string]interface{}) (interface{}, error) {
+	p, err := compileExpr(src)
+	if err != nil {
+		return nil, codedError(CodeExprError, err.Error())
+	}
+	v, err := p.Eval(env)
+	if err != nil {
+		return nil, codedError(CodeExprError, err.Error())
+	}
+	return v, nil
+}
+
+// evalCond evaluates the condition src in env. Errors have code
+// expr_error.
+func evalCond(src string, env map[string]interface{}) (bool, error) {
+	p, err := compileExpr(src)
+	if err != nil {
+		return false, codedError(CodeExprError, err.Error())
+	}
+	ok, err := p.EvalBool(env)
+	if err != nil {
+		return false, codedError(CodeExprError, err.Error())
+	}
+	return ok, nil
+}
+
+// mappingExpr returns the expression of a mapping value written as
+// "=expr".
+func mappingExpr(v string) (string, bool) {
+	if !strings.HasPrefix(v, "=") {
+		return "", false
+	}
+	return strings.TrimSpace(v[1:]), true
+}
+
+// writeOutputs checks a node's result against its output schema and
+// stores it in shared state as its post section says: the output_map
+// first, then output_key.
+func writeOutputs(node DefNode, out interface{}, shared, params map[string]interface{}, input interface{}) error {
+	if err := validateValue("output", node.OutputSchema, out); err != nil {
+		return err
+	}
+	if node.Post.OutputMap != nil {
+		if err := applyOutputMap(node.Post.OutputMap, out, shared, params, input); err != nil {
+			return err
+		}
+	}
+	if node.Post.OutputKey != "" {
+		return setByPath(shared, node.Post.OutputKey, out)
+	}
+	return nil
+}
+
+// applyOutputMap copies fields of a map result into shared state as
+// post.output_map says, evaluating "=expr" values. Keys are write paths
+// and fields are read paths. All values are computed before any is
+// written.
+func applyOutputMap(m map[string]string, out interface{}, shared, params map[string]interface{}, input interface{}) error {
+	_, isMap := out.(map[string]interface{})
+	vals := map[string]interface{}{}
+	for toKey, from := range m {
+		if src, ok := mappingExpr(from); ok {
+			v, err := evalValue(src, map[string]interface{}{"shared": shared, "params": params, "input": input, "output": out})
+			if err != nil {
+				return err
+			}
+			vals[toKey] = v
+		} else if isMap {
+			vals[toKey] = getByPath(out, from)
+		}
+	}
+	for _, k := range sortedKeys(m) {
+		if v, ok := vals[k]; ok {
+			if err := setByPath(shared, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// edgeGuard returns the check findNext applies to edges with a when
+// condition. A condition that cannot be evaluated does not hold.
+func (e *Engine) edgeGuard(taskID string, shared, params map[string]interface{}, action string) func(DefEdge) bool {
+	action = ternary(action == "", "default", action)
+	return func(ed DefEdge) bool {
+		ok, err := evalCond(ed.When, map[string]interface{}{"shared": shared, "params": params, "action": action})
+		if err != nil {
+			e.logf("task=%s edge %s->%s: %v", taskID, ed.From, ed.To, err)
+		}
+		return ok
+	}
+}
+
+// CheckFlow parses and type-checks the expressions of def: the when
+// conditions of choice cases and edges and the "=expr" values of input
+// and output maps, embedded subflows included. It also parses the paths
+// nodes read and write and checks the params, input and output schemas.
+// ValidateFlow reports the same problems as part of its checks.
+func CheckFlow(def FlowDef) error {
+	var errs []error
+	checkDef(def, func(path string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	})
+	return errors.Join(errs...)
+}
+
+// checkDef runs the checks of CheckFlow, passing each problem to report
+// with the path of the field it is in.
+func checkDef(def FlowDef, report func(path string, err error)) {
+	if err := def.ParamsSchema.Check(); err != nil {
+		report("params_schema", err)
+	}
+	checkGraph(def.Nodes, def.Edges, "", report)
+}
+
+func checkGraph(nodes map[string]DefNode, edges []DefEdge, prefix string, report func(string, error)) {
+	check := func(where, src string, vars map[string]expr.Type, cond bool) {
+		p, err := expr.Parse(src)
+		if err == nil {
+			if cond {
+				err = p.CheckBool(vars)
+			} else {
+				_, err = p.Check(vars)
+			}
+		}
+		if err != nil {
+			report(prefix+where, err)
+		}
+	}
+	for _, k := range sortedKeys(nodes) {
+		n := nodes[k]
+		for i, cc := range n.ChoiceCases {
+			if cc.When != "" {
+				check(fmt.Sprintf("nodes.%s.choice_cases[%d].when", k, i), cc.When, condVars, true)
+			}
+		}
+		path := func(where string, err error) {
+			if err != nil {
+				report(fmt.Sprintf("%snodes.%s.%s", prefix, k, where), err)
+			}
+		}
+		if n.Prep.InputKey != "" {
+			path("prep.input_key", checkReadPath(n.Prep.InputKey))
+		}
+		for _, m := range []struct {
+			name string
+			m    map[string]string
+			vars map[string]expr.Type
+		}{{"prep.input_map", n.Prep.InputMap, inputMapVars}, {"post.output_map", n.Post.OutputMap, outputMapVars}} {
+			for _, to := range sortedKeys(m.m) {
+				if m.name == "post.output_map" {
+					path(m.name+"."+to, checkWritePath(to))
+				}
+				if src, ok := mappingExpr(m.m[to]); ok {
+					check(fmt.Sprintf("nodes.%s.%s.%s", k, m.name, to), src, m.vars, false)
+				} else {
+					path(m.name+"."+to, checkReadPath(m.m[to]))
+				}
+			}
+		}
+		if n.Post.OutputKey != "" {
+			path("post.output_key", checkWritePath(n.Post.OutputKey))
+		}
+		path("input_schema", n.InputSchema.Check())
+		path("output_schema", n.OutputSchema.Check())
+		if n.Subflow != nil {
+			checkGraph(n.Subflow.Nodes, n.Subflow.Edges, fmt.Sprintf("%snodes.%s.subflow.", prefix, k), report)
+		}
+	}
+	for i, ed := range edges {
+		if ed.When != "" {
+			check(fmt.Sprintf("edges[%d].when", i), ed.When, guardVars, true)
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
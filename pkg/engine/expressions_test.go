@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExpressions(t *testing.T) {
+	s := openTestStore(t)
+	e := New(s)
+	var gotIn interface{}
+	e.RegisterFunc("order", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		gotIn = in
+		return map[string]interface{}{"items": []interface{}{map[string]interface{}{"price": 30}, map[string]interface{}{"price": 80}}, "country": "DE"}, nil
+	})
+	e.RegisterFunc("noop", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	def := `{"start":"a","nodes":{
+		"a":{"kind":"executor","exec_type":"local_func","func":"order","params":{"rate":0.5},
+			"prep":{"input_map":{"limit":"=params.limit * 2"}},
+			"post":{"output_map":{"total":"=sum([output.items[0].price, output.items[1].price]) * params.rate","country":"country"}}},
+		"c":{"kind":"choice","choice_cases":[{"action":"big","when":"shared.total > 50 && lower(shared.country) in ['de', 'at']"}],"default_action":"small"},
+		"big":{"kind":"executor","exec_type":"local_func","func":"noop","post":{"output_key":"big"}},
+		"guarded":{"kind":"executor","exec_type":"local_func","func":"noop","post":{"output_key":"guarded"}},
+		"small":{"kind":"executor","exec_type":"local_func","func":"noop"}},
+		"edges":[{"from":"a","action":"default","to":"c"},{"from":"c","action":"big","to":"big"},{"from":"c","action":"small","to":"small"},
+			{"from":"big","when":"shared.total > 100","to":"small"},{"from":"big","when":"action == 'default' && params.limit == 3","to":"guarded"}]}`
+	if err := CheckFlow(mustDef(t, def)); err != nil {
+		t.Fatal(err)
+	}
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, `{"limit":3}`, "", "a")
+	for i := 0; i < 5; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		if tk, _ := s.GetTask(tid); tk.CurrentNodeKey == "" {
+			break
+		}
+	}
+	tk, _ := s.GetTask(tid)
+	shared := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+	if in := gotIn.(map[string]interface{}); in["limit"] != 6.0 {
+		t.Fatalf("input %v", gotIn)
+	}
+	if tk.Status != "completed" || shared["total"] != 55.0 || shared["country"] != "DE" || !hasKey(shared, "big") || !hasKey(shared, "guarded") {
+		t.Fatalf("task %s shared %v", tk.Status, shared)
+	}
+}
+
+func TestExpressionErrorFailsNode(t *testing.T) {
+	s := openTestStore(t)
+	e := New(s)
+	def := `{"start":"c","nodes":{"c":{"kind":"choice","choice_cases":[{"action":"x","when":"lower(shared.missing) == 'a'"}]}},"edges":[]}`
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "c")
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if tk.Status != "failed" || len(runs) != 1 || !strings.Contains(runs[0].ErrorText, "argument 1 of lower is null") {
+		t.Fatalf("task %s runs %+v", tk.Status, runs)
+	}
+}
+
+func TestCheckFlow(t *testing.T) {
+	def := `{"start":"a","nodes":{
+		"a":{"kind":"choice","choice_cases":[{"action":"x","when":"len(shared.items)"},{"action":"y","when":"input.n > 1"}]},
+		"b":{"kind":"executor","prep":{"input_map":{"n":"=output.x","lit":"output.x","p":"$shared.x[?(@ >)]"}},"post":{"output_map":{"y":"=upper(1)","z[*]":"z"},"output_key":"a['b"}},
+		"s":{"kind":"subflow","subflow":{"start":"x","nodes":{"x":{"kind":"executor"}},"edges":[{"from":"x","to":"","when":"shared.a +"}]}}},
+		"edges":[{"from":"a","to":"b","when":"input.n > 1"}]}`
+	err := CheckFlow(mustDef(t, def))
+	if err == nil {
+		t.Fatal("no errors")
+	}
+	want := []string{
+		"nodes.a.choice_cases[0].when: " + `expr "len(shared.items)": condition is number, want bool`,
+		"nodes.b.prep.input_map.n: " + `expr "output.x": unknown variable output`,
+		"nodes.b.prep.input_map.p: " + `path ".x[?(@ >)]": `,
+		"nodes.b.post.output_map.y: ",
+		"nodes.b.post.output_map.z[*]: " + `path "z[*]": cannot write through * or a filter`,
+		"nodes.b.post.output_key: " + `path "a['b": unterminated quoted key at 1`,
+		"nodes.s.subflow.edges[0].when: ",
+		"edges[0].when: " + `expr "input.n > 1": unknown variable input`,
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("errors:\n%v", err)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], w) {
+			t.Fatalf("error %d: %q, want prefix %q", i, lines[i], w)
+		}
+	}
+}
+
+func mustDef(t *testing.T, js string) FlowDef {
+	t.Helper()
+	var def FlowDef
+	if err := json.Unmarshal([]byte(js), &def); err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+func hasKey(m map[string]interface{}, k string) bool {
+	_, ok := m[k]
+	return ok
+}
@@ -1,14 +1,16 @@
 package engine
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 // runForeach executes a 'foreach' node, iterating over a list of items.
 // It supports sequential or concurrent execution modes.
-func (e *Engine) runForeach(in NodeRunInput) error {
+func (e *Engine) runForeach(ctx context.Context, in NodeRunInput) error {
 	items := e.resolveItems(in.Input)
 
 	// Handle empty input list
@@ -17,25 +19,36 @@ func (e *Engine) runForeach(in NodeRunInput) error {
 	}
 
 	// Initialize runtime state for iteration
-	rt, fe, done, errs := e.initForeachState(in.Task, in.NodeKey, in.Shared, in.Node)
-	key := "fe:" + in.NodeKey
+	fe, done, errs := e.initForeachState(in.State, in.Node)
 
 	// Determine remaining items to process
 	remaining := e.getRemainingItems(items, done, errs)
 
 	// If all items processed, aggregate results and finish
 	if len(remaining) == 0 {
-		return e.finishForeachNode(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, in.Input, items, done, errs, rt, key)
+		return e.finishForeachNode(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, in.Input, items, done, errs)
+	}
+
+	// Items waiting on a retry run once their backoff has passed
+	keys := indexKeys(remaining)
+	ready, _ := readyBranches(fe, keys)
+	if len(ready) == 0 {
+		return e.branchStep(in, "foreach", fe, keys, in.Task.StepCount)
+	}
+	remaining = remaining[:0]
+	for _, k := range ready {
+		i, _ := strconv.Atoi(k)
+		remaining = append(remaining, i)
 	}
 
 	// Process remaining items based on execution mode
 	mode := fe["mode"].(string)
 	if mode == "concurrent" {
-		return e.runForeachConcurrent(in, items, remaining, fe, done, errs, rt, key)
+		return e.runForeachConcurrent(ctx, in, items, remaining, fe, done, errs)
 	}
 
 	// Sequential mode
-	return e.runForeachSequential(in, items, remaining, fe, done, errs, rt, key)
+	return e.runForeachSequential(ctx, in, items, remaining, fe, done, errs)
 }
 
 // resolveItems extracts the list of items from the input
@@ -49,24 +62,27 @@ func (e *Engine) resolveItems(input interface{}) []interface{} {
 
 // handleEmptyList handles the case where the input list is empty
 func (e *Engine) handleEmptyList(t store.Task, def FlowDef, curr string, node DefNode, input interface{}, shared map[string]interface{}) error {
-	e.recordRun(t, curr, 1, "ok", map[string]interface{}{"input_key": node.Prep.InputKey}, input, []interface{}{}, "", node.Post.ActionStatic, "", "", "")
-	return e.finishNode(t, def, curr, node.Post.ActionStatic, shared, t.StepCount+1, nil)
+	run := nodeRun(t, curr, 1, "ok", map[string]interface{}{"input_key": node.Prep.InputKey}, input, []interface{}{}, "", node.Post.ActionStatic, "", "", "")
+	return e.finishNode(t, def, curr, node.Post.ActionStatic, shared, t.StepCount+1, nil, run)
 }
 
 // initForeachState initializes or retrieves the runtime state for foreach execution
-func (e *Engine) initForeachState(t store.Task, curr string, shared map[string]interface{}, node DefNode) (map[string]interface{}, map[string]interface{}, map[string]interface{}, map[string]interface{}) {
-	rt, _ := shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "fe:" + curr
-	fe, _ := rt[key].(map[string]interface{})
+func (e *Engine) initForeachState(fe map[string]interface{}, node DefNode) (map[string]interface{}, map[string]interface{}, map[string]interface{}) {
 	if fe == nil {
 		fe = map[string]interface{}{"done": map[string]interface{}{}, "errs": map[string]interface{}{}, "idx": 0, "mode": node.ParallelMode, "max": node.MaxParallel, "strategy": node.FailureStrategy}
 	}
 	done := fe["done"].(map[string]interface{})
 	errs := fe["errs"].(map[string]interface{})
-	return rt, fe, done, errs
+	return fe, done, errs
+}
+
+// indexKeys returns the state keys of item indices.
+func indexKeys(idx []int) []string {
+	keys := make([]string, 0, len(idx))
+	for _, i := range idx {
+		keys = append(keys, indexKey(i))
+	}
+	return keys
 }
 
 // getRemainingItems finds indices of items that haven't been processed yet
@@ -84,7 +100,7 @@ func (e *Engine) getRemainingItems(items []interface{}, done map[string]interfac
 }
 
 // finishForeachNode aggregates results and transitions to the next node
-func (e *Engine) finishForeachNode(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, input interface{}, items []interface{}, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string) error {
+func (e *Engine) finishForeachNode(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, input interface{}, items []interface{}, done map[string]interface{}, errs map[string]interface{}) error {
 	agg := make([]interface{}, 0, len(items))
 	for i := range items {
 		agg = append(agg, done[indexKey(i)])
@@ -94,25 +110,22 @@ func (e *Engine) finishForeachNode(t store.Task, def FlowDef, node DefNode, curr
 		action = pickAction(map[string]interface{}{"result": agg}, node.Post.ActionKey)
 	}
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = agg
-	}
-	delete(rt, key)
-	if len(rt) == 0 {
-		delete(shared, "_rt")
-	} else {
-		shared["_rt"] = rt
+		if err := setByPath(shared, node.Post.OutputKey, agg); err != nil {
+			return e.failNode(t, def, curr, shared, input, err)
+		}
 	}
 	hasErr := len(errs) != 0
 	cont := node.FailureStrategy == "continue"
-	e.recordRun(t, curr, 1, ternary(!hasErr || cont, "ok", "error"), map[string]interface{}{"input_key": node.Prep.InputKey}, input, agg, ternary(!hasErr || cont, "", toJSON(errs)), action, "", "", "")
+	run := nodeRun(t, curr, 1, ternary(!hasErr || cont, "ok", "error"), map[string]interface{}{"input_key": node.Prep.InputKey}, input, agg, ternary(!hasErr || cont, "", toJSON(errs)), action, "", "", "")
 	if !hasErr || cont {
-		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil)
+		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil, run)
 	}
-	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, errorString("foreach error"))
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, branchError("foreach error", errs), run)
 }
 
-// runForeachConcurrent executes items concurrently
-func (e *Engine) runForeachConcurrent(in NodeRunInput, items []interface{}, remaining []int, fe map[string]interface{}, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string) error {
+// runForeachConcurrent executes items concurrently. A failed item the
+// node's retry policy covers runs again in a later step.
+func (e *Engine) runForeachConcurrent(ctx context.Context, in NodeRunInput, items []interface{}, remaining []int, fe map[string]interface{}, done map[string]interface{}, errs map[string]interface{}) error {
 	max := in.Node.MaxParallel
 	if max <= 0 || max > len(remaining) {
 		max = len(remaining)
@@ -121,6 +134,7 @@ func (e *Engine) runForeachConcurrent(in NodeRunInput, items []interface{}, rema
 
 	type br struct {
 		idx     int
+		attempt int
 		res     interface{}
 		wid     string
 		wurl    string
@@ -131,7 +145,8 @@ func (e *Engine) runForeachConcurrent(in NodeRunInput, items []interface{}, rema
 
 	// Launch concurrent goroutines
 	for _, i := range sel {
-		go func(ii int, it interface{}) {
+		failed, _ := branchAttempt(fe, indexKey(i))
+		go func(ii int, it interface{}, attempt int) {
 			use, callParams := e.prepareForeachExecution(in.Node, ii, in.Params)
 			execIn := ExecutorInput{
 				Task:    in.Task,
@@ -139,14 +154,17 @@ func (e *Engine) runForeachConcurrent(in NodeRunInput, items []interface{}, rema
 				NodeKey: in.NodeKey,
 				Input:   it,
 				Params:  callParams,
+				Attempt: attempt,
 			}
-			res := e.execExecutor(execIn)
-			ch <- br{idx: ii, res: res.Result, wid: res.WorkerID, wurl: res.WorkerURL, logPath: res.LogPath, err: res.Error}
-		}(i, items[i])
+			res := e.execExecutor(ctx, execIn)
+			ch <- br{idx: ii, attempt: attempt, res: res.Result, wid: res.WorkerID, wurl: res.WorkerURL, logPath: res.LogPath, err: res.Error}
+		}(i, items[i], failed+1)
 	}
 
+	policy := retryPolicy(in.Node)
 	hadErr := false
 	hasPending := false
+	runs := []map[string]interface{}{}
 	for i := 0; i < len(sel); i++ {
 		it := <-ch
 
@@ -156,38 +174,45 @@ func (e *Engine) runForeachConcurrent(in NodeRunInput, items []interface{}, rema
 			continue
 		}
 
-		e.recordRunDetailed(in.Task, in.NodeKey, 1, ternary(it.err == nil, "ok", "error"), "item_complete", fmt.Sprintf("%d", it.idx), map[string]interface{}{"branch": it.idx}, items[it.idx], it.res, errString(it.err), "", it.wid, it.wurl, it.logPath)
-		if it.err != nil {
+		runs = append(runs, nodeRunDetailed(in.Task, in.NodeKey, it.attempt, ternary(it.err == nil, "ok", "error"), "item_complete", fmt.Sprintf("%d", it.idx), map[string]interface{}{"branch": it.idx}, items[it.idx], it.res, errString(it.err), "", it.wid, it.wurl, it.logPath))
+		switch {
+		case it.err == nil:
+			done[indexKey(it.idx)] = it.res
+		case !retryBranch(fe, policy, indexKey(it.idx), it.attempt, it.err):
 			hadErr = true
 			errs[indexKey(it.idx)] = it.err.Error()
-		} else {
-			done[indexKey(it.idx)] = it.res
 		}
 	}
 
+	// Results of branches that finished before the step was interrupted
+	// are dropped with it.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	fe["done"] = done
 	fe["errs"] = errs
-	rt[key] = fe
-	in.Shared["_rt"] = rt
+	ns := nodeState("foreach", in.NodeKey, fe)
 
 	if hasPending {
-		return e.suspendTask(in.Task, "waiting_queue", in.Shared)
+		return e.suspendTask(in.Task, "waiting_queue", in.Shared, ns, runs...)
 	}
 
 	if in.Node.FailureStrategy == "fail_fast" && hadErr {
-		return e.handleForeachFailFast(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, items, done, errs)
+		return e.handleForeachFailFast(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, items, done, errs, runs...)
 	}
 
-	e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-	return nil
+	return e.branchStep(in, "foreach", fe, indexKeys(e.getRemainingItems(items, done, errs)), in.Task.StepCount+1, runs...)
 }
 
 // runForeachSequential executes items sequentially
-func (e *Engine) runForeachSequential(in NodeRunInput, items []interface{}, remaining []int, fe map[string]interface{}, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string) error {
+func (e *Engine) runForeachSequential(ctx context.Context, in NodeRunInput, items []interface{}, remaining []int, fe map[string]interface{}, done map[string]interface{}, errs map[string]interface{}) error {
 	if len(remaining) == 0 {
 		return nil
 	}
 	idx := remaining[0]
+	failed, _ := branchAttempt(fe, indexKey(idx))
+	attempt := failed + 1
 
 	use, callParams := e.prepareForeachExecution(in.Node, idx, in.Params)
 	execIn := ExecutorInput{
@@ -196,37 +221,35 @@ func (e *Engine) runForeachSequential(in NodeRunInput, items []interface{}, rema
 		NodeKey: in.NodeKey,
 		Input:   items[idx],
 		Params:  callParams,
+		Attempt: attempt,
+	}
+	res := e.execExecutor(ctx, execIn)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	res := e.execExecutor(execIn)
 	execRes, workerID, workerURL, logPath, execErr := res.Result, res.WorkerID, res.WorkerURL, res.LogPath, res.Error
 
-	e.recordRunDetailed(in.Task, in.NodeKey, 1, ternary(execErr == nil, "ok", "error"), "item_complete", fmt.Sprintf("%d", idx), map[string]interface{}{"branch": idx}, items[idx], execRes, errString(execErr), "", workerID, workerURL, logPath)
+	run := nodeRunDetailed(in.Task, in.NodeKey, attempt, ternary(execErr == nil, "ok", "error"), "item_complete", fmt.Sprintf("%d", idx), map[string]interface{}{"branch": idx}, items[idx], execRes, errString(execErr), "", workerID, workerURL, logPath)
 
 	if execErr != nil {
 		if execErr == ErrAsyncPending {
-			return e.suspendTask(in.Task, "waiting_queue", in.Shared)
+			return e.suspendTask(in.Task, "waiting_queue", in.Shared, nodeState("foreach", in.NodeKey, fe), run)
 		}
-		errs[indexKey(idx)] = errString(execErr)
-		fe["errs"] = errs
-		rt[key] = fe
-		in.Shared["_rt"] = rt
-
-		e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-		return nil
+		if !retryBranch(fe, retryPolicy(in.Node), indexKey(idx), attempt, execErr) {
+			errs[indexKey(idx)] = errString(execErr)
+			fe["errs"] = errs
+		}
+	} else {
+		done[indexKey(idx)] = execRes
+		fe["done"] = done
 	}
 
-	done[indexKey(idx)] = execRes
-	fe["done"] = done
-	rt[key] = fe
-	in.Shared["_rt"] = rt
-
-	e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-	return nil
+	return e.branchStep(in, "foreach", fe, indexKeys(e.getRemainingItems(items, done, errs)), in.Task.StepCount+1, run)
 }
 
 // prepareForeachExecution creates the DefNode and params for a specific iteration
 func (e *Engine) prepareForeachExecution(node DefNode, idx int, params map[string]interface{}) (DefNode, map[string]interface{}) {
-	use := DefNode{Service: node.Service, ExecType: node.ExecType, Func: node.Func, Script: node.Script, WeightedByLoad: node.WeightedByLoad, MaxAttempts: node.MaxAttempts, AttemptDelayMillis: node.AttemptDelayMillis}
+	use := DefNode{Service: node.Service, ExecType: node.ExecType, Func: node.Func, Script: node.Script, WeightedByLoad: node.WeightedByLoad}
 
 	// Find spec for this index if exists
 	var sp ExecSpec
@@ -264,7 +287,7 @@ func (e *Engine) prepareForeachExecution(node DefNode, idx int, params map[strin
 }
 
 // handleForeachFailFast handles the fail_fast strategy logic for foreach
-func (e *Engine) handleForeachFailFast(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, items []interface{}, done map[string]interface{}, errs map[string]interface{}) error {
+func (e *Engine) handleForeachFailFast(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, items []interface{}, done map[string]interface{}, errs map[string]interface{}, runs ...map[string]interface{}) error {
 	agg := make([]interface{}, 0, len(items))
 	for i := range items {
 		if v, ok := done[indexKey(i)]; ok {
@@ -276,17 +299,9 @@ func (e *Engine) handleForeachFailFast(t store.Task, def FlowDef, node DefNode,
 		action = pickAction(map[string]interface{}{"result": agg}, node.Post.ActionKey)
 	}
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = agg
-	}
-	next := findNext(def.Edges, curr, action)
-
-	status := ternary(next == "", "failed", "running")
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, status)
-		_ = e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, next, action, toJSON(shared), t.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskStatus(t.ID, status)
-		_ = e.Store.UpdateTaskProgress(t.ID, next, action, toJSON(shared), t.StepCount+1)
+		if err := setByPath(shared, node.Post.OutputKey, agg); err != nil {
+			return e.failNode(t, def, curr, shared, nil, err, runs...)
+		}
 	}
-	return nil
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, branchError("foreach error", errs), runs...)
 }
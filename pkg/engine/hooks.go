@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// FlowHooks are executors a flow runs when a task starts and when it ends,
+// whichever node it is on. OnFailure runs for tasks that end failed,
+// compensated or compensation_failed; Finally runs for every end,
+// canceled included, after the others.
+//
+// A hook gets {task_id, status, shared, error} as input, where error is
+// {code, message} or null, and params merged over the task's. It is
+// recorded as a run of the task's current node with sub_status hook and
+// the section as branch_id. End hooks run once the step that ends the task
+// is written, for the status it was written with, so a step that is redone
+// or rejected does not run them. Hooks are not retried and their failures
+// do not change the task's status.
+type FlowHooks struct {
+	OnStart   []ExecSpec `json:"on_start"`
+	OnSuccess []ExecSpec `json:"on_success"`
+	OnFailure []ExecSpec `json:"on_failure"`
+	Finally   []ExecSpec `json:"finally"`
+}
+
+// startHooks runs the on_start hooks of a task that has not made a step
+// yet, unless an earlier try of that step already did.
+func (e *Engine) startHooks(t store.Task, def FlowDef, shared map[string]interface{}) error {
+	if t.StepCount != 0 || len(def.Hooks.OnStart) == 0 {
+		return nil
+	}
+	runs, err := e.Store.ListNodeRuns(t.ID)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if r.SubStatus == "hook" && r.BranchID == "on_start" {
+			return nil
+		}
+	}
+	for _, run := range e.runHooks(t, "on_start", def.Hooks.OnStart, hookInput(t, t.Status, shared, nil)) {
+		if err := e.offloadRun(run); err != nil {
+			return err
+		}
+		if err := e.Store.SaveNodeRun(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endTask writes tr, a step that ends t, and then runs the end hooks. If
+// the store rejected the step's shared state, failStep has failed
+// the task and run the hooks instead.
+func (e *Engine) endTask(t store.Task, def FlowDef, tr store.TaskTransition, shared map[string]interface{}, execErr error, runs ...map[string]interface{}) error {
+	status, err := e.commit(t, tr, runs...)
+	if err != nil || status != tr.Status {
+		return err
+	}
+	e.endHooks(t, def, status, shared, execErr)
+	return nil
+}
+
+// endHooks runs the hooks for a task that ended in status and saves their
+// runs. The task has ended by then, so failures to save are only logged.
+func (e *Engine) endHooks(t store.Task, def FlowDef, status string, shared map[string]interface{}, execErr error) {
+	in := hookInput(t, status, shared, execErr)
+	var runs []map[string]interface{}
+	switch status {
+	case "completed":
+		runs = e.runHooks(t, "on_success", def.Hooks.OnSuccess, in)
+	case "failed", "compensated", "compensation_failed":
+		runs = e.runHooks(t, "on_failure", def.Hooks.OnFailure, in)
+	}
+	for _, run := range append(runs, e.runHooks(t, "finally", def.Hooks.Finally, in)...) {
+		err := e.offloadRun(run)
+		if err == nil {
+			err = e.Store.SaveNodeRun(run)
+		}
+		if err != nil {
+			e.logf("task=%s hook=%s save run failed: %v", t.ID, run["branch_id"], err)
+		}
+	}
+}
+
+func hookInput(t store.Task, status string, shared map[string]interface{}, execErr error) map[string]interface{} {
+	var errv interface{}
+	if execErr != nil {
+		errv = map[string]interface{}{"code": errorCode(execErr), "message": execErr.Error()}
+	}
+	return map[string]interface{}{"task_id": t.ID, "status": status, "shared": shared, "error": errv}
+}
+
+// runHooks runs the hooks of section one after the other. They run to the
+// end even if the step that ends the task was canceled.
+func (e *Engine) runHooks(t store.Task, section string, specs []ExecSpec, input map[string]interface{}) []map[string]interface{} {
+	var runs []map[string]interface{}
+	for i, sp := range specs {
+		params := map[string]interface{}{}
+		var taskParams map[string]interface{}
+		_ = json.Unmarshal([]byte(t.ParamsJSON), &taskParams)
+		for k, v := range taskParams {
+			params[k] = v
+		}
+		shared, _ := input["shared"].(map[string]interface{})
+		sp, err := tmplScope{shared: shared, params: params, input: input, hasInput: true}.renderSpec(sp)
+		for k, v := range sp.Params {
+			params[k] = v
+		}
+		use := DefNode{Service: sp.Service, ExecType: sp.ExecType, Func: sp.Func, Script: sp.Script}
+		var res ExecutorResult
+		if err != nil {
+			res = ExecutorResult{Error: err}
+		} else if use.ExecType == "queue" {
+			res = ExecutorResult{Error: codedError(CodeFatal, "queue hooks unsupported")}
+		} else {
+			res = e.execExecutor(context.Background(), ExecutorInput{Task: t, Node: use, NodeKey: t.CurrentNodeKey, Input: input, Params: params, Attempt: 1})
+		}
+		e.logf("task=%s hook=%s index=%d status=%s", t.ID, section, i, ternary(res.Error == nil, "ok", "error"))
+		runs = append(runs, nodeRunDetailed(t, t.CurrentNodeKey, 1, ternary(res.Error == nil, "ok", "error"), "hook", section, map[string]interface{}{"hook": section, "index": i}, input, res.Result, errString(res.Error), "", res.WorkerID, res.WorkerURL, res.LogPath))
+	}
+	return runs
+}
+
+// taskShared decodes t's shared state for hooks of a step that does not
+// change it.
+func (e *Engine) taskShared(t store.Task) (map[string]interface{}, error) {
+	shared := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(t.SharedJSON), &shared)
+	_, err := e.Blobs.Resolve(shared)
+	return shared, err
+}
@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+type hookCall struct {
+	name  string
+	input map[string]interface{}
+}
+
+func hookEngine(s store.Store, calls *[]hookCall) *Engine {
+	e := New(s)
+	for _, name := range []string{"start", "success", "failure", "finally"} {
+		name := name
+		e.RegisterFunc(name, func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+			m, _ := in.(map[string]interface{})
+			*calls = append(*calls, hookCall{name, m})
+			return nil, nil
+		})
+	}
+	return e
+}
+
+const hooksDef = `"hooks":{"on_start":[{"exec_type":"local_func","func":"start"}],"on_success":[{"exec_type":"local_func","func":"success"}],
+	"on_failure":[{"exec_type":"local_func","func":"failure"}],"finally":[{"exec_type":"local_func","func":"finally"}]}`
+
+func TestHooksOnSuccessAndFailure(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		s := openTestStore(t)
+		var calls []hookCall
+		e := hookEngine(s, &calls)
+		tries := 0
+		e.RegisterFunc("work", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+			tries++
+			if fail || tries == 1 {
+				return nil, errors.New("boom")
+			}
+			return "done", nil
+		})
+		fid, _ := s.CreateFlow("", "f", "")
+		vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"work","post":{"output_key":"out"},"retry":{"max_attempts":2}}},"edges":[],`+hooksDef+`}`, "published")
+		tid, _ := s.CreateTask(vid, "{}", "", "a")
+		for i := 0; i < 2; i++ {
+			if err := e.RunOnce(context.Background(), tid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tk, _ := s.GetTask(tid)
+		want := []string{"start", "success", "finally"}
+		if fail {
+			want = []string{"start", "failure", "finally"}
+		}
+		if len(calls) != 3 || calls[0].name != want[0] || calls[1].name != want[1] || calls[2].name != want[2] {
+			t.Fatalf("fail=%v: hooks %+v", fail, calls)
+		}
+		end := calls[2].input
+		if end["status"] != tk.Status || end["task_id"] != tid {
+			t.Fatalf("fail=%v: finally input %v, task %s", fail, end, tk.Status)
+		}
+		if fail {
+			if errv, _ := end["error"].(map[string]interface{}); errv["message"] != "boom" || errv["code"] != "func_error" {
+				t.Fatalf("error input %v", end["error"])
+			}
+		} else if shared, _ := end["shared"].(map[string]interface{}); shared["out"] != "done" || end["error"] != nil {
+			t.Fatalf("final shared %v", end)
+		}
+		runs, _ := s.ListNodeRuns(tid)
+		hooks := 0
+		for _, r := range runs {
+			if r.SubStatus == "hook" {
+				hooks++
+			}
+		}
+		if hooks != 3 {
+			t.Fatalf("fail=%v: %d hook runs recorded", fail, hooks)
+		}
+	}
+}
+
+func TestFinallyHookOnCancel(t *testing.T) {
+	s := openTestStore(t)
+	var calls []hookCall
+	e := hookEngine(s, &calls)
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"start"}},"edges":[],`+hooksDef+`}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	_ = s.UpdateTaskStatus(tid, "canceling")
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	if tk.Status != "canceled" || len(calls) != 1 || calls[0].name != "finally" || calls[0].input["status"] != "canceled" {
+		t.Fatalf("task %s hooks %+v", tk.Status, calls)
+	}
+}
+
+func TestStartHookOnQueueNode(t *testing.T) {
+	s := openTestStore(t)
+	var calls []hookCall
+	e := hookEngine(s, &calls)
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"q","nodes":{"q":{"kind":"executor","exec_type":"queue","service":"svc","post":{"output_key":"out"}}},"edges":[],`+hooksDef+`}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "q")
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	if tk.Status != "waiting_queue" || len(calls) != 1 || calls[0].name != "start" {
+		t.Fatalf("task %s shared %s hooks %+v", tk.Status, tk.SharedJSON, calls)
+	}
+	jobs, _ := s.ListQueueTasks(tid)
+	if len(jobs) != 1 {
+		t.Fatalf("%d queue jobs", len(jobs))
+	}
+}
+
+func TestEndHooksFollowCommittedStatus(t *testing.T) {
+	names := func(calls []hookCall) []string {
+		var out []string
+		for _, c := range calls {
+			out = append(out, c.name+":"+c.input["status"].(string))
+		}
+		return out
+	}
+	run := func(t *testing.T, s store.Store, e *Engine, out string) string {
+		fid, _ := s.CreateFlow("", "f", "")
+		vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"work","post":{"output_key":"`+out+`"}}},"edges":[],"hooks":{"on_success":[{"exec_type":"local_func","func":"success"}],"on_failure":[{"exec_type":"local_func","func":"failure"}],"finally":[{"exec_type":"local_func","func":"finally"}]}}`, "published")
+		tid, _ := s.CreateTask(vid, "{}", "", "a")
+		return tid
+	}
+
+	t.Run("conflict", func(t *testing.T) {
+		s := openTestStore(t)
+		var calls []hookCall
+		e := hookEngine(s, &calls)
+		var tid string
+		tries := 0
+		e.RegisterFunc("work", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+			if tries++; tries == 1 {
+				// Someone else writes the task while the step runs.
+				return "done", s.UpdateTaskShared(tid, 0, `{"x":1}`, store.TaskEvent{})
+			}
+			return "done", nil
+		})
+		tid = run(t, s, e, "out")
+		if err := e.RunOnce(context.Background(), tid); !errors.Is(err, store.ErrConflict) {
+			t.Fatalf("first try: %v", err)
+		}
+		if len(calls) != 0 {
+			t.Fatalf("hooks ran for a step that was not written: %v", names(calls))
+		}
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(calls); len(got) != 2 || got[0] != "success:completed" || got[1] != "finally:completed" {
+			t.Fatalf("hooks %v", got)
+		}
+	})
+
+	t.Run("shared limit", func(t *testing.T) {
+		s := openTestStore(t)
+		var calls []hookCall
+		e := hookEngine(s, &calls)
+		e.RegisterFunc("work", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+			return "far too long for the limit", nil
+		})
+		tid := run(t, s, e, "out")
+		_ = s.SetSharedLimits(tid, store.SharedLimits{MaxKeyBytes: 8})
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		tk, _ := s.GetTask(tid)
+		if got := names(calls); tk.Status != "failed" || len(got) != 2 || got[0] != "failure:failed" || got[1] != "finally:failed" {
+			t.Fatalf("task %s hooks %v", tk.Status, got)
+		}
+		runs, _ := s.ListNodeRuns(tid)
+		if last := runs[len(runs)-1]; last.SubStatus != "hook" || last.BranchID != "finally" {
+			t.Fatalf("hook runs not saved: %+v", runs)
+		}
+	})
+
+	t.Run("FailTask", func(t *testing.T) {
+		s := openTestStore(t)
+		var calls []hookCall
+		e := hookEngine(s, &calls)
+		tid := run(t, s, e, "out")
+		if err := e.FailTask(tid, errors.New("db down")); err != nil {
+			t.Fatal(err)
+		}
+		tk, _ := s.GetTask(tid)
+		errv, _ := calls[0].input["error"].(map[string]interface{})
+		if got := names(calls); tk.Status != "failed" || len(got) != 2 || got[0] != "failure:failed" || errv["message"] != "db down" {
+			t.Fatalf("task %s hooks %v", tk.Status, got)
+		}
+		// Failing it again is a no-op.
+		if err := e.FailTask(tid, errors.New("again")); err != nil || len(calls) != 2 {
+			t.Fatalf("refail: %v, hooks %v", err, names(calls))
+		}
+	})
+
+	t.Run("FailTask lease lost", func(t *testing.T) {
+		s := openTestStore(t)
+		var calls []hookCall
+		e := hookEngine(s, &calls)
+		e.Owner = "sched-1"
+		tid := run(t, s, e, "out")
+		if _, err := s.LeaseNextTask("sched-2", 60); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.FailTask(tid, errors.New("db down")); !errors.Is(err, store.ErrLeaseLost) {
+			t.Fatalf("want ErrLeaseLost, got %v", err)
+		}
+		if tk, _ := s.GetTask(tid); tk.Status == "failed" || len(calls) != 0 {
+			t.Fatalf("task %s hooks %v", tk.Status, names(calls))
+		}
+	})
+}
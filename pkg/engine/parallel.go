@@ -1,11 +1,13 @@
 package engine
 
 import (
+	"context"
+
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
 // runParallel executes multiple services in parallel (concurrently or sequentially).
-func (e *Engine) runParallel(in NodeRunInput) error {
+func (e *Engine) runParallel(ctx context.Context, in NodeRunInput) error {
 	svcs, specs := e.resolveParallelServices(in.Node, in.Params)
 
 	// Handle no services case
@@ -14,8 +16,7 @@ func (e *Engine) runParallel(in NodeRunInput) error {
 	}
 
 	// Initialize runtime state for parallel execution
-	rt, pl, done, errs := e.initParallelState(in.Task, in.NodeKey, in.Shared, in.Node)
-	key := "pl:" + in.NodeKey
+	pl, done, errs := e.initParallelState(in.State, in.Node)
 
 	// Determine remaining services
 	remaining := e.getRemainingServices(svcs, done, errs)
@@ -23,17 +24,23 @@ func (e *Engine) runParallel(in NodeRunInput) error {
 
 	// If all completed, aggregate results and finish
 	if len(remaining) == 0 {
-		return e.finishParallelNode(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, in.Input, svcs, done, errs, rt, key)
+		return e.finishParallelNode(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, in.Input, svcs, done, errs)
+	}
+
+	// Branches waiting on a retry run once their backoff has passed
+	ready, _ := readyBranches(pl, remaining)
+	if len(ready) == 0 {
+		return e.branchStep(in, "parallel", pl, remaining, in.Task.StepCount)
 	}
 
 	// Launch execution based on mode
 	mode := pl["mode"].(string)
 	if mode == "concurrent" {
-		return e.runConcurrent(in, svcs, specs, remaining, pl, done, errs, rt, key)
+		return e.runConcurrent(ctx, in, svcs, specs, ready, pl, done, errs)
 	}
 
 	// Sequential mode
-	return e.runSequential(in, svcs, specs, pl, done, errs, rt, key, remaining)
+	return e.runSequential(ctx, in, svcs, specs, pl, done, errs, ready)
 }
 
 // resolveParallelServices determines the list of services to execute and their specs
@@ -62,25 +69,18 @@ func (e *Engine) resolveParallelServices(node DefNode, params map[string]interfa
 
 // handleNoServices handles the case where no services are resolved
 func (e *Engine) handleNoServices(t store.Task, curr string, node DefNode, input interface{}, shared map[string]interface{}) error {
-	e.recordRun(t, curr, 1, "error", map[string]interface{}{"input_key": node.Prep.InputKey}, input, nil, "no services", "", "", "", "")
-	e.updateTaskRunning(t, curr, shared)
-	return nil
+	run := nodeRun(t, curr, 1, "error", map[string]interface{}{"input_key": node.Prep.InputKey}, input, nil, "no services", "", "", "", "")
+	return e.updateTaskRunning(t, curr, shared, nil, run)
 }
 
 // initParallelState initializes or retrieves the runtime state for parallel execution
-func (e *Engine) initParallelState(t store.Task, curr string, shared map[string]interface{}, node DefNode) (map[string]interface{}, map[string]interface{}, map[string]interface{}, map[string]interface{}) {
-	rt, _ := shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "pl:" + curr
-	pl, _ := rt[key].(map[string]interface{})
+func (e *Engine) initParallelState(pl map[string]interface{}, node DefNode) (map[string]interface{}, map[string]interface{}, map[string]interface{}) {
 	if pl == nil {
 		pl = map[string]interface{}{"done": map[string]interface{}{}, "errs": map[string]interface{}{}, "mode": node.ParallelMode, "max": node.MaxParallel, "strategy": node.FailureStrategy}
 	}
 	done := pl["done"].(map[string]interface{})
 	errs := pl["errs"].(map[string]interface{})
-	return rt, pl, done, errs
+	return pl, done, errs
 }
 
 // getRemainingServices filters out completed services (both success and error)
@@ -97,14 +97,16 @@ func (e *Engine) getRemainingServices(svcs []string, done map[string]interface{}
 }
 
 // finishParallelNode aggregates results and finalizes the node execution
-func (e *Engine) finishParallelNode(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, input interface{}, svcs []string, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string) error {
+func (e *Engine) finishParallelNode(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, input interface{}, svcs []string, done map[string]interface{}, errs map[string]interface{}) error {
 	agg := make([]interface{}, 0, len(svcs))
 	for _, sname := range svcs {
 		agg = append(agg, done[sname])
 	}
 	action := ""
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = agg
+		if err := setByPath(shared, node.Post.OutputKey, agg); err != nil {
+			return e.failNode(t, def, curr, shared, input, err)
+		}
 	}
 	if node.Post.ActionStatic != "" {
 		action = node.Post.ActionStatic
@@ -112,26 +114,19 @@ func (e *Engine) finishParallelNode(t store.Task, def FlowDef, node DefNode, cur
 		action = pickAction(map[string]interface{}{"result": agg}, node.Post.ActionKey)
 	}
 
-	// Clean up runtime state
-	delete(rt, key)
-	if len(rt) == 0 {
-		delete(shared, "_rt")
-	} else {
-		shared["_rt"] = rt
-	}
-
 	hasErr := len(errs) != 0
 	cont := node.FailureStrategy == "continue"
-	e.recordRun(t, curr, 1, ternary(!hasErr || cont, "ok", "error"), map[string]interface{}{"input_key": node.Prep.InputKey}, input, agg, ternary(!hasErr || cont, "", toJSON(errs)), action, "", "", "")
+	run := nodeRun(t, curr, 1, ternary(!hasErr || cont, "ok", "error"), map[string]interface{}{"input_key": node.Prep.InputKey}, input, agg, ternary(!hasErr || cont, "", toJSON(errs)), action, "", "", "")
 
 	if !hasErr || cont {
-		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil)
+		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil, run)
 	}
-	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, errorString("parallel error"))
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, branchError("parallel error", errs), run)
 }
 
-// runConcurrent executes services concurrently
-func (e *Engine) runConcurrent(in NodeRunInput, svcs []string, specs map[string]ExecSpec, remaining []string, pl map[string]interface{}, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string) error {
+// runConcurrent executes services concurrently. A failed branch the
+// node's retry policy covers runs again in a later step.
+func (e *Engine) runConcurrent(ctx context.Context, in NodeRunInput, svcs []string, specs map[string]ExecSpec, remaining []string, pl map[string]interface{}, done map[string]interface{}, errs map[string]interface{}) error {
 	max := in.Node.MaxParallel
 	if max <= 0 || max > len(remaining) {
 		max = len(remaining)
@@ -141,6 +136,7 @@ func (e *Engine) runConcurrent(in NodeRunInput, svcs []string, specs map[string]
 
 	type br struct {
 		svc     string
+		attempt int
 		res     interface{}
 		wid     string
 		wurl    string
@@ -150,7 +146,8 @@ func (e *Engine) runConcurrent(in NodeRunInput, svcs []string, specs map[string]
 	ch := make(chan br, len(toRun))
 
 	for _, sname := range toRun {
-		go func(sv string) {
+		failed, _ := branchAttempt(pl, sname)
+		go func(sv string, attempt int) {
 			use, callParams := e.prepareExecution(in.Node, specs, sv, in.Params)
 			execIn := ExecutorInput{
 				Task:    in.Task,
@@ -158,14 +155,17 @@ func (e *Engine) runConcurrent(in NodeRunInput, svcs []string, specs map[string]
 				NodeKey: in.NodeKey,
 				Input:   in.Input,
 				Params:  callParams,
+				Attempt: attempt,
 			}
-			res := e.execExecutor(execIn)
-			ch <- br{svc: sv, res: res.Result, wid: res.WorkerID, wurl: res.WorkerURL, logPath: res.LogPath, err: res.Error}
-		}(sname)
+			res := e.execExecutor(ctx, execIn)
+			ch <- br{svc: sv, attempt: attempt, res: res.Result, wid: res.WorkerID, wurl: res.WorkerURL, logPath: res.LogPath, err: res.Error}
+		}(sname, failed+1)
 	}
 
+	policy := retryPolicy(in.Node)
 	hadErr := false
 	hasPending := false
+	runs := []map[string]interface{}{}
 	for i := 0; i < len(toRun); i++ {
 		it := <-ch
 
@@ -176,41 +176,48 @@ func (e *Engine) runConcurrent(in NodeRunInput, svcs []string, specs map[string]
 		}
 
 		e.logf("task=%s node=%s branch=%s status=%s error=%v", in.Task.ID, in.NodeKey, it.svc, ternary(it.err == nil, "ok", "error"), it.err)
-		e.recordRunDetailed(in.Task, in.NodeKey, 1, ternary(it.err == nil, "ok", "error"), "branch_complete", it.svc, map[string]interface{}{"input_key": in.Node.Prep.InputKey, "branch": it.svc}, in.Input, it.res, errString(it.err), "", it.wid, it.wurl, it.logPath)
+		runs = append(runs, nodeRunDetailed(in.Task, in.NodeKey, it.attempt, ternary(it.err == nil, "ok", "error"), "branch_complete", it.svc, map[string]interface{}{"input_key": in.Node.Prep.InputKey, "branch": it.svc}, in.Input, it.res, errString(it.err), "", it.wid, it.wurl, it.logPath))
 
-		if it.err != nil {
+		switch {
+		case it.err == nil:
+			done[it.svc] = it.res
+		case !retryBranch(pl, policy, it.svc, it.attempt, it.err):
 			hadErr = true
 			errs[it.svc] = it.err.Error()
-		} else {
-			done[it.svc] = it.res
 		}
 	}
 
+	// Results of branches that finished before the step was interrupted
+	// are dropped with it.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Update state
 	pl["done"] = done
 	pl["errs"] = errs
-	rt[key] = pl
-	in.Shared["_rt"] = rt
+	ns := nodeState("parallel", in.NodeKey, pl)
 
 	if hasPending {
-		return e.suspendTask(in.Task, "waiting_queue", in.Shared)
+		return e.suspendTask(in.Task, "waiting_queue", in.Shared, ns, runs...)
 	}
 
 	strat := in.Node.FailureStrategy
 	if strat == "fail_fast" && hadErr {
-		return e.handleFailFast(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, svcs, done, errs)
+		return e.handleFailFast(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, svcs, done, errs, runs...)
 	}
 
-	e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-	return nil
+	return e.branchStep(in, "parallel", pl, e.getRemainingServices(svcs, done, errs), in.Task.StepCount+1, runs...)
 }
 
 // runSequential executes services sequentially
-func (e *Engine) runSequential(in NodeRunInput, svcs []string, specs map[string]ExecSpec, pl map[string]interface{}, done map[string]interface{}, errs map[string]interface{}, rt map[string]interface{}, key string, remaining []string) error {
+func (e *Engine) runSequential(ctx context.Context, in NodeRunInput, svcs []string, specs map[string]ExecSpec, pl map[string]interface{}, done map[string]interface{}, errs map[string]interface{}, remaining []string) error {
 	if len(remaining) == 0 {
 		return nil
 	}
 	nextSvc := remaining[0]
+	failed, _ := branchAttempt(pl, nextSvc)
+	attempt := failed + 1
 
 	e.logf("task=%s node=%s parallel next=%s", in.Task.ID, in.NodeKey, nextSvc)
 
@@ -221,38 +228,36 @@ func (e *Engine) runSequential(in NodeRunInput, svcs []string, specs map[string]
 		NodeKey: in.NodeKey,
 		Input:   in.Input,
 		Params:  callParams,
+		Attempt: attempt,
+	}
+	res := e.execExecutor(ctx, execIn)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	res := e.execExecutor(execIn)
 	execRes, workerID, workerURL, logPath, execErr := res.Result, res.WorkerID, res.WorkerURL, res.LogPath, res.Error
 
-	e.recordRunDetailed(in.Task, in.NodeKey, 1, ternary(execErr == nil, "ok", "error"), "branch_complete", nextSvc, map[string]interface{}{"input_key": in.Node.Prep.InputKey, "branch": nextSvc}, in.Input, execRes, errString(execErr), "", workerID, workerURL, logPath)
+	run := nodeRunDetailed(in.Task, in.NodeKey, attempt, ternary(execErr == nil, "ok", "error"), "branch_complete", nextSvc, map[string]interface{}{"input_key": in.Node.Prep.InputKey, "branch": nextSvc}, in.Input, execRes, errString(execErr), "", workerID, workerURL, logPath)
 
 	if execErr != nil {
 		if execErr == ErrAsyncPending {
-			return e.suspendTask(in.Task, "waiting_queue", in.Shared)
+			return e.suspendTask(in.Task, "waiting_queue", in.Shared, nodeState("parallel", in.NodeKey, pl), run)
 		}
 
-		errs[nextSvc] = errString(execErr)
-		pl["errs"] = errs
-		rt[key] = pl
-		in.Shared["_rt"] = rt
-
-		e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-		return nil
+		if !retryBranch(pl, retryPolicy(in.Node), nextSvc, attempt, execErr) {
+			errs[nextSvc] = errString(execErr)
+			pl["errs"] = errs
+		}
+	} else {
+		done[nextSvc] = execRes
+		pl["done"] = done
 	}
 
-	done[nextSvc] = execRes
-	pl["done"] = done
-	rt[key] = pl
-	in.Shared["_rt"] = rt
-
-	e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-	return nil
+	return e.branchStep(in, "parallel", pl, e.getRemainingServices(svcs, done, errs), in.Task.StepCount+1, run)
 }
 
 // prepareExecution creates the DefNode and params for a specific service execution
 func (e *Engine) prepareExecution(node DefNode, specs map[string]ExecSpec, svc string, params map[string]interface{}) (DefNode, map[string]interface{}) {
-	use := DefNode{Service: svc, ExecType: node.ExecType, Func: node.Func, Script: node.Script, WeightedByLoad: node.WeightedByLoad, MaxAttempts: node.MaxAttempts, AttemptDelayMillis: node.AttemptDelayMillis}
+	use := DefNode{Service: svc, ExecType: node.ExecType, Func: node.Func, Script: node.Script, WeightedByLoad: node.WeightedByLoad}
 	callParams := map[string]interface{}{}
 	for k, v := range params {
 		callParams[k] = v
@@ -276,19 +281,14 @@ func (e *Engine) prepareExecution(node DefNode, specs map[string]ExecSpec, svc s
 	return use, callParams
 }
 
-// updateTaskRunning updates the task status to running and saves progress
-func (e *Engine) updateTaskRunning(t store.Task, curr string, shared map[string]interface{}) {
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, "running")
-		_ = e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, curr, "", toJSON(shared), t.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskStatus(t.ID, "running")
-		_ = e.Store.UpdateTaskProgress(t.ID, curr, "", toJSON(shared), t.StepCount+1)
-	}
+// updateTaskRunning updates the task status to running and saves progress,
+// along with the node's state unless ns is nil
+func (e *Engine) updateTaskRunning(t store.Task, curr string, shared map[string]interface{}, ns *store.NodeState, runs ...map[string]interface{}) error {
+	return e.transition(t, withState(store.TaskTransition{Status: "running", CurrentNode: curr, SharedJSON: toJSON(shared), StepCount: t.StepCount + 1}, ns), runs...)
 }
 
 // handleFailFast handles the fail_fast strategy logic
-func (e *Engine) handleFailFast(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, svcs []string, done map[string]interface{}, errs map[string]interface{}) error {
+func (e *Engine) handleFailFast(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, svcs []string, done map[string]interface{}, errs map[string]interface{}, runs ...map[string]interface{}) error {
 	e.logf("task=%s node=%s fail_fast errors=%d", t.ID, curr, len(errs))
 	agg := make([]interface{}, 0, len(done))
 	for _, sname := range svcs {
@@ -298,22 +298,14 @@ func (e *Engine) handleFailFast(t store.Task, def FlowDef, node DefNode, curr st
 	}
 	action := ""
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = agg
+		if err := setByPath(shared, node.Post.OutputKey, agg); err != nil {
+			return e.failNode(t, def, curr, shared, nil, err, runs...)
+		}
 	}
 	if node.Post.ActionStatic != "" {
 		action = node.Post.ActionStatic
 	} else if node.Post.ActionKey != "" {
 		action = pickAction(map[string]interface{}{"result": agg}, node.Post.ActionKey)
 	}
-	next := findNext(def.Edges, curr, action)
-
-	status := ternary(next == "", "failed", "running")
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(t.ID, e.Owner, status)
-		_ = e.Store.UpdateTaskProgressOwned(t.ID, e.Owner, next, action, toJSON(shared), t.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskStatus(t.ID, status)
-		_ = e.Store.UpdateTaskProgress(t.ID, next, action, toJSON(shared), t.StepCount+1)
-	}
-	return nil
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, branchError("parallel error", errs), runs...)
 }
@@ -3,22 +3,12 @@ package engine
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"testing"
 	"time"
-
-	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
 )
 
 func TestParallelQueue_Mixed(t *testing.T) {
-	// Setup DB
-	dbPath := "test_parallel_queue.db"
-	os.Remove(dbPath)
-	defer os.Remove(dbPath)
-	s, err := sqlstore.OpenSQLite(dbPath)
-	if err != nil {
-		t.Fatal(err)
-	}
+	s := openTestStore(t)
 
 	// Setup Engine
 	eng := New(s)
@@ -165,7 +155,7 @@ func TestParallelQueue_Mixed(t *testing.T) {
 	}`
 
 	// Create Flow & Version
-	fid, _ := s.CreateFlow("parallel-queue-flow", "desc")
+	fid, _ := s.CreateFlow("", "parallel-queue-flow", "desc")
 	vid, _ := s.CreateFlowVersion(fid, 1, flowDef, "published")
 
 	// Create Task
@@ -180,7 +170,7 @@ func TestParallelQueue_Mixed(t *testing.T) {
 	}
 
 	// 1. RunOnce: Should launch both. Sync finishes, Async suspends.
-	err = eng.RunOnce(tid)
+	err = eng.RunOnce(context.Background(), tid)
 	if err != nil {
 		t.Fatalf("RunOnce failed: %v", err)
 	}
@@ -193,19 +183,26 @@ func TestParallelQueue_Mixed(t *testing.T) {
 	// Verify Runtime State: branch_sync should be DONE
 	var shared map[string]interface{}
 	json.Unmarshal([]byte(task.SharedJSON), &shared)
-	rt := shared["_rt"].(map[string]interface{})
-	pl := rt["pl:para"].(map[string]interface{})
+	if _, ok := shared["_rt"]; ok {
+		t.Fatal("Expected runtime state to stay out of shared")
+	}
+	ns, err := s.GetNodeState(tid, "para")
+	if err != nil || ns.Kind != "parallel" {
+		t.Fatalf("Expected parallel node state, got %+v %v", ns, err)
+	}
+	var pl map[string]interface{}
+	json.Unmarshal([]byte(ns.StateJSON), &pl)
 	done := pl["done"].(map[string]interface{})
 	
 	if _, ok := done["branch_sync"]; !ok {
-		t.Fatal("Expected branch_sync to be completed and in _rt")
+		t.Fatal("Expected branch_sync to be completed in node state")
 	}
 	if _, ok := done["branch_async"]; ok {
 		t.Fatal("Expected branch_async to NOT be completed")
 	}
 	
 	// Verify Queue Item Exists
-	qTask, err := s.PollQueue("w1", []string{"async-svc"}, 60)
+	qTask, err := s.PollQueue("", "w1", []string{"async-svc"}, 60)
 	if qTask.ID == "" {
 		t.Fatal("Expected queue task")
 	}
@@ -283,7 +280,7 @@ func TestParallelQueue_Mixed(t *testing.T) {
 	s.UpdateTaskStatus(tid, "pending")
 	
 	// 3. Second Run
-	err = eng.RunOnce(tid)
+	err = eng.RunOnce(context.Background(), tid)
 	if err != nil {
 		t.Fatalf("RunOnce failed: %v", err)
 	}
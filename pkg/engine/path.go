@@ -0,0 +1,358 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nuknal/PocketFlowGo/pkg/expr"
+)
+
+// Paths address values in shared state, params and inputs:
+//
+//	order.items[0].id      keys and list indices
+//	items[-1]              indices from the end
+//	items[*].id, user.*    every element of a list or value of a map
+//	items[?(@.qty > 1)]    elements for which an expression on @ holds
+//	["a.b"].c, a['x y']    quoted keys, which may contain dots
+//
+// A path with * or a filter selects a list of values; others select one.
+// Empty segments are skipped, so a..b is a.b.
+
+type segKind int
+
+const (
+	segKey segKind = iota
+	segIndex
+	segWild
+	segFilter
+)
+
+type pathSeg struct {
+	kind   segKind
+	key    string
+	index  int
+	filter *expr.Program
+}
+
+// paths caches parsed paths by source.
+var paths sync.Map
+
+type parsedPath struct {
+	segs []pathSeg
+	err  error
+}
+
+func parsePath(path string) ([]pathSeg, error) {
+	if p, ok := paths.Load(path); ok {
+		pp := p.(parsedPath)
+		return pp.segs, pp.err
+	}
+	segs, err := scanPath(path)
+	paths.Store(path, parsedPath{segs, err})
+	return segs, err
+}
+
+func scanPath(path string) ([]pathSeg, error) {
+	var segs []pathSeg
+	bad := func(i int, msg string) error {
+		return fmt.Errorf("path %q: %s at %d", path, msg, i)
+	}
+	i := 0
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+		case '*':
+			segs = append(segs, pathSeg{kind: segWild})
+			i++
+		case '[':
+			j := i + 1
+			switch {
+			case strings.HasPrefix(path[j:], "*]"):
+				segs = append(segs, pathSeg{kind: segWild})
+				i = j + 2
+			case strings.HasPrefix(path[j:], "?("):
+				end := filterEnd(path, j+2)
+				if end < 0 {
+					return nil, bad(i, "unterminated filter")
+				}
+				p, err := expr.Parse(path[j+2 : end])
+				if err != nil {
+					return nil, bad(i, err.Error())
+				}
+				if err := p.CheckBool(map[string]expr.Type{"@": expr.Any}); err != nil {
+					return nil, bad(i, err.Error())
+				}
+				segs = append(segs, pathSeg{kind: segFilter, filter: p})
+				i = end + 2
+			case j < len(path) && (path[j] == '"' || path[j] == '\''):
+				q := path[j]
+				k := strings.IndexByte(path[j+1:], q)
+				if k < 0 || !strings.HasPrefix(path[j+1+k+1:], "]") {
+					return nil, bad(i, "unterminated quoted key")
+				}
+				segs = append(segs, pathSeg{kind: segKey, key: path[j+1 : j+1+k]})
+				i = j + 1 + k + 2
+			default:
+				k := strings.IndexByte(path[j:], ']')
+				if k < 0 {
+					return nil, bad(i, "missing ]")
+				}
+				n, err := strconv.Atoi(strings.TrimSpace(path[j : j+k]))
+				if err != nil {
+					return nil, bad(i, "bad index "+strconv.Quote(path[j:j+k]))
+				}
+				segs = append(segs, pathSeg{kind: segIndex, index: n})
+				i = j + k + 1
+			}
+		default:
+			j := i
+			for j < len(path) && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			segs = append(segs, pathSeg{kind: segKey, key: path[i:j]})
+			i = j
+		}
+	}
+	return segs, nil
+}
+
+// filterEnd returns the offset of the ")]" closing a filter whose
+// expression starts at i, skipping parentheses and quotes inside it.
+func filterEnd(path string, i int) int {
+	depth := 0
+	for ; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '"', '\'':
+			k := strings.IndexByte(path[i+1:], c)
+			if k < 0 {
+				return -1
+			}
+			i += k + 1
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				if strings.HasPrefix(path[i:], ")]") {
+					return i
+				}
+				return -1
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// getByPath retrieves a value from a nested map/slice structure by path
+// (e.g. "a.b[0].c"), or nil if there is none or the path is invalid.
+func getByPath(v interface{}, path string) interface{} {
+	cur, _ := lookupPath(v, path)
+	return cur
+}
+
+// lookupPath is getByPath that also reports whether path exists, so that
+// an explicit null can be told from a missing key. A path selecting a
+// list of values always exists.
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	segs, err := parsePath(path)
+	if err != nil {
+		return nil, false
+	}
+	cur := []interface{}{v}
+	multi := false
+	for _, s := range segs {
+		var next []interface{}
+		for _, c := range cur {
+			next = s.appendSelected(next, c)
+		}
+		cur = next
+		multi = multi || s.kind == segWild || s.kind == segFilter
+	}
+	switch {
+	case multi:
+		if cur == nil {
+			cur = []interface{}{}
+		}
+		return cur, true
+	case len(cur) == 0:
+		return nil, false
+	}
+	return cur[0], true
+}
+
+// appendSelected appends the values segment s selects in c to out.
+func (s pathSeg) appendSelected(out []interface{}, c interface{}) []interface{} {
+	switch s.kind {
+	case segKey:
+		if m, ok := c.(map[string]interface{}); ok {
+			if v, ok := m[s.key]; ok {
+				out = append(out, v)
+			}
+		}
+	case segIndex:
+		if l, ok := c.([]interface{}); ok {
+			if i, ok := listIndex(l, s.index); ok {
+				out = append(out, l[i])
+			}
+		}
+	case segWild, segFilter:
+		var elems []interface{}
+		switch x := c.(type) {
+		case []interface{}:
+			elems = x
+		case map[string]interface{}:
+			keys := make([]string, 0, len(x))
+			for k := range x {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				elems = append(elems, x[k])
+			}
+		}
+		for _, el := range elems {
+			if s.kind == segFilter {
+				if ok, _ := s.filter.EvalBool(map[string]interface{}{"@": el}); !ok {
+					continue
+				}
+			}
+			out = append(out, el)
+		}
+	}
+	return out
+}
+
+// listIndex resolves i, which counts from the end if negative, in l.
+func listIndex(l []interface{}, i int) (int, bool) {
+	if i < 0 {
+		i += len(l)
+	}
+	return i, i >= 0 && i < len(l)
+}
+
+// setByPath writes v at path in m, creating maps for missing keys on the
+// way. Write paths take keys and indices of existing list elements, not
+// wildcards or filters.
+func setByPath(m map[string]interface{}, path string, v interface{}) error {
+	if err := checkWritePath(path); err != nil {
+		return err
+	}
+	segs, _ := parsePath(path)
+	var cur interface{} = m
+	for i, s := range segs {
+		last := i == len(segs)-1
+		switch s.kind {
+		case segKey:
+			mm, ok := cur.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("path %q: %s is %s, not a map", path, pathPrefix(segs[:i]), kindOf(cur))
+			}
+			if last {
+				mm[s.key] = v
+				return nil
+			}
+			next, ok := mm[s.key]
+			if !ok || next == nil {
+				if segs[i+1].kind != segKey {
+					return fmt.Errorf("path %q: no list at %s", path, pathPrefix(segs[:i+1]))
+				}
+				next = map[string]interface{}{}
+				mm[s.key] = next
+			}
+			cur = next
+		case segIndex:
+			l, ok := cur.([]interface{})
+			if !ok {
+				return fmt.Errorf("path %q: %s is %s, not a list", path, pathPrefix(segs[:i]), kindOf(cur))
+			}
+			j, ok := listIndex(l, s.index)
+			if !ok {
+				return fmt.Errorf("path %q: index %d out of range at %s", path, s.index, pathPrefix(segs[:i]))
+			}
+			if last {
+				l[j] = v
+				return nil
+			}
+			cur = l[j]
+		}
+	}
+	return nil
+}
+
+// checkWritePath reports whether path can be written by setByPath.
+func checkWritePath(path string) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("path %q: empty", path)
+	}
+	for _, s := range segs {
+		if s.kind == segWild || s.kind == segFilter {
+			return fmt.Errorf("path %q: cannot write through * or a filter", path)
+		}
+	}
+	return nil
+}
+
+// checkReadPath reports whether a read path, which may be a $params,
+// $shared or $input reference, parses. Templates are checked when they
+// are rendered.
+func checkReadPath(path string) error {
+	if strings.Contains(path, "${") {
+		return nil
+	}
+	for _, root := range []string{"$params", "$shared", "$input"} {
+		if strings.HasPrefix(path, root) {
+			path = path[len(root):]
+			break
+		}
+	}
+	_, err := parsePath(path)
+	return err
+}
+
+// pathPrefix renders segments for error messages.
+func pathPrefix(segs []pathSeg) string {
+	if len(segs) == 0 {
+		return "the root"
+	}
+	var b strings.Builder
+	for _, s := range segs {
+		switch s.kind {
+		case segKey:
+			if strings.ContainsAny(s.key, ".[") {
+				fmt.Fprintf(&b, "[%q]", s.key)
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(s.key)
+		case segIndex:
+			fmt.Fprintf(&b, "[%d]", s.index)
+		}
+	}
+	return b.String()
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "a map"
+	case []interface{}:
+		return "a list"
+	case string:
+		return "a string"
+	case bool:
+		return "a bool"
+	}
+	return "a number"
+}
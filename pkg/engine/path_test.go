@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func TestSetByPath(t *testing.T) {
+	cases := []struct {
+		name string
+		m    string
+		path string
+		want string
+		err  string
+	}{
+		{"top_level", `{}`, "a", `{"a":1}`, ""},
+		{"creates_maps", `{"order":{"id":7}}`, "order.payment.status", `{"order":{"id":7,"payment":{"status":1}}}`, ""},
+		{"replaces_null", `{"a":null}`, "a.b", `{"a":{"b":1}}`, ""},
+		{"list_element", `{"a":[{"x":0},{"x":0}]}`, "a[-1].x", `{"a":[{"x":0},{"x":1}]}`, ""},
+		{"quoted_key", `{}`, `a["b.c"]`, `{"a":{"b.c":1}}`, ""},
+		{"not_a_map", `{"a":"s"}`, "a.b", "", `path "a.b": a is a string, not a map`},
+		{"no_list", `{}`, "a[0]", "", `path "a[0]": no list at a`},
+		{"out_of_range", `{"a":[]}`, "a[0]", "", `path "a[0]": index 0 out of range at a`},
+		{"wildcard", `{"a":[]}`, "a[*]", "", "cannot write through * or a filter"},
+		{"empty", `{}`, "", "", `path "": empty`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := map[string]interface{}{}
+			_ = json.Unmarshal([]byte(c.m), &m)
+			err := setByPath(m, c.path, 1.0)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("err=%v want %q", err, c.err)
+				}
+				return
+			}
+			want := map[string]interface{}{}
+			_ = json.Unmarshal([]byte(c.want), &want)
+			if err != nil || !reflect.DeepEqual(m, want) {
+				t.Fatalf("got=%v err=%v want=%v", m, err, want)
+			}
+		})
+	}
+}
+
+func TestPathsInFlow(t *testing.T) {
+	s := openTestStore(t)
+	e := New(s)
+	var gotIn interface{}
+	e.RegisterFunc("cart", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"id": "a", "qty": 1.0},
+			map[string]interface{}{"id": "b", "qty": 3.0},
+		}}, nil
+	})
+	e.RegisterFunc("pay", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		gotIn = in
+		return "paid", nil
+	})
+	def := `{"start":"cart","nodes":{
+		"cart":{"kind":"executor","exec_type":"local_func","func":"cart","post":{"output_map":{"order.ids":"items[*].id","order.bulk":"items[?(@.qty > 1)].id"}}},
+		"pay":{"kind":"executor","exec_type":"local_func","func":"pay",
+			"prep":{"input_map":{"last":"$shared.order.ids[-1]","ids":"$shared[\"order\"].ids"}},
+			"post":{"output_key":"order.payment.status"}},
+		"wait":{"kind":"wait_event","params":{"signal_key":"$shared.events[\"pay.done\"]"},"post":{"output_key":"order.payment.event"}}},
+		"edges":[{"from":"cart","action":"default","to":"pay"},{"from":"pay","action":"default","to":"wait"}]}`
+	if err := CheckFlow(mustDef(t, def)); err != nil {
+		t.Fatal(err)
+	}
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "cart")
+	for i := 0; i < 3; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PatchTaskShared(tid, []store.SharedOp{{Op: "set", Key: "events", Value: []byte(`{"pay.done":{"ok":true}}`)}}, store.TaskEvent{Type: "signal"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	shared := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+	if !reflect.DeepEqual(gotIn, map[string]interface{}{"last": "b", "ids": []interface{}{"a", "b"}}) {
+		t.Fatalf("input %v", gotIn)
+	}
+	want := map[string]interface{}{
+		"ids":     []interface{}{"a", "b"},
+		"bulk":    []interface{}{"b"},
+		"payment": map[string]interface{}{"status": "paid", "event": map[string]interface{}{"ok": true}},
+	}
+	if tk.Status != "completed" || !reflect.DeepEqual(shared["order"], want) {
+		t.Fatalf("task %s shared %v", tk.Status, shared)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package engine
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killGroupOnCancel only bounds how long cmd's output is waited for after
+// it is killed; process groups are not available here.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = time.Second
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package engine
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killGroupOnCancel starts cmd in a process group of its own and makes
+// canceling its context kill the whole group, so processes the script
+// started do not outlive it.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+}
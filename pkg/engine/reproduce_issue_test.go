@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -10,7 +11,7 @@ func TestParallelNode_UpperFunc_MissingInput(t *testing.T) {
 	s := openTestStore(t)
 	// We don't need external workers for this test as we will register local func
 
-	fid, err := s.CreateFlow("f_upper_fail", "")
+	fid, err := s.CreateFlow("", "f_upper_fail", "")
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -79,7 +80,7 @@ func TestParallelNode_UpperFunc_MissingInput(t *testing.T) {
 
 	// Let's see what happens.
 	for i := 0; i < 20; i++ {
-		err := e.RunOnce(tid)
+		err := e.RunOnce(context.Background(), tid)
 		if err != nil {
 			// RunOnce might return error if DB fails, but usually it swallows execution errors and updates Task status.
 			t.Logf("RunOnce returned error: %v", err)
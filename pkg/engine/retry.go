@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// Error codes executors attach to failures. A retry policy's
+// retryable_errors lists the codes it retries; "fatal" is never retried.
+const (
+	CodeNoWorker    = "no_worker"
+	CodeUnavailable = "unavailable"
+	CodeWorkerError = "worker_error"
+	CodeTimeout     = "timeout"
+	CodeScriptError = "script_error"
+	CodeFuncError   = "func_error"
+	CodeBranchError = "branch_error"
+	// CodeTemplateError is a ${...} reference that cannot be resolved.
+	CodeTemplateError = "template_error"
+	// CodeExprError is an expression that fails to evaluate.
+	CodeExprError = "expr_error"
+	// CodeSchemaError is a node input or output that does not match the
+	// node's schema.
+	CodeSchemaError = "schema_error"
+	CodeFatal       = "fatal"
+	CodeError       = "error"
+)
+
+// ExecError is a node failure with the code retry policies and error
+// edges match on.
+type ExecError struct {
+	Code string
+	Msg  string
+	// Details are written to shared state along with a caught error.
+	Details map[string]interface{}
+}
+
+func (e *ExecError) Error() string { return e.Msg }
+
+func codedError(code, msg string) error { return &ExecError{Code: code, Msg: msg} }
+
+// errorCode returns the code of an executor error.
+func errorCode(err error) string {
+	var ee *ExecError
+	switch {
+	case errors.Is(err, ErrFatal):
+		return CodeFatal
+	case errors.As(err, &ee) && ee.Code != "":
+		return ee.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	return CodeError
+}
+
+// RetryPolicy says how often and how soon a failed executor node runs
+// again. Attempt n+1 is scheduled InitialMillis*Multiplier^(n-1) after
+// attempt n failed, capped at MaxMillis and spread by ±Jitter of itself.
+type RetryPolicy struct {
+	// MaxAttempts counts the first run; 0 or 1 disables retries.
+	MaxAttempts   int `json:"max_attempts"`
+	InitialMillis int `json:"initial_interval_ms"`
+	// Multiplier defaults to 2.
+	Multiplier float64 `json:"multiplier"`
+	// MaxMillis, if positive, caps the interval.
+	MaxMillis int `json:"max_interval_ms"`
+	// Jitter is a fraction between 0 and 1.
+	Jitter float64 `json:"jitter"`
+	// RetryOn lists the error codes to retry; empty retries all but fatal.
+	RetryOn []string `json:"retryable_errors"`
+}
+
+// retryPolicy returns the node's policy. Nodes without a retry block keep
+// the older max_retries and wait_ms: that many retries, wait_ms apart. The
+// local executors' max_attempts and attempt_delay_ms count and space
+// attempts the same way; the larger count wins and wait_ms is used if set.
+func retryPolicy(n DefNode) RetryPolicy {
+	if n.Retry == nil {
+		p := RetryPolicy{MaxAttempts: n.MaxRetries + 1, InitialMillis: n.WaitMillis, Multiplier: 1}
+		if n.MaxAttempts > p.MaxAttempts {
+			p.MaxAttempts = n.MaxAttempts
+		}
+		if p.InitialMillis == 0 {
+			p.InitialMillis = n.AttemptDelayMillis
+		}
+		return p
+	}
+	p := *n.Retry
+	if p.Multiplier <= 0 {
+		p.Multiplier = 2
+	}
+	return p
+}
+
+// retries reports whether attempt, which failed with err, is retried.
+func (p RetryPolicy) retries(attempt int, err error) bool {
+	code := errorCode(err)
+	if attempt >= p.MaxAttempts || code == CodeFatal {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, c := range p.RetryOn {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// delay is the wait after failed attempt n, counted from 1.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.InitialMillis) * math.Pow(p.Multiplier, float64(n-1))
+	if p.MaxMillis > 0 && d > float64(p.MaxMillis) {
+		d = float64(p.MaxMillis)
+	}
+	if j := math.Min(math.Max(p.Jitter, 0), 1); j > 0 {
+		d *= 1 + j*(2*rand.Float64()-1)
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+// retryState is the retry bookkeeping kept in the task while its current
+// node waits to run again.
+type retryState struct {
+	Node      string `json:"node"`
+	Attempt   int    `json:"attempt"`
+	NextRunAt int64  `json:"next_run_at"`
+	LastError string `json:"last_error"`
+	LastCode  string `json:"last_code"`
+}
+
+// loadRetryState returns the failed attempts so far at node curr.
+func loadRetryState(js string, curr string) retryState {
+	var rs retryState
+	if json.Unmarshal([]byte(js), &rs) != nil || rs.Node != curr {
+		return retryState{Node: curr}
+	}
+	return rs
+}
+
+// branchAttempt returns how often branch key of a parallel or foreach node
+// has failed so far and when it may run again. The node state keeps these
+// in its "retry" map, keyed like done and errs.
+func branchAttempt(state map[string]interface{}, key string) (int, int64) {
+	r, _ := state["retry"].(map[string]interface{})
+	b, _ := r[key].(map[string]interface{})
+	attempt, _ := asFloat(b["attempt"])
+	next, _ := asFloat(b["next_run_at"])
+	return int(attempt), int64(next)
+}
+
+// retryBranch records failed attempt of branch key in state if the node's
+// policy retries it, and reports whether it does. A retried branch stays
+// out of errs until its last attempt.
+func retryBranch(state map[string]interface{}, p RetryPolicy, key string, attempt int, err error) bool {
+	if !p.retries(attempt, err) {
+		return false
+	}
+	r, _ := state["retry"].(map[string]interface{})
+	if r == nil {
+		r = map[string]interface{}{}
+		state["retry"] = r
+	}
+	r[key] = map[string]interface{}{"attempt": attempt, "next_run_at": time.Now().Add(p.delay(attempt)).UnixMilli(), "last_error": errString(err), "last_code": errorCode(err)}
+	return true
+}
+
+// readyBranches returns the keys whose backoff has passed and the earliest
+// time one of the others may run, or 0 if none waits.
+func readyBranches(state map[string]interface{}, keys []string) ([]string, int64) {
+	now := time.Now().UnixMilli()
+	ready := []string{}
+	var wait int64
+	for _, k := range keys {
+		_, next := branchAttempt(state, k)
+		if next <= now {
+			ready = append(ready, k)
+		} else if wait == 0 || next < wait {
+			wait = next
+		}
+	}
+	return ready, wait
+}
+
+// branchStep saves the state of a parallel or foreach node after a step.
+// When every branch left waits on a retry the task is parked in
+// waiting_retry until the earliest is due, giving up the lease meanwhile.
+func (e *Engine) branchStep(in NodeRunInput, kind string, state map[string]interface{}, pending []string, stepCount int, runs ...map[string]interface{}) error {
+	ns := nodeState(kind, in.NodeKey, state)
+	ready, wait := readyBranches(state, pending)
+	if len(ready) != 0 || wait == 0 {
+		return e.transition(in.Task, withState(store.TaskTransition{Status: "running", CurrentNode: in.NodeKey, SharedJSON: toJSON(in.Shared), StepCount: stepCount}, ns), runs...)
+	}
+	tr := store.TaskTransition{
+		Status:      "waiting_retry",
+		CurrentNode: in.NodeKey,
+		LastAction:  in.Task.LastAction,
+		SharedJSON:  toJSON(in.Shared),
+		StepCount:   stepCount,
+		NextRunAt:   wait,
+	}
+	if err := e.transition(in.Task, withState(tr, ns), runs...); err != nil {
+		return err
+	}
+	e.logf("task=%s node=%s branch retry pending=%d at=%d", in.Task.ID, in.NodeKey, len(pending), wait)
+	return nil
+}
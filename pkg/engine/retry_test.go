@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy(DefNode{Retry: &RetryPolicy{MaxAttempts: 5, InitialMillis: 100, MaxMillis: 500}})
+	for n, want := range []int{100, 200, 400, 500, 500} {
+		if got := p.delay(n + 1); got != time.Duration(want)*time.Millisecond {
+			t.Fatalf("delay(%d) = %v, want %dms", n+1, got, want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 50; i++ {
+		if d := p.delay(1); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+
+	legacy := retryPolicy(DefNode{MaxRetries: 2, WaitMillis: 30})
+	if legacy.MaxAttempts != 3 || legacy.delay(2) != 30*time.Millisecond {
+		t.Fatalf("legacy policy %+v", legacy)
+	}
+	if !legacy.retries(1, errors.New("x")) || legacy.retries(3, errors.New("x")) || legacy.retries(1, ErrFatal) {
+		t.Fatal("legacy retries")
+	}
+	local := retryPolicy(DefNode{MaxAttempts: 4, AttemptDelayMillis: 20})
+	if local.MaxAttempts != 4 || local.delay(3) != 20*time.Millisecond {
+		t.Fatalf("max_attempts policy %+v", local)
+	}
+	only := RetryPolicy{MaxAttempts: 3, RetryOn: []string{CodeTimeout}}
+	if !only.retries(1, context.DeadlineExceeded) || only.retries(1, codedError(CodeWorkerError, "x")) {
+		t.Fatal("retryable_errors not applied")
+	}
+}
+
+func TestRetryReschedulesTask(t *testing.T) {
+	s := openTestStore(t)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "busy", "code": "unavailable"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(execResponse{Result: "done"})
+	}))
+	defer srv.Close()
+	_ = s.RegisterWorker(store.WorkerInfo{ID: "w", URL: srv.URL, Services: []string{"flaky"}, LastHeartbeat: time.Now().Unix(), Status: "online"})
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","service":"flaky","post":{"output_key":"r"},"retry":{"max_attempts":3,"initial_interval_ms":40,"multiplier":2,"retryable_errors":["unavailable"]}}},"edges":[]}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	e := New(s)
+	e.Owner = "tester"
+
+	for attempt, wait := range []int64{40, 80} {
+		if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+			t.Fatalf("attempt %d: lease: %v", attempt+1, err)
+		}
+		before := time.Now().UnixMilli()
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+		tk, _ := s.GetTask(tid)
+		var rs retryState
+		_ = json.Unmarshal([]byte(tk.RetryStateJSON), &rs)
+		if tk.Status != "waiting_retry" || tk.LeaseOwner != "" || tk.StepCount != 0 || rs.Attempt != attempt+1 || rs.LastCode != "unavailable" {
+			t.Fatalf("attempt %d: task %+v", attempt+1, tk)
+		}
+		if tk.NextRunAt < before+wait || tk.NextRunAt > time.Now().UnixMilli()+wait {
+			t.Fatalf("attempt %d: next run in %dms, want %dms", attempt+1, tk.NextRunAt-before, wait)
+		}
+		if _, err := s.LeaseNextTask(e.Owner, 60); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("attempt %d: leased during backoff: %v", attempt+1, err)
+		}
+		time.Sleep(time.Until(time.UnixMilli(tk.NextRunAt)))
+	}
+	if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if tk.Status != "completed" || tk.RetryStateJSON != "{}" || calls != 3 || len(runs) != 3 || runs[2].AttemptNo != 3 || runs[2].Status != "ok" {
+		t.Fatalf("task %+v runs %+v", tk, runs)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	cases := []struct {
+		name  string
+		code  string
+		steps int
+	}{
+		{"attempts exhausted", "unavailable", 2},
+		{"not retryable", "bad_request", 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := openTestStore(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "no", "code": c.code})
+			}))
+			defer srv.Close()
+			_ = s.RegisterWorker(store.WorkerInfo{ID: "w", URL: srv.URL, Services: []string{"svc"}, LastHeartbeat: time.Now().Unix(), Status: "online"})
+			fid, _ := s.CreateFlow("", "f", "")
+			vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","service":"svc","retry":{"max_attempts":2,"retryable_errors":["unavailable"]}}},"edges":[]}`, "published")
+			tid, _ := s.CreateTask(vid, "{}", "", "a")
+			e := New(s)
+			for i := 0; i < c.steps; i++ {
+				if err := e.RunOnce(context.Background(), tid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tk, _ := s.GetTask(tid)
+			runs, _ := s.ListNodeRuns(tid)
+			if tk.Status != "failed" || len(runs) != c.steps || runs[len(runs)-1].ErrorText != "no" {
+				t.Fatalf("task %+v runs %+v", tk, runs)
+			}
+		})
+	}
+}
+
+func TestLocalScriptAttempts(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_script","script":{"cmd":"sh","args":["-c","echo try; exit 1"]},"max_attempts":2}},"edges":[]}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	e := New(s)
+	defer os.RemoveAll(filepath.Join("logs", "tasks", tid))
+	for i := 0; i < 2; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if tk.Status != "failed" || len(runs) != 2 {
+		t.Fatalf("task %s runs %+v", tk.Status, runs)
+	}
+	for i, r := range runs {
+		if want := filepath.Join("logs", "tasks", tid, fmt.Sprintf("a_%d.log", i+1)); r.AttemptNo != i+1 || r.LogPath != want {
+			t.Fatalf("run %d: attempt %d log %q, want %q", i, r.AttemptNo, r.LogPath, want)
+		}
+		if b, err := os.ReadFile(r.LogPath); err != nil || string(b) != "try\n" {
+			t.Fatalf("run %d log %q %v", i, b, err)
+		}
+	}
+}
+
+func TestRetryBranches(t *testing.T) {
+	cases := []struct {
+		name string
+		node string
+		want []interface{}
+	}{
+		{"parallel branch", `{"kind":"parallel","parallel_mode":"concurrent","parallel_execs":[{"service":"a","exec_type":"local_func","func":"ok"},{"service":"b","exec_type":"local_func","func":"flaky"}],"retry":{"max_attempts":2,"initial_interval_ms":30},"post":{"output_key":"r"}}`, []interface{}{"ok", "flaky"}},
+		{"foreach item", `{"kind":"foreach","exec_type":"local_func","func":"ok","prep":{"input_key":"$params.items"},"foreach_execs":[{"index":1,"func":"flaky"}],"max_attempts":2,"attempt_delay_ms":30,"post":{"output_key":"r"}}`, []interface{}{"ok", "flaky"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := openTestStore(t)
+			e := New(s)
+			e.Owner = "tester"
+			e.RegisterFunc("ok", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+				return "ok", nil
+			})
+			calls := 0
+			e.RegisterFunc("flaky", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+				if calls++; calls == 1 {
+					return nil, codedError(CodeUnavailable, "busy")
+				}
+				return "flaky", nil
+			})
+			fid, _ := s.CreateFlow("", "f", "")
+			vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"n","nodes":{"n":`+c.node+`},"edges":[]}`, "published")
+			tid, _ := s.CreateTask(vid, `{"items":[1,2]}`, "", "n")
+
+			if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+				t.Fatalf("lease: %v", err)
+			}
+			parked := false
+			for i := 0; i < 10; i++ {
+				tk, _ := s.GetTask(tid)
+				if tk.Status == "completed" || tk.Status == "failed" {
+					break
+				}
+				if tk.Status == "waiting_retry" {
+					parked = true
+					if _, err := s.LeaseNextTask(e.Owner, 60); !errors.Is(err, sql.ErrNoRows) {
+						t.Fatalf("leased during backoff: %v", err)
+					}
+					time.Sleep(time.Until(time.UnixMilli(tk.NextRunAt)))
+					if _, err := s.LeaseNextTask(e.Owner, 60); err != nil {
+						t.Fatalf("lease after backoff: %v", err)
+					}
+				}
+				if err := e.RunOnce(context.Background(), tid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tk, _ := s.GetTask(tid)
+			shared := map[string]interface{}{}
+			_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+			if tk.Status != "completed" || !parked || calls != 2 || fmt.Sprint(shared["r"]) != fmt.Sprint(c.want) {
+				t.Fatalf("task %s parked %v calls %d shared %v", tk.Status, parked, calls, shared)
+			}
+			runs, _ := s.ListNodeRuns(tid)
+			attempts := []int{}
+			for _, r := range runs {
+				if r.BranchID == "b" || r.BranchID == "1" {
+					attempts = append(attempts, r.AttemptNo)
+				}
+			}
+			if fmt.Sprint(attempts) != "[1 2]" {
+				t.Fatalf("branch attempts %v", attempts)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"strings"
 	"time"
 
@@ -9,19 +10,18 @@ import (
 
 // runSubflow executes a nested flow definition.
 // It manages the subflow's state and progression independently of the main flow.
-func (e *Engine) runSubflow(in NodeRunInput) error {
+func (e *Engine) runSubflow(ctx context.Context, in NodeRunInput) error {
 	// Initialize runtime state for subflow
-	rt, sf, currSub, subShared := e.initSubflowState(in.Task, in.NodeKey, in.Node, in.Shared)
-	key := "sf:" + in.NodeKey
+	sf, currSub, subShared := e.initSubflowState(in.Node, in.State)
 
 	// Handle retry strategy delay
-	if e.handleSubflowRetryDelay(in.Task, in.NodeKey, in.Node, in.Shared, rt, sf, key) {
-		return nil
+	if e.handleSubflowRetryDelay(in.Node, sf) {
+		return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("subflow", in.NodeKey, sf))
 	}
 
 	// Check if subflow execution is complete
 	if currSub == "" {
-		return e.finishSubflow(in.Task, in.FlowDef, in.NodeKey, in.Node, in.Shared, subShared, rt, key)
+		return e.finishSubflow(in.Task, in.FlowDef, in.NodeKey, in.Node, in.Shared)
 	}
 
 	// Prepare execution for the current node in subflow
@@ -30,7 +30,7 @@ func (e *Engine) runSubflow(in NodeRunInput) error {
 
 	// Prepare parameters and input for the sub-node
 	childParams := e.prepareSubNodeParams(in.Node, sn, in.Params, currSub)
-	subInput := e.prepareSubNodeInput(sn, childParams, subShared)
+	subInput, inputErr := e.prepareSubNodeInput(sn, childParams, subShared)
 
 	// Determine execution configuration (overrides)
 	eff := e.resolveSubNodeConfig(in.Node, currSub, sn)
@@ -43,70 +43,67 @@ func (e *Engine) runSubflow(in NodeRunInput) error {
 		Input:   subInput,
 		Params:  childParams,
 	}
-	res := e.execExecutor(execIn)
+	res := ExecutorResult{Error: inputErr}
+	if inputErr == nil {
+		res = e.execExecutor(ctx, execIn)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	execRes, workerID, workerURL, logPath, execErr := res.Result, res.WorkerID, res.WorkerURL, res.LogPath, res.Error
 
 	// Process result and determine next action
 	subAction := ""
 	if execErr == nil {
-		subAction = e.processSubNodeSuccess(sn, execRes, subShared)
+		subAction, execErr = e.processSubNodeSuccess(sn, execRes, subShared, childParams, subInput)
 	}
 
 	e.logf("task=%s node=%s kind=subflow sub=%s status=%s action=%s", in.Task.ID, in.NodeKey, currSub, ternary(execErr == nil, "ok", "error"), subAction)
-	e.recordRunDetailed(in.Task, in.NodeKey, 1, ternary(execErr == nil, "ok", "error"), "sub_node_complete", currSub, map[string]interface{}{"input_key": sn.Prep.InputKey, "sub": currSub}, subInput, execRes, errString(execErr), subAction, workerID, workerURL, logPath)
+	run := nodeRunDetailed(in.Task, in.NodeKey, 1, ternary(execErr == nil, "ok", "error"), "sub_node_complete", currSub, map[string]interface{}{"input_key": sn.Prep.InputKey, "sub": currSub}, subInput, execRes, errString(execErr), subAction, workerID, workerURL, logPath)
 
 	if execErr != nil {
 		if execErr == ErrAsyncPending {
-			return e.suspendTask(in.Task, "waiting_queue", in.Shared)
+			return e.suspendTask(in.Task, "waiting_queue", in.Shared, nodeState("subflow", in.NodeKey, sf), run)
 		}
 
 		// Handle retry logic
 		if in.Node.FailureStrategy == "retry" {
-			if e.handleSubflowRetry(in.Task, in.NodeKey, in.Node, in.Shared, rt, sf, key) {
-				return nil
+			if e.handleSubflowRetry(in.Node, sf) {
+				return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("subflow", in.NodeKey, sf), run)
 			}
 			// Retries exhausted, fall through to fail
 		}
 
 		// Handle failure completion
-		return e.finishSubflowFailure(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, subShared, rt, key, execErr)
+		return e.finishSubflowFailure(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, subShared, execErr, run)
 	}
 
 	// Transition to next sub-node
-	nextSub := findNext(in.Node.Subflow.Edges, currSub, subAction)
+	nextSub := findNext(in.Node.Subflow.Edges, currSub, subAction, e.edgeGuard(in.Task.ID, subShared, childParams, subAction))
 	if nextSub == "" {
 		// Subflow reached end
-		return e.finishSubflowSuccess(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, subShared, rt, key, subAction)
+		return e.finishSubflowSuccess(in.Task, in.FlowDef, in.Node, in.NodeKey, in.Shared, subShared, subAction, run)
 	}
 
 	// Advance subflow state
 	sf["curr"] = nextSub
 	sf["shared"] = subShared
-	rt[key] = sf
-	in.Shared["_rt"] = rt
-	e.updateTaskRunning(in.Task, in.NodeKey, in.Shared)
-	return nil
+	return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("subflow", in.NodeKey, sf), run)
 }
 
 // initSubflowState initializes or retrieves the runtime state for subflow execution
-func (e *Engine) initSubflowState(t store.Task, curr string, node DefNode, shared map[string]interface{}) (map[string]interface{}, map[string]interface{}, string, map[string]interface{}) {
-	rt, _ := shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "sf:" + curr
-	sf, _ := rt[key].(map[string]interface{})
+func (e *Engine) initSubflowState(node DefNode, sf map[string]interface{}) (map[string]interface{}, string, map[string]interface{}) {
 	if sf == nil {
 		sf = map[string]interface{}{"curr": node.Subflow.Start, "shared": map[string]interface{}{}, "last": ""}
 	}
 	currSub, _ := sf["curr"].(string)
 	subShared, _ := sf["shared"].(map[string]interface{})
-	return rt, sf, currSub, subShared
+	return sf, currSub, subShared
 }
 
 // handleSubflowRetryDelay checks if we need to wait for a retry delay
-// Returns true if execution should pause (delay active)
-func (e *Engine) handleSubflowRetryDelay(t store.Task, curr string, node DefNode, shared map[string]interface{}, rt map[string]interface{}, sf map[string]interface{}, key string) bool {
+// Returns true if execution should pause (delay active); the caller saves progress
+func (e *Engine) handleSubflowRetryDelay(node DefNode, sf map[string]interface{}) bool {
 	if node.FailureStrategy != "retry" {
 		return false
 	}
@@ -118,24 +115,21 @@ func (e *Engine) handleSubflowRetryDelay(t store.Task, curr string, node DefNode
 		nt = int64(v2)
 	}
 	if nt > 0 && now < nt {
-		rt[key] = sf
-		shared["_rt"] = rt
-		e.updateTaskRunning(t, curr, shared)
 		return true
 	}
 	return false
 }
 
 // finishSubflow handles the case where the subflow itself is complete (empty current node)
-func (e *Engine) finishSubflow(t store.Task, def FlowDef, curr string, node DefNode, shared map[string]interface{}, subShared map[string]interface{}, rt map[string]interface{}, key string) error {
+func (e *Engine) finishSubflow(t store.Task, def FlowDef, curr string, node DefNode, shared map[string]interface{}) error {
 	action := node.Post.ActionStatic
-	e.recordRun(t, curr, 1, "ok", map[string]interface{}{"input_key": node.Prep.InputKey}, nil, nil, "", action, "", "", "")
+	run := nodeRun(t, curr, 1, "ok", map[string]interface{}{"input_key": node.Prep.InputKey}, nil, nil, "", action, "", "", "")
 
 	// Clean up runtime state if needed (though typically this is done when last node finishes)
 	// But here we might be re-entering a completed subflow?
 	// The original logic just finished the node.
 
-	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil)
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil, run)
 }
 
 // prepareSubNodeParams merges params for the sub-node
@@ -159,29 +153,36 @@ func (e *Engine) prepareSubNodeParams(node DefNode, sn DefNode, params map[strin
 	return childParams
 }
 
+// subRef reads a sub-node input: a $params/$shared reference or a path
+// in the subflow's shared state.
+func subRef(path string, subShared, childParams map[string]interface{}) interface{} {
+	if strings.HasPrefix(path, "$") {
+		return resolveRef(path, subShared, childParams, nil)
+	}
+	return getByPath(subShared, path)
+}
+
 // prepareSubNodeInput resolves input for the sub-node
-func (e *Engine) prepareSubNodeInput(sn DefNode, childParams map[string]interface{}, subShared map[string]interface{}) interface{} {
+func (e *Engine) prepareSubNodeInput(sn DefNode, childParams map[string]interface{}, subShared map[string]interface{}) (interface{}, error) {
 	var subInput interface{}
 	if sn.Prep.InputMap != nil {
 		m := make(map[string]interface{})
 		for k, path := range sn.Prep.InputMap {
-			if strings.HasPrefix(path, "$params.") {
-				kk := strings.TrimPrefix(path, "$params.")
-				m[k] = childParams[kk]
+			if src, ok := mappingExpr(path); ok {
+				v, err := evalValue(src, map[string]interface{}{"shared": subShared, "params": childParams})
+				if err != nil {
+					return nil, err
+				}
+				m[k] = v
 			} else {
-				m[k] = subShared[path]
+				m[k] = subRef(path, subShared, childParams)
 			}
 		}
 		subInput = m
 	} else if sn.Prep.InputKey != "" {
-		if strings.HasPrefix(sn.Prep.InputKey, "$params.") {
-			k := strings.TrimPrefix(sn.Prep.InputKey, "$params.")
-			subInput = childParams[k]
-		} else {
-			subInput = subShared[sn.Prep.InputKey]
-		}
+		subInput = subRef(sn.Prep.InputKey, subShared, childParams)
 	}
-	return subInput
+	return subInput, validateValue("input", sn.InputSchema, subInput)
 }
 
 // resolveSubNodeConfig applies overrides and defaults for the sub-node execution
@@ -229,16 +230,9 @@ func (e *Engine) resolveSubNodeConfig(node DefNode, currSub string, sn DefNode)
 }
 
 // processSubNodeSuccess handles successful execution of a sub-node
-func (e *Engine) processSubNodeSuccess(sn DefNode, execRes interface{}, subShared map[string]interface{}) string {
-	if sn.Post.OutputMap != nil {
-		if mm, ok := execRes.(map[string]interface{}); ok {
-			for toKey, fromField := range sn.Post.OutputMap {
-				subShared[toKey] = mm[fromField]
-			}
-		}
-	}
-	if sn.Post.OutputKey != "" {
-		subShared[sn.Post.OutputKey] = execRes
+func (e *Engine) processSubNodeSuccess(sn DefNode, execRes interface{}, subShared map[string]interface{}, params map[string]interface{}, input interface{}) (string, error) {
+	if err := writeOutputs(sn, execRes, subShared, params, input); err != nil {
+		return "", err
 	}
 
 	subAction := ""
@@ -247,12 +241,12 @@ func (e *Engine) processSubNodeSuccess(sn DefNode, execRes interface{}, subShare
 	} else if sn.Post.ActionKey != "" {
 		subAction = pickAction(execRes, sn.Post.ActionKey)
 	}
-	return subAction
+	return subAction, nil
 }
 
 // handleSubflowRetry manages retry logic for failed sub-nodes
-// Returns true if retry is scheduled (execution should stop/return)
-func (e *Engine) handleSubflowRetry(t store.Task, curr string, node DefNode, shared map[string]interface{}, rt map[string]interface{}, sf map[string]interface{}, key string) bool {
+// Returns true if retry is scheduled (the caller saves progress and returns)
+func (e *Engine) handleSubflowRetry(node DefNode, sf map[string]interface{}) bool {
 	rcount := 0
 	if v, ok := sf["retries"].(int); ok {
 		rcount = v
@@ -268,42 +262,34 @@ func (e *Engine) handleSubflowRetry(t store.Task, curr string, node DefNode, sha
 	if node.MaxRetries > 0 && rcount >= node.MaxRetries {
 		return false // Exhausted retries
 	}
-
-	rt[key] = sf
-	shared["_rt"] = rt
-	e.updateTaskRunning(t, curr, shared)
 	return true
 }
 
 // finishSubflowFailure handles the final failure of a sub-node (retries exhausted or fail_fast)
-func (e *Engine) finishSubflowFailure(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, subShared map[string]interface{}, rt map[string]interface{}, key string, execErr error) error {
+func (e *Engine) finishSubflowFailure(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, subShared map[string]interface{}, execErr error, runs ...map[string]interface{}) error {
 	action := node.Post.ActionStatic
 	if action == "" && node.Post.ActionKey != "" {
 		action = pickAction(subShared, node.Post.ActionKey)
 	}
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = subShared
-	}
-
-	// Cleanup
-	delete(rt, key)
-	if len(rt) == 0 {
-		delete(shared, "_rt")
-	} else {
-		shared["_rt"] = rt
+		if err := setByPath(shared, node.Post.OutputKey, subShared); err != nil {
+			return e.failNode(t, def, curr, shared, nil, err, runs...)
+		}
 	}
 
 	if node.FailureStrategy == "continue" {
-		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil)
+		return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil, runs...)
 	}
-	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, execErr)
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, execErr, runs...)
 }
 
 // finishSubflowSuccess handles the completion of the entire subflow
-func (e *Engine) finishSubflowSuccess(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, subShared map[string]interface{}, rt map[string]interface{}, key string, lastSubAction string) error {
+func (e *Engine) finishSubflowSuccess(t store.Task, def FlowDef, node DefNode, curr string, shared map[string]interface{}, subShared map[string]interface{}, lastSubAction string, runs ...map[string]interface{}) error {
 	action := ""
 	if node.Post.OutputKey != "" {
-		shared[node.Post.OutputKey] = subShared
+		if err := setByPath(shared, node.Post.OutputKey, subShared); err != nil {
+			return e.failNode(t, def, curr, shared, nil, err, runs...)
+		}
 	}
 	if node.Post.ActionStatic != "" {
 		action = node.Post.ActionStatic
@@ -311,13 +297,6 @@ func (e *Engine) finishSubflowSuccess(t store.Task, def FlowDef, node DefNode, c
 		action = pickAction(subShared, node.Post.ActionKey)
 	}
 
-	delete(rt, key)
-	if len(rt) == 0 {
-		delete(shared, "_rt")
-	} else {
-		shared["_rt"] = rt
-	}
-
 	e.logf("task=%s node=%s kind=subflow finish action=%s next=%s", t.ID, curr, action, "TODO") // next resolved in finishNode
-	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil)
+	return e.finishNode(t, def, curr, action, shared, t.StepCount+1, nil, runs...)
 }
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tmplScope holds the values a template can refer to: ${params.x},
+// ${shared.x} and, where the node's input has been built, ${input.x}.
+type tmplScope struct {
+	shared   map[string]interface{}
+	params   map[string]interface{}
+	input    interface{}
+	hasInput bool
+}
+
+// render interpolates the ${...} references in s. A string that is a
+// single reference gives the referenced value as is, keeping its type;
+// references embedded in text are written as strings, and values other
+// than strings as JSON. "$${" stands for a literal "${".
+func (sc tmplScope) render(s string) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	rest := s
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if i > 0 && rest[i-1] == '$' {
+			b.WriteString(rest[:i-1])
+			b.WriteString("${")
+			rest = rest[i+2:]
+			continue
+		}
+		j := strings.Index(rest[i:], "}")
+		if j < 0 {
+			return nil, templateError(s, "unterminated ${")
+		}
+		v, err := sc.lookup(strings.TrimSpace(rest[i+2 : i+j]))
+		if err != nil {
+			return nil, templateError(s, err.Error())
+		}
+		if len(rest) == len(s) && i == 0 && j == len(s)-1 {
+			return v, nil
+		}
+		b.WriteString(rest[:i])
+		if str, ok := v.(string); ok {
+			b.WriteString(str)
+		} else {
+			b.WriteString(toJSON(v))
+		}
+		rest = rest[i+j+1:]
+	}
+	return b.String(), nil
+}
+
+// renderString renders s where the result must be a string, e.g. a
+// script argument.
+func (sc tmplScope) renderString(s string) (string, error) {
+	v, err := sc.render(s)
+	if err != nil {
+		return "", err
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	return toJSON(v), nil
+}
+
+// renderValue renders the strings in v, descending into maps and slices.
+// v itself is not modified.
+func (sc tmplScope) renderValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		return sc.render(x)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, it := range x {
+			r, err := sc.renderValue(it)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		arr := make([]interface{}, len(x))
+		for i, it := range x {
+			r, err := sc.renderValue(it)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = r
+		}
+		return arr, nil
+	}
+	return v, nil
+}
+
+func (sc tmplScope) renderParams(params map[string]interface{}) (map[string]interface{}, error) {
+	if params == nil {
+		return nil, nil
+	}
+	v, err := sc.renderValue(params)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+func (sc tmplScope) renderScript(args []string, env map[string]string) ([]string, map[string]string, error) {
+	var outArgs []string
+	for _, a := range args {
+		r, err := sc.renderString(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		outArgs = append(outArgs, r)
+	}
+	var outEnv map[string]string
+	if env != nil {
+		outEnv = make(map[string]string, len(env))
+		for k, v := range env {
+			r, err := sc.renderString(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			outEnv[k] = r
+		}
+	}
+	return outArgs, outEnv, nil
+}
+
+// renderSpec renders the params and script args and env of sp.
+func (sc tmplScope) renderSpec(sp ExecSpec) (ExecSpec, error) {
+	var err error
+	if sp.Params, err = sc.renderParams(sp.Params); err != nil {
+		return sp, err
+	}
+	sp.Script.Args, sp.Script.Env, err = sc.renderScript(sp.Script.Args, sp.Script.Env)
+	return sp, err
+}
+
+// renderNode renders the script args and env of n and its exec specs.
+// Its params are rendered with the task's, before the input is built.
+func (sc tmplScope) renderNode(n DefNode) (DefNode, error) {
+	var err error
+	if n.Script.Args, n.Script.Env, err = sc.renderScript(n.Script.Args, n.Script.Env); err != nil {
+		return n, err
+	}
+	for _, specs := range []*[]ExecSpec{&n.ParallelExecs, &n.ForeachExecs, &n.SubflowExecs} {
+		if len(*specs) == 0 {
+			continue
+		}
+		out := make([]ExecSpec, len(*specs))
+		for i, sp := range *specs {
+			if out[i], err = sc.renderSpec(sp); err != nil {
+				return n, err
+			}
+		}
+		*specs = out
+	}
+	return n, nil
+}
+
+// lookup resolves a reference like shared.user.id or input.items[0].
+func (sc tmplScope) lookup(ref string) (interface{}, error) {
+	root, path := ref, ""
+	if i := strings.IndexAny(ref, ".["); i >= 0 {
+		root, path = ref[:i], ref[i:]
+	}
+	var v interface{}
+	switch root {
+	case "params":
+		v = sc.params
+	case "shared":
+		v = sc.shared
+	case "input":
+		if !sc.hasInput {
+			return nil, fmt.Errorf("input is not available in ${%s}", ref)
+		}
+		v = sc.input
+	case "":
+		return nil, fmt.Errorf("empty reference")
+	default:
+		return nil, fmt.Errorf("unknown root %q in ${%s}, want params, shared or input", root, ref)
+	}
+	v, ok := lookupPath(v, path)
+	if !ok {
+		return nil, fmt.Errorf("no value at %s", ref)
+	}
+	return v, nil
+}
+
+func templateError(s, msg string) error {
+	return codedError(CodeTemplateError, fmt.Sprintf("template %q: %s", s, msg))
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	sc := tmplScope{
+		shared:   map[string]interface{}{"user": map[string]interface{}{"id": 7.0, "tags": []interface{}{"a", "b"}}, "none": nil},
+		params:   map[string]interface{}{"limit": 10.0, "name": "x"},
+		input:    map[string]interface{}{"ok": true},
+		hasInput: true,
+	}
+	cases := []struct {
+		name string
+		s    string
+		want interface{}
+		err  string
+	}{
+		{"literal", "plain", "plain", ""},
+		{"whole_keeps_type", "${params.limit}", 10.0, ""},
+		{"whole_map", "${shared.user}", sc.shared["user"], ""},
+		{"whole_null", "${shared.none}", nil, ""},
+		{"embedded", "https://api/${shared.user.id}/orders?limit=${params.limit}", "https://api/7/orders?limit=10", ""},
+		{"embedded_json", "tags=${shared.user.tags}", `tags=["a","b"]`, ""},
+		{"index_and_spaces", "${ shared.user.tags[1] }-${input.ok}", "b-true", ""},
+		{"escape", "$${params.limit} is ${params.name}", "${params.limit} is x", ""},
+		{"missing", "id=${shared.user.email}", nil, `template "id=${shared.user.email}": no value at shared.user.email`},
+		{"unknown_root", "${env.HOME}", nil, `unknown root "env"`},
+		{"unterminated", "${params.limit", nil, "unterminated ${"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := sc.render(c.s)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) || errorCode(err) != CodeTemplateError {
+					t.Fatalf("err=%v want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got=%#v err=%v want=%#v", got, err, c.want)
+			}
+		})
+	}
+	if _, err := (tmplScope{}).render("${input.ok}"); err == nil {
+		t.Fatal("input resolved outside of a node step")
+	}
+}
+
+func TestTemplatesInNode(t *testing.T) {
+	s := openTestStore(t)
+	e := New(s)
+	var gotIn interface{}
+	var gotParams map[string]interface{}
+	e.RegisterFunc("call", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		gotIn, gotParams = in, p
+		return "ok", nil
+	})
+	e.RegisterFunc("user", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"id": 42}, nil
+	})
+	def := `{"start":"u","nodes":{"u":{"kind":"executor","exec_type":"local_func","func":"user","post":{"output_key":"user"}},"a":{"kind":"executor","exec_type":"local_func","func":"call",
+		"params":{"url":"https://api/${shared.user.id}/orders?limit=${params.limit}","limit":5,"user":"${shared.user}","raw":"${params.raw}"},
+		"prep":{"input_map":{"id":"${shared.user.id}","legacy":"$params.limit","text":"hello"}}},
+		"b":{"kind":"executor","exec_type":"local_func","func":"call","params":{"email":"${shared.user.email}"}}},
+		"edges":[{"from":"u","action":"default","to":"a"},{"from":"a","action":"default","to":"b"}]}`
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, def, "published")
+	tid, _ := s.CreateTask(vid, `{"limit":20,"raw":"${not.rendered}"}`, "", "u")
+	for i := 0; i < 2; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantParams := map[string]interface{}{"url": "https://api/42/orders?limit=20", "limit": 20.0, "user": map[string]interface{}{"id": 42.0}, "raw": "${not.rendered}"}
+	if !reflect.DeepEqual(gotParams, wantParams) {
+		t.Fatalf("params %v", gotParams)
+	}
+	if in := gotIn.(map[string]interface{}); in["id"] != 42.0 || in["legacy"] != 20.0 || in["text"] != "hello" {
+		t.Fatalf("input %v", gotIn)
+	}
+
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	last := runs[len(runs)-1]
+	if tk.Status != "failed" || last.NodeKey != "b" || !strings.Contains(last.ErrorText, "no value at shared.user.email") {
+		t.Fatalf("task %s last run %+v", tk.Status, last)
+	}
+	shared := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+	if shared["user"] == nil {
+		t.Fatalf("shared lost: %v", shared)
+	}
+}
@@ -1,36 +1,19 @@
 package engine
 
 import (
+	"context"
 	"time"
 )
 
 // runTimer executes a 'timer' node, which pauses execution for a specified duration.
-func (e *Engine) runTimer(in NodeRunInput) error {
-	// Initialize runtime state for timer
-	rt, _ := in.Shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "tm:" + in.NodeKey
-	tm, _ := rt[key].(map[string]interface{})
+func (e *Engine) runTimer(ctx context.Context, in NodeRunInput) error {
+	tm := in.State
 	now := time.Now().UnixMilli()
 
 	// Start timer if not already running
 	if tm == nil {
 		tm = map[string]interface{}{"start": now}
-		rt[key] = tm
-		in.Shared["_rt"] = rt
-		if e.Owner != "" {
-			_ = e.Store.UpdateTaskStatusOwned(in.Task.ID, e.Owner, "running")
-		} else {
-			_ = e.Store.UpdateTaskStatus(in.Task.ID, "running")
-		}
-		if e.Owner != "" {
-			_ = e.Store.UpdateTaskProgressOwned(in.Task.ID, e.Owner, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-		} else {
-			_ = e.Store.UpdateTaskProgress(in.Task.ID, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-		}
-		return nil
+		return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("timer", in.NodeKey, tm))
 	}
 
 	// Calculate delay
@@ -54,28 +37,14 @@ func (e *Engine) runTimer(in NodeRunInput) error {
 	if delay <= 0 || now-start >= int64(delay) {
 		action := in.Node.Post.ActionStatic
 		if in.Node.Post.OutputKey != "" {
-			in.Shared[in.Node.Post.OutputKey] = in.Input
+			if err := setByPath(in.Shared, in.Node.Post.OutputKey, in.Input); err != nil {
+				return e.failNode(in.Task, in.FlowDef, in.NodeKey, in.Shared, in.Input, err)
+			}
 		}
-		delete(rt, key)
-		if len(rt) == 0 {
-			delete(in.Shared, "_rt")
-		} else {
-			in.Shared["_rt"] = rt
-		}
-		e.recordRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"delay_ms": delay}, in.Input, nil, "", action, "", "", "")
-		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil)
+		run := nodeRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"delay_ms": delay}, in.Input, nil, "", action, "", "", "")
+		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil, run)
 	}
 
 	// If not expired, update status and continue waiting
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(in.Task.ID, e.Owner, "running")
-	} else {
-		_ = e.Store.UpdateTaskStatus(in.Task.ID, "running")
-	}
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskProgressOwned(in.Task.ID, e.Owner, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskProgress(in.Task.ID, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	}
-	return nil
+	return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("timer", in.NodeKey, tm))
 }
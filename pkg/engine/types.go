@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"github.com/nuknal/PocketFlowGo/pkg/schema"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 )
 
@@ -11,6 +12,8 @@ type ExecutorInput struct {
 	NodeKey string                 `json:"node_key"`
 	Input   interface{}            `json:"input"`
 	Params  map[string]interface{} `json:"params"`
+	// Attempt counts the runs of the node so far, this one included.
+	Attempt int `json:"attempt"`
 }
 
 // ExecutorResult encapsulates the result of execution.
@@ -32,6 +35,9 @@ type NodeRunInput struct {
 	Shared  map[string]interface{} `json:"shared"`
 	Params  map[string]interface{} `json:"params"`
 	Input   interface{}            `json:"input"`
+	// State is the node's runtime state saved by an earlier step, nil if
+	// there is none.
+	State map[string]interface{} `json:"state"`
 }
 
 // DefNode represents a node in the flow definition.
@@ -63,6 +69,8 @@ type DefNode struct {
 		ActionStatic string            `json:"action_static"`
 		ActionKey    string            `json:"action_key"`
 	} `json:"post"`
+	// Retry replaces MaxRetries and WaitMillis for executor nodes.
+	Retry              *RetryPolicy  `json:"retry"`
 	MaxRetries         int           `json:"max_retries"`
 	WaitMillis         int           `json:"wait_ms"`
 	MaxAttempts        int           `json:"max_attempts"`
@@ -79,6 +87,16 @@ type DefNode struct {
 	ParallelMode       string        `json:"parallel_mode"`
 	MaxParallel        int           `json:"max_parallel"`
 	FailureStrategy    string        `json:"failure_strategy"`
+	// OnError routes failures of the node, tried in order before the
+	// flow's catch.
+	OnError []ErrorEdge `json:"on_error"`
+	// Compensate undoes the node's side effects when the task is
+	// compensated.
+	Compensate *Compensation `json:"compensate"`
+	// InputSchema and OutputSchema are JSON Schemas the node's input and
+	// the result of its executor must match.
+	InputSchema  *schema.Schema `json:"input_schema"`
+	OutputSchema *schema.Schema `json:"output_schema"`
 }
 
 // DefEdge represents a transition between nodes.
@@ -86,6 +104,8 @@ type DefEdge struct {
 	From   string `json:"from"`
 	Action string `json:"action"`
 	To     string `json:"to"`
+	// When is an expression the edge is only taken if true.
+	When string `json:"when"`
 }
 
 // FlowDef represents the entire flow definition.
@@ -93,6 +113,13 @@ type FlowDef struct {
 	Start string             `json:"start"`
 	Nodes map[string]DefNode `json:"nodes"`
 	Edges []DefEdge          `json:"edges"`
+	// Catch routes failures of any node that its own on_error edges do
+	// not.
+	Catch []ErrorEdge `json:"catch"`
+	Hooks FlowHooks   `json:"hooks"`
+	// ParamsSchema is a JSON Schema task params must match. Its property
+	// defaults fill in params a new task leaves out.
+	ParamsSchema *schema.Schema `json:"params_schema"`
 }
 
 // EmbeddedFlow represents a sub-flow definition.
@@ -106,6 +133,8 @@ type EmbeddedFlow struct {
 type ChoiceCase struct {
 	Action string                 `json:"action"`
 	Expr   map[string]interface{} `json:"expr"`
+	// When is an expression (pkg/expr) used instead of Expr if set.
+	When string `json:"when"`
 }
 
 // ExecSpec represents a specification for execution.
@@ -3,7 +3,6 @@ package engine
 import (
 	"encoding/json"
 	"strconv"
-	"strings"
 )
 
 // toJSON marshals a value to a JSON string, ignoring errors.
@@ -40,13 +39,18 @@ func pickAction(res interface{}, key string) string {
 }
 
 // findNext determines the next node key based on the current node and action.
-func findNext(edges []DefEdge, from string, action string) string {
+// Edges are tried in order; one with a when condition is taken only if guard
+// says it holds, and matches any action if it has none.
+func findNext(edges []DefEdge, from string, action string, guard func(DefEdge) bool) string {
 	a := action
 	if a == "" {
 		a = "default"
 	}
 	for _, ed := range edges {
-		if ed.From == from && ed.Action == a {
+		if ed.From != from || ed.Action != a && (ed.Action != "" || ed.When == "") {
+			continue
+		}
+		if ed.When == "" || guard != nil && guard(ed) {
 			return ed.To
 		}
 	}
@@ -54,59 +58,3 @@ func findNext(edges []DefEdge, from string, action string) string {
 }
 
 func indexKey(i int) string { return strconv.Itoa(i) }
-
-// getByPath retrieves a value from a nested map/slice structure using dot notation (e.g. "a.b[0].c").
-func getByPath(v interface{}, path string) interface{} {
-	if path == "" {
-		return v
-	}
-	parts := strings.Split(path, ".")
-	cur := v
-	for _, seg := range parts {
-		if seg == "" {
-			continue
-		}
-		name, idx, hasIdx := parseSegment(seg)
-		switch m := cur.(type) {
-		case map[string]interface{}:
-			cur = m[name]
-		default:
-			return nil
-		}
-		if hasIdx {
-			switch arr := cur.(type) {
-			case []interface{}:
-				if idx >= 0 && idx < len(arr) {
-					cur = arr[idx]
-				} else {
-					return nil
-				}
-			default:
-				return nil
-			}
-		}
-		if cur == nil {
-			return nil
-		}
-	}
-	return cur
-}
-
-// parseSegment parses a path segment like "items[0]" into name="items", idx=0, hasIdx=true.
-func parseSegment(seg string) (string, int, bool) {
-	i := strings.Index(seg, "[")
-	if i < 0 {
-		return seg, -1, false
-	}
-	j := strings.Index(seg, "]")
-	if j < 0 || j < i+1 {
-		return seg, -1, false
-	}
-	name := seg[:i]
-	numStr := seg[i+1 : j]
-	n, err := strconv.Atoi(numStr)
-	if err != nil {
-		return seg, -1, false
-	}
-	return name, n, true
-}
@@ -21,8 +21,18 @@ func TestGetByPath(t *testing.T) {
 		{"array_then_map", map[string]interface{}{"a": []interface{}{map[string]interface{}{"x": 9.0}}}, "a[0].x", 9.0},
 		{"skip_empty_segments", map[string]interface{}{"a": map[string]interface{}{"b": 7.0}}, "a..b", 7.0},
 		{"array_root_empty_path", []interface{}{1.0, 2.0}, "", []interface{}{1.0, 2.0}},
-		{"array_root_segment_not_supported", []interface{}{[]interface{}{1.0}}, "[0]", nil},
-		{"negative_index", map[string]interface{}{"a": []interface{}{1.0}}, "a[-1]", nil},
+		{"array_root_segment", []interface{}{[]interface{}{1.0}}, "[0]", []interface{}{1.0}},
+		{"negative_index", map[string]interface{}{"a": []interface{}{1.0, 2.0}}, "a[-1]", 2.0},
+		{"negative_index_out_of_bounds", map[string]interface{}{"a": []interface{}{1.0}}, "a[-2]", nil},
+		{"wildcard", map[string]interface{}{"a": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{"x": 0.0}, map[string]interface{}{"id": 2.0}}}, "a[*].id", []interface{}{1.0, 2.0}},
+		{"wildcard_map_values", map[string]interface{}{"a": map[string]interface{}{"y": 2.0, "x": 1.0}}, "a.*", []interface{}{1.0, 2.0}},
+		{"wildcard_no_match", map[string]interface{}{"a": 1.0}, "a[*]", []interface{}{}},
+		{"filter", map[string]interface{}{"a": []interface{}{map[string]interface{}{"q": 1.0}, map[string]interface{}{"q": 3.0, "id": "x"}}}, "a[?(@.q > 1)].id", []interface{}{"x"}},
+		{"filter_with_brackets", map[string]interface{}{"a": []interface{}{"x)]", "y"}}, "a[?(@ in ['x)]'])]", []interface{}{"x)]"}},
+		{"quoted_key", map[string]interface{}{"a.b": map[string]interface{}{"c": 5.0}}, `["a.b"].c`, 5.0},
+		{"quoted_key_single", map[string]interface{}{"a": map[string]interface{}{"x y": 6.0}}, "a['x y']", 6.0},
+		{"invalid_filter", map[string]interface{}{"a": []interface{}{1.0}}, "a[?(@ +)]", nil},
+		{"unterminated_quote", map[string]interface{}{"a": 1.0}, `["a]`, nil},
 		{"invalid_index_text", map[string]interface{}{"a": []interface{}{1.0}}, "a[x]", nil},
 		{"invalid_empty_index", map[string]interface{}{"a": []interface{}{1.0}}, "a[]", nil},
 	}
@@ -0,0 +1,460 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nuknal/PocketFlowGo/pkg/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// Issue is a problem ValidateFlow found in a flow definition. Path is the
+// field it is in, e.g. "nodes.a.kind" or "edges[2].to", and Line and
+// Column where that field is in the source, or 0 if unknown.
+type Issue struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Issue severities. Errors make a definition invalid; warnings point at
+// things that are likely mistakes but run.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+func (i Issue) String() string {
+	var b strings.Builder
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "%d:", i.Line)
+		if i.Column > 0 {
+			fmt.Fprintf(&b, "%d:", i.Column)
+		}
+		b.WriteByte(' ')
+	}
+	b.WriteString(i.Severity)
+	if i.Path != "" {
+		b.WriteString(": " + i.Path)
+	}
+	return b.String() + ": " + i.Message
+}
+
+// Issues are the findings of ValidateFlow, in source order.
+type Issues []Issue
+
+// HasErrors reports whether any issue is an error.
+func (l Issues) HasErrors() bool {
+	for _, i := range l {
+		if i.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returns the errors among l.
+func (l Issues) Errors() Issues { return l.filter(SeverityError) }
+
+// Warnings returns the warnings among l.
+func (l Issues) Warnings() Issues { return l.filter(SeverityWarning) }
+
+func (l Issues) filter(sev string) Issues {
+	out := Issues{}
+	for _, i := range l {
+		if i.Severity == sev {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// Node kinds and exec types the engine runs; an empty one means executor
+// and http.
+var (
+	nodeKinds = map[string]bool{"": true, "executor": true, "remote": true, "choice": true, "parallel": true, "foreach": true, "subflow": true, "timer": true, "wait_event": true, "approval": true}
+	execTypes = map[string]bool{"": true, "http": true, "local_func": true, "local_script": true, "queue": true}
+)
+
+// ValidateFlow statically checks a flow definition given as JSON or YAML:
+// that it parses into a FlowDef, that start, edges and error routes refer
+// to existing nodes, that node kinds and exec types are known and have
+// what they need to run, and what CheckFlow checks. Unknown fields,
+// unreachable nodes and actions without an edge are warnings. Flow
+// versions are validated when they are published.
+func ValidateFlow(src []byte) Issues {
+	v := &validator{issues: Issues{}}
+	var root yaml.Node
+	if err := yaml.Unmarshal(src, &root); err != nil {
+		v.add(SeverityError, "", "invalid definition: %v", err)
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			v.issues[0].Line, _ = strconv.Atoi(m[1])
+		}
+		return v.issues
+	}
+	if len(root.Content) == 0 {
+		v.add(SeverityError, "", "empty definition")
+		return v.issues
+	}
+	doc := root.Content[0]
+	v.pos = map[string][2]int{"": {doc.Line, doc.Column}}
+	v.index(doc, "")
+
+	var m interface{}
+	if err := doc.Decode(&m); err != nil {
+		v.add(SeverityError, "", "invalid definition: %v", err)
+		return v.issues
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		v.add(SeverityError, "", "invalid definition: %v", err)
+		return v.sorted()
+	}
+	var def FlowDef
+	if err := json.Unmarshal(b, &def); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			v.add(SeverityError, te.Field, "%s value, want %s", te.Value, jsonKind(te.Type))
+		} else {
+			v.add(SeverityError, "", "invalid definition: %v", err)
+		}
+		return v.sorted()
+	}
+	v.unknownFields(doc, reflect.TypeOf(def), "")
+	v.graph(def.Start, def.Nodes, def.Edges, "")
+	for i, c := range def.Catch {
+		v.target(fmt.Sprintf("catch[%d].to", i), c.To, def.Nodes)
+	}
+	for _, h := range []struct {
+		name  string
+		specs []ExecSpec
+	}{{"on_start", def.Hooks.OnStart}, {"on_success", def.Hooks.OnSuccess}, {"on_failure", def.Hooks.OnFailure}, {"finally", def.Hooks.Finally}} {
+		for i, sp := range h.specs {
+			v.execSpec(fmt.Sprintf("hooks.%s[%d]", h.name, i), sp)
+			if sp.ExecType == "queue" {
+				v.add(SeverityError, fmt.Sprintf("hooks.%s[%d].exec_type", h.name, i), "queue hooks are not supported")
+			}
+		}
+	}
+	reachable := v.reachable(def.Start, def.Nodes, def.Edges, def.Catch)
+	for _, k := range sortedKeys(def.Nodes) {
+		if def.Start != "" && !reachable[k] {
+			v.add(SeverityWarning, "nodes."+k, "node is not reachable from start")
+		}
+	}
+	checkDef(def, func(path string, err error) {
+		v.add(SeverityError, path, "%v", err)
+	})
+	return v.sorted()
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+
+type validator struct {
+	issues Issues
+	// pos maps paths to the line and column of their field.
+	pos map[string][2]int
+}
+
+func (v *validator) add(sev, path, format string, args ...interface{}) {
+	i := Issue{Severity: sev, Path: path, Message: fmt.Sprintf(format, args...)}
+	// A path the source does not have, such as a missing field, is
+	// placed at its closest parent.
+	for p := path; ; p = parentPath(p) {
+		if lc, ok := v.pos[p]; ok {
+			i.Line, i.Column = lc[0], lc[1]
+			break
+		}
+		if p == "" {
+			break
+		}
+	}
+	v.issues = append(v.issues, i)
+}
+
+func (v *validator) sorted() Issues {
+	sort.SliceStable(v.issues, func(a, b int) bool {
+		x, y := v.issues[a], v.issues[b]
+		if x.Line != y.Line {
+			return x.Line < y.Line
+		}
+		return x.Column < y.Column
+	})
+	return v.issues
+}
+
+func parentPath(p string) string {
+	i := strings.LastIndexAny(p, ".[")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// index records the position of every field and list element under n.
+func (v *validator) index(n *yaml.Node, path string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, val := n.Content[i], n.Content[i+1]
+			p := joinPath(path, k.Value)
+			v.pos[p] = [2]int{k.Line, k.Column}
+			v.index(val, p)
+		}
+	case yaml.SequenceNode:
+		for i, el := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			v.pos[p] = [2]int{el.Line, el.Column}
+			v.index(el, p)
+		}
+	}
+}
+
+func joinPath(path, k string) string {
+	if path == "" {
+		return k
+	}
+	return path + "." + k
+}
+
+var schemaType = reflect.TypeOf(schema.Schema{})
+
+// unknownFields warns about fields under n that t, the type n decodes
+// into, does not have.
+func (v *validator) unknownFields(n *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == schemaType:
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		jsonFields(t, fields)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			p := joinPath(path, k)
+			if ft, ok := fields[k]; ok {
+				v.unknownFields(n.Content[i+1], ft, p)
+			} else {
+				v.add(SeverityWarning, p, "unknown field")
+			}
+		}
+	case t.Kind() == reflect.Map && n.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v.unknownFields(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value))
+		}
+	case t.Kind() == reflect.Slice && n.Kind == yaml.SequenceNode:
+		for i, el := range n.Content {
+			v.unknownFields(el, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// jsonFields collects the JSON field names of struct t, those of embedded
+// structs included.
+func jsonFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			jsonFields(f.Type, fields)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" {
+			name = f.Name
+		}
+		if name != "-" {
+			fields[name] = f.Type
+		}
+	}
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a bool"
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	}
+	return "a number"
+}
+
+// graph checks the nodes and edges of a flow or embedded subflow.
+func (v *validator) graph(start string, nodes map[string]DefNode, edges []DefEdge, prefix string) {
+	switch {
+	case start == "":
+		v.add(SeverityError, prefix+"start", "missing start")
+	case !hasNode(nodes, start):
+		v.add(SeverityError, prefix+"start", "start %q is not a node", start)
+	}
+	if len(nodes) == 0 {
+		v.add(SeverityError, prefix+"nodes", "no nodes")
+	}
+	for i, ed := range edges {
+		p := fmt.Sprintf("%sedges[%d]", prefix, i)
+		if ed.From == "" {
+			v.add(SeverityError, p+".from", "missing from")
+		} else if !hasNode(nodes, ed.From) {
+			v.add(SeverityError, p+".from", "%q is not a node", ed.From)
+		}
+		// An edge to "" ends the flow.
+		if ed.To != "" && !hasNode(nodes, ed.To) {
+			v.add(SeverityError, p+".to", "%q is not a node", ed.To)
+		}
+	}
+	for _, k := range sortedKeys(nodes) {
+		v.node(k, nodes[k], nodes, edges, prefix+"nodes."+k)
+	}
+}
+
+func (v *validator) node(k string, n DefNode, nodes map[string]DefNode, edges []DefEdge, p string) {
+	if !nodeKinds[n.Kind] {
+		v.add(SeverityError, p+".kind", "unknown kind %q", n.Kind)
+		return
+	}
+	switch n.Kind {
+	case "", "executor", "remote":
+		v.execSpec(p, ExecSpec{Service: n.Service, ExecType: n.ExecType, Func: n.Func, Script: n.Script})
+	case "foreach":
+		// foreach_execs override the node's exec for some items.
+		base := ExecSpec{Service: n.Service, ExecType: n.ExecType, Func: n.Func, Script: n.Script}
+		v.execSpec(p, base)
+		for i, sp := range n.ForeachExecs {
+			use := base
+			if sp.ExecType != "" {
+				use.ExecType = sp.ExecType
+			}
+			if sp.Func != "" {
+				use.Func = sp.Func
+			}
+			if sp.Script.Cmd != "" {
+				use.Script = sp.Script
+			}
+			v.execSpec(fmt.Sprintf("%s.foreach_execs[%d]", p, i), use)
+		}
+	case "parallel":
+		if len(n.ParallelServices) == 0 && len(n.ParallelExecs) == 0 && n.Params["services"] == nil {
+			v.add(SeverityError, p, "parallel node has no parallel_services, parallel_execs or params.services")
+		}
+		for i, sp := range n.ParallelExecs {
+			v.execSpec(fmt.Sprintf("%s.parallel_execs[%d]", p, i), sp)
+		}
+	case "subflow":
+		if n.Subflow == nil {
+			v.add(SeverityError, p+".subflow", "subflow node has no subflow")
+			break
+		}
+		v.graph(n.Subflow.Start, n.Subflow.Nodes, n.Subflow.Edges, p+".subflow.")
+		for i, sp := range n.SubflowExecs {
+			sp2 := fmt.Sprintf("%s.subflow_execs[%d]", p, i)
+			if !hasNode(n.Subflow.Nodes, sp.Node) {
+				v.add(SeverityError, sp2+".node", "%q is not a node of the subflow", sp.Node)
+			}
+			if !execTypes[sp.ExecType] {
+				v.add(SeverityError, sp2+".exec_type", "unknown exec_type %q", sp.ExecType)
+			}
+		}
+	case "choice":
+		actions := []string{}
+		for _, cc := range n.ChoiceCases {
+			actions = append(actions, cc.Action)
+		}
+		if n.DefaultAction != "" {
+			actions = append(actions, n.DefaultAction)
+		}
+		for _, a := range actions {
+			if !hasEdge(edges, k, a) {
+				v.add(SeverityWarning, p, "no edge for action %q; the flow ends there", a)
+			}
+		}
+	}
+	if n.Compensate != nil {
+		v.execSpec(p+".compensate", n.Compensate.ExecSpec)
+	}
+	for i, h := range n.OnError {
+		v.target(fmt.Sprintf("%s.on_error[%d].to", p, i), h.To, nodes)
+	}
+}
+
+// execSpec checks that sp has a known exec type and what that needs to
+// run.
+func (v *validator) execSpec(p string, sp ExecSpec) {
+	switch sp.ExecType {
+	case "", "http", "queue":
+		if sp.Service == "" {
+			v.add(SeverityError, p+".service", "missing service")
+		}
+	case "local_func":
+		if sp.Func == "" {
+			v.add(SeverityError, p+".func", "missing func")
+		}
+	case "local_script":
+		if sp.Script.Cmd == "" && sp.Script.Code == "" {
+			v.add(SeverityError, p+".script", "script needs cmd or code")
+		}
+	default:
+		v.add(SeverityError, p+".exec_type", "unknown exec_type %q", sp.ExecType)
+	}
+}
+
+func (v *validator) target(p, to string, nodes map[string]DefNode) {
+	if to == "" {
+		v.add(SeverityError, p, "missing to")
+	} else if !hasNode(nodes, to) {
+		v.add(SeverityError, p, "%q is not a node", to)
+	}
+}
+
+// reachable returns the nodes a task can get to from start by edges and
+// error routes.
+func (v *validator) reachable(start string, nodes map[string]DefNode, edges []DefEdge, catch []ErrorEdge) map[string]bool {
+	seen := map[string]bool{}
+	var visit func(k string)
+	visit = func(k string) {
+		if seen[k] || !hasNode(nodes, k) {
+			return
+		}
+		seen[k] = true
+		for _, ed := range edges {
+			if ed.From == k {
+				visit(ed.To)
+			}
+		}
+		for _, h := range nodes[k].OnError {
+			visit(h.To)
+		}
+		for _, h := range catch {
+			visit(h.To)
+		}
+	}
+	visit(start)
+	return seen
+}
+
+func hasNode(nodes map[string]DefNode, k string) bool {
+	_, ok := nodes[k]
+	return ok
+}
+
+func hasEdge(edges []DefEdge, from, action string) bool {
+	for _, ed := range edges {
+		if ed.From == from && (ed.Action == action || ed.Action == "" && ed.When != "") {
+			return true
+		}
+	}
+	return false
+}
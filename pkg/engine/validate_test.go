@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFlow(t *testing.T) {
+	src := `start: a
+nodes:
+  a:
+    kind: executor
+    service: svc
+    ouput_key: x
+    on_error:
+      - to: nowhere
+  b:
+    kind: choise
+  c:
+    kind: choice
+    choice_cases:
+      - action: yes
+        when: "shared.n >"
+  d:
+    kind: subflow
+  e:
+    kind: parallel
+    parallel_execs:
+      - exec_type: grpc
+      - exec_type: local_func
+  f:
+    exec_type: local_script
+edges:
+  - from: a
+    to: c
+    action: default
+  - from: c
+    action: no
+    to: missing
+  - from: c
+    action: no
+    to: e
+catch:
+  - to: f
+`
+	want := []string{
+		"6:5: warning: nodes.a.ouput_key: unknown field",
+		`8:9: error: nodes.a.on_error[0].to: "nowhere" is not a node`,
+		"9:3: warning: nodes.b: node is not reachable from start",
+		`10:5: error: nodes.b.kind: unknown kind "choise"`,
+		`11:3: warning: nodes.c: no edge for action "yes"; the flow ends there`,
+		`15:9: error: nodes.c.choice_cases[0].when: expr "shared.n >": unexpected end of expression (at 10)`,
+		"16:3: error: nodes.d.subflow: subflow node has no subflow",
+		"16:3: warning: nodes.d: node is not reachable from start",
+		`21:9: error: nodes.e.parallel_execs[0].exec_type: unknown exec_type "grpc"`,
+		"22:9: error: nodes.e.parallel_execs[1].func: missing func",
+		"23:3: error: nodes.f.script: script needs cmd or code",
+		`31:5: error: edges[1].to: "missing" is not a node`,
+	}
+	issues := ValidateFlow([]byte(src))
+	if len(issues) != len(want) || len(issues.Warnings()) != 4 {
+		t.Fatalf("issues: %v", issues)
+	}
+	for i, w := range want {
+		if got := issues[i].String(); got != w {
+			t.Fatalf("issue %d: %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestValidateFlowSource(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"f"}},"edges":[]}`, ""},
+		{`{"start":"a","nodes":{`, "1: error: invalid definition: yaml: line 1: did not find expected node content"},
+		{"{\n  \"start\": \"a\",\n  \"nodes\": {\"a\": {\"max_retries\": \"3\"}}\n}", "3:19: error: nodes.a.max_retries: string value, want a number"},
+		{"# flow\nnodes: {}", "2:1: error: start: missing start"},
+		{``, "error: empty definition"},
+	}
+	for _, c := range cases {
+		issues := ValidateFlow([]byte(c.src))
+		if c.want == "" {
+			if len(issues) != 0 {
+				t.Fatalf("%s: %v", c.src, issues)
+			}
+			continue
+		}
+		if len(issues) == 0 || !strings.HasPrefix(issues[0].String(), c.want) {
+			t.Fatalf("%s: %v, want %q", c.src, issues, c.want)
+		}
+	}
+}
@@ -1,18 +1,14 @@
 package engine
 
 import (
+	"context"
 	"time"
 )
 
 // runWaitEvent executes a 'wait_event' node, pausing execution until a signal is received or timeout occurs.
-func (e *Engine) runWaitEvent(in NodeRunInput) error {
+func (e *Engine) runWaitEvent(ctx context.Context, in NodeRunInput) error {
 	// Initialize runtime state
-	rt, _ := in.Shared["_rt"].(map[string]interface{})
-	if rt == nil {
-		rt = map[string]interface{}{}
-	}
-	key := "we:" + in.NodeKey
-	we, _ := rt[key].(map[string]interface{})
+	we := in.State
 	if we == nil {
 		we = map[string]interface{}{"start": time.Now().UnixMilli()}
 	}
@@ -38,16 +34,12 @@ func (e *Engine) runWaitEvent(in NodeRunInput) error {
 			action = pickAction(map[string]interface{}{"signal": sig}, in.Node.Post.ActionKey)
 		}
 		if in.Node.Post.OutputKey != "" {
-			in.Shared[in.Node.Post.OutputKey] = sig
-		}
-		delete(rt, key)
-		if len(rt) == 0 {
-			delete(in.Shared, "_rt")
-		} else {
-			in.Shared["_rt"] = rt
+			if err := setByPath(in.Shared, in.Node.Post.OutputKey, sig); err != nil {
+				return e.failNode(in.Task, in.FlowDef, in.NodeKey, in.Shared, in.Input, err)
+			}
 		}
-		e.recordRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"signal_key": signalKey}, in.Input, sig, "", action, "", "", "")
-		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil)
+		run := nodeRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"signal_key": signalKey}, in.Input, sig, "", action, "", "", "")
+		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil, run)
 	}
 
 	// Check for timeout
@@ -61,54 +53,18 @@ func (e *Engine) runWaitEvent(in NodeRunInput) error {
 		// Handle timeout strategies
 		if strat == "retry" {
 			we["start"] = time.Now().UnixMilli()
-			rt[key] = we
-			in.Shared["_rt"] = rt
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskStatusOwned(in.Task.ID, e.Owner, "running")
-			} else {
-				_ = e.Store.UpdateTaskStatus(in.Task.ID, "running")
-			}
-			if e.Owner != "" {
-				_ = e.Store.UpdateTaskProgressOwned(in.Task.ID, e.Owner, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-			} else {
-				_ = e.Store.UpdateTaskProgress(in.Task.ID, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-			}
-			return nil
+			return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("wait_event", in.NodeKey, we))
 		}
 		action := in.Node.Post.ActionStatic
 		if strat == "continue" {
-			delete(rt, key)
-			if len(rt) == 0 {
-				delete(in.Shared, "_rt")
-			} else {
-				in.Shared["_rt"] = rt
-			}
-			e.recordRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"signal_key": signalKey}, in.Input, nil, "", action, "", "", "")
-			return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil)
+			run := nodeRun(in.Task, in.NodeKey, 1, "ok", map[string]interface{}{"signal_key": signalKey}, in.Input, nil, "", action, "", "", "")
+			return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, nil, run)
 		}
 		// Default timeout behavior: fail
-		delete(rt, key)
-		if len(rt) == 0 {
-			delete(in.Shared, "_rt")
-		} else {
-			in.Shared["_rt"] = rt
-		}
-		e.recordRun(in.Task, in.NodeKey, 1, "error", map[string]interface{}{"signal_key": signalKey}, in.Input, nil, "timeout", action, "", "", "")
-		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, errorString("timeout"))
+		run := nodeRun(in.Task, in.NodeKey, 1, "error", map[string]interface{}{"signal_key": signalKey}, in.Input, nil, "timeout", action, "", "", "")
+		return e.finishNode(in.Task, in.FlowDef, in.NodeKey, action, in.Shared, in.Task.StepCount+1, codedError(CodeTimeout, "timeout"), run)
 	}
 
 	// Update state and wait
-	rt[key] = we
-	in.Shared["_rt"] = rt
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskStatusOwned(in.Task.ID, e.Owner, "running")
-	} else {
-		_ = e.Store.UpdateTaskStatus(in.Task.ID, "running")
-	}
-	if e.Owner != "" {
-		_ = e.Store.UpdateTaskProgressOwned(in.Task.ID, e.Owner, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	} else {
-		_ = e.Store.UpdateTaskProgress(in.Task.ID, in.NodeKey, "", toJSON(in.Shared), in.Task.StepCount+1)
-	}
-	return nil
+	return e.updateTaskRunning(in.Task, in.NodeKey, in.Shared, nodeState("wait_event", in.NodeKey, we))
 }
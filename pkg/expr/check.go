@@ -0,0 +1,241 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Type is a set of value types. A value whose type is not known before
+// evaluation, like a field of shared state, has type Any.
+type Type uint8
+
+const (
+	Null Type = 1 << iota
+	Bool
+	Number
+	String
+	List
+	Map
+
+	Any = Null | Bool | Number | String | List | Map
+)
+
+var typeNames = []string{"null", "bool", "number", "string", "list", "map"}
+
+func (t Type) String() string {
+	if t == Any {
+		return "any"
+	}
+	var names []string
+	for i, n := range typeNames {
+		if t&(1<<i) != 0 {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "nothing"
+	}
+	return strings.Join(names, "|")
+}
+
+// typeOf returns the type of a value as produced by normalize.
+func typeOf(v interface{}) Type {
+	switch v.(type) {
+	case nil:
+		return Null
+	case bool:
+		return Bool
+	case float64:
+		return Number
+	case string:
+		return String
+	case []interface{}:
+		return List
+	case map[string]interface{}:
+		return Map
+	}
+	return Any
+}
+
+// Check type-checks the program with the variables vars and returns the
+// type of its result. It reports unknown variables and functions, wrong
+// argument counts, operands that can never have a usable type and invalid
+// constant regular expressions.
+func (p *Program) Check(vars map[string]Type) (Type, error) {
+	c := checker{src: p.src, vars: vars}
+	return c.check(p.root)
+}
+
+// CheckBool is Check for a program that must give a bool, like a
+// condition. null counts as false.
+func (p *Program) CheckBool(vars map[string]Type) error {
+	t, err := p.Check(vars)
+	if err != nil {
+		return err
+	}
+	if t&(Bool|Null) == 0 {
+		return &Error{Src: p.src, Pos: p.root.at(), Msg: fmt.Sprintf("condition is %s, want bool", t)}
+	}
+	return nil
+}
+
+type checker struct {
+	src  string
+	vars map[string]Type
+}
+
+func (c *checker) errorf(n node, format string, args ...interface{}) error {
+	return &Error{Src: c.src, Pos: n.at(), Msg: fmt.Sprintf(format, args...)}
+}
+
+// want reports an error unless t may be one of want.
+func (c *checker) want(n node, t, want Type, what string) error {
+	if t&want == 0 {
+		return c.errorf(n, "%s is %s, want %s", what, t, want)
+	}
+	return nil
+}
+
+func (c *checker) check(n node) (Type, error) {
+	switch n := n.(type) {
+	case *literal:
+		return typeOf(n.v), nil
+	case *ident:
+		t, ok := c.vars[n.name]
+		if !ok {
+			return 0, c.errorf(n, "unknown variable %s", n.name)
+		}
+		return t, nil
+	case *member:
+		t, err := c.check(n.x)
+		if err != nil {
+			return 0, err
+		}
+		return Any, c.want(n, t, Map|Null, "."+n.name+" operand")
+	case *index:
+		t, err := c.check(n.x)
+		if err != nil {
+			return 0, err
+		}
+		it, err := c.check(n.i)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.want(n, t, List|Map|Null, "indexed value"); err != nil {
+			return 0, err
+		}
+		return Any, c.want(n.i, it, Number|String, "index")
+	case *list:
+		for _, e := range n.elems {
+			if _, err := c.check(e); err != nil {
+				return 0, err
+			}
+		}
+		return List, nil
+	case *unary:
+		t, err := c.check(n.x)
+		if err != nil {
+			return 0, err
+		}
+		if n.op == "-" {
+			return Number, c.want(n, t, Number, "operand of -")
+		}
+		return Bool, c.want(n, t, Bool|Null, "operand of !")
+	case *cond:
+		t, err := c.check(n.c)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.want(n.c, t, Bool|Null, "condition"); err != nil {
+			return 0, err
+		}
+		a, err := c.check(n.a)
+		if err != nil {
+			return 0, err
+		}
+		b, err := c.check(n.b)
+		return a | b, err
+	case *binary:
+		return c.checkBinary(n)
+	case *call:
+		return c.checkCall(n)
+	}
+	return 0, c.errorf(n, "unknown node")
+}
+
+func (c *checker) checkBinary(n *binary) (Type, error) {
+	l, err := c.check(n.l)
+	if err != nil {
+		return 0, err
+	}
+	r, err := c.check(n.r)
+	if err != nil {
+		return 0, err
+	}
+	what := "operand of " + n.op
+	switch n.op {
+	case "&&", "||":
+		if err := c.want(n.l, l, Bool|Null, what); err != nil {
+			return 0, err
+		}
+		return Bool, c.want(n.r, r, Bool|Null, what)
+	case "==", "!=":
+		return Bool, nil
+	case "<", "<=", ">", ">=":
+		if err := c.want(n.l, l, Number|String, what); err != nil {
+			return 0, err
+		}
+		if err := c.want(n.r, r, Number|String, what); err != nil {
+			return 0, err
+		}
+		if l&r == 0 {
+			return 0, c.errorf(n, "cannot compare %s and %s", l, r)
+		}
+		return Bool, nil
+	case "in":
+		return Bool, c.want(n.r, r, List|String|Map|Null, "right operand of in")
+	case "+":
+		if err := c.want(n.l, l, Number|String|List, what); err != nil {
+			return 0, err
+		}
+		if err := c.want(n.r, r, Number|String|List, what); err != nil {
+			return 0, err
+		}
+		if l&r == 0 {
+			return 0, c.errorf(n, "cannot add %s and %s", l, r)
+		}
+		return l & r & (Number | String | List), nil
+	}
+	if err := c.want(n.l, l, Number, what); err != nil {
+		return 0, err
+	}
+	return Number, c.want(n.r, r, Number, what)
+}
+
+func (c *checker) checkCall(n *call) (Type, error) {
+	f, ok := funcs[n.fn]
+	if !ok {
+		return 0, c.errorf(n, "unknown function %s", n.fn)
+	}
+	if err := f.arity(n.fn, len(n.args)); err != nil {
+		return 0, c.errorf(n, "%v", err)
+	}
+	for i, a := range n.args {
+		t, err := c.check(a)
+		if err != nil {
+			return 0, err
+		}
+		if err := c.want(a, t, f.param(i), fmt.Sprintf("argument %d of %s", i+1, n.fn)); err != nil {
+			return 0, err
+		}
+	}
+	if n.fn == "matches" {
+		if lit, ok := n.args[1].(*literal); ok {
+			if _, err := regexp.Compile(lit.v.(string)); err != nil {
+				return 0, c.errorf(lit, "bad regexp: %v", err)
+			}
+		}
+	}
+	return f.result, nil
+}
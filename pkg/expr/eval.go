@@ -0,0 +1,347 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Eval evaluates the program with the variables in env. Fields of a
+// missing value or a map without them are null rather than errors, so
+// shared.a.b is null if shared has no a.
+func (p *Program) Eval(env map[string]interface{}) (interface{}, error) {
+	ev := evaluator{src: p.src, env: env}
+	return ev.eval(p.root)
+}
+
+// EvalBool evaluates a condition. null counts as false.
+func (p *Program) EvalBool(env map[string]interface{}) (bool, error) {
+	v, err := p.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	switch b := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return b, nil
+	}
+	return false, &Error{Src: p.src, Pos: p.root.at(), Msg: fmt.Sprintf("condition is %s, want bool", typeOf(v))}
+}
+
+type evaluator struct {
+	src string
+	env map[string]interface{}
+}
+
+func (ev *evaluator) errorf(n node, format string, args ...interface{}) error {
+	return &Error{Src: ev.src, Pos: n.at(), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (ev *evaluator) eval(n node) (interface{}, error) {
+	switch n := n.(type) {
+	case *literal:
+		return n.v, nil
+	case *ident:
+		v, ok := ev.env[n.name]
+		if !ok {
+			return nil, ev.errorf(n, "unknown variable %s", n.name)
+		}
+		return normalize(v), nil
+	case *member:
+		x, err := ev.eval(n.x)
+		if err != nil {
+			return nil, err
+		}
+		switch m := x.(type) {
+		case nil:
+			return nil, nil
+		case map[string]interface{}:
+			return normalize(m[n.name]), nil
+		}
+		return nil, ev.errorf(n, "cannot get .%s of %s", n.name, typeOf(x))
+	case *index:
+		return ev.evalIndex(n)
+	case *list:
+		out := make([]interface{}, len(n.elems))
+		for i, e := range n.elems {
+			v, err := ev.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case *unary:
+		x, err := ev.eval(n.x)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "-" {
+			f, ok := x.(float64)
+			if !ok {
+				return nil, ev.errorf(n, "operand of - is %s, want number", typeOf(x))
+			}
+			return -f, nil
+		}
+		b, err := ev.truth(n.x, x)
+		return !b, err
+	case *cond:
+		c, err := ev.eval(n.c)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ev.truth(n.c, c)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return ev.eval(n.a)
+		}
+		return ev.eval(n.b)
+	case *binary:
+		return ev.evalBinary(n)
+	case *call:
+		return ev.evalCall(n)
+	}
+	return nil, ev.errorf(n, "unknown node")
+}
+
+// truth reads a condition: a bool, or null for false.
+func (ev *evaluator) truth(n node, v interface{}) (bool, error) {
+	switch b := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return b, nil
+	}
+	return false, ev.errorf(n, "condition is %s, want bool", typeOf(v))
+}
+
+func (ev *evaluator) evalIndex(n *index) (interface{}, error) {
+	x, err := ev.eval(n.x)
+	if err != nil {
+		return nil, err
+	}
+	i, err := ev.eval(n.i)
+	if err != nil {
+		return nil, err
+	}
+	switch c := x.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		f, ok := i.(float64)
+		if !ok {
+			return nil, ev.errorf(n.i, "list index is %s, want number", typeOf(i))
+		}
+		if k := int(f); k >= 0 && k < len(c) {
+			return c[k], nil
+		} else if k < 0 && -k <= len(c) {
+			return c[len(c)+k], nil
+		}
+		return nil, nil
+	case map[string]interface{}:
+		k, ok := i.(string)
+		if !ok {
+			return nil, ev.errorf(n.i, "map key is %s, want string", typeOf(i))
+		}
+		return normalize(c[k]), nil
+	}
+	return nil, ev.errorf(n, "cannot index %s", typeOf(x))
+}
+
+func (ev *evaluator) evalBinary(n *binary) (interface{}, error) {
+	l, err := ev.eval(n.l)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		b, err := ev.truth(n.l, l)
+		if err != nil || b == (n.op == "||") {
+			return b, err
+		}
+		r, err := ev.eval(n.r)
+		if err != nil {
+			return nil, err
+		}
+		return ev.truth(n.r, r)
+	}
+	r, err := ev.eval(n.r)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch r.(type) {
+		case nil, []interface{}, string, map[string]interface{}:
+			return contains(r, l), nil
+		}
+		return nil, ev.errorf(n.r, "right operand of in is %s, want list, string or map", typeOf(r))
+	case "<", "<=", ">", ">=":
+		c, ok := compare(l, r)
+		if !ok {
+			return nil, ev.errorf(n, "cannot compare %s and %s", typeOf(l), typeOf(r))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "+":
+		switch a := l.(type) {
+		case string:
+			if b, ok := r.(string); ok {
+				return a + b, nil
+			}
+		case []interface{}:
+			if b, ok := r.([]interface{}); ok {
+				return append(append([]interface{}{}, a...), b...), nil
+			}
+		}
+	}
+	a, aok := l.(float64)
+	b, bok := r.(float64)
+	if !aok || !bok {
+		return nil, ev.errorf(n, "cannot apply %s to %s and %s", n.op, typeOf(l), typeOf(r))
+	}
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, ev.errorf(n, "division by zero")
+		}
+		return a / b, nil
+	}
+	if b == 0 {
+		return nil, ev.errorf(n, "division by zero")
+	}
+	return math.Mod(a, b), nil
+}
+
+func (ev *evaluator) evalCall(n *call) (interface{}, error) {
+	f, ok := funcs[n.fn]
+	if !ok {
+		return nil, ev.errorf(n, "unknown function %s", n.fn)
+	}
+	if err := f.arity(n.fn, len(n.args)); err != nil {
+		return nil, ev.errorf(n, "%v", err)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := ev.eval(a)
+		if err != nil {
+			return nil, err
+		}
+		if t := typeOf(v); t&f.param(i) == 0 {
+			return nil, ev.errorf(a, "argument %d of %s is %s, want %s", i+1, n.fn, t, f.param(i))
+		}
+		args[i] = v
+	}
+	v, err := f.fn(args)
+	if err != nil {
+		return nil, ev.errorf(n, "%s: %v", n.fn, err)
+	}
+	return v, nil
+}
+
+// normalize turns Go values that are not JSON values, e.g. ints or typed
+// slices from local funcs, into their JSON equivalents.
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, bool, float64, string, []interface{}, map[string]interface{}:
+		return v
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case json.Number:
+		f, _ := x.Float64()
+		return f
+	}
+	var out interface{}
+	b, err := json.Marshal(v)
+	if err != nil || json.Unmarshal(b, &out) != nil {
+		return fmt.Sprint(v)
+	}
+	return out
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two numbers or two strings.
+func compare(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+// contains reports whether list c has an element equal to v, string c
+// has substring v or map c has key v. Nothing is in null.
+func contains(c, v interface{}) bool {
+	switch x := c.(type) {
+	case []interface{}:
+		for _, e := range x {
+			if equal(normalize(e), v) {
+				return true
+			}
+		}
+	case string:
+		s, ok := v.(string)
+		return ok && strings.Contains(x, s)
+	case map[string]interface{}:
+		s, ok := v.(string)
+		_, has := x[s]
+		return ok && has
+	}
+	return false
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case nil:
+		return "null"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,447 @@
+// Package expr implements the expression language of flow definitions: a
+// small, typed language over JSON values used by choice cases, edge
+// guards and value mappings, e.g.
+//
+//	len(input.items) > 0 && lower(shared.user.country) in ["de", "at"]
+//	shared.total * 1.19
+//	date(params.deadline) - now() < duration("24h")
+//
+// Values are JSON values: null, bool, number (float64), string, list and
+// map. Times are numbers of unix milliseconds.
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Program is a parsed expression.
+type Program struct {
+	src  string
+	root node
+}
+
+// Parse parses src into a program.
+func Parse(src string) (*Program, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, toks: toks}
+	root, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t.pos, "unexpected %s", t)
+	}
+	return &Program{src: src, root: root}, nil
+}
+
+func (p *Program) String() string { return p.src }
+
+// Error is a parse, type or evaluation error, with the offset in the
+// source it refers to.
+type Error struct {
+	Src string
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("expr %q: %s (at %d)", e.Src, e.Msg, e.Pos)
+}
+
+// AST nodes. pos is the offset of the node in the source.
+type (
+	node interface{ at() int }
+
+	literal struct {
+		pos int
+		v   interface{}
+	}
+	ident struct {
+		pos  int
+		name string
+	}
+	member struct {
+		pos  int
+		x    node
+		name string
+	}
+	index struct {
+		pos int
+		x   node
+		i   node
+	}
+	call struct {
+		pos  int
+		fn   string
+		args []node
+	}
+	unary struct {
+		pos int
+		op  string
+		x   node
+	}
+	binary struct {
+		pos  int
+		op   string
+		l, r node
+	}
+	cond struct {
+		pos     int
+		c, a, b node
+	}
+	list struct {
+		pos   int
+		elems []node
+	}
+)
+
+func (n *literal) at() int { return n.pos }
+func (n *ident) at() int   { return n.pos }
+func (n *member) at() int  { return n.pos }
+func (n *index) at() int   { return n.pos }
+func (n *call) at() int    { return n.pos }
+func (n *unary) at() int   { return n.pos }
+func (n *binary) at() int  { return n.pos }
+func (n *cond) at() int    { return n.pos }
+func (n *list) at() int    { return n.pos }
+
+const (
+	tokEOF = iota
+	tokNum
+	tokStr
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind int
+	pos  int
+	text string
+	num  float64
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokStr:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+// ops lists the operators, longest first.
+var ops = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ",", ".", "?", ":"}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			f, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, &Error{Src: src, Pos: i, Msg: "bad number " + src[i:j]}
+			}
+			toks = append(toks, token{kind: tokNum, pos: i, text: src[i:j], num: f})
+			i = j
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(src[j])
+					}
+					continue
+				}
+				b.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, &Error{Src: src, Pos: i, Msg: "unterminated string"}
+			}
+			toks = append(toks, token{kind: tokStr, pos: i, text: b.String()})
+			i = j + 1
+		case c == '@':
+			// @ is a variable: the element a path filter is testing.
+			toks = append(toks, token{kind: tokIdent, pos: i, text: "@"})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, pos: i, text: src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range ops {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Src: src, Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{kind: tokOp, pos: i, text: op})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+type parser struct {
+	src  string
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// is reports whether the next token is the operator or keyword s and
+// consumes it if so.
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	if (t.kind == tokOp || t.kind == tokIdent) && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.is(s) {
+		t := p.peek()
+		return p.errorf(t.pos, "expected '%s', found %s", s, t)
+	}
+	return nil
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &Error{Src: p.src, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ternary parses c ? a : b, the lowest precedence.
+func (p *parser) ternary() (node, error) {
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	pos := p.peek().pos
+	if !p.is("?") {
+		return c, nil
+	}
+	a, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return &cond{pos: pos, c: c, a: a, b: b}, nil
+}
+
+// binaryLevel parses operands joined by the operators of one precedence
+// level, left to right. Keywords are normalized to their symbols.
+func (p *parser) binaryLevel(operand func() (node, error), ops map[string]string) (node, error) {
+	l, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		op, ok := ops[t.text]
+		if !ok || t.kind != tokOp && t.kind != tokIdent {
+			return l, nil
+		}
+		p.next()
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l = &binary{pos: t.pos, op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) or() (node, error) {
+	return p.binaryLevel(p.and, map[string]string{"||": "||", "or": "||"})
+}
+
+func (p *parser) and() (node, error) {
+	return p.binaryLevel(p.compare, map[string]string{"&&": "&&", "and": "&&"})
+}
+
+func (p *parser) compare() (node, error) {
+	l, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="),
+		t.kind == tokIdent && t.text == "in":
+		p.next()
+		r, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return &binary{pos: t.pos, op: t.text, l: l, r: r}, nil
+	case t.kind == tokIdent && t.text == "not" && p.toks[p.i+1].kind == tokIdent && p.toks[p.i+1].text == "in":
+		p.i += 2
+		r, err := p.additive()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{pos: t.pos, op: "!", x: &binary{pos: t.pos, op: "in", l: l, r: r}}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) additive() (node, error) {
+	return p.binaryLevel(p.multiplicative, map[string]string{"+": "+", "-": "-"})
+}
+
+func (p *parser) multiplicative() (node, error) {
+	return p.binaryLevel(p.unary, map[string]string{"*": "*", "/": "/", "%": "%"})
+}
+
+func (p *parser) unary() (node, error) {
+	t := p.peek()
+	if t.kind == tokOp && (t.text == "!" || t.text == "-") || t.kind == tokIdent && t.text == "not" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{pos: t.pos, op: ternary(t.text == "-", "-", "!"), x: x}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (node, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.is("."):
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, p.errorf(name.pos, "expected field name, found %s", name)
+			}
+			x = &member{pos: t.pos, x: x, name: name.text}
+		case p.is("["):
+			i, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &index{pos: t.pos, x: x, i: i}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNum:
+		return &literal{pos: t.pos, v: t.num}, nil
+	case tokStr:
+		return &literal{pos: t.pos, v: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &literal{pos: t.pos, v: t.text == "true"}, nil
+		case "null":
+			return &literal{pos: t.pos}, nil
+		case "and", "or", "not", "in":
+			return nil, p.errorf(t.pos, "unexpected %s", t)
+		}
+		if !p.is("(") {
+			return &ident{pos: t.pos, name: t.text}, nil
+		}
+		c := &call{pos: t.pos, fn: t.text}
+		args, err := p.elems(")")
+		c.args = args
+		return c, err
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			elems, err := p.elems("]")
+			return &list{pos: t.pos, elems: elems}, err
+		}
+	}
+	return nil, p.errorf(t.pos, "unexpected %s", t)
+}
+
+// elems parses a comma separated list of expressions up to end.
+func (p *parser) elems(end string) ([]node, error) {
+	var out []node
+	if p.is(end) {
+		return out, nil
+	}
+	for {
+		x, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+		if p.is(end) {
+			return out, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func ternary(c bool, a, b string) string {
+	if c {
+		return a
+	}
+	return b
+}
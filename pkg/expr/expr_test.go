@@ -0,0 +1,141 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEnv = map[string]interface{}{
+	"shared": map[string]interface{}{
+		"user":  map[string]interface{}{"name": "Ada", "country": "DE", "age": 36},
+		"items": []interface{}{map[string]interface{}{"price": 2.5}, map[string]interface{}{"price": 4.0}},
+		"tags":  []interface{}{"a", "b"},
+	},
+	"params": map[string]interface{}{"limit": 10.0, "deadline": "2024-05-02T00:00:00Z"},
+}
+
+func TestEval(t *testing.T) {
+	now = func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+	cases := []struct {
+		src  string
+		want interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3 - -1", 10.0},
+		{"7 % 4 / 2", 1.5},
+		{"'a' + \"b\"", "ab"},
+		{"[1, 2] + [3]", []interface{}{1.0, 2.0, 3.0}},
+		{"shared.user.age >= 18 && shared.user.name == 'Ada'", true},
+		{"shared.user.missing.deeper == null", true},
+		{"shared.items[1].price", 4.0},
+		{"shared.tags[-1]", "b"},
+		{"shared['user']['name']", "Ada"},
+		{"lower(shared.user.country) in ['de', 'at']", true},
+		{"'x' not in shared.tags", true},
+		{"not (1 > 2) and true or false", true},
+		{"len(shared.items) > 0 ? 'some' : 'none'", "some"},
+		{"sum([1, 2, 3.5])", 6.5},
+		{"max(1, [5, 3], 2)", 5.0},
+		{"round(2.5) + floor(1.9) + ceil(0.1) + abs(-1)", 6.0},
+		{"upper(trim('  hi '))", "HI"},
+		{"matches('order-42', '^order-[0-9]+$')", true},
+		{"startsWith('abc', 'ab') && endsWith('abc', 'bc') && contains('abc', 'b')", true},
+		{"join(split('a,b,c', ','), '-')", "a-b-c"},
+		{"replace('a-b', '-', '+') + substr('hello', 1, 3)", "a+bell"},
+		{"number('42') + number(true)", 43.0},
+		{"string(1.5) + string([1])", "1.5[1]"},
+		{"keys(shared.user)", []interface{}{"age", "country", "name"}},
+		{"default(shared.nope, 'x')", "x"},
+		{"first(shared.tags) + last(shared.tags)", "ab"},
+		{"date(params.deadline) - now() < duration('24h') + 1", true},
+		{"formatDate(date('2024-05-01'))", "2024-05-01T00:00:00Z"},
+		{"contains(shared.user, 'age')", true},
+	}
+	for _, c := range cases {
+		p, err := Parse(c.src)
+		if err != nil {
+			t.Fatalf("%s: %v", c.src, err)
+		}
+		got, err := p.Eval(testEnv)
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s = %#v, %v; want %#v", c.src, got, err, c.want)
+		}
+		if _, err := p.Check(map[string]Type{"shared": Any, "params": Any}); err != nil {
+			t.Fatalf("%s: check: %v", c.src, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	vars := map[string]Type{"shared": Any, "action": String}
+	cases := []struct {
+		src   string
+		stage string
+		err   string
+	}{
+		{"1 +", "parse", "unexpected end of expression"},
+		{"(1", "parse", "expected ')'"},
+		{"'abc", "parse", "unterminated string"},
+		{"a # b", "parse", "unexpected character"},
+		{"1 2", "parse", "unexpected '2'"},
+		{"foo.bar", "check", "unknown variable foo"},
+		{"nope(1)", "check", "unknown function nope"},
+		{"len()", "check", "len needs at least 1 arguments"},
+		{"lower('a', 'b')", "check", "lower takes at most 1 arguments"},
+		{"lower(1)", "check", "argument 1 of lower is number, want string"},
+		{"'a' - 1", "check", "operand of - is string, want number"},
+		{"1 < 'a'", "check", "cannot compare number and string"},
+		{"1 && true", "check", "operand of && is number, want null|bool"},
+		{"matches(action, '(')", "check", "bad regexp"},
+		{"action + 1", "check", "cannot add string and number"},
+		{"len(shared.x) > 1", "", ""},
+		{"lower(shared.x)", "eval", "argument 1 of lower is null, want string"},
+		{"shared.x / 0", "eval", "cannot apply / to null and number"},
+		{"1 / 0", "eval", "division by zero"},
+		{"shared.n.m", "eval", "cannot get .m of number"},
+	}
+	for _, c := range cases {
+		p, err := Parse(c.src)
+		if c.stage == "parse" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: parse error %v, want %q", c.src, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.src, err)
+		}
+		_, err = p.Check(vars)
+		if c.stage == "check" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: check error %v, want %q", c.src, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: check: %v", c.src, err)
+		}
+		if c.stage == "eval" {
+			_, err = p.Eval(map[string]interface{}{"shared": map[string]interface{}{"n": 1}, "action": "a"})
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("%s: eval error %v, want %q", c.src, err, c.err)
+			}
+		}
+	}
+}
+
+func TestCheckBool(t *testing.T) {
+	vars := map[string]Type{"shared": Any}
+	for src, ok := range map[string]bool{"shared.a > 1": true, "shared.a": true, "len(shared.a)": false, "'x'": false} {
+		p, err := Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.CheckBool(vars); (err == nil) != ok {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// function is a built-in function. params are the accepted types of each
+// argument; with variadic the last one repeats. Arguments past min are
+// optional. fn gets arguments already checked against params.
+type function struct {
+	params   []Type
+	min      int
+	variadic bool
+	result   Type
+	fn       func(args []interface{}) (interface{}, error)
+}
+
+func (f function) param(i int) Type {
+	if i >= len(f.params) {
+		return f.params[len(f.params)-1]
+	}
+	return f.params[i]
+}
+
+func (f function) arity(name string, n int) error {
+	switch {
+	case n < f.min:
+		return fmt.Errorf("%s needs at least %d arguments, got %d", name, f.min, n)
+	case !f.variadic && n > len(f.params):
+		return fmt.Errorf("%s takes at most %d arguments, got %d", name, len(f.params), n)
+	}
+	return nil
+}
+
+// now is replaced in tests.
+var now = time.Now
+
+var funcs map[string]function
+
+func init() {
+	str := func(f func(string) string) function {
+		return function{params: []Type{String}, min: 1, result: String, fn: func(a []interface{}) (interface{}, error) {
+			return f(a[0].(string)), nil
+		}}
+	}
+	num := func(f func(float64) float64) function {
+		return function{params: []Type{Number}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			return f(a[0].(float64)), nil
+		}}
+	}
+	pred := func(f func(string, string) bool) function {
+		return function{params: []Type{String, String}, min: 2, result: Bool, fn: func(a []interface{}) (interface{}, error) {
+			return f(a[0].(string), a[1].(string)), nil
+		}}
+	}
+	funcs = map[string]function{
+		"len": {params: []Type{String | List | Map}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			switch x := a[0].(type) {
+			case string:
+				return float64(len([]rune(x))), nil
+			case []interface{}:
+				return float64(len(x)), nil
+			}
+			return float64(len(a[0].(map[string]interface{}))), nil
+		}},
+		"lower":      str(strings.ToLower),
+		"upper":      str(strings.ToUpper),
+		"trim":       str(strings.TrimSpace),
+		"startsWith": pred(strings.HasPrefix),
+		"endsWith":   pred(strings.HasSuffix),
+		"contains": {params: []Type{String | List | Map, Any}, min: 2, result: Bool, fn: func(a []interface{}) (interface{}, error) {
+			return contains(a[0], a[1]), nil
+		}},
+		"matches": {params: []Type{String, String}, min: 2, result: Bool, fn: func(a []interface{}) (interface{}, error) {
+			re, err := regexp.Compile(a[1].(string))
+			if err != nil {
+				return nil, fmt.Errorf("bad regexp: %v", err)
+			}
+			return re.MatchString(a[0].(string)), nil
+		}},
+		"replace": {params: []Type{String, String, String}, min: 3, result: String, fn: func(a []interface{}) (interface{}, error) {
+			return strings.ReplaceAll(a[0].(string), a[1].(string), a[2].(string)), nil
+		}},
+		"split": {params: []Type{String, String}, min: 2, result: List, fn: func(a []interface{}) (interface{}, error) {
+			out := []interface{}{}
+			for _, s := range strings.Split(a[0].(string), a[1].(string)) {
+				out = append(out, s)
+			}
+			return out, nil
+		}},
+		"join": {params: []Type{List, String}, min: 1, result: String, fn: func(a []interface{}) (interface{}, error) {
+			sep := ""
+			if len(a) > 1 {
+				sep = a[1].(string)
+			}
+			var parts []string
+			for _, v := range a[0].([]interface{}) {
+				parts = append(parts, toString(v))
+			}
+			return strings.Join(parts, sep), nil
+		}},
+		"substr": {params: []Type{String, Number, Number}, min: 2, result: String, fn: func(a []interface{}) (interface{}, error) {
+			r := []rune(a[0].(string))
+			start := clamp(int(a[1].(float64)), len(r))
+			end := len(r)
+			if len(a) > 2 {
+				end = clamp(start+int(a[2].(float64)), len(r))
+			}
+			return string(r[start:end]), nil
+		}},
+		"abs":   num(math.Abs),
+		"floor": num(math.Floor),
+		"ceil":  num(math.Ceil),
+		"round": num(math.Round),
+		"min":   {params: []Type{Number | List}, min: 1, variadic: true, result: Number | Null, fn: extreme(-1)},
+		"max":   {params: []Type{Number | List}, min: 1, variadic: true, result: Number | Null, fn: extreme(1)},
+		"sum": {params: []Type{List}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			ns, err := numbers(a)
+			if err != nil {
+				return nil, err
+			}
+			s := 0.0
+			for _, n := range ns {
+				s += n
+			}
+			return s, nil
+		}},
+		"number": {params: []Type{Number | String | Bool}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			switch x := a[0].(type) {
+			case float64:
+				return x, nil
+			case bool:
+				if x {
+					return 1.0, nil
+				}
+				return 0.0, nil
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(a[0].(string)), 64)
+			if err != nil {
+				return nil, fmt.Errorf("not a number: %q", a[0])
+			}
+			return f, nil
+		}},
+		"string": {params: []Type{Any}, min: 1, result: String, fn: func(a []interface{}) (interface{}, error) {
+			return toString(a[0]), nil
+		}},
+		"keys": {params: []Type{Map}, min: 1, result: List, fn: func(a []interface{}) (interface{}, error) {
+			m := a[0].(map[string]interface{})
+			ks := make([]string, 0, len(m))
+			for k := range m {
+				ks = append(ks, k)
+			}
+			sort.Strings(ks)
+			out := make([]interface{}, len(ks))
+			for i, k := range ks {
+				out[i] = k
+			}
+			return out, nil
+		}},
+		"first": {params: []Type{List}, min: 1, result: Any, fn: func(a []interface{}) (interface{}, error) {
+			if l := a[0].([]interface{}); len(l) > 0 {
+				return l[0], nil
+			}
+			return nil, nil
+		}},
+		"last": {params: []Type{List}, min: 1, result: Any, fn: func(a []interface{}) (interface{}, error) {
+			if l := a[0].([]interface{}); len(l) > 0 {
+				return l[len(l)-1], nil
+			}
+			return nil, nil
+		}},
+		"default": {params: []Type{Any, Any}, min: 2, result: Any, fn: func(a []interface{}) (interface{}, error) {
+			if a[0] == nil {
+				return a[1], nil
+			}
+			return a[0], nil
+		}},
+		"now": {result: Number, fn: func(a []interface{}) (interface{}, error) {
+			return float64(now().UnixMilli()), nil
+		}},
+		"date": {params: []Type{String | Number}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			if n, ok := a[0].(float64); ok {
+				return n, nil
+			}
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+				if t, err := time.Parse(layout, a[0].(string)); err == nil {
+					return float64(t.UnixMilli()), nil
+				}
+			}
+			return nil, fmt.Errorf("not a date: %q", a[0])
+		}},
+		"formatDate": {params: []Type{Number, String}, min: 1, result: String, fn: func(a []interface{}) (interface{}, error) {
+			layout := time.RFC3339
+			if len(a) > 1 {
+				layout = a[1].(string)
+			}
+			return time.UnixMilli(int64(a[0].(float64))).UTC().Format(layout), nil
+		}},
+		"duration": {params: []Type{String}, min: 1, result: Number, fn: func(a []interface{}) (interface{}, error) {
+			d, err := time.ParseDuration(a[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			return float64(d.Milliseconds()), nil
+		}},
+	}
+}
+
+func clamp(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > n {
+		return n
+	}
+	return i
+}
+
+// numbers flattens numbers and lists of numbers.
+func numbers(args []interface{}) ([]float64, error) {
+	var out []float64
+	for _, a := range args {
+		switch x := a.(type) {
+		case float64:
+			out = append(out, x)
+		case []interface{}:
+			ns, err := numbers(x)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ns...)
+		default:
+			return nil, fmt.Errorf("%s is not a number", typeOf(a))
+		}
+	}
+	return out, nil
+}
+
+// extreme returns the min (sign -1) or max (1) of numbers and lists of
+// numbers, or null if there are none.
+func extreme(sign float64) func([]interface{}) (interface{}, error) {
+	return func(a []interface{}) (interface{}, error) {
+		ns, err := numbers(a)
+		if err != nil || len(ns) == 0 {
+			return nil, err
+		}
+		m := ns[0]
+		for _, n := range ns[1:] {
+			if (n-m)*sign > 0 {
+				m = n
+			}
+		}
+		return m, nil
+	}
+}
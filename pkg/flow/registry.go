@@ -19,6 +19,16 @@ type WorkerInfo struct {
 type RegistryClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
+	// Namespace, when set, is sent as the X-Namespace header so the worker
+	// registers in and is listed from that namespace.
+	Namespace string
+}
+
+// scope sets the namespace header on req.
+func (rc *RegistryClient) scope(req *http.Request) {
+	if rc.Namespace != "" {
+		req.Header.Set("X-Namespace", rc.Namespace)
+	}
 }
 
 func (rc *RegistryClient) Register(w WorkerInfo) error {
@@ -34,6 +44,7 @@ func (rc *RegistryClient) Register(w WorkerInfo) error {
 	if err != nil {
 		return err
 	}
+	rc.scope(req)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := c.Do(req)
 	if err != nil {
@@ -60,6 +71,7 @@ func (rc *RegistryClient) Heartbeat(id string, url string, load int) error {
 	if err != nil {
 		return err
 	}
+	rc.scope(req)
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := c.Do(req)
 	if err != nil {
@@ -81,6 +93,7 @@ func (rc *RegistryClient) Allocate(service string) (WorkerInfo, error) {
 	if err != nil {
 		return WorkerInfo{}, err
 	}
+	rc.scope(req)
 	resp, err := c.Do(req)
 	if err != nil {
 		return WorkerInfo{}, err
@@ -106,6 +119,7 @@ func (rc *RegistryClient) List(service string) ([]WorkerInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	rc.scope(req)
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
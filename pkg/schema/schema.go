@@ -0,0 +1,513 @@
+// Package schema validates JSON values against JSON Schema. It supports
+// the keywords flow contracts need:
+//
+//	type, enum, const, default
+//	properties, required, additionalProperties, minProperties, maxProperties
+//	items, minItems, maxItems, uniqueItems
+//	minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf
+//	minLength, maxLength, pattern
+//	allOf, anyOf, oneOf, not
+//
+// Annotations such as title, description and format are ignored. Other
+// keywords, $ref among them, are reported by Check rather than ignored, so
+// that a schema never silently validates less than it says.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a parsed JSON Schema. The zero value and nil accept anything.
+type Schema struct {
+	Types      []string
+	Enum       []interface{}
+	Const      interface{}
+	HasConst   bool
+	Default    interface{}
+	HasDefault bool
+	Properties map[string]*Schema
+	Required   []string
+	// Additional is the schema of properties not in Properties; NoAdditional
+	// rejects them.
+	Additional    *Schema
+	NoAdditional  bool
+	MinProperties *int
+	MaxProperties *int
+	Items         *Schema
+	MinItems      *int
+	MaxItems      *int
+	UniqueItems   bool
+	Minimum       *float64
+	Maximum       *float64
+	ExclusiveMin  *float64
+	ExclusiveMax  *float64
+	MultipleOf    *float64
+	MinLength     *int
+	MaxLength     *int
+	Pattern       *regexp.Regexp
+	AllOf         []*Schema
+	AnyOf         []*Schema
+	OneOf         []*Schema
+	Not           *Schema
+
+	raw json.RawMessage
+	// errs are problems with the schema itself, reported by Check.
+	errs []error
+}
+
+var typeNames = map[string]bool{"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true}
+
+var annotations = map[string]bool{"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "format": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true}
+
+// MarshalJSON returns the schema as it was given.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	if s.raw == nil {
+		return []byte("{}"), nil
+	}
+	return s.raw, nil
+}
+
+// UnmarshalJSON parses a schema. Invalid keyword values are kept as
+// errors for Check, so that a definition with a bad schema still loads.
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	*s = Schema{raw: append(json.RawMessage(nil), b...)}
+	var kw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &kw); err != nil {
+		var ok bool
+		if json.Unmarshal(b, &ok) == nil {
+			// true accepts anything, false nothing.
+			if !ok {
+				s.Not = &Schema{raw: json.RawMessage("{}")}
+			}
+			return nil
+		}
+		return fmt.Errorf("schema must be an object or a bool")
+	}
+	keys := make([]string, 0, len(kw))
+	for k := range kw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := s.keyword(k, kw[k]); err != nil {
+			s.errs = append(s.errs, fmt.Errorf("%s: %w", k, err))
+		}
+	}
+	return nil
+}
+
+func (s *Schema) keyword(k string, v json.RawMessage) error {
+	sub := func(v json.RawMessage) (*Schema, error) {
+		c := &Schema{}
+		return c, json.Unmarshal(v, c)
+	}
+	subs := func(v json.RawMessage) ([]*Schema, error) {
+		var l []*Schema
+		if err := json.Unmarshal(v, &l); err != nil {
+			return nil, err
+		}
+		if len(l) == 0 {
+			return nil, fmt.Errorf("must not be empty")
+		}
+		return l, nil
+	}
+	var err error
+	switch k {
+	case "type":
+		var one string
+		if json.Unmarshal(v, &one) == nil {
+			s.Types = []string{one}
+		} else if err = json.Unmarshal(v, &s.Types); err != nil {
+			return fmt.Errorf("must be a string or a list of strings")
+		}
+		for _, t := range s.Types {
+			if !typeNames[t] {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	case "enum":
+		err = json.Unmarshal(v, &s.Enum)
+	case "const":
+		s.HasConst = true
+		err = json.Unmarshal(v, &s.Const)
+	case "default":
+		s.HasDefault = true
+		err = json.Unmarshal(v, &s.Default)
+	case "properties":
+		err = json.Unmarshal(v, &s.Properties)
+	case "required":
+		err = json.Unmarshal(v, &s.Required)
+	case "additionalProperties":
+		var ok bool
+		if json.Unmarshal(v, &ok) == nil {
+			s.NoAdditional = !ok
+		} else {
+			s.Additional, err = sub(v)
+		}
+	case "minProperties":
+		err = json.Unmarshal(v, &s.MinProperties)
+	case "maxProperties":
+		err = json.Unmarshal(v, &s.MaxProperties)
+	case "items":
+		s.Items, err = sub(v)
+	case "minItems":
+		err = json.Unmarshal(v, &s.MinItems)
+	case "maxItems":
+		err = json.Unmarshal(v, &s.MaxItems)
+	case "uniqueItems":
+		err = json.Unmarshal(v, &s.UniqueItems)
+	case "minimum":
+		err = json.Unmarshal(v, &s.Minimum)
+	case "maximum":
+		err = json.Unmarshal(v, &s.Maximum)
+	case "exclusiveMinimum":
+		err = json.Unmarshal(v, &s.ExclusiveMin)
+	case "exclusiveMaximum":
+		err = json.Unmarshal(v, &s.ExclusiveMax)
+	case "multipleOf":
+		if err = json.Unmarshal(v, &s.MultipleOf); err == nil && *s.MultipleOf <= 0 {
+			err = fmt.Errorf("must be greater than 0")
+		}
+	case "minLength":
+		err = json.Unmarshal(v, &s.MinLength)
+	case "maxLength":
+		err = json.Unmarshal(v, &s.MaxLength)
+	case "pattern":
+		var p string
+		if err = json.Unmarshal(v, &p); err == nil {
+			s.Pattern, err = regexp.Compile(p)
+		}
+	case "allOf":
+		s.AllOf, err = subs(v)
+	case "anyOf":
+		s.AnyOf, err = subs(v)
+	case "oneOf":
+		s.OneOf, err = subs(v)
+	case "not":
+		s.Not, err = sub(v)
+	default:
+		if !annotations[k] {
+			return fmt.Errorf("unsupported keyword")
+		}
+	}
+	return err
+}
+
+// Check reports problems with the schema itself, in nested schemas too:
+// unsupported keywords, invalid keyword values and defaults that do not
+// match their schema.
+func (s *Schema) Check() error {
+	var errs []string
+	s.check("", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+func (s *Schema) check(at string, errs *[]string) {
+	if s == nil {
+		return
+	}
+	for _, err := range s.errs {
+		*errs = append(*errs, join(at, err.Error()))
+	}
+	if s.HasDefault {
+		if err := s.Validate(s.Default); err != nil {
+			*errs = append(*errs, join(at, "default: "+err.Error()))
+		}
+	}
+	for _, k := range sortedKeys(s.Properties) {
+		s.Properties[k].check(join(at, "properties."+k), errs)
+	}
+	s.Additional.check(join(at, "additionalProperties"), errs)
+	s.Items.check(join(at, "items"), errs)
+	for _, g := range []struct {
+		name string
+		l    []*Schema
+	}{{"allOf", s.AllOf}, {"anyOf", s.AnyOf}, {"oneOf", s.OneOf}} {
+		for i, c := range g.l {
+			c.check(join(at, fmt.Sprintf("%s[%d]", g.name, i)), errs)
+		}
+	}
+	s.Not.check(join(at, "not"), errs)
+}
+
+func join(at, s string) string {
+	if at == "" {
+		return s
+	}
+	return at + "." + s
+}
+
+// Error is a value that does not match a schema. Path is where in the
+// value, e.g. "user.tags[1]"; it is empty for the value itself.
+type Error struct {
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Path + ": " + e.Msg
+}
+
+// Errors lists the mismatches of a value, in the order they were found.
+type Errors []*Error
+
+func (l Errors) Error() string {
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Validate checks v, a JSON value, against s and returns Errors if it
+// does not match. Go numbers other than float64 are accepted as numbers.
+func (s *Schema) Validate(v interface{}) error {
+	var errs Errors
+	s.validate(normalize(v), "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (s *Schema) validate(v interface{}, at string, errs *Errors) {
+	if s == nil {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, &Error{Path: at, Msg: fmt.Sprintf(format, args...)})
+	}
+	if len(s.errs) != 0 {
+		fail("invalid schema: %v", s.errs[0])
+		return
+	}
+	if len(s.Types) != 0 && !hasType(s.Types, v) {
+		fail("%s is %s, want %s", describe(v), typeOf(v), strings.Join(s.Types, " or "))
+		return
+	}
+	if s.Enum != nil && !containsValue(s.Enum, v) {
+		fail("%s is not one of %s", describe(v), toJSON(s.Enum))
+	}
+	if s.HasConst && !reflect.DeepEqual(s.Const, v) {
+		fail("%s is not %s", describe(v), toJSON(s.Const))
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(x, at, errs, fail)
+	case []interface{}:
+		if s.MinItems != nil && len(x) < *s.MinItems {
+			fail("has %d items, want at least %d", len(x), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(x) > *s.MaxItems {
+			fail("has %d items, want at most %d", len(x), *s.MaxItems)
+		}
+		if s.UniqueItems {
+			for i := range x {
+				for j := 0; j < i; j++ {
+					if reflect.DeepEqual(x[i], x[j]) {
+						fail("items %d and %d are equal", j, i)
+					}
+				}
+			}
+		}
+		for i, el := range x {
+			s.Items.validate(el, fmt.Sprintf("%s[%d]", at, i), errs)
+		}
+	case float64:
+		switch {
+		case s.Minimum != nil && x < *s.Minimum:
+			fail("%s is less than %s", describe(x), describe(*s.Minimum))
+		case s.ExclusiveMin != nil && x <= *s.ExclusiveMin:
+			fail("%s is not greater than %s", describe(x), describe(*s.ExclusiveMin))
+		case s.Maximum != nil && x > *s.Maximum:
+			fail("%s is greater than %s", describe(x), describe(*s.Maximum))
+		case s.ExclusiveMax != nil && x >= *s.ExclusiveMax:
+			fail("%s is not less than %s", describe(x), describe(*s.ExclusiveMax))
+		}
+		if s.MultipleOf != nil {
+			if q := x / *s.MultipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("%s is not a multiple of %s", describe(x), describe(*s.MultipleOf))
+			}
+		}
+	case string:
+		n := len([]rune(x))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("%s is shorter than %d characters", describe(x), *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("%s is longer than %d characters", describe(x), *s.MaxLength)
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(x) {
+			fail("%s does not match %s", describe(x), strconv.Quote(s.Pattern.String()))
+		}
+	}
+	for _, c := range s.AllOf {
+		c.validate(v, at, errs)
+	}
+	if s.AnyOf != nil && matching(s.AnyOf, v) == 0 {
+		fail("%s matches none of anyOf", describe(v))
+	}
+	if s.OneOf != nil {
+		if n := matching(s.OneOf, v); n != 1 {
+			fail("%s matches %d of oneOf, want 1", describe(v), n)
+		}
+	}
+	if s.Not != nil && s.Not.Validate(v) == nil {
+		fail("%s must not match the schema in not", describe(v))
+	}
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, at string, errs *Errors, fail func(string, ...interface{})) {
+	for _, k := range s.Required {
+		if _, ok := m[k]; !ok {
+			fail("missing required property %s", strconv.Quote(k))
+		}
+	}
+	if s.MinProperties != nil && len(m) < *s.MinProperties {
+		fail("has %d properties, want at least %d", len(m), *s.MinProperties)
+	}
+	if s.MaxProperties != nil && len(m) > *s.MaxProperties {
+		fail("has %d properties, want at most %d", len(m), *s.MaxProperties)
+	}
+	for _, k := range sortedKeys(m) {
+		if p, ok := s.Properties[k]; ok {
+			p.validate(m[k], propPath(at, k), errs)
+		} else if s.NoAdditional {
+			*errs = append(*errs, &Error{Path: propPath(at, k), Msg: "unknown property"})
+		} else {
+			s.Additional.validate(m[k], propPath(at, k), errs)
+		}
+	}
+}
+
+// ApplyDefaults sets the properties of m that are missing, or nil, to
+// the defaults of their schemas, and fills in nested objects the same
+// way.
+func (s *Schema) ApplyDefaults(m map[string]interface{}) {
+	if s == nil || m == nil {
+		return
+	}
+	for k, p := range s.Properties {
+		if p == nil {
+			continue
+		}
+		if v, ok := m[k]; (!ok || v == nil) && p.HasDefault {
+			m[k] = normalize(p.Default)
+		}
+		if sub, ok := m[k].(map[string]interface{}); ok {
+			p.ApplyDefaults(sub)
+		}
+	}
+}
+
+func matching(l []*Schema, v interface{}) int {
+	n := 0
+	for _, c := range l {
+		if c.Validate(v) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func hasType(types []string, v interface{}) bool {
+	t := typeOf(v)
+	for _, want := range types {
+		if want == t || want == "number" && t == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if x == math.Trunc(x) && !math.IsInf(x, 0) {
+			return "integer"
+		}
+	}
+	return "number"
+}
+
+func containsValue(l []interface{}, v interface{}) bool {
+	for _, x := range l {
+		if reflect.DeepEqual(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe renders v for messages, shortened if long.
+func describe(v interface{}) string {
+	s := toJSON(v)
+	if len(s) > 40 {
+		s = s[:37] + "..."
+	}
+	return s
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// normalize turns v into plain JSON values by a round trip through JSON
+// unless it is one already.
+func normalize(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, bool, float64, string:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if json.Unmarshal(b, &out) != nil {
+		return v
+	}
+	return out
+}
+
+// propPath appends property k to path at, quoting keys that are not plain
+// names.
+func propPath(at, k string) string {
+	if k == "" || strings.ContainsAny(k, ".[]'\" ") {
+		return at + "[" + strconv.Quote(k) + "]"
+	}
+	return join(at, k)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
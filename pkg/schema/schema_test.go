@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, js string) *Schema {
+	t.Helper()
+	s := &Schema{}
+	if err := json.Unmarshal([]byte(js), s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(); err != nil {
+		t.Fatalf("%s: %v", js, err)
+	}
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	s := parse(t, `{"type":"object","required":["id","tags"],"additionalProperties":false,"properties":{
+		"id":{"type":"integer","minimum":1},
+		"name":{"type":"string","minLength":2,"maxLength":5,"pattern":"^[a-z]+$"},
+		"tags":{"type":"array","items":{"enum":["a","b"]},"uniqueItems":true,"maxItems":3},
+		"price":{"type":"number","exclusiveMinimum":0,"multipleOf":0.5},
+		"kind":{"oneOf":[{"const":"x"},{"type":"string","maxLength":1}]},
+		"ref":{"anyOf":[{"type":"null"},{"type":"string"}],"not":{"const":""}},
+		"weird key":{"type":"boolean"}}}`)
+	cases := []struct {
+		v    string
+		want string
+	}{
+		{`{"id":3,"tags":["a"],"name":"abc","price":1.5,"ref":null,"weird key":true}`, ""},
+		{`[]`, `[] is array, want object`},
+		{`{"tags":[]}`, `missing required property "id"`},
+		{`{"id":1.5,"tags":[]}`, `id: 1.5 is number, want integer`},
+		{`{"id":0,"tags":[]}`, `id: 0 is less than 1`},
+		{`{"id":1,"tags":["a","c","a"]}`, `tags: items 0 and 2 are equal; tags[1]: "c" is not one of ["a","b"]`},
+		{`{"id":1,"tags":[],"name":"A"}`, `name: "A" is shorter than 2 characters; name: "A" does not match "^[a-z]+$"`},
+		{`{"id":1,"tags":[],"price":0.7}`, `price: 0.7 is not a multiple of 0.5`},
+		{`{"id":1,"tags":[],"price":0}`, `price: 0 is not greater than 0`},
+		{`{"id":1,"tags":[],"kind":"x"}`, `kind: "x" matches 2 of oneOf, want 1`},
+		{`{"id":1,"tags":[],"ref":1}`, `ref: 1 matches none of anyOf`},
+		{`{"id":1,"tags":[],"ref":""}`, `ref: "" must not match the schema in not`},
+		{`{"id":1,"tags":[],"other":1,"weird key":1}`, `other: unknown property; ["weird key"]: 1 is integer, want boolean`},
+	}
+	for _, c := range cases {
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.v), &v); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if err := s.Validate(v); err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Fatalf("%s: %q, want %q", c.v, got, c.want)
+		}
+	}
+}
+
+func TestValidateGoValues(t *testing.T) {
+	s := parse(t, `{"type":"object","properties":{"n":{"type":"integer"},"l":{"type":"array","items":{"type":"number"}}}}`)
+	if err := s.Validate(map[string]interface{}{"n": 3, "l": []int{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var nilSchema *Schema
+	if err := nilSchema.Validate("anything"); err != nil {
+		t.Fatal(err)
+	}
+	if err := parse(t, `false`).Validate(1.0); err == nil {
+		t.Fatal("false schema accepted a value")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := &Schema{}
+	js := `{"type":"object","$ref":"#/x","properties":{"a":{"type":"int"},"b":{"pattern":"("},"c":{"type":"string","default":1}},"items":{"minItems":"x"}}`
+	if err := json.Unmarshal([]byte(js), s); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Check()
+	want := []string{
+		"$ref: unsupported keyword",
+		`properties.a.type: unknown type "int"`,
+		"properties.b.pattern: error parsing regexp",
+		"properties.c.default: 1 is integer, want string",
+		"items.minItems: json: cannot unmarshal",
+	}
+	if err == nil {
+		t.Fatal("no error")
+	}
+	got := strings.Split(err.Error(), "; ")
+	if len(got) != len(want) {
+		t.Fatalf("errors: %v", err)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(got[i], w) {
+			t.Fatalf("error %d: %q, want prefix %q", i, got[i], w)
+		}
+	}
+	if b, _ := json.Marshal(s); string(b) != js {
+		t.Fatalf("marshal: %s", b)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	s := parse(t, `{"properties":{"limit":{"type":"integer","default":10},"opts":{"default":{},"properties":{"mode":{"default":"fast"}}},"set":{"default":1}}}`)
+	m := map[string]interface{}{"set": 2.0, "opts": nil}
+	s.ApplyDefaults(m)
+	want := map[string]interface{}{"limit": 10.0, "set": 2.0, "opts": map[string]interface{}{"mode": "fast"}}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %v", m)
+	}
+}
@@ -8,29 +8,96 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nuknal/PocketFlowGo/pkg/archive"
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
 	"github.com/nuknal/PocketFlowGo/pkg/engine"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
 	"gopkg.in/yaml.v3"
 )
 
 // Server serves the API endpoints.
-type Server struct{ Store store.Store }
+type Server struct {
+	Store store.Store
+	// Archive, when set, backs the /api/archive endpoints.
+	Archive *archive.Archiver
+	// Blobs, when set, offloads large worker results and resolves blob
+	// references in task and run details.
+	Blobs *blob.Codec
+	// SharedLimits applies to new tasks that do not set their own.
+	SharedLimits store.SharedLimits
+}
 
 func writeJSON(w http.ResponseWriter, v interface{}, code int) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Actor, X-Namespace")
 	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// actorOf names who made a request for the task journal: the X-Actor
+// header if set, else the client address.
+func actorOf(r *http.Request) string {
+	if a := r.Header.Get("X-Actor"); a != "" {
+		return a
+	}
+	return r.RemoteAddr
+}
+
+// namespaceOf returns the namespace a request is scoped to: the
+// X-Namespace header, else the namespace query parameter, else the default
+// namespace.
+func namespaceOf(r *http.Request) string {
+	if ns := r.Header.Get("X-Namespace"); ns != "" {
+		return ns
+	}
+	return store.Namespace(r.URL.Query().Get("namespace"))
+}
+
+// taskIn loads task id and checks that it belongs to the request's
+// namespace. Otherwise it writes a 404, as tasks of other namespaces do not
+// exist for the caller, and returns false.
+func (s *Server) taskIn(w http.ResponseWriter, r *http.Request, id string) (store.Task, bool) {
+	t, err := s.Store.GetTask(id)
+	if err == nil && t.Namespace != namespaceOf(r) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, map[string]string{"error": "not found"}, 404)
+		} else {
+			writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		}
+		return store.Task{}, false
+	}
+	return t, true
+}
+
+// flowIn is taskIn for flows.
+func (s *Server) flowIn(w http.ResponseWriter, r *http.Request, id string) (store.Flow, bool) {
+	f, err := s.Store.GetFlow(id)
+	if err == nil && f.Namespace != namespaceOf(r) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSON(w, map[string]string{"error": "flow not found"}, 404)
+		} else {
+			writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		}
+		return store.Flow{}, false
+	}
+	return f, true
+}
+
 func withCORS(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Actor, X-Namespace")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(204)
@@ -53,6 +120,7 @@ func (s *Server) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/flows", withCORS(s.handleFlows))
 	mux.HandleFunc("/api/flows/version", withCORS(s.handleFlowVersion))
 	mux.HandleFunc("/api/flows/version/get", withCORS(s.handleGetFlowVersion))
+	mux.HandleFunc("/api/flows/validate", withCORS(s.handleValidateFlow))
 	mux.HandleFunc("/api/tasks", withCORS(s.handleTasks))
 	mux.HandleFunc("/api/tasks/get", withCORS(s.handleGetTask))
 	mux.HandleFunc("/api/tasks/run_once", withCORS(s.handleRunOnce))
@@ -60,6 +128,13 @@ func (s *Server) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/tasks/runs", withCORS(s.handleTaskRuns))
 	mux.HandleFunc("/api/tasks/logs", withCORS(s.handleTaskLogs))
 	mux.HandleFunc("/api/tasks/signal", withCORS(s.handleTaskSignal))
+	mux.HandleFunc("/api/tasks/shared", withCORS(s.handleTaskShared))
+	mux.HandleFunc("/api/tasks/events", withCORS(s.handleTaskEvents))
+	mux.HandleFunc("/api/tasks/state", withCORS(s.handleTaskState))
+	mux.HandleFunc("/api/blobs", withCORS(s.handleBlob))
+	mux.HandleFunc("/api/retention", withCORS(s.handleRetention))
+	mux.HandleFunc("/api/archive", withCORS(s.handleArchive))
+	mux.HandleFunc("/api/archive/restore", withCORS(s.handleArchiveRestore))
 	mux.HandleFunc("/api/queue/poll", withCORS(s.handleQueuePoll))
 	mux.HandleFunc("/api/queue/complete", withCORS(s.handleQueueComplete))
 	mux.HandleFunc("/api/queue/update_run", withCORS(s.handleQueueUpdateRun))
@@ -82,6 +157,14 @@ func (s *Server) handleQueueUpdateRun(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, map[string]string{"error": "run_id required"}, 400)
 		return
 	}
+	run, err := s.Store.GetNodeRun(payload.RunID)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "run not found"}, 404)
+		return
+	}
+	if _, ok := s.taskIn(w, r, run.TaskID); !ok {
+		return
+	}
 
 	updates := map[string]interface{}{
 		"status": payload.Status,
@@ -107,7 +190,7 @@ func (s *Server) handleQueuePoll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := s.Store.PollQueue(payload.WorkerID, payload.Services, 60) // 60s visibility timeout
+	task, err := s.Store.PollQueue(namespaceOf(r), payload.WorkerID, payload.Services, 60) // 60s visibility timeout
 	if err != nil {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
@@ -137,7 +220,16 @@ func (s *Server) handleQueueComplete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 1. Mark queue task as completed
+	if q, err := s.Store.GetQueueTask(payload.QueueID); err != nil || q.Namespace != namespaceOf(r) {
+		writeJSON(w, map[string]string{"error": "queue task not found"}, 404)
+		return
+	}
 	taskID, err := s.Store.CompleteQueueTask(payload.QueueID)
+	if errors.Is(err, store.ErrRevoked) {
+		// The task was canceled while the worker ran; drop the result.
+		writeJSON(w, map[string]string{"error": err.Error()}, 409)
+		return
+	}
 	if err != nil {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
@@ -173,8 +265,12 @@ func (s *Server) handleQueueComplete(w http.ResponseWriter, r *http.Request) {
 			"error_text":  payload.Error,
 		}
 		if payload.Result != nil {
-			b, _ := json.Marshal(payload.Result)
-			updates["exec_output_json"] = string(b)
+			out, err := s.encodeResult(payload.Result)
+			if err != nil {
+				writeJSON(w, map[string]string{"error": err.Error()}, 500)
+				return
+			}
+			updates["exec_output_json"] = out
 		} else {
 			updates["exec_output_json"] = "{}"
 		}
@@ -204,8 +300,12 @@ func (s *Server) handleQueueComplete(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if payload.Result != nil {
-			b, _ := json.Marshal(payload.Result)
-			run["exec_output_json"] = string(b)
+			out, err := s.encodeResult(payload.Result)
+			if err != nil {
+				writeJSON(w, map[string]string{"error": err.Error()}, 500)
+				return
+			}
+			run["exec_output_json"] = out
 		}
 
 		if err := s.Store.SaveNodeRun(run); err != nil {
@@ -225,7 +325,8 @@ func (s *Server) handleQueueComplete(w http.ResponseWriter, r *http.Request) {
 
 	// For this iteration, let's just set it to PENDING.
 	// We will modify the Engine to check for completed runs before executing.
-	if err := s.Store.UpdateTaskStatus(taskID, "pending"); err != nil {
+	qb, _ := json.Marshal(map[string]string{"queue_id": payload.QueueID})
+	if err := s.Store.SetTaskStatus(taskID, "pending", store.TaskEvent{Type: "resume", Actor: actorOf(r), DataJSON: string(qb)}); err != nil {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
 	}
@@ -233,6 +334,16 @@ func (s *Server) handleQueueComplete(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"ok": "1"}, 200)
 }
 
+// encodeResult marshals a worker result for node_runs, moving large values
+// into blobs.
+func (s *Server) encodeResult(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return s.Blobs.OffloadJSON(string(b))
+}
+
 func (s *Server) handleTaskLogs(w http.ResponseWriter, r *http.Request) {
 	runID := r.URL.Query().Get("run_id")
 	if runID == "" {
@@ -250,6 +361,9 @@ func (s *Server) handleTaskLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, ok := s.taskIn(w, r, run.TaskID); !ok {
+		return
+	}
 	if run.LogPath == "" {
 		writeJSON(w, map[string]string{"error": "no log path"}, 404)
 		return
@@ -279,7 +393,7 @@ func (s *Server) handleRegisterWorker(w http.ResponseWriter, r *http.Request) {
 	}
 	dec := json.NewDecoder(r.Body)
 	_ = dec.Decode(&payload)
-	_ = s.Store.RegisterWorker(store.WorkerInfo{ID: payload.ID, URL: payload.URL, Services: payload.Services, Load: 0, LastHeartbeat: time.Now().Unix(), Status: "online", Type: payload.Type})
+	_ = s.Store.RegisterWorker(store.WorkerInfo{ID: payload.ID, Namespace: namespaceOf(r), URL: payload.URL, Services: payload.Services, Load: 0, LastHeartbeat: time.Now().Unix(), Status: "online", Type: payload.Type})
 	writeJSON(w, map[string]string{"ok": "1"}, 200)
 }
 
@@ -303,14 +417,14 @@ func (s *Server) handleListWorkers(w http.ResponseWriter, r *http.Request) {
 		ttl = 15
 	}
 	_ = s.Store.RefreshWorkersStatus(ttl)
-	lst, _ := s.Store.ListWorkers(service, ttl)
+	lst, _ := s.Store.ListWorkers(namespaceOf(r), service, ttl)
 	writeJSON(w, lst, 200)
 }
 
 func (s *Server) handleAllocate(w http.ResponseWriter, r *http.Request) {
 	service := r.URL.Query().Get("service")
 	_ = s.Store.RefreshWorkersStatus(15)
-	lst, _ := s.Store.ListWorkers(service, 15)
+	lst, _ := s.Store.ListWorkers(namespaceOf(r), service, 15)
 	if len(lst) == 0 {
 		writeJSON(w, map[string]string{"error": "no worker"}, 500)
 		return
@@ -339,7 +453,7 @@ func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
 		}
 		dec := json.NewDecoder(r.Body)
 		_ = dec.Decode(&payload)
-		id, err := s.Store.CreateFlow(payload.Name, payload.Description)
+		id, err := s.Store.CreateFlow(namespaceOf(r), payload.Name, payload.Description)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
@@ -359,7 +473,7 @@ func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
 		}
 		offset := (page - 1) * pageSize
 
-		flows, total, err := s.Store.ListFlows(pageSize, offset)
+		flows, total, err := s.Store.ListFlows(namespaceOf(r), pageSize, offset)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
@@ -402,6 +516,20 @@ func (s *Server) handleFlowVersion(w http.ResponseWriter, r *http.Request) {
 			payload.DefinitionJSON = string(jsonBytes)
 		}
 
+		if _, ok := s.flowIn(w, r, payload.FlowID); !ok {
+			return
+		}
+		if payload.Status == "published" {
+			// Validate the source as given, so that issues point at its lines.
+			src := payload.DefinitionJSON
+			if payload.DefinitionYAML != "" {
+				src = payload.DefinitionYAML
+			}
+			if issues := engine.ValidateFlow([]byte(src)); issues.HasErrors() {
+				writeJSON(w, map[string]interface{}{"error": "invalid definition", "issues": issues}, 400)
+				return
+			}
+		}
 		id, err := s.Store.CreateFlowVersion(payload.FlowID, payload.Version, payload.DefinitionJSON, payload.Status)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
@@ -415,6 +543,9 @@ func (s *Server) handleFlowVersion(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, map[string]string{"error": "missing flow_id"}, 400)
 			return
 		}
+		if _, ok := s.flowIn(w, r, flowID); !ok {
+			return
+		}
 		versions, err := s.Store.ListFlowVersions(flowID)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
@@ -426,6 +557,29 @@ func (s *Server) handleFlowVersion(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"error": "method"}, 405)
 }
 
+// handleValidateFlow validates a definition without storing it and
+// returns its issues, errors and warnings.
+func (s *Server) handleValidateFlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, map[string]string{"error": "method"}, 405)
+		return
+	}
+	var payload struct {
+		DefinitionJSON string
+		DefinitionYAML string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, map[string]string{"error": "invalid body: " + err.Error()}, 400)
+		return
+	}
+	src := payload.DefinitionJSON
+	if payload.DefinitionYAML != "" {
+		src = payload.DefinitionYAML
+	}
+	issues := engine.ValidateFlow([]byte(src))
+	writeJSON(w, map[string]interface{}{"valid": !issues.HasErrors(), "issues": issues}, 200)
+}
+
 func (s *Server) handleGetFlowVersion(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
@@ -441,18 +595,37 @@ func (s *Server) handleGetFlowVersion(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
 	}
+	if _, ok := s.flowIn(w, r, fv.FlowID); !ok {
+		return
+	}
 	writeJSON(w, fv, 200)
 }
 
 func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		var payload struct {
-			FlowID     string
-			Version    int
-			ParamsJSON string
+			FlowID       string
+			Version      int
+			ParamsJSON   string
+			RequestID    string
+			SharedLimits *store.SharedLimits
 		}
 		dec := json.NewDecoder(r.Body)
 		_ = dec.Decode(&payload)
+		if payload.ParamsJSON == "" {
+			payload.ParamsJSON = "{}"
+		}
+		if !json.Valid([]byte(payload.ParamsJSON)) {
+			writeJSON(w, map[string]string{"error": "ParamsJSON is not valid JSON"}, 400)
+			return
+		}
+		requestID := r.Header.Get("Idempotency-Key")
+		if requestID == "" {
+			requestID = payload.RequestID
+		}
+		if _, ok := s.flowIn(w, r, payload.FlowID); !ok {
+			return
+		}
 		var fv store.FlowVersion
 		var err error
 		if payload.Version == 0 {
@@ -464,20 +637,40 @@ func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
 		}
-		var def struct{ Start string }
+		var def engine.FlowDef
 		_ = json.Unmarshal([]byte(fv.DefinitionJSON), &def)
 		if def.Start == "" {
 			writeJSON(w, map[string]string{"error": "no start"}, 400)
 			return
 		}
-		id, err := s.Store.CreateTask(fv.ID, payload.ParamsJSON, "", def.Start)
+		params, err := engine.PrepareParams(def, payload.ParamsJSON)
+		if err != nil {
+			writeJSON(w, map[string]string{"error": "invalid params: " + err.Error()}, 400)
+			return
+		}
+		id, created, err := s.Store.CreateTaskOnce(fv.ID, params, requestID, def.Start)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
 		}
-		writeJSON(w, map[string]string{"id": id}, 200)
+		limits := s.SharedLimits
+		if payload.SharedLimits != nil {
+			limits = *payload.SharedLimits
+		}
+		if created && limits != (store.SharedLimits{}) {
+			if err := s.Store.SetSharedLimits(id, limits); err != nil {
+				writeJSON(w, map[string]string{"error": err.Error()}, 500)
+				return
+			}
+		}
+		writeJSON(w, map[string]interface{}{"id": id, "created": created}, 200)
 		return
 	} else if r.Method == http.MethodGet {
+		qs := r.URL.Query()
+		if qs.Has("q") || qs.Has("sort") || qs.Has("cursor") || qs.Has("limit") {
+			s.searchTasks(w, r)
+			return
+		}
 		status := r.URL.Query().Get("status")
 		flowVersionID := r.URL.Query().Get("flow_version_id")
 		pageS := r.URL.Query().Get("page")
@@ -492,7 +685,7 @@ func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 		}
 		offset := (page - 1) * pageSize
 
-		tasks, total, err := s.Store.ListTasks(status, flowVersionID, pageSize, offset)
+		tasks, total, err := s.Store.ListTasks(namespaceOf(r), status, flowVersionID, pageSize, offset)
 		if err != nil {
 			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
@@ -508,14 +701,45 @@ func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"error": "method"}, 405)
 }
 
-func (s *Server) handleGetTask(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	t, err := s.Store.GetTask(id)
+// searchTasks serves GET /tasks?q=...&sort=...&limit=...&cursor=... with
+// cursor pagination. status and flow_version_id are accepted as shorthand
+// filters. Results are always limited to the request's namespace.
+func (s *Server) searchTasks(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	filters, err := store.ParseTaskFilters(qs.Get("q"))
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, map[string]string{"error": "not found"}, 404)
-			return
+		writeJSON(w, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+	for _, k := range []string{"status", "flow_version_id", "flow_id"} {
+		if v := qs.Get(k); v != "" {
+			filters = append(filters, store.TaskFilter{Field: k, Op: "=", Value: v})
 		}
+	}
+	filters = append(filters, store.TaskFilter{Field: "namespace", Op: "=", Value: namespaceOf(r)})
+	limit, _ := strconv.Atoi(qs.Get("limit"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+	page, err := s.Store.SearchTasks(store.TaskQuery{Filters: filters, Sort: qs.Get("sort"), Limit: limit, Cursor: qs.Get("cursor")})
+	if errors.Is(err, store.ErrBadQuery) {
+		writeJSON(w, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
+	writeJSON(w, page, 200)
+}
+
+func (s *Server) handleGetTask(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.taskIn(w, r, r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+	var err error
+	if t.SharedJSON, err = s.Blobs.ResolveJSON(t.SharedJSON); err != nil {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
 	}
@@ -528,16 +752,22 @@ func (s *Server) handleRunOnce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := r.URL.Query().Get("id")
+	if _, ok := s.taskIn(w, r, id); !ok {
+		return
+	}
 	eng := engine.New(s.Store)
+	eng.Blobs = s.Blobs
 	owner := r.URL.Query().Get("owner")
 	if owner == "" {
 		owner = "manual"
 	}
 	eng.Owner = owner
-	err := eng.RunOnce(id)
+	ctx, stop := eng.WatchCancel(r.Context(), id, 500*time.Millisecond)
+	defer stop()
+	err := eng.RunOnce(ctx, id)
 	if err != nil {
 		code := 500
-		if err.Error() == "lease_mismatch" || err.Error() == "lease_expired" {
+		if err.Error() == "lease_mismatch" || err.Error() == "lease_expired" || errors.Is(err, store.ErrLeaseLost) {
 			code = 409
 		}
 		writeJSON(w, map[string]string{"error": err.Error()}, code)
@@ -552,20 +782,77 @@ func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := r.URL.Query().Get("id")
-	_ = s.Store.UpdateTaskStatus(id, "canceling")
+	if _, ok := s.taskIn(w, r, id); !ok {
+		return
+	}
+	if err := s.Store.RequestCancel(id, store.TaskEvent{Type: "cancel", Actor: actorOf(r)}); err != nil {
+		code := 500
+		if errors.Is(err, store.ErrFinished) {
+			code = 409
+		}
+		writeJSON(w, map[string]string{"error": err.Error()}, code)
+		return
+	}
 	writeJSON(w, map[string]string{"ok": "1"}, 200)
 }
 
 func (s *Server) handleTaskRuns(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("task_id")
+	if _, ok := s.taskIn(w, r, id); !ok {
+		return
+	}
 	runs, err := s.Store.ListNodeRuns(id)
 	if err != nil {
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
 		return
 	}
+	for i := range runs {
+		if runs[i].ExecInputJSON, err = s.Blobs.ResolveJSON(runs[i].ExecInputJSON); err != nil {
+			break
+		}
+		if runs[i].ExecOutputJSON, err = s.Blobs.ResolveJSON(runs[i].ExecOutputJSON); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
 	writeJSON(w, runs, 200)
 }
 
+func (s *Server) handleTaskEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("task_id")
+	if _, ok := s.taskIn(w, r, id); !ok {
+		return
+	}
+	evs, err := s.Store.ListTaskEvents(id)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
+	writeJSON(w, evs, 200)
+}
+
+func (s *Server) handleTaskState(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("task_id")
+	if _, ok := s.taskIn(w, r, id); !ok {
+		return
+	}
+	states, err := s.Store.ListNodeStates(id)
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
+	for i := range states {
+		if states[i].StateJSON, err = s.Blobs.ResolveJSON(states[i].StateJSON); err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, 500)
+			return
+		}
+	}
+	writeJSON(w, states, 200)
+}
+
 func (s *Server) handleTaskSignal(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, map[string]string{"error": "method"}, 405)
@@ -582,22 +869,231 @@ func (s *Server) handleTaskSignal(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, map[string]string{"error": "bad request"}, 400)
 		return
 	}
-	t, err := s.Store.GetTask(payload.TaskID)
+	if _, ok := s.taskIn(w, r, payload.TaskID); !ok {
+		return
+	}
+	v, err := s.Blobs.Offload(payload.Value)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, map[string]string{"error": "not found"}, 404)
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
+	vb, _ := json.Marshal(v)
+	kb, _ := json.Marshal(map[string]string{"key": payload.Key})
+	s.patchShared(w, payload.TaskID, []store.SharedOp{{Op: "set", Key: payload.Key, Value: vb}}, store.TaskEvent{Type: "signal", Actor: actorOf(r), DataJSON: string(kb)})
+}
+
+// handleTaskShared serves POST /api/tasks/shared, which applies set,
+// delete and merge ops to individual keys of a task's shared state.
+func (s *Server) handleTaskShared(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, map[string]string{"error": "method"}, 405)
+		return
+	}
+	var payload struct {
+		TaskID string           `json:"task_id"`
+		Ops    []store.SharedOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.TaskID == "" || len(payload.Ops) == 0 {
+		writeJSON(w, map[string]string{"error": "bad request"}, 400)
+		return
+	}
+	if _, ok := s.taskIn(w, r, payload.TaskID); !ok {
+		return
+	}
+	keys := make([]string, 0, len(payload.Ops))
+	for i, op := range payload.Ops {
+		keys = append(keys, op.Key)
+		if op.Op != "set" || s.Blobs == nil {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(op.Value, &v); err != nil {
+			continue // rejected by the store
+		}
+		v, err := s.Blobs.Offload(v)
+		if err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, 500)
 			return
 		}
+		payload.Ops[i].Value, _ = json.Marshal(v)
+	}
+	kb, _ := json.Marshal(map[string][]string{"keys": keys})
+	s.patchShared(w, payload.TaskID, payload.Ops, store.TaskEvent{Actor: actorOf(r), DataJSON: string(kb)})
+}
+
+// patchShared applies ops to a task's shared state and writes the response.
+func (s *Server) patchShared(w http.ResponseWriter, taskID string, ops []store.SharedOp, ev store.TaskEvent) {
+	err := s.Store.PatchTaskShared(taskID, ops, ev)
+	switch {
+	case err == nil:
+		writeJSON(w, map[string]string{"ok": "1"}, 200)
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSON(w, map[string]string{"error": "not found"}, 404)
+	case errors.Is(err, store.ErrBadShared):
+		writeJSON(w, map[string]string{"error": err.Error()}, 400)
+	case errors.Is(err, store.ErrSharedLimit):
+		writeJSON(w, map[string]string{"error": err.Error()}, 413)
+	default:
 		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+	}
+}
+
+// handleBlob serves GET /api/blobs?task_id=...&ref=sha256:... with the
+// referenced value. Blobs are content-addressed and shared by all
+// namespaces, so the blob is only served if the task, which must be in the
+// caller's namespace, refers to it.
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if s.Blobs == nil {
+		writeJSON(w, map[string]string{"error": "blob store not configured"}, 404)
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	t, ok := s.taskIn(w, r, r.URL.Query().Get("task_id"))
+	if !ok {
+		return
+	}
+	used, err := s.taskUsesBlob(t, ref)
+	if err == nil && !used {
+		err = blob.ErrNotFound
+	}
+	var b []byte
+	if err == nil {
+		b, err = s.Blobs.Store.Get(ref)
+	}
+	if err != nil {
+		code := 500
+		if errors.Is(err, blob.ErrNotFound) {
+			code = 404
+		}
+		writeJSON(w, map[string]string{"error": err.Error()}, code)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// taskUsesBlob reports whether ref is referenced by t's shared state, node
+// runs or node states, directly or from inside another blob.
+func (s *Server) taskUsesBlob(t store.Task, ref string) (bool, error) {
+	docs := []string{t.SharedJSON}
+	runs, err := s.Store.ListNodeRuns(t.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, nr := range runs {
+		docs = append(docs, nr.ExecInputJSON, nr.ExecOutputJSON)
+	}
+	states, err := s.Store.ListNodeStates(t.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, ns := range states {
+		docs = append(docs, ns.StateJSON)
+	}
+	for _, js := range docs {
+		if !strings.Contains(js, `"`+blob.RefKey+`"`) {
+			continue
+		}
+		var v interface{}
+		if json.Unmarshal([]byte(js), &v) != nil {
+			continue
+		}
+		if ok, err := s.Blobs.Reaches(v, ref); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (s *Server) handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ps, err := s.Store.ListRetentionPolicies(namespaceOf(r))
+		if err != nil {
+			writeJSON(w, map[string]string{"error": err.Error()}, 500)
+			return
+		}
+		writeJSON(w, ps, 200)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, map[string]string{"error": "method"}, 405)
+		return
+	}
+	var p store.RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 400)
+		return
+	}
+	ok := false
+	for _, st := range store.RetentionStatuses {
+		if p.Status == st {
+			ok = true
+		}
+	}
+	if !ok {
+		writeJSON(w, map[string]string{"error": "status must be one of " + strings.Join(store.RetentionStatuses, ", ")}, 400)
 		return
 	}
-	var shared map[string]interface{}
-	_ = json.Unmarshal([]byte(t.SharedJSON), &shared)
-	if shared == nil {
-		shared = map[string]interface{}{}
+	// A policy without a flow covers every flow of the caller's namespace
+	// and no other.
+	p.Namespace = namespaceOf(r)
+	if p.FlowID != "" {
+		if _, ok := s.flowIn(w, r, p.FlowID); !ok {
+			return
+		}
+	}
+	if err := s.Store.SetRetentionPolicy(p); err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
 	}
-	shared[payload.Key] = payload.Value
-	sb, _ := json.Marshal(shared)
-	_ = s.Store.UpdateTaskProgress(payload.TaskID, t.CurrentNodeKey, "", string(sb), t.StepCount)
 	writeJSON(w, map[string]string{"ok": "1"}, 200)
 }
+
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if s.Archive == nil {
+		writeJSON(w, map[string]string{"error": "archive not configured"}, 404)
+		return
+	}
+	es, err := s.Archive.List(r.URL.Query().Get("flow_id"))
+	if err != nil {
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+		return
+	}
+	out := []archive.Entry{}
+	for _, e := range es {
+		if e.Namespace == namespaceOf(r) {
+			out = append(out, e)
+		}
+	}
+	writeJSON(w, out, 200)
+}
+
+func (s *Server) handleArchiveRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, map[string]string{"error": "method"}, 405)
+		return
+	}
+	if s.Archive == nil {
+		writeJSON(w, map[string]string{"error": "archive not configured"}, 404)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	rec, err := s.Archive.Find(id)
+	if err == nil && store.Namespace(rec.Task.Namespace) != namespaceOf(r) {
+		err = archive.ErrNotArchived
+	}
+	if err == nil {
+		err = s.Archive.Restore(id)
+	}
+	switch {
+	case errors.Is(err, archive.ErrNotArchived):
+		writeJSON(w, map[string]string{"error": err.Error()}, 404)
+	case errors.Is(err, store.ErrConflict):
+		writeJSON(w, map[string]string{"error": "task already exists"}, 409)
+	case err != nil:
+		writeJSON(w, map[string]string{"error": err.Error()}, 500)
+	default:
+		writeJSON(w, map[string]string{"ok": "1"}, 200)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/engine"
+	"github.com/nuknal/PocketFlowGo/pkg/store/memstore"
+)
+
+func TestCancelFinishedTask(t *testing.T) {
+	s := memstore.New()
+	e := engine.New(s)
+	e.RegisterFunc("work", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		return "done", nil
+	})
+	hooks := 0
+	e.RegisterFunc("finally", func(ctx context.Context, in interface{}, p map[string]interface{}) (interface{}, error) {
+		hooks++
+		return nil, nil
+	})
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a","nodes":{"a":{"kind":"executor","exec_type":"local_func","func":"work"}},"edges":[],"hooks":{"finally":[{"exec_type":"local_func","func":"finally"}]}}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	for i := 0; i < 2; i++ {
+		if err := e.RunOnce(context.Background(), tid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tk, _ := s.GetTask(tid)
+	runs, _ := s.ListNodeRuns(tid)
+	if tk.Status != "completed" || hooks != 1 {
+		t.Fatalf("task %s hooks %d", tk.Status, hooks)
+	}
+
+	mux := http.NewServeMux()
+	(&Server{Store: s}).RegisterRoutes(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/tasks/cancel?id="+tid, nil))
+	if rec.Code != 409 {
+		t.Fatalf("cancel completed task: %d %s", rec.Code, rec.Body)
+	}
+	if err := e.RunOnce(context.Background(), tid); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := s.GetTask(tid)
+	afterRuns, _ := s.ListNodeRuns(tid)
+	if after.Status != "completed" || after.Revision != tk.Revision || len(afterRuns) != len(runs) || hooks != 1 {
+		t.Fatalf("task %s rev %d runs %d hooks %d", after.Status, after.Revision, len(afterRuns), hooks)
+	}
+
+	// A task that has not finished is canceled as before.
+	tid2, _ := s.CreateTask(vid, "{}", "", "a")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/tasks/cancel?id="+tid2, nil))
+	if tk, _ := s.GetTask(tid2); rec.Code != 200 || tk.Status != "canceling" {
+		t.Fatalf("cancel pending task: %d %s", rec.Code, tk.Status)
+	}
+}
+
+func TestBlobNamespace(t *testing.T) {
+	s := memstore.New()
+	srv := &Server{Store: s, Blobs: &blob.Codec{Store: &blob.FS{Dir: t.TempDir()}, Threshold: 10}}
+	mux := http.NewServeMux()
+	srv.RegisterRoutes(mux)
+	fid, _ := s.CreateFlow("acme", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	other, _ := s.CreateTask(vid, "{}", "", "a")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/tasks/shared", strings.NewReader(`{"task_id":"`+tid+`","ops":[{"op":"set","key":"k","value":"`+strings.Repeat("x", 20)+`"}]}`))
+	req.Header.Set("X-Namespace", "acme")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("set shared: %d %s", rec.Code, rec.Body)
+	}
+	tk, _ := s.GetTask(tid)
+	var shared map[string]interface{}
+	_ = json.Unmarshal([]byte(tk.SharedJSON), &shared)
+	ref, ok := blob.RefOf(shared["k"])
+	if !ok {
+		t.Fatalf("value not offloaded: %s", tk.SharedJSON)
+	}
+
+	for _, c := range []struct {
+		ns, task string
+		code     int
+	}{
+		{"acme", tid, 200},
+		{"default", tid, 404}, // task in another namespace
+		{"acme", other, 404},  // task does not use the blob
+		{"acme", "", 404},     // no task
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/blobs?task_id="+c.task+"&ref="+ref, nil)
+		req.Header.Set("X-Namespace", c.ns)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Fatalf("%+v: %d %s", c, rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Package backend selects and opens a store.Store implementation from a DSN.
+package backend
+
+import (
+	"os"
+	"strings"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/migrate"
+	"github.com/nuknal/PocketFlowGo/pkg/store/pgstore"
+	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
+)
+
+// Open opens the Store described by dsn.
+// DSNs starting with postgres:// or postgresql:// select PostgreSQL.
+// Anything else is a SQLite path, optionally prefixed with sqlite://.
+func Open(dsn string) (store.Store, error) {
+	if IsPostgres(dsn) {
+		return pgstore.OpenPostgres(dsn)
+	}
+	return sqlstore.OpenSQLite(SQLitePath(dsn))
+}
+
+// Migrator opens the database described by dsn without changing its schema
+// and returns its migrator. Close m.DB when done.
+func Migrator(dsn string) (*migrate.Migrator, error) {
+	if IsPostgres(dsn) {
+		s, err := pgstore.ConnectPostgres(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s.Migrator(), nil
+	}
+	s, err := sqlstore.ConnectSQLite(SQLitePath(dsn))
+	if err != nil {
+		return nil, err
+	}
+	return s.Migrator(), nil
+}
+
+// DSNFromEnv returns SCHEDULER_DSN, falling back to the legacy
+// SCHEDULER_DB and then to scheduler.db.
+func DSNFromEnv() string {
+	if dsn := os.Getenv("SCHEDULER_DSN"); dsn != "" {
+		return dsn
+	}
+	if dsn := os.Getenv("SCHEDULER_DB"); dsn != "" {
+		return dsn
+	}
+	return "scheduler.db"
+}
+
+// IsPostgres reports whether dsn refers to a PostgreSQL database.
+func IsPostgres(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// SQLitePath strips an optional sqlite:// or sqlite3:// scheme from dsn.
+func SQLitePath(dsn string) string {
+	for _, p := range []string{"sqlite://", "sqlite3://"} {
+		if strings.HasPrefix(dsn, p) {
+			return strings.TrimPrefix(dsn, p)
+		}
+	}
+	return dsn
+}
@@ -0,0 +1,423 @@
+// Package cryptstore wraps a store.Store so that task params, shared state
+// values, node run input and output, node states and queue inputs are
+// encrypted at rest. Writes are
+// encoded before they reach the backend and reads are decoded before they
+// are returned, so callers only ever see plaintext.
+package cryptstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// Fields lists the stored columns Store encrypts. Their content is opaque
+// to the backend, so it cannot be searched.
+var Fields = []string{"tasks.params_json", "task_shared.value_json", "node_runs.exec_input_json", "node_runs.exec_output_json", "node_states.state_json", "task_queue.input_json"}
+
+// runFields are the node run map keys that are encrypted.
+var runFields = []string{"exec_input_json", "exec_output_json"}
+
+// Store encrypts the fields in Fields with Codec on their way into the
+// wrapped Store and decrypts them on the way out. Values stored in
+// plaintext before encryption was enabled are read as they are, if Codec
+// passes them through, until RecodeTask re-encrypts them.
+type Store struct {
+	store.Store
+	Codec store.ValueCodec
+}
+
+// New wraps s.
+func New(s store.Store, codec store.ValueCodec) *Store {
+	return &Store{Store: s, Codec: codec}
+}
+
+// Encrypted reports whether a tasks column, as named by
+// store.TaskFilter.JSONPath, is encrypted.
+func (s *Store) Encrypted(column string) bool {
+	return column == "params_json" || column == "shared_json"
+}
+
+func (s *Store) encode(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	return s.Codec.Encode(v)
+}
+
+// encodeShared encodes every value of a shared state document.
+func (s *Store) encodeShared(doc string) (string, error) {
+	if doc == "" {
+		return "", nil
+	}
+	vals, err := store.SplitShared(doc)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range vals {
+		if vals[k], err = s.Codec.Encode(v); err != nil {
+			return "", err
+		}
+	}
+	return store.JoinShared(vals), nil
+}
+
+func (s *Store) decodeShared(doc string) (string, error) {
+	if doc == "" {
+		return "", nil
+	}
+	vals, err := store.SplitShared(doc)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range vals {
+		if vals[k], err = s.Codec.Decode(v); err != nil {
+			return "", fmt.Errorf("shared key %q: %w", k, err)
+		}
+	}
+	return store.JoinShared(vals), nil
+}
+
+// encodeRun returns a copy of a node run's fields with runFields encoded.
+func (s *Store) encodeRun(nr map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(nr))
+	for k, v := range nr {
+		out[k] = v
+	}
+	for _, f := range runFields {
+		v, ok := out[f].(string)
+		if !ok {
+			continue
+		}
+		var err error
+		if out[f], err = s.encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) decodeTask(t store.Task, err error) (store.Task, error) {
+	if err != nil || t.ID == "" {
+		return t, err
+	}
+	if t.ParamsJSON, err = s.Codec.Decode(t.ParamsJSON); err != nil {
+		return store.Task{}, fmt.Errorf("task %s params: %w", t.ID, err)
+	}
+	if t.SharedJSON, err = s.decodeShared(t.SharedJSON); err != nil {
+		return store.Task{}, fmt.Errorf("task %s: %w", t.ID, err)
+	}
+	return t, nil
+}
+
+func (s *Store) decodeTasks(ts []store.Task, err error) ([]store.Task, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range ts {
+		if ts[i], err = s.decodeTask(ts[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+func (s *Store) decodeRun(r store.NodeRun, err error) (store.NodeRun, error) {
+	if err != nil {
+		return r, err
+	}
+	if r.ExecInputJSON, err = s.Codec.Decode(r.ExecInputJSON); err != nil {
+		return store.NodeRun{}, fmt.Errorf("run %s input: %w", r.ID, err)
+	}
+	if r.ExecOutputJSON, err = s.Codec.Decode(r.ExecOutputJSON); err != nil {
+		return store.NodeRun{}, fmt.Errorf("run %s output: %w", r.ID, err)
+	}
+	return r, nil
+}
+
+func (s *Store) decodeState(ns store.NodeState, err error) (store.NodeState, error) {
+	if err != nil {
+		return ns, err
+	}
+	if ns.StateJSON, err = s.Codec.Decode(ns.StateJSON); err != nil {
+		return store.NodeState{}, fmt.Errorf("task %s node %s state: %w", ns.TaskID, ns.NodeKey, err)
+	}
+	return ns, nil
+}
+
+func (s *Store) decodeQueue(q store.QueueTask, err error) (store.QueueTask, error) {
+	if err != nil || q.ID == "" {
+		return q, err
+	}
+	if q.InputJSON, err = s.Codec.Decode(q.InputJSON); err != nil {
+		return store.QueueTask{}, fmt.Errorf("queue entry %s input: %w", q.ID, err)
+	}
+	return q, nil
+}
+
+// withCodec returns copies of ops that store their values through Codec.
+func (s *Store) withCodec(ops []store.SharedOp) []store.SharedOp {
+	out := make([]store.SharedOp, len(ops))
+	for i, op := range ops {
+		op.Codec = s.Codec
+		out[i] = op
+	}
+	return out
+}
+
+func (s *Store) CreateTask(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, error) {
+	p, err := s.encode(paramsJSON)
+	if err != nil {
+		return "", err
+	}
+	return s.Store.CreateTask(flowVersionID, p, requestID, startNode)
+}
+
+func (s *Store) CreateTaskOnce(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, bool, error) {
+	p, err := s.encode(paramsJSON)
+	if err != nil {
+		return "", false, err
+	}
+	return s.Store.CreateTaskOnce(flowVersionID, p, requestID, startNode)
+}
+
+func (s *Store) GetTask(id string) (store.Task, error) {
+	return s.decodeTask(s.Store.GetTask(id))
+}
+
+func (s *Store) LeaseNextTask(owner string, ttlSec int64) (store.Task, error) {
+	return s.decodeTask(s.Store.LeaseNextTask(owner, ttlSec))
+}
+
+func (s *Store) UpdateTaskProgress(id string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	sh, err := s.encodeShared(sharedJSON)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateTaskProgress(id, currentNode, lastAction, sh, stepCount)
+}
+
+func (s *Store) UpdateTaskProgressOwned(id string, owner string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	sh, err := s.encodeShared(sharedJSON)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateTaskProgressOwned(id, owner, currentNode, lastAction, sh, stepCount)
+}
+
+func (s *Store) TransitionTask(id string, owner string, tr store.TaskTransition) error {
+	var err error
+	if tr.SharedJSON, err = s.encodeShared(tr.SharedJSON); err != nil {
+		return err
+	}
+	tr.Shared = s.withCodec(tr.Shared)
+	runs := make([]map[string]interface{}, len(tr.NodeRuns))
+	for i, nr := range tr.NodeRuns {
+		if runs[i], err = s.encodeRun(nr); err != nil {
+			return err
+		}
+	}
+	tr.NodeRuns = runs
+	states := make([]store.NodeState, len(tr.NodeStates))
+	for i, ns := range tr.NodeStates {
+		// An empty StateJSON deletes the state and stays empty.
+		if ns.StateJSON, err = s.encode(ns.StateJSON); err != nil {
+			return err
+		}
+		states[i] = ns
+	}
+	tr.NodeStates = states
+	return s.Store.TransitionTask(id, owner, tr)
+}
+
+func (s *Store) UpdateTaskShared(id string, revision int64, sharedJSON string, ev store.TaskEvent) error {
+	sh, err := s.encodeShared(sharedJSON)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateTaskShared(id, revision, sh, ev)
+}
+
+func (s *Store) PatchTaskShared(id string, ops []store.SharedOp, ev store.TaskEvent) error {
+	return s.Store.PatchTaskShared(id, s.withCodec(ops), ev)
+}
+
+func (s *Store) ListTasks(namespace string, status string, flowVersionID string, limit, offset int) ([]store.Task, int64, error) {
+	ts, total, err := s.Store.ListTasks(namespace, status, flowVersionID, limit, offset)
+	ts, err = s.decodeTasks(ts, err)
+	return ts, total, err
+}
+
+// SearchTasks refuses filters on encrypted JSON paths with an error
+// wrapping store.ErrBadQuery.
+func (s *Store) SearchTasks(q store.TaskQuery) (store.TaskPage, error) {
+	for _, f := range q.Filters {
+		if col, _, ok := f.JSONPath(); ok && s.Encrypted(col) {
+			return store.TaskPage{}, fmt.Errorf("%w: %s is encrypted and cannot be searched", store.ErrBadQuery, f.Field)
+		}
+	}
+	page, err := s.Store.SearchTasks(q)
+	page.Tasks, err = s.decodeTasks(page.Tasks, err)
+	return page, err
+}
+
+func (s *Store) ListExpiredTasks(now int64, limit int) ([]store.Task, error) {
+	return s.decodeTasks(s.Store.ListExpiredTasks(now, limit))
+}
+
+// RestoreTask takes t and runs as read from this Store, in plaintext, and
+// encrypts them again.
+func (s *Store) RestoreTask(t store.Task, runs []store.NodeRun, events []store.TaskEvent) error {
+	var err error
+	if t.ParamsJSON, err = s.encode(t.ParamsJSON); err != nil {
+		return err
+	}
+	if t.SharedJSON, err = s.encodeShared(t.SharedJSON); err != nil {
+		return err
+	}
+	enc := make([]store.NodeRun, len(runs))
+	for i, r := range runs {
+		if r.ExecInputJSON, err = s.encode(r.ExecInputJSON); err != nil {
+			return err
+		}
+		if r.ExecOutputJSON, err = s.encode(r.ExecOutputJSON); err != nil {
+			return err
+		}
+		enc[i] = r
+	}
+	return s.Store.RestoreTask(t, enc, events)
+}
+
+func (s *Store) SaveNodeRun(nr map[string]interface{}) error {
+	nr, err := s.encodeRun(nr)
+	if err != nil {
+		return err
+	}
+	return s.Store.SaveNodeRun(nr)
+}
+
+func (s *Store) CreateNodeRun(nr map[string]interface{}) error {
+	nr, err := s.encodeRun(nr)
+	if err != nil {
+		return err
+	}
+	return s.Store.CreateNodeRun(nr)
+}
+
+func (s *Store) UpdateNodeRun(id string, updates map[string]interface{}) error {
+	updates, err := s.encodeRun(updates)
+	if err != nil {
+		return err
+	}
+	return s.Store.UpdateNodeRun(id, updates)
+}
+
+func (s *Store) ListNodeRuns(taskID string) ([]store.NodeRun, error) {
+	runs, err := s.Store.ListNodeRuns(taskID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		if runs[i], err = s.decodeRun(runs[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+func (s *Store) GetNodeRun(id string) (store.NodeRun, error) {
+	return s.decodeRun(s.Store.GetNodeRun(id))
+}
+
+func (s *Store) GetNodeState(taskID string, nodeKey string) (store.NodeState, error) {
+	return s.decodeState(s.Store.GetNodeState(taskID, nodeKey))
+}
+
+func (s *Store) ListNodeStates(taskID string) ([]store.NodeState, error) {
+	states, err := s.Store.ListNodeStates(taskID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range states {
+		if states[i], err = s.decodeState(states[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+func (s *Store) RestoreNodeState(ns store.NodeState) error {
+	var err error
+	if ns.StateJSON, err = s.encode(ns.StateJSON); err != nil {
+		return err
+	}
+	return s.Store.RestoreNodeState(ns)
+}
+
+func (s *Store) EnqueueTask(taskID, nodeKey, service, inputJSON string) (string, error) {
+	in, err := s.encode(inputJSON)
+	if err != nil {
+		return "", err
+	}
+	return s.Store.EnqueueTask(taskID, nodeKey, service, in)
+}
+
+func (s *Store) PollQueue(namespace string, workerID string, services []string, timeoutSec int64) (store.QueueTask, error) {
+	return s.decodeQueue(s.Store.PollQueue(namespace, workerID, services, timeoutSec))
+}
+
+func (s *Store) GetQueueTask(id string) (store.QueueTask, error) {
+	return s.decodeQueue(s.Store.GetQueueTask(id))
+}
+
+func (s *Store) ListQueueTasks(taskID string) ([]store.QueueTask, error) {
+	qs, err := s.Store.ListQueueTasks(taskID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range qs {
+		if qs[i], err = s.decodeQueue(qs[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return qs, nil
+}
+
+func (s *Store) RestoreQueueTask(q store.QueueTask) error {
+	var err error
+	if q.InputJSON, err = s.encode(q.InputJSON); err != nil {
+		return err
+	}
+	return s.Store.RestoreQueueTask(q)
+}
+
+// Rotate passes the encrypted fields of every task in s, the unwrapped
+// backend, through fn with RecodeTask. fn is typically crypt.Cipher.Rotate,
+// which moves values to the current key and encrypts plaintext. Tasks
+// deleted meanwhile are skipped. It returns the number of tasks recoded.
+func Rotate(s store.Store, fn func(stored string) (string, error)) (int, error) {
+	n := 0
+	q := store.TaskQuery{Sort: "created_at", Limit: 200}
+	for {
+		page, err := s.SearchTasks(q)
+		if err != nil {
+			return n, err
+		}
+		for _, t := range page.Tasks {
+			err := s.RecodeTask(t.ID, fn)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return n, fmt.Errorf("task %s: %w", t.ID, err)
+			}
+			n++
+		}
+		if page.NextCursor == "" {
+			return n, nil
+		}
+		q.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,250 @@
+package cryptstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/blob"
+	"github.com/nuknal/PocketFlowGo/pkg/crypt"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/sqlstore"
+)
+
+func TestEncryptedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys.json")
+	if _, err := crypt.AddKey(keys); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := crypt.LoadKeyFile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &crypt.Cipher{Keys: ring}
+	raw, err := sqlstore.OpenSQLite(filepath.Join(dir, "s.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(raw, c)
+
+	// A task written before encryption was turned on.
+	fid, _ := raw.CreateFlow("", "f", "")
+	vid, _ := raw.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	old, _ := raw.CreateTask(vid, `{"ssn":"old.secret"}`, "", "a")
+
+	tid, err := s.CreateTask(vid, `{"ssn":"123.45"}`, "", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransitionTask(tid, "", store.TaskTransition{Status: "running", CurrentNode: "a", SharedJSON: `{"card":"42.42","n":1}`, StepCount: 1,
+		NodeRuns:   []map[string]interface{}{{"task_id": tid, "node_key": "a", "attempt_no": 1, "status": "ok", "prep_json": "{}", "exec_input_json": `"42.42"`, "exec_output_json": `{"token":"tok.9"}`, "error_text": "", "action": "", "started_at": int64(1), "finished_at": int64(1), "worker_id": "w", "worker_url": "u"}},
+		NodeStates: []store.NodeState{{NodeKey: "a", Kind: "foreach", Version: 1, StateJSON: `{"done":{"0":"77.77"}}`}}}); err != nil {
+		t.Fatal(err)
+	}
+	qid, err := s.EnqueueTask(tid, "a", "svc", `{"card":"55.55"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PatchTaskShared(tid, []store.SharedOp{{Op: "merge", Key: "card", Value: []byte(`{"last4":"42.42"}`)}, {Op: "set", Key: "m", Value: []byte(`{"pin":"99.99"}`)}}, store.TaskEvent{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetTask(tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ParamsJSON != `{"ssn":"123.45"}` || got.SharedJSON != `{"card":{"last4":"42.42"},"m":{"pin":"99.99"},"n":1}` {
+		t.Fatalf("decrypted task %+v", got)
+	}
+	runs, err := s.ListNodeRuns(tid)
+	if err != nil || len(runs) != 1 || runs[0].ExecInputJSON != `"42.42"` || runs[0].ExecOutputJSON != `{"token":"tok.9"}` {
+		t.Fatalf("decrypted runs %+v %v", runs, err)
+	}
+	if legacy, err := s.GetTask(old); err != nil || legacy.ParamsJSON != `{"ssn":"old.secret"}` {
+		t.Fatalf("plaintext task %+v %v", legacy, err)
+	}
+	if ns, err := s.GetNodeState(tid, "a"); err != nil || ns.StateJSON != `{"done":{"0":"77.77"}}` {
+		t.Fatalf("decrypted node state %+v %v", ns, err)
+	}
+	if q, err := s.PollQueue("", "w", []string{"svc"}, 60); err != nil || q.ID != qid || q.InputJSON != `{"card":"55.55"}` {
+		t.Fatalf("decrypted queue entry %+v %v", q, err)
+	}
+
+	// Nothing readable reaches the database.
+	dump := func() string {
+		var b strings.Builder
+		for _, q := range []string{"SELECT params_json FROM tasks", "SELECT value_json FROM task_shared", "SELECT exec_input_json || exec_output_json FROM node_runs", "SELECT state_json FROM node_states", "SELECT input_json FROM task_queue"} {
+			rows, err := raw.DB.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var v string
+				_ = rows.Scan(&v)
+				b.WriteString(v)
+			}
+			rows.Close()
+		}
+		return b.String()
+	}
+	for _, secret := range []string{"123.45", "42.42", "99.99", "tok.9", "77.77", "55.55"} {
+		if strings.Contains(dump(), secret) {
+			t.Fatalf("%q stored in plaintext", secret)
+		}
+	}
+
+	if _, err := s.SearchTasks(store.TaskQuery{Filters: []store.TaskFilter{{Field: "$params.ssn", Op: "=", Value: "123.45"}}}); !errors.Is(err, store.ErrBadQuery) {
+		t.Fatalf("search on encrypted path: %v", err)
+	}
+	if page, err := s.SearchTasks(store.TaskQuery{Filters: []store.TaskFilter{{Field: "status", Op: "=", Value: "running"}}}); err != nil || len(page.Tasks) != 1 || page.Tasks[0].ParamsJSON != `{"ssn":"123.45"}` {
+		t.Fatalf("search %+v %v", page, err)
+	}
+
+	// Rotating moves everything, the plaintext task included, to the new
+	// key; the old key can then be dropped.
+	k1 := ring.Current
+	k2, err := crypt.AddKey(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = crypt.LoadKeyFile(keys); err != nil {
+		t.Fatal(err)
+	}
+	c.Keys = ring
+	n, err := Rotate(raw, c.Rotate)
+	if err != nil || n != 2 {
+		t.Fatalf("rotate %d %v", n, err)
+	}
+	if strings.Contains(dump(), "old.secret") || strings.Contains(dump(), k1+":") || !strings.Contains(dump(), k2+":") {
+		t.Fatal("values left behind by rotation")
+	}
+	delete(ring.Keys, k1)
+	if got, err := s.GetTask(tid); err != nil || got.SharedJSON != `{"card":{"last4":"42.42"},"m":{"pin":"99.99"},"n":1}` {
+		t.Fatalf("after rotation %+v %v", got, err)
+	}
+	if legacy, err := s.GetTask(old); err != nil || legacy.ParamsJSON != `{"ssn":"old.secret"}` {
+		t.Fatalf("legacy after rotation %+v %v", legacy, err)
+	}
+	if states, err := s.ListNodeStates(tid); err != nil || len(states) != 1 || states[0].StateJSON != `{"done":{"0":"77.77"}}` {
+		t.Fatalf("node states after rotation %+v %v", states, err)
+	}
+	if qs, err := s.ListQueueTasks(tid); err != nil || len(qs) != 1 || qs[0].InputJSON != `{"card":"55.55"}` {
+		t.Fatalf("queue after rotation %+v %v", qs, err)
+	}
+}
+
+func TestBlobsEncryptedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys.json")
+	k1, err := crypt.AddKey(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := crypt.LoadKeyFile(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &crypt.Cipher{Keys: ring}
+	raw, err := sqlstore.OpenSQLite(filepath.Join(dir, "s.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(raw, c)
+	blobDir := filepath.Join(dir, "blobs")
+	codec := &blob.Codec{Store: &blob.FS{Dir: blobDir, Sealer: c}, Threshold: 64}
+
+	// A blob written before encryption was turned on.
+	legacy, err := (&blob.FS{Dir: blobDir}).Put([]byte(`"old.secret"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := strings.Repeat("4242.", 20)
+	shared, err := codec.OffloadJSON(`{"card":"` + secret + `","n":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(`"` + secret + `"`))
+	if strings.Contains(shared, secret) || strings.Contains(shared, hex.EncodeToString(sum[:])) || !strings.Contains(shared, `"hmac-sha256:`+k1+`:`) {
+		t.Fatalf("offloaded shared state %s", shared)
+	}
+	if again, _ := codec.OffloadJSON(`{"card":"` + secret + `","n":1}`); again != shared {
+		t.Fatalf("same value, different reference: %s %s", shared, again)
+	}
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	tid, _ := s.CreateTask(vid, "{}", "", "a")
+	if err := s.TransitionTask(tid, "", store.TaskTransition{Status: "running", CurrentNode: "a", SharedJSON: shared, StepCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := func() []string {
+		var out []string
+		_ = filepath.WalkDir(blobDir, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				b, _ := os.ReadFile(p)
+				out = append(out, string(b))
+			}
+			return err
+		})
+		return out
+	}
+	if got := files(); len(got) != 2 {
+		t.Fatalf("blob files %q", got)
+	}
+	for _, f := range files() {
+		if strings.Contains(f, "4242") {
+			t.Fatalf("blob stored in plaintext: %s", f)
+		}
+	}
+	resolve := func() string {
+		tk, err := s.GetTask(tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js, err := codec.ResolveJSON(tk.SharedJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return js
+	}
+	if got := resolve(); got != `{"card":"`+secret+`","n":1}` {
+		t.Fatalf("resolved %s", got)
+	}
+
+	// Rotation, as pfctl reencrypt does it, seals the legacy blob and
+	// rewraps the others under the new key; references stay valid.
+	k2, err := crypt.AddKey(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring, err = crypt.LoadKeyFile(keys); err != nil {
+		t.Fatal(err)
+	}
+	c.Keys = ring
+	if _, err := Rotate(raw, c.Rotate); err != nil {
+		t.Fatal(err)
+	}
+	n, err := (&blob.FS{Dir: blobDir}).Rotate(c.Rotate)
+	if err != nil || n != 2 {
+		t.Fatalf("rotate %d %v", n, err)
+	}
+	for _, f := range files() {
+		if id, ok := crypt.KeyOf(f); !ok || id != k2 {
+			t.Fatalf("blob not under new key: %s", f)
+		}
+	}
+	delete(ring.Keys, k1)
+	if got := resolve(); got != `{"card":"`+secret+`","n":1}` {
+		t.Fatalf("resolved after rotation %s", got)
+	}
+	if b, err := codec.Store.Get(legacy); err != nil || string(b) != `"old.secret"` {
+		t.Fatalf("legacy blob %q %v", b, err)
+	}
+}
@@ -0,0 +1,79 @@
+package memstore
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func (m *Memory) RestoreFlow(f store.Flow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.flows[f.ID]; ok {
+		return store.ErrConflict
+	}
+	f.Namespace = store.Namespace(f.Namespace)
+	m.flows[f.ID] = flowRow{Flow: f, seq: m.next()}
+	return nil
+}
+
+func (m *Memory) RestoreFlowVersion(v store.FlowVersion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.versions[v.ID]; ok {
+		return store.ErrConflict
+	}
+	m.versions[v.ID] = versionRow{FlowVersion: v, seq: m.next()}
+	return nil
+}
+
+func (m *Memory) RestoreNodeState(ns store.NodeState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[[2]string{ns.TaskID, ns.NodeKey}] = ns
+	return nil
+}
+
+func (m *Memory) GetQueueTask(id string) (store.QueueTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queue[id]
+	if !ok {
+		return store.QueueTask{}, sql.ErrNoRows
+	}
+	return q.QueueTask, nil
+}
+
+func (m *Memory) ListQueueTasks(taskID string) ([]store.QueueTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := []queueRow{}
+	for _, q := range m.queue {
+		if q.TaskID == taskID {
+			rows = append(rows, q)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].CreatedAt != rows[j].CreatedAt {
+			return rows[i].CreatedAt < rows[j].CreatedAt
+		}
+		return rows[i].seq < rows[j].seq
+	})
+	out := make([]store.QueueTask, len(rows))
+	for i, q := range rows {
+		out[i] = q.QueueTask
+	}
+	return out, nil
+}
+
+func (m *Memory) RestoreQueueTask(q store.QueueTask) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.queue[q.ID]; ok {
+		return store.ErrConflict
+	}
+	q.Namespace = store.Namespace(q.Namespace)
+	m.queue[q.ID] = queueRow{QueueTask: q, seq: m.next()}
+	return nil
+}
@@ -0,0 +1,1047 @@
+// Package memstore implements store.Store in memory.
+// It is intended for embedding the engine and for fast tests; nothing is persisted.
+package memstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// Memory implements the Store interface with in-memory maps guarded by a mutex.
+// Missing rows are reported as sql.ErrNoRows to match the SQL backends.
+type Memory struct {
+	mu sync.Mutex
+
+	seq int64
+
+	workers     map[string]store.WorkerInfo
+	workerOrder []string
+
+	flows    map[string]flowRow
+	versions map[string]versionRow
+	tasks    map[string]taskRow
+	runs     map[string]runRow
+	queue    map[string]queueRow
+	policies map[[3]string]store.RetentionPolicy
+	events   []store.TaskEvent
+	states   map[[2]string]store.NodeState
+	// shared holds each task's shared state as encoded values by key.
+	shared map[string]map[string]string
+}
+
+type flowRow struct {
+	store.Flow
+	seq int64
+}
+
+type versionRow struct {
+	store.FlowVersion
+	seq int64
+}
+
+type taskRow struct {
+	store.Task
+	seq int64
+}
+
+type runRow struct {
+	store.NodeRun
+	seq int64
+}
+
+type queueRow struct {
+	store.QueueTask
+	seq int64
+}
+
+// New creates an empty in-memory store.
+func New() *Memory {
+	return &Memory{
+		workers:  map[string]store.WorkerInfo{},
+		flows:    map[string]flowRow{},
+		versions: map[string]versionRow{},
+		tasks:    map[string]taskRow{},
+		runs:     map[string]runRow{},
+		queue:    map[string]queueRow{},
+		policies: map[[3]string]store.RetentionPolicy{},
+		states:   map[[2]string]store.NodeState{},
+		shared:   map[string]map[string]string{},
+	}
+}
+
+func nowUnix() int64 { return store.NowUnix() }
+
+func (m *Memory) next() int64 {
+	m.seq++
+	return m.seq
+}
+
+// RegisterWorker registers or updates a worker.
+func (m *Memory) RegisterWorker(w store.WorkerInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w.Type == "" {
+		w.Type = "http"
+	}
+	w.Services = append([]string(nil), w.Services...)
+	w.Namespace = store.Namespace(w.Namespace)
+	w.LastHeartbeat = nowUnix()
+	if _, ok := m.workers[w.ID]; !ok {
+		m.workerOrder = append(m.workerOrder, w.ID)
+	}
+	m.workers[w.ID] = w
+	return nil
+}
+
+func (m *Memory) HeartbeatWorker(id string, url string, load int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := nowUnix()
+	for k, w := range m.workers {
+		if w.ID == id || w.URL == url {
+			w.LastHeartbeat = now
+			w.Load = load
+			w.Status = "online"
+			m.workers[k] = w
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RefreshWorkersStatus(ttl int64) error {
+	if ttl <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	th := nowUnix() - ttl
+	for k, w := range m.workers {
+		if w.LastHeartbeat > 0 && w.LastHeartbeat < th {
+			w.Status = "offline"
+			m.workers[k] = w
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListWorkers(namespace string, service string, ttl int64) ([]store.WorkerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []store.WorkerInfo{}
+	now := nowUnix()
+	for _, id := range m.workerOrder {
+		w := m.workers[id]
+		if ttl > 0 && now-w.LastHeartbeat > ttl {
+			continue
+		}
+		if namespace != "" && w.Namespace != namespace {
+			continue
+		}
+		if service != "" && !contains(w.Services, service) {
+			continue
+		}
+		w.Services = append([]string(nil), w.Services...)
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func (m *Memory) CreateFlow(namespace string, name string, description string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := store.GenID("flow")
+	m.flows[id] = flowRow{Flow: store.Flow{ID: id, Namespace: store.Namespace(namespace), Name: name, Description: description, CreatedAt: nowUnix()}, seq: m.next()}
+	return id, nil
+}
+
+func (m *Memory) CreateFlowVersion(flowID string, version int, definitionJSON string, status string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := store.GenID("ver")
+	m.versions[id] = versionRow{FlowVersion: store.FlowVersion{ID: id, FlowID: flowID, Version: version, DefinitionJSON: definitionJSON, Status: status}, seq: m.next()}
+	return id, nil
+}
+
+func (m *Memory) GetFlow(id string) (store.Flow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.flows[id]
+	if !ok {
+		return store.Flow{}, sql.ErrNoRows
+	}
+	return f.Flow, nil
+}
+
+func (m *Memory) ListFlows(namespace string, limit, offset int) ([]store.Flow, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := make([]flowRow, 0, len(m.flows))
+	for _, f := range m.flows {
+		if namespace != "" && f.Namespace != namespace {
+			continue
+		}
+		rows = append(rows, f)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].CreatedAt != rows[j].CreatedAt {
+			return rows[i].CreatedAt > rows[j].CreatedAt
+		}
+		return rows[i].seq > rows[j].seq
+	})
+	var flows []store.Flow
+	for _, f := range page(len(rows), limit, offset) {
+		flows = append(flows, rows[f].Flow)
+	}
+	return flows, int64(len(rows)), nil
+}
+
+func (m *Memory) ListFlowVersions(flowID string) ([]store.FlowVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var versions []store.FlowVersion
+	for _, v := range m.sortedVersions(flowID) {
+		versions = append(versions, v.FlowVersion)
+	}
+	return versions, nil
+}
+
+// sortedVersions returns the versions of a flow, highest version first.
+func (m *Memory) sortedVersions(flowID string) []versionRow {
+	rows := []versionRow{}
+	for _, v := range m.versions {
+		if v.FlowID == flowID {
+			rows = append(rows, v)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Version != rows[j].Version {
+			return rows[i].Version > rows[j].Version
+		}
+		return rows[i].seq > rows[j].seq
+	})
+	return rows
+}
+
+func (m *Memory) LatestPublishedVersion(flowID string) (store.FlowVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.sortedVersions(flowID) {
+		if v.Status == "published" {
+			return v.FlowVersion, nil
+		}
+	}
+	return store.FlowVersion{}, sql.ErrNoRows
+}
+
+func (m *Memory) GetFlowVersionByFlowIDAndVersion(flowID string, version int) (store.FlowVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.sortedVersions(flowID) {
+		if v.Version == version {
+			return v.FlowVersion, nil
+		}
+	}
+	return store.FlowVersion{}, sql.ErrNoRows
+}
+
+func (m *Memory) GetFlowVersionByID(id string) (store.FlowVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.versions[id]
+	if !ok {
+		return store.FlowVersion{}, sql.ErrNoRows
+	}
+	return v.FlowVersion, nil
+}
+
+func (m *Memory) CreateTask(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.findRequest(flowVersionID, requestID); ok {
+		return "", errDuplicateRequest
+	}
+	return m.insertTask(flowVersionID, paramsJSON, requestID, startNode), nil
+}
+
+func (m *Memory) CreateTaskOnce(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.findRequest(flowVersionID, requestID); ok {
+		return id, false, nil
+	}
+	return m.insertTask(flowVersionID, paramsJSON, requestID, startNode), true, nil
+}
+
+var errDuplicateRequest = errors.New("duplicate request_id for flow")
+
+// findRequest looks up a task by idempotency key within the version's flow.
+func (m *Memory) findRequest(flowVersionID string, requestID string) (string, bool) {
+	if requestID == "" {
+		return "", false
+	}
+	flowID := m.versions[flowVersionID].FlowID
+	for _, t := range m.tasks {
+		if t.RequestID == requestID && m.versions[t.FlowVersionID].FlowID == flowID {
+			return t.ID, true
+		}
+	}
+	return "", false
+}
+
+func (m *Memory) insertTask(flowVersionID string, paramsJSON string, requestID string, startNode string) string {
+	id := store.GenID("task")
+	now := nowUnix()
+	if paramsJSON == "" {
+		paramsJSON = "{}"
+	}
+	m.tasks[id] = taskRow{Task: store.Task{
+		ID:             id,
+		Namespace:      m.namespaceOf(flowVersionID),
+		FlowVersionID:  flowVersionID,
+		Status:         "pending",
+		ParamsJSON:     paramsJSON,
+		CurrentNodeKey: startNode,
+		RetryStateJSON: "{}",
+		RequestID:      requestID,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Revision:       1,
+	}, seq: m.next()}
+	m.journal(store.TaskEvent{TaskID: id, Type: "create", ToStatus: "pending", NodeKey: startNode})
+	return id
+}
+
+// namespaceOf returns the namespace of the flow of a flow version.
+func (m *Memory) namespaceOf(flowVersionID string) string {
+	if f, ok := m.flows[m.versions[flowVersionID].FlowID]; ok {
+		return f.Namespace
+	}
+	return store.DefaultNamespace
+}
+
+// withFlow fills the flow columns and shared state that the SQL backends
+// join in.
+func (m *Memory) withFlow(t store.Task) store.Task {
+	t.SharedJSON = store.JoinShared(m.shared[t.ID])
+	if v, ok := m.versions[t.FlowVersionID]; ok {
+		t.FlowVersion = v.Version
+		if f, ok := m.flows[v.FlowID]; ok {
+			t.FlowID = f.ID
+			t.FlowName = f.Name
+		}
+	}
+	return t
+}
+
+func (m *Memory) GetTask(id string) (store.Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return store.Task{}, sql.ErrNoRows
+	}
+	return m.withFlow(t.Task), nil
+}
+
+func (m *Memory) LeaseNextTask(owner string, ttlSec int64) (store.Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now, nowMs := nowUnix(), store.NowMillis()
+	var best *taskRow
+	for _, t := range m.tasks {
+		t := t
+		if t.Status != "pending" && t.Status != "running" && t.Status != "waiting_retry" && t.Status != "compensating" && t.Status != "canceling" {
+			continue
+		}
+		if t.LeaseExpiry != 0 && t.LeaseExpiry >= now {
+			continue
+		}
+		if t.NextRunAt > nowMs && t.Status != "canceling" {
+			continue
+		}
+		if best == nil || t.UpdatedAt < best.UpdatedAt || (t.UpdatedAt == best.UpdatedAt && t.seq < best.seq) {
+			best = &t
+		}
+	}
+	if best == nil {
+		return store.Task{}, sql.ErrNoRows
+	}
+	from := best.Status
+	best.LeaseOwner = owner
+	best.LeaseExpiry = now + ttlSec
+	best.Status = store.LeasedStatus(from)
+	best.Revision++
+	m.tasks[best.ID] = *best
+	m.journal(store.TaskEvent{TaskID: best.ID, Type: "lease", FromStatus: from, ToStatus: best.Status, NodeKey: best.CurrentNodeKey, Actor: owner})
+	return m.withFlow(best.Task), nil
+}
+
+func (m *Memory) ExtendLease(id string, owner string, ttlSec int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if ok && t.LeaseOwner == owner {
+		t.LeaseExpiry = nowUnix() + ttlSec
+		m.tasks[id] = t
+	}
+	return nil
+}
+
+// owned reports whether owner currently holds an unexpired lease on t.
+func owned(t taskRow, owner string) bool {
+	return t.LeaseOwner == owner && t.LeaseExpiry > nowUnix()
+}
+
+func (m *Memory) UpdateTaskStatus(id string, status string) error {
+	return m.SetTaskStatus(id, status, store.TaskEvent{})
+}
+
+func (m *Memory) SetTaskStatus(id string, status string, ev store.TaskEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tasks[id]; ok {
+		m.setStatus(t, status, ev)
+	}
+	return nil
+}
+
+func (m *Memory) RequestCancel(id string, ev store.TaskEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if store.Finished(t.Status) {
+		return store.ErrFinished
+	}
+	m.setStatus(t, "canceling", ev)
+	return nil
+}
+
+func (m *Memory) UpdateTaskStatusOwned(id string, owner string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tasks[id]; ok && owned(t, owner) {
+		m.setStatus(t, status, store.TaskEvent{Actor: owner})
+	}
+	return nil
+}
+
+func (m *Memory) setStatus(t taskRow, status string, ev store.TaskEvent) {
+	ev.TaskID, ev.FromStatus, ev.ToStatus = t.ID, t.Status, status
+	if ev.NodeKey == "" {
+		ev.NodeKey = t.CurrentNodeKey
+	}
+	t.Status = status
+	t.UpdatedAt = nowUnix()
+	t.Revision++
+	m.tasks[t.ID] = t
+	m.journal(ev)
+}
+
+func (m *Memory) UpdateTaskProgress(id string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tasks[id]; ok {
+		return m.progress(t, currentNode, lastAction, sharedJSON, stepCount, store.TaskEvent{Type: "step"})
+	}
+	return nil
+}
+
+func (m *Memory) UpdateTaskProgressOwned(id string, owner string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tasks[id]; ok && owned(t, owner) {
+		return m.progress(t, currentNode, lastAction, sharedJSON, stepCount, store.TaskEvent{Type: "step", Actor: owner})
+	}
+	return nil
+}
+
+func (m *Memory) TransitionTask(id string, owner string, tr store.TaskTransition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if owner != "" && !owned(t, owner) {
+		return store.ErrLeaseLost
+	}
+	if tr.Revision != 0 && tr.Revision != t.Revision {
+		return store.ErrConflict
+	}
+	cur := m.shared[id]
+	if tr.SharedJSON != "" {
+		cur = nil
+	}
+	ops, err := store.DiffShared("", tr.SharedJSON)
+	if err != nil {
+		return err
+	}
+	shared, err := m.applyShared(t.Task, cur, append(ops, tr.Shared...))
+	if err != nil {
+		return err
+	}
+	m.journal(store.TaskEvent{TaskID: id, FromStatus: t.Status, ToStatus: tr.Status, NodeKey: tr.CurrentNode, Actor: owner})
+	m.shared[id] = shared
+	t.CurrentNodeKey, t.LastAction, t.StepCount, t.Status = tr.CurrentNode, tr.LastAction, tr.StepCount, tr.Status
+	if tr.RetryStateJSON != "" {
+		t.RetryStateJSON = tr.RetryStateJSON
+	}
+	t.NextRunAt = tr.NextRunAt
+	if tr.NextRunAt != 0 {
+		t.LeaseOwner, t.LeaseExpiry = "", 0
+	}
+	t.UpdatedAt = nowUnix()
+	t.Revision++
+	m.tasks[id] = t
+	for _, nr := range tr.NodeRuns {
+		if _, ok := nr["id"]; !ok {
+			nr["id"] = store.GenID("run")
+		}
+		var r store.NodeRun
+		applyNodeRun(&r, nr)
+		m.runs[r.ID] = runRow{NodeRun: r, seq: m.next()}
+	}
+	for _, ns := range tr.NodeStates {
+		k := [2]string{id, ns.NodeKey}
+		if ns.StateJSON == "" {
+			delete(m.states, k)
+			continue
+		}
+		ns.TaskID, ns.UpdatedAt = id, nowUnix()
+		m.states[k] = ns
+	}
+	return nil
+}
+
+func (m *Memory) GetNodeState(taskID string, nodeKey string) (store.NodeState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ns, ok := m.states[[2]string{taskID, nodeKey}]
+	if !ok {
+		return store.NodeState{}, sql.ErrNoRows
+	}
+	return ns, nil
+}
+
+func (m *Memory) ListNodeStates(taskID string) ([]store.NodeState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []store.NodeState{}
+	for k, ns := range m.states {
+		if k[0] == taskID {
+			out = append(out, ns)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeKey < out[j].NodeKey })
+	return out, nil
+}
+
+// progress moves t's cursor and replaces its shared state.
+func (m *Memory) progress(t taskRow, currentNode string, lastAction string, sharedJSON string, stepCount int, ev store.TaskEvent) error {
+	ops, err := store.DiffShared("", sharedJSON)
+	if err != nil {
+		return err
+	}
+	shared, err := m.applyShared(t.Task, nil, ops)
+	if err != nil {
+		return err
+	}
+	m.shared[t.ID] = shared
+	ev.TaskID, ev.FromStatus, ev.ToStatus, ev.NodeKey = t.ID, t.Status, t.Status, currentNode
+	m.journal(ev)
+	t.CurrentNodeKey = currentNode
+	t.LastAction = lastAction
+	t.StepCount = stepCount
+	t.UpdatedAt = nowUnix()
+	t.Revision++
+	m.tasks[t.ID] = t
+	return nil
+}
+
+// applyShared returns a copy of cur with ops applied, or an error if the
+// result breaks t's shared state limits.
+func (m *Memory) applyShared(t store.Task, cur map[string]string, ops []store.SharedOp) (map[string]string, error) {
+	next := make(map[string]string, len(cur))
+	for k, v := range cur {
+		next[k] = v
+	}
+	grew := false
+	for _, op := range ops {
+		v, ok, err := op.Apply(next[op.Key])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			delete(next, op.Key)
+			continue
+		}
+		if err := t.SharedLimits.CheckValue(t.ID, op.Key, v); err != nil {
+			return nil, err
+		}
+		next[op.Key] = v
+		grew = true
+	}
+	if grew {
+		var total int64
+		for k, v := range next {
+			total += store.SharedSize(k, v)
+		}
+		if err := t.SharedLimits.CheckTotal(t.ID, total); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+func (m *Memory) UpdateTaskShared(id string, revision int64, sharedJSON string, ev store.TaskEvent) error {
+	ops, err := store.DiffShared("", sharedJSON)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if revision != 0 && revision != t.Revision {
+		return store.ErrConflict
+	}
+	shared, err := m.applyShared(t.Task, nil, ops)
+	if err != nil {
+		return err
+	}
+	t.Revision++
+	m.saveShared(t, shared, ev)
+	return nil
+}
+
+func (m *Memory) PatchTaskShared(id string, ops []store.SharedOp, ev store.TaskEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	shared, err := m.applyShared(t.Task, m.shared[id], ops)
+	if err != nil {
+		return err
+	}
+	m.saveShared(t, shared, ev)
+	return nil
+}
+
+// saveShared stores t with new shared state and journals ev for it.
+func (m *Memory) saveShared(t taskRow, shared map[string]string, ev store.TaskEvent) {
+	m.shared[t.ID] = shared
+	t.UpdatedAt = nowUnix()
+	m.tasks[t.ID] = t
+	if ev.Type == "" {
+		ev.Type = "shared"
+	}
+	if ev.NodeKey == "" {
+		ev.NodeKey = t.CurrentNodeKey
+	}
+	ev.TaskID, ev.FromStatus, ev.ToStatus = t.ID, t.Status, t.Status
+	m.journal(ev)
+}
+
+func (m *Memory) SetSharedLimits(id string, l store.SharedLimits) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	data, _ := json.Marshal(l)
+	t.SharedLimits = l
+	t.UpdatedAt = nowUnix()
+	t.Revision++
+	m.tasks[id] = t
+	m.journal(store.TaskEvent{TaskID: id, Type: "limits", FromStatus: t.Status, ToStatus: t.Status, NodeKey: t.CurrentNodeKey, DataJSON: string(data)})
+	return nil
+}
+
+// journal appends ev to the task journal, filling in defaults the SQL
+// backends also apply.
+func (m *Memory) journal(ev store.TaskEvent) {
+	if ev.Type == "" {
+		ev.Type = store.EventType(ev.FromStatus, ev.ToStatus)
+	}
+	if ev.DataJSON == "" {
+		ev.DataJSON = "{}"
+	}
+	if ev.CreatedAt == 0 {
+		ev.CreatedAt = nowUnix()
+	}
+	ev.Seq = m.next()
+	m.events = append(m.events, ev)
+}
+
+func (m *Memory) ListTaskEvents(taskID string) ([]store.TaskEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []store.TaskEvent{}
+	for _, ev := range m.events {
+		if ev.TaskID == taskID {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+func (m *Memory) ListTasks(namespace string, status string, flowVersionID string, limit, offset int) ([]store.Task, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := []taskRow{}
+	for _, t := range m.tasks {
+		if namespace != "" && t.Namespace != namespace {
+			continue
+		}
+		if status != "" && t.Status != status {
+			continue
+		}
+		if flowVersionID != "" && t.FlowVersionID != flowVersionID {
+			continue
+		}
+		rows = append(rows, t)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].UpdatedAt != rows[j].UpdatedAt {
+			return rows[i].UpdatedAt > rows[j].UpdatedAt
+		}
+		return rows[i].seq > rows[j].seq
+	})
+	out := []store.Task{}
+	for _, i := range page(len(rows), limit, offset) {
+		out = append(out, m.withFlow(rows[i].Task))
+	}
+	return out, int64(len(rows)), nil
+}
+
+// SearchTasks evaluates q by scanning every task.
+func (m *Memory) SearchTasks(q store.TaskQuery) (store.TaskPage, error) {
+	col, desc, err := q.SortField()
+	if err != nil {
+		return store.TaskPage{}, err
+	}
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return store.TaskPage{}, err
+		}
+	}
+	var cv int64
+	var cid string
+	if q.Cursor != "" {
+		if cv, cid, err = store.DecodeCursor(q.Cursor); err != nil {
+			return store.TaskPage{}, err
+		}
+	}
+	key := func(t store.Task) int64 {
+		if col == "created_at" {
+			return t.CreatedAt
+		}
+		return t.UpdatedAt
+	}
+	// before reports whether a sorts ahead of b.
+	before := func(av int64, aid string, bv int64, bid string) bool {
+		if av != bv {
+			return (av < bv) != desc
+		}
+		return aid != bid && (aid < bid) != desc
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := []store.Task{}
+	for _, r := range m.tasks {
+		t := m.withFlow(r.Task)
+		t.FlowID = m.versions[t.FlowVersionID].FlowID
+		if q.Cursor != "" && !before(cv, cid, key(t), t.ID) {
+			continue
+		}
+		if matchTask(t, q.Filters) {
+			rows = append(rows, t)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return before(key(rows[i]), rows[i].ID, key(rows[j]), rows[j].ID) })
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	out := store.TaskPage{Tasks: rows}
+	if len(rows) > limit {
+		out.Tasks = rows[:limit]
+		last := rows[limit-1]
+		out.NextCursor = store.EncodeCursor(key(last), last.ID)
+	}
+	return out, nil
+}
+
+func matchTask(t store.Task, fs []store.TaskFilter) bool {
+	for _, f := range fs {
+		var got interface{}
+		if doc, keys, ok := f.JSONPath(); ok {
+			raw := t.ParamsJSON
+			if doc == "shared_json" {
+				raw = t.SharedJSON
+			}
+			var v interface{}
+			_ = json.Unmarshal([]byte(raw), &v)
+			for _, k := range keys {
+				obj, _ := v.(map[string]interface{})
+				v = obj[k]
+			}
+			got = v
+		} else {
+			got = map[string]interface{}{
+				"namespace":        t.Namespace,
+				"status":           t.Status,
+				"flow_id":          t.FlowID,
+				"flow_version_id":  t.FlowVersionID,
+				"request_id":       t.RequestID,
+				"current_node_key": t.CurrentNodeKey,
+				"lease_owner":      t.LeaseOwner,
+				"created_at":       t.CreatedAt,
+				"updated_at":       t.UpdatedAt,
+			}[f.Field]
+		}
+		if !compare(got, f.Op, f.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare applies op to values of the same type. Like SQL, a missing value
+// never matches a non-null comparison; other type mismatches only satisfy !=.
+func compare(a interface{}, op string, b interface{}) bool {
+	c, ok := 0, true
+	switch av := a.(type) {
+	case string:
+		bv, isStr := b.(string)
+		ok = isStr
+		c = strings.Compare(av, bv)
+	case int64:
+		bv, isInt := b.(int64)
+		ok = isInt
+		c = cmpFloat(float64(av), float64(bv))
+	case float64:
+		bv, isNum := b.(float64)
+		ok = isNum
+		c = cmpFloat(av, bv)
+	case bool:
+		bv, isBool := b.(bool)
+		ok = isBool && op != "<" && op != ">" && op != "<=" && op != ">="
+		if av != bv {
+			c = 1
+		}
+	case nil:
+		ok = b == nil
+	default:
+		ok = false
+	}
+	if !ok {
+		return op == "!=" && a != nil
+	}
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (m *Memory) SaveNodeRun(nr map[string]interface{}) error {
+	nr["id"] = store.GenID("run")
+	return m.CreateNodeRun(nr)
+}
+
+func (m *Memory) CreateNodeRun(nr map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var r store.NodeRun
+	applyNodeRun(&r, nr)
+	m.runs[r.ID] = runRow{NodeRun: r, seq: m.next()}
+	return nil
+}
+
+func (m *Memory) UpdateNodeRun(id string, updates map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.runs[id]
+	if !ok {
+		return nil
+	}
+	applyNodeRun(&r.NodeRun, updates)
+	r.ID = id
+	m.runs[id] = r
+	return nil
+}
+
+func (m *Memory) ListNodeRuns(taskID string) ([]store.NodeRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := []runRow{}
+	for _, r := range m.runs {
+		if r.TaskID == taskID {
+			rows = append(rows, r)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].StartedAt != rows[j].StartedAt {
+			return rows[i].StartedAt < rows[j].StartedAt
+		}
+		return rows[i].seq < rows[j].seq
+	})
+	out := make([]store.NodeRun, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, r.NodeRun)
+	}
+	return out, nil
+}
+
+func (m *Memory) GetNodeRun(id string) (store.NodeRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.runs[id]
+	if !ok {
+		return store.NodeRun{}, sql.ErrNoRows
+	}
+	return r.NodeRun, nil
+}
+
+// EnqueueTask adds a new task to the queue
+func (m *Memory) EnqueueTask(taskID, nodeKey, service, inputJSON string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := store.GenID("q")
+	ns := store.DefaultNamespace
+	if t, ok := m.tasks[taskID]; ok {
+		ns = t.Namespace
+	}
+	m.queue[id] = queueRow{QueueTask: store.QueueTask{ID: id, Namespace: ns, TaskID: taskID, NodeKey: nodeKey, Service: service, InputJSON: inputJSON, Status: "pending", CreatedAt: nowUnix()}, seq: m.next()}
+	return id, nil
+}
+
+// PollQueue claims the oldest pending queue entry for the given services.
+func (m *Memory) PollQueue(namespace string, workerID string, services []string, timeoutSec int64) (store.QueueTask, error) {
+	if len(services) == 0 {
+		return store.QueueTask{}, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var best *queueRow
+	for _, q := range m.queue {
+		q := q
+		if q.Status != "pending" || q.Namespace != store.Namespace(namespace) || !contains(services, q.Service) {
+			continue
+		}
+		if best == nil || q.CreatedAt < best.CreatedAt || (q.CreatedAt == best.CreatedAt && q.seq < best.seq) {
+			best = &q
+		}
+	}
+	if best == nil {
+		return store.QueueTask{}, nil
+	}
+	now := nowUnix()
+	best.Status = "claimed"
+	best.WorkerID = workerID
+	best.StartedAt = now
+	best.TimeoutAt = now + timeoutSec
+	m.queue[best.ID] = *best
+	return best.QueueTask, nil
+}
+
+// CompleteQueueTask marks a queue task as completed and returns its task ID.
+func (m *Memory) CompleteQueueTask(queueID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queue[queueID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	if q.Status == "revoked" {
+		return "", store.ErrRevoked
+	}
+	q.Status = "completed"
+	m.queue[queueID] = q
+	return q.TaskID, nil
+}
+
+// FailQueueTask marks a queue task as failed
+func (m *Memory) FailQueueTask(queueID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if q, ok := m.queue[queueID]; ok && q.Status != "revoked" {
+		q.Status = "failed"
+		m.queue[queueID] = q
+	}
+	return nil
+}
+
+func (m *Memory) RevokeQueueTasks(taskID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for id, q := range m.queue {
+		if q.TaskID == taskID && (q.Status == "pending" || q.Status == "claimed") {
+			q.Status = "revoked"
+			m.queue[id] = q
+			n++
+		}
+	}
+	return n, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// page returns the indexes selected by limit/offset out of n rows.
+// A non-positive limit selects every row.
+func page(n, limit, offset int) []int {
+	if limit <= 0 {
+		offset = 0
+		limit = n
+	}
+	out := []int{}
+	for i := offset; i < n && i < offset+limit; i++ {
+		if i >= 0 {
+			out = append(out, i)
+		}
+	}
+	return out
+}
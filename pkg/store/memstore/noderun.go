@@ -0,0 +1,77 @@
+package memstore
+
+import (
+	"fmt"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// applyNodeRun copies node_runs columns from a column map onto r.
+// Unknown columns are ignored, as are values of unexpected types.
+func applyNodeRun(r *store.NodeRun, cols map[string]interface{}) {
+	for k, v := range cols {
+		switch k {
+		case "id":
+			r.ID = asString(v)
+		case "task_id":
+			r.TaskID = asString(v)
+		case "node_key":
+			r.NodeKey = asString(v)
+		case "attempt_no":
+			r.AttemptNo = int(asInt(v))
+		case "status":
+			r.Status = asString(v)
+		case "sub_status":
+			r.SubStatus = asString(v)
+		case "branch_id":
+			r.BranchID = asString(v)
+		case "prep_json":
+			r.PrepJSON = asString(v)
+		case "exec_input_json":
+			r.ExecInputJSON = asString(v)
+		case "exec_output_json":
+			r.ExecOutputJSON = asString(v)
+		case "error_text":
+			r.ErrorText = asString(v)
+		case "action":
+			r.Action = asString(v)
+		case "started_at":
+			r.StartedAt = asInt(v)
+		case "finished_at":
+			r.FinishedAt = asInt(v)
+		case "worker_id":
+			r.WorkerID = asString(v)
+		case "worker_url":
+			r.WorkerURL = asString(v)
+		case "log_path":
+			r.LogPath = asString(v)
+		}
+	}
+}
+
+func asString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func asInt(v interface{}) int64 {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	}
+	return 0
+}
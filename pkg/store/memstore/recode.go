@@ -0,0 +1,73 @@
+package memstore
+
+import (
+	"database/sql"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func (m *Memory) RecodeTask(id string, fn func(stored string) (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	// Recode into copies so that an error leaves everything as it was.
+	params, err := fn(t.ParamsJSON)
+	if err != nil {
+		return err
+	}
+	shared := make(map[string]string, len(m.shared[id]))
+	for k, v := range m.shared[id] {
+		if shared[k], err = fn(v); err != nil {
+			return err
+		}
+	}
+	runs := map[string]runRow{}
+	for rid, r := range m.runs {
+		if r.TaskID != id {
+			continue
+		}
+		if r.ExecInputJSON, err = fn(r.ExecInputJSON); err != nil {
+			return err
+		}
+		if r.ExecOutputJSON, err = fn(r.ExecOutputJSON); err != nil {
+			return err
+		}
+		runs[rid] = r
+	}
+	states := map[[2]string]store.NodeState{}
+	for k, ns := range m.states {
+		if ns.TaskID != id {
+			continue
+		}
+		if ns.StateJSON, err = fn(ns.StateJSON); err != nil {
+			return err
+		}
+		states[k] = ns
+	}
+	jobs := map[string]queueRow{}
+	for qid, q := range m.queue {
+		if q.TaskID != id {
+			continue
+		}
+		if q.InputJSON, err = fn(q.InputJSON); err != nil {
+			return err
+		}
+		jobs[qid] = q
+	}
+	t.ParamsJSON = params
+	m.tasks[id] = t
+	m.shared[id] = shared
+	for rid, r := range runs {
+		m.runs[rid] = r
+	}
+	for k, ns := range states {
+		m.states[k] = ns
+	}
+	for qid, q := range jobs {
+		m.queue[qid] = q
+	}
+	return nil
+}
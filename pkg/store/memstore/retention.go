@@ -0,0 +1,146 @@
+package memstore
+
+import (
+	"sort"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func (m *Memory) SetRetentionPolicy(p store.RetentionPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p.Namespace = store.Namespace(p.Namespace)
+	key := [3]string{p.Namespace, p.FlowID, p.Status}
+	if p.KeepSec <= 0 {
+		delete(m.policies, key)
+		return nil
+	}
+	p.UpdatedAt = nowUnix()
+	m.policies[key] = p
+	return nil
+}
+
+func (m *Memory) ListRetentionPolicies(namespace string) ([]store.RetentionPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []store.RetentionPolicy{}
+	for _, p := range m.policies {
+		if namespace == "" || p.Namespace == namespace {
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		if out[i].FlowID != out[j].FlowID {
+			return out[i].FlowID < out[j].FlowID
+		}
+		return out[i].Status < out[j].Status
+	})
+	return out, nil
+}
+
+func (m *Memory) ListExpiredTasks(now int64, limit int) ([]store.Task, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []store.Task{}
+	for _, r := range m.tasks {
+		if !retained(r.Status) {
+			continue
+		}
+		flowID := m.versions[r.FlowVersionID].FlowID
+		p, ok := m.policies[[3]string{r.Namespace, flowID, r.Status}]
+		if !ok {
+			p, ok = m.policies[[3]string{r.Namespace, "", r.Status}]
+		}
+		if ok && r.UpdatedAt+p.KeepSec < now {
+			out = append(out, m.withFlow(r.Task))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].UpdatedAt != out[j].UpdatedAt {
+			return out[i].UpdatedAt < out[j].UpdatedAt
+		}
+		return out[i].ID < out[j].ID
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *Memory) DeleteTasks(ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gone := map[string]bool{}
+	for _, id := range ids {
+		gone[id] = true
+		delete(m.tasks, id)
+		delete(m.shared, id)
+	}
+	for id, r := range m.runs {
+		if gone[r.TaskID] {
+			delete(m.runs, id)
+		}
+	}
+	events := m.events[:0]
+	for _, ev := range m.events {
+		if !gone[ev.TaskID] {
+			events = append(events, ev)
+		}
+	}
+	m.events = events
+	for k := range m.states {
+		if gone[k[0]] {
+			delete(m.states, k)
+		}
+	}
+	for id, q := range m.queue {
+		if gone[q.TaskID] {
+			delete(m.queue, id)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RestoreTask(t store.Task, runs []store.NodeRun, events []store.TaskEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tasks[t.ID]; ok {
+		return store.ErrConflict
+	}
+	t.FlowName, t.FlowVersion = "", 0
+	if v, ok := m.versions[t.FlowVersionID]; ok {
+		t.FlowID = v.FlowID
+		t.Namespace = m.namespaceOf(t.FlowVersionID)
+	}
+	t.Namespace = store.Namespace(t.Namespace)
+	t.LeaseOwner, t.LeaseExpiry = "", 0
+	shared, err := store.SplitShared(t.SharedJSON)
+	if err != nil {
+		return err
+	}
+	t.SharedJSON = ""
+	m.shared[t.ID] = shared
+	m.tasks[t.ID] = taskRow{Task: t, seq: m.next()}
+	for _, r := range runs {
+		m.runs[r.ID] = runRow{NodeRun: r, seq: m.next()}
+	}
+	for _, ev := range events {
+		ev.TaskID = t.ID
+		m.journal(ev)
+	}
+	m.journal(store.TaskEvent{TaskID: t.ID, Type: "restore", FromStatus: t.Status, ToStatus: t.Status, NodeKey: t.CurrentNodeKey})
+	return nil
+}
+
+// retained reports whether tasks in status are subject to retention.
+func retained(status string) bool {
+	for _, st := range store.RetentionStatuses {
+		if st == status {
+			return true
+		}
+	}
+	return false
+}
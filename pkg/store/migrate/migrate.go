@@ -0,0 +1,303 @@
+// Package migrate applies ordered, numbered schema migrations and records
+// them in a schema_migrations table.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dialect selects the SQL flavour used for bookkeeping queries.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// Migration is one schema change. Up and Down run inside a transaction.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// State describes a migration and whether it has been applied.
+type State struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt int64
+	// Unknown is set for versions recorded in the database but not known
+	// to this binary, e.g. after running a newer build against the same DB.
+	Unknown bool
+}
+
+// Migrator applies Migrations to DB.
+type Migrator struct {
+	DB         *sql.DB
+	Dialect    Dialect
+	Migrations []Migration
+}
+
+// New returns a Migrator with migrations sorted by version.
+func New(db *sql.DB, d Dialect, ms []Migration) *Migrator {
+	sorted := append([]Migration(nil), ms...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{DB: db, Dialect: d, Migrations: sorted}
+}
+
+// Exec returns a migration step that runs stmts in order.
+func Exec(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range stmts {
+			if _, err := tx.Exec(q); err != nil {
+				return fmt.Errorf("%s: %w", q, err)
+			}
+		}
+		return nil
+	}
+}
+
+// advisoryLockKey serialises migrators sharing one PostgreSQL database.
+const advisoryLockKey = 7215033
+
+func (m *Migrator) bind(q string) string {
+	if m.Dialect != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.DB.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at BIGINT)")
+	return err
+}
+
+func (m *Migrator) applied() (map[int]State, error) {
+	rows, err := m.DB.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int]State{}
+	for rows.Next() {
+		var st State
+		var name sql.NullString
+		if err := rows.Scan(&st.Version, &name, &st.AppliedAt); err != nil {
+			return nil, err
+		}
+		st.Name = name.String
+		st.Applied = true
+		out[st.Version] = st
+	}
+	return out, rows.Err()
+}
+
+// Status lists every known migration plus any unknown applied versions.
+func (m *Migrator) Status() ([]State, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	out := []State{}
+	for _, mg := range m.Migrations {
+		st := State{Version: mg.Version, Name: mg.Name}
+		if a, ok := done[mg.Version]; ok {
+			st.Applied = true
+			st.AppliedAt = a.AppliedAt
+			delete(done, mg.Version)
+		}
+		out = append(out, st)
+	}
+	for _, a := range done {
+		a.Unknown = true
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Version returns the highest applied version, or 0 for an empty database.
+func (m *Migrator) Version() (int, error) {
+	sts, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+	v := 0
+	for _, st := range sts {
+		if st.Applied && st.Version > v {
+			v = st.Version
+		}
+	}
+	return v, nil
+}
+
+// Up applies pending migrations up to and including target.
+// A target of 0 applies everything.
+func (m *Migrator) Up(target int) ([]Migration, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	out := []Migration{}
+	for _, mg := range m.Migrations {
+		if target > 0 && mg.Version > target {
+			break
+		}
+		ok, err := m.run(mg, true)
+		if err != nil {
+			return out, err
+		}
+		if ok {
+			out = append(out, mg)
+		}
+	}
+	return out, nil
+}
+
+// Down rolls back the most recently applied steps migrations.
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	out := []Migration{}
+	for i := len(m.Migrations) - 1; i >= 0 && len(out) < steps; i-- {
+		mg := m.Migrations[i]
+		if _, ok := done[mg.Version]; !ok {
+			continue
+		}
+		if mg.Down == nil {
+			return out, fmt.Errorf("migration %d (%s) is irreversible", mg.Version, mg.Name)
+		}
+		ok, err := m.run(mg, false)
+		if err != nil {
+			return out, err
+		}
+		if ok {
+			out = append(out, mg)
+		}
+	}
+	return out, nil
+}
+
+// run applies or reverts mg in one transaction. It reports false when
+// another migrator got there first.
+func (m *Migrator) run(mg Migration, up bool) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if m.Dialect == Postgres {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", advisoryLockKey); err != nil {
+			return false, err
+		}
+	}
+	var n int
+	if err := tx.QueryRow(m.bind("SELECT COUNT(1) FROM schema_migrations WHERE version=?"), mg.Version).Scan(&n); err != nil {
+		return false, err
+	}
+	if up == (n > 0) {
+		return false, nil
+	}
+	step := mg.Up
+	if !up {
+		step = mg.Down
+	}
+	if step != nil {
+		if err := step(tx); err != nil {
+			return false, fmt.Errorf("migration %d (%s): %w", mg.Version, mg.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec(m.bind("INSERT INTO schema_migrations(version,name,applied_at) VALUES(?,?,?)"), mg.Version, mg.Name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec(m.bind("DELETE FROM schema_migrations WHERE version=?"), mg.Version)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// HasColumn reports whether table has column. It lets migrations adopt
+// databases created before migrations were tracked.
+func HasColumn(tx *sql.Tx, d Dialect, table, column string) (bool, error) {
+	if d == Postgres {
+		var n int
+		err := tx.QueryRow("SELECT COUNT(1) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name=$1 AND column_name=$2", table, column).Scan(&n)
+		return n > 0, err
+	}
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// AddColumn adds column to table unless it already exists.
+func AddColumn(d Dialect, table, column, typ string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		ok, err := HasColumn(tx, d, table, column)
+		if err != nil || ok {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, typ))
+		return err
+	}
+}
+
+// DropColumn removes column from table if present.
+func DropColumn(d Dialect, table, column string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		ok, err := HasColumn(tx, d, table, column)
+		if err != nil || !ok {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column))
+		return err
+	}
+}
+
+// Steps chains several migration steps.
+func Steps(fns ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
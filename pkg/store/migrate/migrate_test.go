@@ -0,0 +1,242 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", t.TempDir()+"/test.db")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func hasTable(t *testing.T, db *sql.DB, name string) bool {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name=?", name).Scan(&n); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return n > 0
+}
+
+func hasColumn(t *testing.T, db *sql.DB, table, column string) bool {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer tx.Rollback()
+	ok, err := HasColumn(tx, SQLite, table, column)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return ok
+}
+
+var testMigrations = []Migration{
+	{Version: 2, Name: "b_column", Up: AddColumn(SQLite, "a", "b", "TEXT"), Down: DropColumn(SQLite, "a", "b")},
+	{Version: 1, Name: "a_table", Up: Exec("CREATE TABLE a (id TEXT PRIMARY KEY)"), Down: Exec("DROP TABLE a")},
+	{Version: 3, Name: "c_table", Up: Exec("CREATE TABLE c (id TEXT PRIMARY KEY)"), Down: Exec("DROP TABLE c")},
+}
+
+func TestUpDownStatus(t *testing.T) {
+	db := openTestDB(t)
+	m := New(db, SQLite, testMigrations)
+	if v, err := m.Version(); err != nil || v != 0 {
+		t.Fatalf("fresh version %d err %v", v, err)
+	}
+
+	done, err := m.Up(2)
+	if err != nil || len(done) != 2 || done[0].Version != 1 || done[1].Version != 2 {
+		t.Fatalf("up to 2: %+v err %v", done, err)
+	}
+	if !hasTable(t, db, "a") || !hasColumn(t, db, "a", "b") || hasTable(t, db, "c") {
+		t.Fatalf("schema after up to 2")
+	}
+	sts, err := m.Status()
+	if err != nil || len(sts) != 3 {
+		t.Fatalf("status %+v err %v", sts, err)
+	}
+	for i, want := range []bool{true, true, false} {
+		if sts[i].Version != i+1 || sts[i].Applied != want {
+			t.Fatalf("status[%d] %+v", i, sts[i])
+		}
+	}
+	if sts[0].AppliedAt == 0 || sts[2].AppliedAt != 0 {
+		t.Fatalf("applied_at %+v", sts)
+	}
+
+	if done, err = m.Up(0); err != nil || len(done) != 1 || done[0].Version != 3 {
+		t.Fatalf("up all: %+v err %v", done, err)
+	}
+	if v, _ := m.Version(); v != 3 {
+		t.Fatalf("version %d", v)
+	}
+
+	if done, err = m.Down(2); err != nil || len(done) != 2 || done[0].Version != 3 || done[1].Version != 2 {
+		t.Fatalf("down 2: %+v err %v", done, err)
+	}
+	if hasTable(t, db, "c") || hasColumn(t, db, "a", "b") || !hasTable(t, db, "a") {
+		t.Fatalf("schema after down 2")
+	}
+	if v, _ := m.Version(); v != 1 {
+		t.Fatalf("version after down %d", v)
+	}
+}
+
+func TestUpAlreadyApplied(t *testing.T) {
+	db := openTestDB(t)
+	m := New(db, SQLite, testMigrations)
+	if _, err := m.Up(0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	before, _ := m.Status()
+
+	// A second migrator over the same database sees everything applied
+	// and must not re-run CREATE TABLE.
+	done, err := New(db, SQLite, testMigrations).Up(0)
+	if err != nil || len(done) != 0 {
+		t.Fatalf("re-run: %+v err %v", done, err)
+	}
+	if ok, err := m.run(testMigrations[1], true); err != nil || ok {
+		t.Fatalf("run applied: %v %v", ok, err)
+	}
+	after, _ := m.Status()
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("status changed: %+v -> %+v", before[i], after[i])
+		}
+	}
+
+	// Down past the last applied migration stops at what is recorded.
+	if done, err := m.Down(10); err != nil || len(done) != 3 {
+		t.Fatalf("down: %+v err %v", done, err)
+	}
+	if done, err := m.Down(1); err != nil || len(done) != 0 {
+		t.Fatalf("down on empty: %+v err %v", done, err)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	boom := errors.New("boom")
+	ms := append([]Migration(nil), testMigrations...)
+	ms = append(ms, Migration{
+		Version: 4,
+		Name:    "broken",
+		Up: Steps(
+			Exec("CREATE TABLE d (id TEXT PRIMARY KEY)"),
+			AddColumn(SQLite, "a", "e", "TEXT"),
+			func(tx *sql.Tx) error { return boom },
+		),
+	})
+	m := New(db, SQLite, ms)
+	done, err := m.Up(0)
+	if !errors.Is(err, boom) {
+		t.Fatalf("want boom, got %v", err)
+	}
+	if len(done) != 3 {
+		t.Fatalf("applied before failure: %+v", done)
+	}
+	if hasTable(t, db, "d") || hasColumn(t, db, "a", "e") {
+		t.Fatalf("failed migration left schema changes behind")
+	}
+	if v, _ := m.Version(); v != 3 {
+		t.Fatalf("version %d", v)
+	}
+
+	// A failing Down leaves the migration applied.
+	ms = ms[:3]
+	ms[2].Down = func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DROP TABLE c"); err != nil {
+			return err
+		}
+		return boom
+	}
+	m = New(db, SQLite, ms)
+	if _, err := m.Down(1); !errors.Is(err, boom) {
+		t.Fatalf("want boom, got %v", err)
+	}
+	if !hasTable(t, db, "c") {
+		t.Fatalf("failed down dropped table c")
+	}
+	if v, _ := m.Version(); v != 3 {
+		t.Fatalf("version after failed down %d", v)
+	}
+}
+
+func TestIrreversibleDown(t *testing.T) {
+	db := openTestDB(t)
+	m := New(db, SQLite, []Migration{{Version: 1, Name: "once", Up: Exec("CREATE TABLE a (id TEXT)")}})
+	if _, err := m.Up(0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if _, err := m.Down(1); err == nil {
+		t.Fatalf("expected irreversible error")
+	}
+	if v, _ := m.Version(); v != 1 {
+		t.Fatalf("version %d", v)
+	}
+}
+
+func TestStatusUnknownVersion(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := New(db, SQLite, testMigrations).Up(0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	sts, err := New(db, SQLite, testMigrations[:2]).Status()
+	if err != nil || len(sts) != 3 {
+		t.Fatalf("status %+v err %v", sts, err)
+	}
+	if !sts[2].Unknown || !sts[2].Applied || sts[2].Name != "c_table" {
+		t.Fatalf("unknown %+v", sts[2])
+	}
+}
+
+func TestAddDropColumnIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("CREATE TABLE a (id TEXT)"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	step := func(fn func(tx *sql.Tx) error) {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	add := AddColumn(SQLite, "a", "b", "TEXT")
+	step(add)
+	step(add)
+	if !hasColumn(t, db, "a", "b") {
+		t.Fatalf("column b missing")
+	}
+	drop := DropColumn(SQLite, "a", "b")
+	step(drop)
+	step(drop)
+	if hasColumn(t, db, "a", "b") {
+		t.Fatalf("column b still present")
+	}
+}
+
+func TestBind(t *testing.T) {
+	q := "SELECT 1 FROM t WHERE a=? AND b=?"
+	if got := (&Migrator{Dialect: SQLite}).bind(q); got != q {
+		t.Fatalf("sqlite bind %q", got)
+	}
+	if got := (&Migrator{Dialect: Postgres}).bind(q); got != "SELECT 1 FROM t WHERE a=$1 AND b=$2" {
+		t.Fatalf("postgres bind %q", got)
+	}
+}
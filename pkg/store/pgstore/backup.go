@@ -0,0 +1,70 @@
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// insertOnce runs an INSERT ... ON CONFLICT DO NOTHING and reports
+// ErrConflict if it inserted nothing.
+func insertOnce(db execer, q string, args ...interface{}) error {
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+func (s *Postgres) RestoreFlow(f store.Flow) error {
+	return insertOnce(s.DB, "INSERT INTO flows(id,namespace,name,description,created_at) VALUES($1,$2,$3,$4,$5) ON CONFLICT (id) DO NOTHING", f.ID, store.Namespace(f.Namespace), f.Name, f.Description, f.CreatedAt)
+}
+
+func (s *Postgres) RestoreFlowVersion(v store.FlowVersion) error {
+	return insertOnce(s.DB, "INSERT INTO flow_versions(id,flow_id,version,definition_json,status,created_at) VALUES($1,$2,$3,$4,$5,$6) ON CONFLICT (id) DO NOTHING", v.ID, v.FlowID, v.Version, v.DefinitionJSON, v.Status, nowUnix())
+}
+
+func (s *Postgres) RestoreNodeState(ns store.NodeState) error {
+	_, err := s.DB.Exec("INSERT INTO node_states(task_id,node_key,kind,version,state_json,updated_at) VALUES($1,$2,$3,$4,$5,$6) ON CONFLICT (task_id,node_key) DO UPDATE SET kind=EXCLUDED.kind, version=EXCLUDED.version, state_json=EXCLUDED.state_json, updated_at=EXCLUDED.updated_at",
+		ns.TaskID, ns.NodeKey, ns.Kind, ns.Version, ns.StateJSON, ns.UpdatedAt)
+	return err
+}
+
+const queueSelect = "SELECT id,namespace,task_id,node_key,service,input_json,status,worker_id,created_at,started_at,timeout_at FROM task_queue"
+
+func scanQueueTask(row scanner) (store.QueueTask, error) {
+	var q store.QueueTask
+	var wid sql.NullString
+	err := row.Scan(&q.ID, &q.Namespace, &q.TaskID, &q.NodeKey, &q.Service, &q.InputJSON, &q.Status, &wid, &q.CreatedAt, &q.StartedAt, &q.TimeoutAt)
+	q.WorkerID = wid.String
+	return q, err
+}
+
+func (s *Postgres) GetQueueTask(id string) (store.QueueTask, error) {
+	return scanQueueTask(s.DB.QueryRow(queueSelect+" WHERE id=$1", id))
+}
+
+func (s *Postgres) ListQueueTasks(taskID string) ([]store.QueueTask, error) {
+	rows, err := s.DB.Query(queueSelect+" WHERE task_id=$1 ORDER BY created_at, id", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.QueueTask{}
+	for rows.Next() {
+		q, err := scanQueueTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+func (s *Postgres) RestoreQueueTask(q store.QueueTask) error {
+	return insertOnce(s.DB, "INSERT INTO task_queue(id,namespace,task_id,node_key,service,input_json,status,worker_id,created_at,started_at,timeout_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) ON CONFLICT (id) DO NOTHING",
+		q.ID, store.Namespace(q.Namespace), q.TaskID, q.NodeKey, q.Service, q.InputJSON, q.Status, q.WorkerID, q.CreatedAt, q.StartedAt, q.TimeoutAt)
+}
@@ -0,0 +1,248 @@
+package pgstore
+
+import (
+	"github.com/nuknal/PocketFlowGo/pkg/store/migrate"
+)
+
+// migrations is the ordered PostgreSQL schema history. Append new entries;
+// never edit one that has shipped.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS flows (id TEXT PRIMARY KEY, name TEXT, description TEXT, created_at BIGINT);",
+			"CREATE TABLE IF NOT EXISTS flow_versions (id TEXT PRIMARY KEY, flow_id TEXT, version INTEGER, definition_json TEXT, status TEXT, created_at BIGINT);",
+			"CREATE TABLE IF NOT EXISTS nodes (id TEXT PRIMARY KEY, flow_version_id TEXT, node_key TEXT, service TEXT, kind TEXT, config_json TEXT);",
+			"CREATE TABLE IF NOT EXISTS edges (id TEXT PRIMARY KEY, flow_version_id TEXT, from_node_key TEXT, action TEXT, to_node_key TEXT);",
+			"CREATE TABLE IF NOT EXISTS tasks (id TEXT PRIMARY KEY, flow_version_id TEXT, status TEXT, params_json TEXT, shared_json TEXT, current_node_key TEXT, last_action TEXT, step_count INTEGER, retry_state_json TEXT, lease_owner TEXT, lease_expiry BIGINT, request_id TEXT, created_at BIGINT, updated_at BIGINT);",
+			"CREATE TABLE IF NOT EXISTS node_runs (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, attempt_no INTEGER, status TEXT, sub_status TEXT, branch_id TEXT, prep_json TEXT, exec_input_json TEXT, exec_output_json TEXT, error_text TEXT, action TEXT, started_at BIGINT, finished_at BIGINT, worker_id TEXT, worker_url TEXT, log_path TEXT);",
+			"CREATE TABLE IF NOT EXISTS workers (id TEXT PRIMARY KEY, url TEXT, services_json TEXT, load INTEGER, last_heartbeat BIGINT, status TEXT, type TEXT);",
+			"CREATE TABLE IF NOT EXISTS task_queue (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, service TEXT, input_json TEXT, status TEXT, worker_id TEXT, created_at BIGINT, started_at BIGINT, timeout_at BIGINT);",
+			"CREATE INDEX IF NOT EXISTS idx_queue_service_status ON task_queue(service, status);",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_status_lease ON tasks(status, lease_expiry);",
+			"CREATE INDEX IF NOT EXISTS idx_node_runs_task ON node_runs(task_id, started_at);",
+		),
+		Down: migrate.Exec(
+			"DROP TABLE IF EXISTS task_queue;",
+			"DROP TABLE IF EXISTS workers;",
+			"DROP TABLE IF EXISTS node_runs;",
+			"DROP TABLE IF EXISTS tasks;",
+			"DROP TABLE IF EXISTS edges;",
+			"DROP TABLE IF EXISTS nodes;",
+			"DROP TABLE IF EXISTS flow_versions;",
+			"DROP TABLE IF EXISTS flows;",
+		),
+	},
+	{
+		Version: 2,
+		Name:    "task_revision",
+		Up:      migrate.AddColumn(migrate.Postgres, "tasks", "revision", "BIGINT NOT NULL DEFAULT 1"),
+		Down:    migrate.DropColumn(migrate.Postgres, "tasks", "revision"),
+	},
+	{
+		// Idempotency keys (request_id) are unique per flow.
+		Version: 3,
+		Name:    "task_flow_request_id",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.Postgres, "tasks", "flow_id", "TEXT NOT NULL DEFAULT ''"),
+			migrate.Exec(
+				"UPDATE tasks t SET flow_id=fv.flow_id FROM flow_versions fv WHERE fv.id=t.flow_version_id",
+				"UPDATE tasks SET request_id='' WHERE request_id IS NULL",
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_tasks_flow_request ON tasks(flow_id, request_id) WHERE request_id <> ''",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_tasks_flow_request"),
+			migrate.DropColumn(migrate.Postgres, "tasks", "flow_id"),
+		),
+	},
+	{
+		// Indexes for SearchTasks. Empty params/shared documents become {}
+		// so JSON path filters never see malformed input.
+		Version: 4,
+		Name:    "task_search_indexes",
+		Up: migrate.Exec(
+			"UPDATE tasks SET params_json='{}' WHERE params_json IS NULL OR params_json=''",
+			"UPDATE tasks SET shared_json='{}' WHERE shared_json IS NULL OR shared_json=''",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_status_updated ON tasks(status, updated_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_flow_created ON tasks(flow_id, created_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_created ON tasks(created_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_updated ON tasks(updated_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_node ON tasks(current_node_key)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_lease_owner ON tasks(lease_owner)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_tasks_lease_owner",
+			"DROP INDEX IF EXISTS idx_tasks_node",
+			"DROP INDEX IF EXISTS idx_tasks_updated",
+			"DROP INDEX IF EXISTS idx_tasks_created",
+			"DROP INDEX IF EXISTS idx_tasks_flow_created",
+			"DROP INDEX IF EXISTS idx_tasks_status_updated",
+		),
+	},
+	{
+		Version: 5,
+		Name:    "retention_policies",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS retention_policies (flow_id TEXT NOT NULL, status TEXT NOT NULL, keep_sec BIGINT NOT NULL, updated_at BIGINT, PRIMARY KEY (flow_id, status))",
+			"CREATE INDEX IF NOT EXISTS idx_queue_task ON task_queue(task_id)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_queue_task",
+			"DROP TABLE IF EXISTS retention_policies",
+		),
+	},
+	{
+		// Append-only journal of task state changes.
+		Version: 6,
+		Name:    "task_events",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS task_events (seq BIGSERIAL PRIMARY KEY, task_id TEXT NOT NULL, type TEXT NOT NULL, from_status TEXT NOT NULL DEFAULT '', to_status TEXT NOT NULL DEFAULT '', node_key TEXT NOT NULL DEFAULT '', actor TEXT NOT NULL DEFAULT '', data_json TEXT NOT NULL DEFAULT '{}', created_at BIGINT NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS idx_task_events_task ON task_events(task_id, seq)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_task_events_task",
+			"DROP TABLE IF EXISTS task_events",
+		),
+	},
+	{
+		// Engine bookkeeping per task node, formerly kept under shared._rt.
+		Version: 7,
+		Name:    "node_states",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS node_states (task_id TEXT NOT NULL, node_key TEXT NOT NULL, kind TEXT NOT NULL DEFAULT '', version INTEGER NOT NULL DEFAULT 1, state_json TEXT NOT NULL, updated_at BIGINT NOT NULL, PRIMARY KEY (task_id, node_key))",
+		),
+		Down: migrate.Exec(
+			"DROP TABLE IF EXISTS node_states",
+		),
+	},
+	{
+		// Shared state moves from tasks.shared_json to one row per key, so
+		// writers of different keys no longer overwrite each other.
+		Version: 8,
+		Name:    "task_shared",
+		Up: migrate.Steps(
+			migrate.Exec(
+				"CREATE TABLE IF NOT EXISTS task_shared (task_id TEXT NOT NULL, key TEXT NOT NULL, value_json TEXT NOT NULL, size BIGINT NOT NULL, updated_at BIGINT NOT NULL, PRIMARY KEY (task_id, key))",
+				`INSERT INTO task_shared(task_id,key,value_json,size,updated_at)
+				SELECT t.id, j.key, j.value::text, octet_length(j.key) + octet_length(j.value::text), COALESCE(t.updated_at, 0)
+				FROM tasks t, jsonb_each(CASE WHEN t.shared_json LIKE '{%' THEN t.shared_json::jsonb ELSE '{}'::jsonb END) j
+				ON CONFLICT DO NOTHING`,
+			),
+			migrate.DropColumn(migrate.Postgres, "tasks", "shared_json"),
+			migrate.AddColumn(migrate.Postgres, "tasks", "shared_max_bytes", "BIGINT NOT NULL DEFAULT 0"),
+			migrate.AddColumn(migrate.Postgres, "tasks", "shared_max_key_bytes", "BIGINT NOT NULL DEFAULT 0"),
+		),
+		Down: migrate.Steps(
+			migrate.DropColumn(migrate.Postgres, "tasks", "shared_max_key_bytes"),
+			migrate.DropColumn(migrate.Postgres, "tasks", "shared_max_bytes"),
+			migrate.AddColumn(migrate.Postgres, "tasks", "shared_json", "TEXT NOT NULL DEFAULT '{}'"),
+			migrate.Exec(
+				`UPDATE tasks SET shared_json=COALESCE((SELECT '{' || string_agg(to_json(s.key)::text || ':' || s.value_json, ',' ORDER BY s.key COLLATE "C") || '}' FROM task_shared s WHERE s.task_id = tasks.id), '{}')`,
+				"DROP TABLE IF EXISTS task_shared",
+			),
+		),
+	},
+	{
+		// Flows, tasks, workers and queue entries are grouped by namespace;
+		// existing rows land in the default one.
+		Version: 9,
+		Name:    "namespaces",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.Postgres, "flows", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.Postgres, "tasks", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.Postgres, "workers", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.Postgres, "task_queue", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.Exec(
+				"CREATE INDEX IF NOT EXISTS idx_flows_namespace ON flows(namespace, created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_tasks_namespace ON tasks(namespace, updated_at)",
+				"CREATE INDEX IF NOT EXISTS idx_queue_namespace ON task_queue(namespace, service, status)",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec(
+				"DROP INDEX IF EXISTS idx_queue_namespace",
+				"DROP INDEX IF EXISTS idx_tasks_namespace",
+				"DROP INDEX IF EXISTS idx_flows_namespace",
+			),
+			migrate.DropColumn(migrate.Postgres, "task_queue", "namespace"),
+			migrate.DropColumn(migrate.Postgres, "workers", "namespace"),
+			migrate.DropColumn(migrate.Postgres, "tasks", "namespace"),
+			migrate.DropColumn(migrate.Postgres, "flows", "namespace"),
+		),
+	},
+	{
+		// Tasks waiting to retry a node are not leased before next_run_at
+		// (unix milliseconds).
+		Version: 10,
+		Name:    "next_run_at",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.Postgres, "tasks", "next_run_at", "BIGINT NOT NULL DEFAULT 0"),
+			migrate.Exec("CREATE INDEX IF NOT EXISTS idx_tasks_next_run ON tasks(status, next_run_at)"),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_tasks_next_run"),
+			migrate.DropColumn(migrate.Postgres, "tasks", "next_run_at"),
+		),
+	},
+	{
+		// Node runs started in the same second (started_at has whole
+		// seconds) are listed in the order they were written. Existing runs are
+		// numbered by started_at and ID.
+		Version: 11,
+		Name:    "node_run_seq",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.Postgres, "node_runs", "seq", "BIGINT"),
+			migrate.Exec(
+				"CREATE SEQUENCE IF NOT EXISTS node_runs_seq OWNED BY node_runs.seq",
+				"UPDATE node_runs SET seq=o.n FROM (SELECT id, row_number() OVER (ORDER BY started_at, id) AS n FROM node_runs) o WHERE node_runs.id=o.id",
+				"SELECT setval('node_runs_seq', (SELECT COALESCE(MAX(seq), 0) + 1 FROM node_runs), false)",
+				"ALTER TABLE node_runs ALTER COLUMN seq SET DEFAULT nextval('node_runs_seq'), ALTER COLUMN seq SET NOT NULL",
+				"CREATE INDEX IF NOT EXISTS idx_node_runs_seq ON node_runs(task_id, seq)",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_node_runs_seq"),
+			migrate.DropColumn(migrate.Postgres, "node_runs", "seq"),
+		),
+	},
+	{
+		// Retention policies belong to a namespace, and one without a flow
+		// only covers that namespace. Flow policies move to their flow's
+		// namespace, the others to the default one.
+		Version: 12,
+		Name:    "retention_namespace",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.Postgres, "retention_policies", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.Exec(
+				"UPDATE retention_policies p SET namespace=f.namespace FROM flows f WHERE f.id = p.flow_id",
+				"ALTER TABLE retention_policies DROP CONSTRAINT IF EXISTS retention_policies_pkey",
+				"ALTER TABLE retention_policies ADD PRIMARY KEY (namespace, flow_id, status)",
+			),
+		),
+		// Only the default namespace's policies without a flow survive.
+		Down: migrate.Steps(
+			migrate.Exec(
+				"DELETE FROM retention_policies WHERE flow_id = '' AND namespace <> 'default'",
+				"ALTER TABLE retention_policies DROP CONSTRAINT IF EXISTS retention_policies_pkey",
+				"ALTER TABLE retention_policies ADD PRIMARY KEY (flow_id, status)",
+			),
+			migrate.DropColumn(migrate.Postgres, "retention_policies", "namespace"),
+		),
+	},
+	{
+		// GIN indexes for SearchTasks equality filters on JSON paths, which
+		// it writes as containment (@>) of the path's value.
+		Version: 13,
+		Name:    "task_search_json_indexes",
+		Up: migrate.Exec(
+			"CREATE INDEX IF NOT EXISTS idx_tasks_params_gin ON tasks USING GIN ((NULLIF(params_json,'')::jsonb) jsonb_path_ops)",
+			"CREATE INDEX IF NOT EXISTS idx_task_shared_value_gin ON task_shared USING GIN ((value_json::jsonb) jsonb_path_ops)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_task_shared_value_gin",
+			"DROP INDEX IF EXISTS idx_tasks_params_gin",
+		),
+	},
+}
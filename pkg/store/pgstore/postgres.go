@@ -0,0 +1,798 @@
+// Package pgstore implements store.Store on top of PostgreSQL.
+package pgstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/migrate"
+)
+
+// Postgres implements the Store interface using a PostgreSQL database.
+// Leasing and queue polling use SELECT ... FOR UPDATE SKIP LOCKED so that
+// several schedulers can share one database.
+type Postgres struct{ DB *sql.DB }
+
+// OpenPostgres opens a connection to the PostgreSQL database described by dsn
+// and migrates it to the latest schema version.
+func OpenPostgres(dsn string) (*Postgres, error) {
+	s, err := ConnectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Init(); err != nil {
+		s.DB.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ConnectPostgres opens the database without touching its schema.
+func ConnectPostgres(dsn string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{DB: db}, nil
+}
+
+// Migrator returns the schema migrator for this database.
+func (s *Postgres) Migrator() *migrate.Migrator {
+	return migrate.New(s.DB, migrate.Postgres, migrations)
+}
+
+// Init initializes the database schema by applying pending migrations.
+func (s *Postgres) Init() error {
+	_, err := s.Migrator().Up(0)
+	return err
+}
+
+func nowUnix() int64 { return store.NowUnix() }
+
+func genID(prefix string) string { return store.GenID(prefix) }
+
+const taskSelect = `SELECT
+		t.id, t.namespace, t.flow_version_id, t.status, t.params_json, ` + sharedDoc + `, t.current_node_key, t.last_action, t.step_count, t.retry_state_json, t.next_run_at, t.lease_owner, t.lease_expiry, t.request_id, t.created_at, t.updated_at, t.revision, t.shared_max_bytes, t.shared_max_key_bytes,
+		COALESCE(f.id, ''), COALESCE(f.name, ''), COALESCE(fv.version, 0)
+	FROM tasks t
+	LEFT JOIN flow_versions fv ON t.flow_version_id = fv.id
+	LEFT JOIN flows f ON fv.flow_id = f.id`
+
+const nodeRunSelect = "SELECT id,task_id,node_key,attempt_no,status,sub_status,branch_id,prep_json,exec_input_json,exec_output_json,error_text,action,started_at,finished_at,worker_id,worker_url,log_path FROM node_runs"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTask(row scanner) (store.Task, error) {
+	var t store.Task
+	err := row.Scan(&t.ID, &t.Namespace, &t.FlowVersionID, &t.Status, &t.ParamsJSON, &t.SharedJSON, &t.CurrentNodeKey, &t.LastAction, &t.StepCount, &t.RetryStateJSON, &t.NextRunAt, &t.LeaseOwner, &t.LeaseExpiry, &t.RequestID, &t.CreatedAt, &t.UpdatedAt, &t.Revision, &t.SharedLimits.MaxBytes, &t.SharedLimits.MaxKeyBytes, &t.FlowID, &t.FlowName, &t.FlowVersion)
+	return t, err
+}
+
+func scanNodeRun(row scanner) (store.NodeRun, error) {
+	var r store.NodeRun
+	var sub, branch, lp sql.NullString
+	if err := row.Scan(&r.ID, &r.TaskID, &r.NodeKey, &r.AttemptNo, &r.Status, &sub, &branch, &r.PrepJSON, &r.ExecInputJSON, &r.ExecOutputJSON, &r.ErrorText, &r.Action, &r.StartedAt, &r.FinishedAt, &r.WorkerID, &r.WorkerURL, &lp); err != nil {
+		return store.NodeRun{}, err
+	}
+	r.SubStatus = sub.String
+	r.BranchID = branch.String
+	r.LogPath = lp.String
+	return r, nil
+}
+
+func scanFlowVersion(row scanner) (store.FlowVersion, error) {
+	var fv store.FlowVersion
+	if err := row.Scan(&fv.ID, &fv.FlowID, &fv.Version, &fv.DefinitionJSON, &fv.Status); err != nil {
+		return store.FlowVersion{}, err
+	}
+	return fv, nil
+}
+
+// RegisterWorker registers or updates a worker in the database.
+func (s *Postgres) RegisterWorker(w store.WorkerInfo) error {
+	b, _ := json.Marshal(w.Services)
+	// Default to http if type is missing
+	if w.Type == "" {
+		w.Type = "http"
+	}
+	_, err := s.DB.Exec("INSERT INTO workers(id,namespace,url,services_json,load,last_heartbeat,status,type) VALUES($1,$2,$3,$4,$5,$6,$7,$8) ON CONFLICT(id) DO UPDATE SET namespace=excluded.namespace, url=excluded.url, services_json=excluded.services_json, load=excluded.load, last_heartbeat=excluded.last_heartbeat, status=excluded.status, type=excluded.type", w.ID, store.Namespace(w.Namespace), w.URL, string(b), w.Load, nowUnix(), w.Status, w.Type)
+	return err
+}
+
+func (s *Postgres) HeartbeatWorker(id string, url string, load int) error {
+	_, err := s.DB.Exec("UPDATE workers SET last_heartbeat=$1, load=$2, status='online' WHERE id=$3 OR url=$4", nowUnix(), load, id, url)
+	return err
+}
+
+func (s *Postgres) RefreshWorkersStatus(ttl int64) error {
+	if ttl <= 0 {
+		return nil
+	}
+	th := nowUnix() - ttl
+	_, err := s.DB.Exec("UPDATE workers SET status='offline' WHERE last_heartbeat>0 AND last_heartbeat<$1", th)
+	return err
+}
+
+func (s *Postgres) ListWorkers(namespace string, service string, ttl int64) ([]store.WorkerInfo, error) {
+	rows, err := s.DB.Query("SELECT id,namespace,url,services_json,load,last_heartbeat,status,type FROM workers WHERE $1='' OR namespace=$1", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.WorkerInfo{}
+	now := nowUnix()
+	for rows.Next() {
+		var id, ns, url, sj, status string
+		var typeStr sql.NullString
+		var load int
+		var hb int64
+		if err := rows.Scan(&id, &ns, &url, &sj, &load, &hb, &status, &typeStr); err != nil {
+			return nil, err
+		}
+		if ttl > 0 && now-hb > ttl {
+			continue
+		}
+		var arr []string
+		_ = json.Unmarshal([]byte(sj), &arr)
+		if service != "" {
+			ok := false
+			for _, sname := range arr {
+				if sname == service {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+		out = append(out, store.WorkerInfo{ID: id, Namespace: ns, URL: url, Services: arr, Load: load, LastHeartbeat: hb, Status: status, Type: typeStr.String})
+	}
+	return out, rows.Err()
+}
+
+func (s *Postgres) CreateFlow(namespace string, name string, description string) (string, error) {
+	id := genID("flow")
+	_, err := s.DB.Exec("INSERT INTO flows(id,namespace,name,description,created_at) VALUES($1,$2,$3,$4,$5)", id, store.Namespace(namespace), name, description, nowUnix())
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *Postgres) CreateFlowVersion(flowID string, version int, definitionJSON string, status string) (string, error) {
+	id := genID("ver")
+	_, err := s.DB.Exec("INSERT INTO flow_versions(id,flow_id,version,definition_json,status,created_at) VALUES($1,$2,$3,$4,$5,$6)", id, flowID, version, definitionJSON, status, nowUnix())
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *Postgres) GetFlow(id string) (store.Flow, error) {
+	var f store.Flow
+	var desc sql.NullString
+	err := s.DB.QueryRow("SELECT id, namespace, name, description, created_at FROM flows WHERE id=$1", id).Scan(&f.ID, &f.Namespace, &f.Name, &desc, &f.CreatedAt)
+	f.Description = desc.String
+	return f, err
+}
+
+func (s *Postgres) ListFlows(namespace string, limit, offset int) ([]store.Flow, int64, error) {
+	var count int64
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM flows WHERE $1='' OR namespace=$1", namespace).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	q := "SELECT id, namespace, name, description, created_at FROM flows WHERE $1='' OR namespace=$1 ORDER BY created_at DESC"
+	args := []interface{}{namespace}
+	if limit > 0 {
+		q += " LIMIT $2 OFFSET $3"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var flows []store.Flow
+	for rows.Next() {
+		var f store.Flow
+		var desc sql.NullString
+		if err := rows.Scan(&f.ID, &f.Namespace, &f.Name, &desc, &f.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		f.Description = desc.String
+		flows = append(flows, f)
+	}
+	return flows, count, rows.Err()
+}
+
+func (s *Postgres) ListFlowVersions(flowID string) ([]store.FlowVersion, error) {
+	rows, err := s.DB.Query("SELECT id, flow_id, version, definition_json, status FROM flow_versions WHERE flow_id=$1 ORDER BY version DESC", flowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []store.FlowVersion
+	for rows.Next() {
+		fv, err := scanFlowVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, fv)
+	}
+	return versions, rows.Err()
+}
+
+func (s *Postgres) LatestPublishedVersion(flowID string) (store.FlowVersion, error) {
+	return scanFlowVersion(s.DB.QueryRow("SELECT id,flow_id,version,definition_json,status FROM flow_versions WHERE flow_id=$1 AND status='published' ORDER BY version DESC LIMIT 1", flowID))
+}
+
+func (s *Postgres) GetFlowVersionByFlowIDAndVersion(flowID string, version int) (store.FlowVersion, error) {
+	return scanFlowVersion(s.DB.QueryRow("SELECT id,flow_id,version,definition_json,status FROM flow_versions WHERE flow_id=$1 AND version=$2", flowID, version))
+}
+
+func (s *Postgres) GetFlowVersionByID(id string) (store.FlowVersion, error) {
+	return scanFlowVersion(s.DB.QueryRow("SELECT id,flow_id,version,definition_json,status FROM flow_versions WHERE id=$1", id))
+}
+
+// flowNamespace is the namespace of the flow of flow version $2.
+const flowNamespace = "COALESCE((SELECT f.namespace FROM flow_versions v JOIN flows f ON f.id = v.flow_id WHERE v.id=$2),'default')"
+
+const insertTask = "INSERT INTO tasks(id,flow_version_id,flow_id,namespace,status,params_json,current_node_key,last_action,step_count,retry_state_json,lease_owner,lease_expiry,request_id,created_at,updated_at,revision) VALUES($1,$2,COALESCE((SELECT flow_id FROM flow_versions WHERE id=$2),'')," + flowNamespace + ",$3,COALESCE(NULLIF($4,''),'{}'),$5,$6,$7,$8,$9,$10,$11,$12,$13,1)"
+
+func (s *Postgres) CreateTask(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, error) {
+	id := genID("task")
+	now := nowUnix()
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(insertTask, id, flowVersionID, "pending", paramsJSON, startNode, "", 0, "{}", "", 0, requestID, now, now); err != nil {
+			return err
+		}
+		return appendEvent(tx, store.TaskEvent{TaskID: id, Type: "create", ToStatus: "pending", NodeKey: startNode})
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *Postgres) CreateTaskOnce(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, bool, error) {
+	if requestID == "" {
+		id, err := s.CreateTask(flowVersionID, paramsJSON, requestID, startNode)
+		return id, err == nil, err
+	}
+	id := genID("task")
+	now := nowUnix()
+	created := false
+	err := s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(insertTask+" ON CONFLICT (flow_id, request_id) WHERE request_id <> '' DO NOTHING", id, flowVersionID, "pending", paramsJSON, startNode, "", 0, "{}", "", 0, requestID, now, now)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		created = true
+		return appendEvent(tx, store.TaskEvent{TaskID: id, Type: "create", ToStatus: "pending", NodeKey: startNode})
+	})
+	if err != nil || created {
+		return id, created, err
+	}
+	err = s.DB.QueryRow("SELECT id FROM tasks WHERE flow_id=COALESCE((SELECT flow_id FROM flow_versions WHERE id=$1),'') AND request_id=$2", flowVersionID, requestID).Scan(&id)
+	if err != nil {
+		return "", false, err
+	}
+	return id, false, nil
+}
+
+func (s *Postgres) GetTask(id string) (store.Task, error) {
+	return scanTask(s.DB.QueryRow(taskSelect+" WHERE t.id=$1", id))
+}
+
+// LeaseNextTask claims the oldest runnable task. Rows locked by another
+// scheduler's lease transaction are skipped instead of waited on.
+func (s *Postgres) LeaseNextTask(owner string, ttlSec int64) (store.Task, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return store.Task{}, err
+	}
+	now := nowUnix()
+	var id, from, node string
+	err = tx.QueryRow("SELECT id, status, current_node_key FROM tasks WHERE status IN ('pending','running','waiting_retry','compensating','canceling') AND (lease_expiry=0 OR lease_expiry<$1) AND (next_run_at<=$2 OR status='canceling') ORDER BY updated_at ASC LIMIT 1 FOR UPDATE SKIP LOCKED", now, store.NowMillis()).Scan(&id, &from, &node)
+	if err != nil {
+		tx.Rollback()
+		return store.Task{}, err
+	}
+	to := store.LeasedStatus(from)
+	if _, err := tx.Exec("UPDATE tasks SET lease_owner=$1, lease_expiry=$2, status=$3, revision=revision+1 WHERE id=$4", owner, now+ttlSec, to, id); err != nil {
+		tx.Rollback()
+		return store.Task{}, err
+	}
+	if err := appendEvent(tx, store.TaskEvent{TaskID: id, Type: "lease", FromStatus: from, ToStatus: to, NodeKey: node, Actor: owner}); err != nil {
+		tx.Rollback()
+		return store.Task{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return store.Task{}, err
+	}
+	return s.GetTask(id)
+}
+
+func (s *Postgres) ExtendLease(id string, owner string, ttlSec int64) error {
+	_, err := s.DB.Exec("UPDATE tasks SET lease_owner=$1, lease_expiry=$2 WHERE id=$3 AND lease_owner=$4", owner, nowUnix()+ttlSec, id, owner)
+	return err
+}
+
+func (s *Postgres) UpdateTaskStatus(id string, status string) error {
+	return s.SetTaskStatus(id, status, store.TaskEvent{})
+}
+
+func (s *Postgres) SetTaskStatus(id string, status string, ev store.TaskEvent) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := journaledUpdate(tx, id, status, ev, "UPDATE tasks SET status=$1, revision=revision+1, updated_at=$2 WHERE id=$3", status, nowUnix(), id)
+		return err
+	})
+}
+
+func (s *Postgres) RequestCancel(id string, ev store.TaskEvent) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "canceling", ev, "UPDATE tasks SET status='canceling', revision=revision+1, updated_at=$1 WHERE id=$2 AND status NOT IN "+finishedIn, nowUnix(), id)
+		if err != nil || ok {
+			return err
+		}
+		var status string
+		if err := tx.QueryRow("SELECT status FROM tasks WHERE id=$1", id).Scan(&status); err != nil {
+			return err
+		}
+		return store.ErrFinished
+	})
+}
+
+func (s *Postgres) UpdateTaskStatusOwned(id string, owner string, status string) error {
+	now := nowUnix()
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := journaledUpdate(tx, id, status, store.TaskEvent{Actor: owner}, "UPDATE tasks SET status=$1, revision=revision+1, updated_at=$2 WHERE id=$3 AND lease_owner=$4 AND lease_expiry>$5", status, now, id, owner, now)
+		return err
+	})
+}
+
+func (s *Postgres) UpdateTaskProgress(id string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", store.TaskEvent{Type: "step", NodeKey: currentNode}, "UPDATE tasks SET current_node_key=$1, last_action=$2, step_count=$3, revision=revision+1, updated_at=$4 WHERE id=$5", currentNode, lastAction, stepCount, nowUnix(), id)
+		if err != nil || !ok {
+			return err
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
+}
+
+func (s *Postgres) UpdateTaskProgressOwned(id string, owner string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
+	now := nowUnix()
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", store.TaskEvent{Type: "step", NodeKey: currentNode, Actor: owner}, "UPDATE tasks SET current_node_key=$1, last_action=$2, step_count=$3, revision=revision+1, updated_at=$4 WHERE id=$5 AND lease_owner=$6 AND lease_expiry>$7", currentNode, lastAction, stepCount, now, id, owner, now)
+		if err != nil || !ok {
+			return err
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
+}
+
+func (s *Postgres) TransitionTask(id string, owner string, tr store.TaskTransition) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := nowUnix()
+	q := "UPDATE tasks SET status=$1, current_node_key=$2, last_action=$3, step_count=$4, retry_state_json=COALESCE(NULLIF($5,''),retry_state_json), next_run_at=$6, revision=revision+1, updated_at=$7"
+	if tr.NextRunAt != 0 {
+		q += ", lease_owner='', lease_expiry=0"
+	}
+	q += " WHERE id=$8"
+	args := []interface{}{tr.Status, tr.CurrentNode, tr.LastAction, tr.StepCount, tr.RetryStateJSON, tr.NextRunAt, now, id}
+	if owner != "" {
+		args = append(args, owner, now)
+		q += fmt.Sprintf(" AND lease_owner=$%d AND lease_expiry>$%d", len(args)-1, len(args))
+	}
+	if tr.Revision != 0 {
+		args = append(args, tr.Revision)
+		q += fmt.Sprintf(" AND revision=$%d", len(args))
+	}
+	ok, err := journaledUpdate(tx, id, tr.Status, store.TaskEvent{NodeKey: tr.CurrentNode, Actor: owner}, q, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return missReason(tx, id, owner, tr.Revision, now)
+	}
+	if tr.SharedJSON != "" {
+		if err := replaceShared(tx, id, tr.SharedJSON); err != nil {
+			return err
+		}
+	}
+	if err := writeShared(tx, id, tr.Shared); err != nil {
+		return err
+	}
+	for _, nr := range tr.NodeRuns {
+		if _, ok := nr["id"]; !ok {
+			nr["id"] = genID("run")
+		}
+		if err := insertNodeRun(tx, nr); err != nil {
+			return err
+		}
+	}
+	for _, ns := range tr.NodeStates {
+		if err := saveNodeState(tx, id, ns); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Postgres) UpdateTaskShared(id string, revision int64, sharedJSON string, ev store.TaskEvent) error {
+	now := nowUnix()
+	q := "UPDATE tasks SET revision=revision+1, updated_at=$1 WHERE id=$2"
+	args := []interface{}{now, id}
+	if revision != 0 {
+		q += " AND revision=$3"
+		args = append(args, revision)
+	}
+	if ev.Type == "" {
+		ev.Type = "shared"
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", ev, q, args...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return missReason(tx, id, "", revision, now)
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// missReason explains why a conditional task update matched no row.
+func missReason(db queryer, id string, owner string, revision int64, now int64) error {
+	var leaseOwner string
+	var leaseExpiry, rev int64
+	if err := db.QueryRow("SELECT lease_owner, lease_expiry, revision FROM tasks WHERE id=$1", id).Scan(&leaseOwner, &leaseExpiry, &rev); err != nil {
+		return err
+	}
+	if owner != "" && (leaseOwner != owner || leaseExpiry <= now) {
+		return store.ErrLeaseLost
+	}
+	return store.ErrConflict
+}
+
+func (s *Postgres) ListTasks(namespace string, status string, flowVersionID string, limit, offset int) ([]store.Task, int64, error) {
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	if namespace != "" {
+		args = append(args, namespace)
+		where += fmt.Sprintf(" AND t.namespace=$%d", len(args))
+	}
+	if status != "" {
+		args = append(args, status)
+		where += fmt.Sprintf(" AND t.status=$%d", len(args))
+	}
+	if flowVersionID != "" {
+		args = append(args, flowVersionID)
+		where += fmt.Sprintf(" AND t.flow_version_id=$%d", len(args))
+	}
+	var count int64
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM tasks t"+where, args...).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	q := taskSelect + where + " ORDER BY t.updated_at DESC"
+	if limit > 0 {
+		args = append(args, limit, offset)
+		q += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+	rows, err := s.DB.Query(q, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []store.Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, t)
+	}
+	return out, count, rows.Err()
+}
+
+// SearchTasks runs q with keyset pagination on (sort column, id).
+func (s *Postgres) SearchTasks(q store.TaskQuery) (store.TaskPage, error) {
+	col, desc, err := q.SortField()
+	if err != nil {
+		return store.TaskPage{}, err
+	}
+	where := " WHERE 1=1"
+	args := []interface{}{}
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return store.TaskPage{}, err
+		}
+		column, keys, ok := f.JSONPath()
+		if !ok {
+			args = append(args, f.Value)
+			where += fmt.Sprintf(" AND t.%s %s $%d", store.TaskColumns[f.Field], f.Op, len(args))
+			continue
+		}
+		// Paths are validated, so they are inlined. Equality also tests
+		// containment of the value at the path, which the GIN indexes on
+		// params and shared values cover; other comparisons read the path
+		// expression, which an index from IndexJSONPath covers.
+		doc, expr := "NULLIF(t.params_json,'')::jsonb", fmt.Sprintf("(NULLIF(t.params_json,'')::jsonb #> '{%s}')", strings.Join(keys, ","))
+		if column == "shared_json" {
+			doc, expr = "s.value_json::jsonb", fmt.Sprintf("(s.value_json::jsonb #> '{%s}')", strings.Join(keys[1:], ","))
+		}
+		if f.Value == nil {
+			if column == "shared_json" {
+				// A missing key is null too, so look the key up for each
+				// task.
+				expr = fmt.Sprintf("(SELECT %s FROM task_shared s WHERE s.task_id = t.id AND s.key = '%s')", expr, keys[0])
+			}
+			if f.Op == "=" {
+				where += fmt.Sprintf(" AND (%s IS NULL OR %s = 'null'::jsonb)", expr, expr)
+			} else {
+				where += fmt.Sprintf(" AND (%s IS NOT NULL AND %s <> 'null'::jsonb)", expr, expr)
+			}
+			continue
+		}
+		b, err := json.Marshal(f.Value)
+		if err != nil {
+			return store.TaskPage{}, err
+		}
+		args = append(args, string(b))
+		cond := fmt.Sprintf("%s %s $%d::jsonb", expr, f.Op, len(args))
+		if f.Op == "=" {
+			inner := keys
+			if column == "shared_json" {
+				inner = keys[1:]
+			}
+			c, err := json.Marshal(containing(inner, f.Value))
+			if err != nil {
+				return store.TaskPage{}, err
+			}
+			args = append(args, string(c))
+			cond = fmt.Sprintf("%s @> $%d::jsonb AND %s", doc, len(args), cond)
+		}
+		if column == "shared_json" {
+			cond = fmt.Sprintf("t.id IN (SELECT s.task_id FROM task_shared s WHERE s.key = '%s' AND %s)", keys[0], cond)
+		}
+		where += " AND " + cond
+	}
+	cmp, order := ">", " ASC"
+	if desc {
+		cmp, order = "<", " DESC"
+	}
+	if q.Cursor != "" {
+		cv, cid, err := store.DecodeCursor(q.Cursor)
+		if err != nil {
+			return store.TaskPage{}, err
+		}
+		args = append(args, cv, cid)
+		where += fmt.Sprintf(" AND (t.%s, t.id) %s ($%d, $%d)", col, cmp, len(args)-1, len(args))
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	args = append(args, limit+1)
+	query := taskSelect + where + " ORDER BY t." + col + order + ", t.id" + order + fmt.Sprintf(" LIMIT $%d", len(args))
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return store.TaskPage{}, err
+	}
+	defer rows.Close()
+	page := store.TaskPage{Tasks: []store.Task{}}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return store.TaskPage{}, err
+		}
+		page.Tasks = append(page.Tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return store.TaskPage{}, err
+	}
+	if len(page.Tasks) > limit {
+		page.Tasks = page.Tasks[:limit]
+		last := page.Tasks[limit-1]
+		v := last.UpdatedAt
+		if col == "created_at" {
+			v = last.CreatedAt
+		}
+		page.NextCursor = store.EncodeCursor(v, last.ID)
+	}
+	return page, nil
+}
+
+// containing nests v under keys, the document @> tests for a path equal to v.
+func containing(keys []string, v interface{}) interface{} {
+	for i := len(keys) - 1; i >= 0; i-- {
+		v = map[string]interface{}{keys[i]: v}
+	}
+	return v
+}
+
+// IndexJSONPath creates an index on the expression SearchTasks compares for
+// path, for filters other than equality, which the GIN indexes cover.
+func (s *Postgres) IndexJSONPath(path string) error {
+	doc, keys, err := store.IndexPath(path)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "idx_tasks_%s" ON tasks ((NULLIF(params_json,'')::jsonb #> '{%s}'))`, path, strings.Join(keys, ","))
+	if doc == "shared_json" {
+		q = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "idx_task_shared_%s" ON task_shared (key, (value_json::jsonb #> '{%s}'))`, strings.Join(append([]string{"$"}, keys[1:]...), "."), strings.Join(keys[1:], ","))
+	}
+	_, err = s.DB.Exec(q)
+	return err
+}
+
+func (s *Postgres) SaveNodeRun(nr map[string]interface{}) error {
+	nr["id"] = genID("run")
+	return s.CreateNodeRun(nr)
+}
+
+var nodeRunCols = []string{"id", "task_id", "node_key", "attempt_no", "status", "sub_status", "branch_id", "prep_json", "exec_input_json", "exec_output_json", "error_text", "action", "started_at", "finished_at", "worker_id", "worker_url", "log_path"}
+
+func (s *Postgres) CreateNodeRun(nr map[string]interface{}) error {
+	return insertNodeRun(s.DB, nr)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertNodeRun(db execer, nr map[string]interface{}) error {
+	vals := make([]interface{}, 0, len(nodeRunCols))
+	ph := make([]string, 0, len(nodeRunCols))
+	for i, c := range nodeRunCols {
+		vals = append(vals, nr[c])
+		ph = append(ph, fmt.Sprintf("$%d", i+1))
+	}
+	_, err := db.Exec("INSERT INTO node_runs("+strings.Join(nodeRunCols, ",")+") VALUES("+strings.Join(ph, ",")+")", vals...)
+	return err
+}
+
+func (s *Postgres) UpdateNodeRun(id string, updates map[string]interface{}) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	cols := []string{}
+	vals := []interface{}{}
+	for k, v := range updates {
+		vals = append(vals, v)
+		cols = append(cols, fmt.Sprintf("%s=$%d", pq.QuoteIdentifier(k), len(vals)))
+	}
+	vals = append(vals, id)
+	q := fmt.Sprintf("UPDATE node_runs SET %s WHERE id=$%d", strings.Join(cols, ","), len(vals))
+	_, err := s.DB.Exec(q, vals...)
+	return err
+}
+
+func (s *Postgres) ListNodeRuns(taskID string) ([]store.NodeRun, error) {
+	rows, err := s.DB.Query(nodeRunSelect+" WHERE task_id=$1 ORDER BY started_at ASC, seq ASC", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.NodeRun{}
+	for rows.Next() {
+		r, err := scanNodeRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *Postgres) GetNodeRun(id string) (store.NodeRun, error) {
+	return scanNodeRun(s.DB.QueryRow(nodeRunSelect+" WHERE id=$1", id))
+}
+
+// EnqueueTask adds a new task to the queue
+func (s *Postgres) EnqueueTask(taskID, nodeKey, service, inputJSON string) (string, error) {
+	id := genID("q")
+	_, err := s.DB.Exec("INSERT INTO task_queue(id,namespace,task_id,node_key,service,input_json,status,worker_id,created_at,started_at,timeout_at) VALUES($1,COALESCE((SELECT namespace FROM tasks WHERE id=$2),'default'),$2,$3,$4,$5,$6,$7,$8,$9,$10)",
+		id, taskID, nodeKey, service, inputJSON, "pending", "", nowUnix(), 0, 0)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// PollQueue claims the oldest pending queue entry for the given services.
+// Entries locked by a concurrent poller are skipped, so pollers never block
+// each other or claim the same entry.
+func (s *Postgres) PollQueue(namespace string, workerID string, services []string, timeoutSec int64) (store.QueueTask, error) {
+	if len(services) == 0 {
+		return store.QueueTask{}, nil
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return store.QueueTask{}, err
+	}
+
+	var qt store.QueueTask
+	err = tx.QueryRow("SELECT id, namespace, task_id, node_key, service, input_json FROM task_queue WHERE status='pending' AND namespace=$1 AND service = ANY($2) ORDER BY created_at ASC LIMIT 1 FOR UPDATE SKIP LOCKED", store.Namespace(namespace), pq.Array(services)).
+		Scan(&qt.ID, &qt.Namespace, &qt.TaskID, &qt.NodeKey, &qt.Service, &qt.InputJSON)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return store.QueueTask{}, nil
+		}
+		return store.QueueTask{}, err
+	}
+
+	now := nowUnix()
+	timeoutAt := now + timeoutSec
+	if _, err := tx.Exec("UPDATE task_queue SET status='claimed', worker_id=$1, started_at=$2, timeout_at=$3 WHERE id=$4", workerID, now, timeoutAt, qt.ID); err != nil {
+		tx.Rollback()
+		return store.QueueTask{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return store.QueueTask{}, err
+	}
+
+	qt.Status = "claimed"
+	qt.WorkerID = workerID
+	qt.StartedAt = now
+	qt.TimeoutAt = timeoutAt
+	return qt, nil
+}
+
+// CompleteQueueTask marks a queue task as completed and returns its task ID.
+func (s *Postgres) CompleteQueueTask(queueID string) (string, error) {
+	var taskID string
+	err := s.DB.QueryRow("UPDATE task_queue SET status='completed' WHERE id=$1 AND status<>'revoked' RETURNING task_id", queueID).Scan(&taskID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, gerr := s.GetQueueTask(queueID); gerr == nil {
+			return "", store.ErrRevoked
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return taskID, nil
+}
+
+// FailQueueTask marks a queue task as failed
+func (s *Postgres) FailQueueTask(queueID string) error {
+	_, err := s.DB.Exec("UPDATE task_queue SET status='failed' WHERE id=$1 AND status<>'revoked'", queueID)
+	return err
+}
+
+func (s *Postgres) RevokeQueueTasks(taskID string) (int, error) {
+	res, err := s.DB.Exec("UPDATE task_queue SET status='revoked' WHERE task_id=$1 AND status IN ('pending','claimed')", taskID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
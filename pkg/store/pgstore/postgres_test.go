@@ -0,0 +1,157 @@
+package pgstore
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/storetest"
+)
+
+// openTestStore connects to the database in PGSTORE_TEST_DSN and empties it.
+// Tests are skipped when no DSN is configured.
+func openTestStore(t *testing.T) *Postgres {
+	dsn := os.Getenv("PGSTORE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PGSTORE_TEST_DSN not set")
+	}
+	s, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := s.DB.Exec("TRUNCATE flows, flow_versions, tasks, node_runs, workers, task_queue, task_events, task_shared, node_states, retention_policies"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store { return openTestStore(t) })
+}
+
+func TestLeaseNextTaskSkipLocked(t *testing.T) {
+	s := openTestStore(t)
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	const n = 20
+	for i := 0; i < n; i++ {
+		if _, err := s.CreateTask(vid, "{}", "", "a"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	seen := map[string]string{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			for {
+				tk, err := s.LeaseNextTask(owner, 60)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				if prev, ok := seen[tk.ID]; ok {
+					t.Errorf("task %s leased by %s and %s", tk.ID, prev, owner)
+				}
+				seen[tk.ID] = owner
+				mu.Unlock()
+			}
+		}(string(rune('a' + w)))
+	}
+	wg.Wait()
+	if len(seen) != n {
+		t.Fatalf("leased %d tasks, want %d", len(seen), n)
+	}
+}
+
+func TestPollQueueSkipLocked(t *testing.T) {
+	s := openTestStore(t)
+	const n = 20
+	for i := 0; i < n; i++ {
+		if _, err := s.EnqueueTask("task", "node", "svc", "{}"); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			for {
+				qt, err := s.PollQueue("", worker, []string{"svc"}, 60)
+				if err != nil {
+					t.Errorf("%v", err)
+					return
+				}
+				if qt.ID == "" {
+					return
+				}
+				mu.Lock()
+				if seen[qt.ID] {
+					t.Errorf("queue entry %s claimed twice", qt.ID)
+				}
+				seen[qt.ID] = true
+				mu.Unlock()
+			}
+		}(string(rune('a' + w)))
+	}
+	wg.Wait()
+	if len(seen) != n {
+		t.Fatalf("claimed %d entries, want %d", len(seen), n)
+	}
+	if _, err := s.CompleteQueueTask("missing"); err == nil {
+		t.Fatalf("expected error for unknown queue id")
+	}
+}
+
+func TestIndexJSONPath(t *testing.T) {
+	s := openTestStore(t)
+	for _, p := range []string{"$params.customer_id", "$shared.order.id"} {
+		if err := s.IndexJSONPath(p); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if err := s.IndexJSONPath(p); err != nil {
+			t.Fatalf("%s again: %v", p, err)
+		}
+	}
+	if err := s.IndexJSONPath("status"); !errors.Is(err, store.ErrBadQuery) {
+		t.Fatalf("err %v, want ErrBadQuery", err)
+	}
+	var n int
+	if err := s.DB.QueryRow("SELECT COUNT(1) FROM pg_indexes WHERE indexname IN ('idx_tasks_params_gin', 'idx_task_shared_value_gin', 'idx_tasks_$params.customer_id', 'idx_task_shared_$.id')").Scan(&n); err != nil || n != 4 {
+		t.Fatalf("indexes %d %v", n, err)
+	}
+
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	ids := []string{}
+	for _, c := range []string{"41", "42"} {
+		id, err := s.CreateTask(vid, `{"customer_id":`+c+`}`, "", "a")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := s.PatchTaskShared(id, []store.SharedOp{{Op: "set", Key: "order", Value: []byte(`{"id":"o` + c + `"}`)}}, store.TaskEvent{}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		ids = append(ids, id)
+	}
+	for _, q := range []string{"$params.customer_id=42", "$params.customer_id>41", "$shared.order.id=o42", "$shared.order.id>o41"} {
+		fs, err := store.ParseTaskFilters(q)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		page, err := s.SearchTasks(store.TaskQuery{Filters: fs})
+		if err != nil || len(page.Tasks) != 1 || page.Tasks[0].ID != ids[1] {
+			t.Fatalf("%s: %+v %v", q, page.Tasks, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pgstore
+
+import (
+	"database/sql"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// recodeRows reads (key, value) pairs with q and returns the pairs whose
+// value fn changes, holding the new value.
+func recodeRows(tx *sql.Tx, fn func(string) (string, error), q string, args ...interface{}) ([][2]string, error) {
+	rows, err := tx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	var all [][2]string
+	for rows.Next() {
+		var kv [2]string
+		if err := rows.Scan(&kv[0], &kv[1]); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		all = append(all, kv)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	var changed [][2]string
+	for _, kv := range all {
+		v, err := fn(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if v != kv[1] {
+			changed = append(changed, [2]string{kv[0], v})
+		}
+	}
+	return changed, nil
+}
+
+func (s *Postgres) RecodeTask(id string, fn func(stored string) (string, error)) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM tasks WHERE id=$1", id).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return sql.ErrNoRows
+		}
+		params, err := recodeRows(tx, fn, "SELECT id, COALESCE(params_json,'') FROM tasks WHERE id=$1", id)
+		if err != nil {
+			return err
+		}
+		for _, kv := range params {
+			if _, err := tx.Exec("UPDATE tasks SET params_json=$1 WHERE id=$2", kv[1], kv[0]); err != nil {
+				return err
+			}
+		}
+		shared, err := recodeRows(tx, fn, "SELECT key, value_json FROM task_shared WHERE task_id=$1", id)
+		if err != nil {
+			return err
+		}
+		for _, kv := range shared {
+			if _, err := tx.Exec("UPDATE task_shared SET value_json=$1, size=$2 WHERE task_id=$3 AND key=$4", kv[1], store.SharedSize(kv[0], kv[1]), id, kv[0]); err != nil {
+				return err
+			}
+		}
+		for _, col := range []string{"exec_input_json", "exec_output_json"} {
+			runs, err := recodeRows(tx, fn, "SELECT id, COALESCE("+col+",'') FROM node_runs WHERE task_id=$1", id)
+			if err != nil {
+				return err
+			}
+			for _, kv := range runs {
+				if _, err := tx.Exec("UPDATE node_runs SET "+col+"=$1 WHERE id=$2", kv[1], kv[0]); err != nil {
+					return err
+				}
+			}
+		}
+		states, err := recodeRows(tx, fn, "SELECT node_key, state_json FROM node_states WHERE task_id=$1", id)
+		if err != nil {
+			return err
+		}
+		for _, kv := range states {
+			if _, err := tx.Exec("UPDATE node_states SET state_json=$1 WHERE task_id=$2 AND node_key=$3", kv[1], id, kv[0]); err != nil {
+				return err
+			}
+		}
+		jobs, err := recodeRows(tx, fn, "SELECT id, COALESCE(input_json,'') FROM task_queue WHERE task_id=$1", id)
+		if err != nil {
+			return err
+		}
+		for _, kv := range jobs {
+			if _, err := tx.Exec("UPDATE task_queue SET input_json=$1 WHERE id=$2", kv[1], kv[0]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package pgstore
+
+import (
+	"github.com/lib/pq"
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func (s *Postgres) SetRetentionPolicy(p store.RetentionPolicy) error {
+	ns := store.Namespace(p.Namespace)
+	if p.KeepSec <= 0 {
+		_, err := s.DB.Exec("DELETE FROM retention_policies WHERE namespace=$1 AND flow_id=$2 AND status=$3", ns, p.FlowID, p.Status)
+		return err
+	}
+	_, err := s.DB.Exec("INSERT INTO retention_policies(namespace,flow_id,status,keep_sec,updated_at) VALUES($1,$2,$3,$4,$5) ON CONFLICT (namespace,flow_id,status) DO UPDATE SET keep_sec=EXCLUDED.keep_sec, updated_at=EXCLUDED.updated_at", ns, p.FlowID, p.Status, p.KeepSec, nowUnix())
+	return err
+}
+
+func (s *Postgres) ListRetentionPolicies(namespace string) ([]store.RetentionPolicy, error) {
+	rows, err := s.DB.Query("SELECT namespace,flow_id,status,keep_sec,updated_at FROM retention_policies WHERE $1='' OR namespace=$1 ORDER BY namespace, flow_id, status", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.RetentionPolicy{}
+	for rows.Next() {
+		var p store.RetentionPolicy
+		if err := rows.Scan(&p.Namespace, &p.FlowID, &p.Status, &p.KeepSec, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// expiredWhere picks the flow's own policy for the task status, falling
+// back to the default policy of the task's namespace with an empty flow_id.
+const expiredWhere = `
+	LEFT JOIN retention_policies pf ON pf.namespace = t.namespace AND pf.flow_id = t.flow_id AND pf.flow_id <> '' AND pf.status = t.status
+	LEFT JOIN retention_policies pd ON pd.namespace = t.namespace AND pd.flow_id = '' AND pd.status = t.status
+	WHERE t.status IN ('completed','failed','canceled','compensated','compensation_failed')
+	AND t.updated_at + COALESCE(pf.keep_sec, pd.keep_sec) < $1
+	ORDER BY t.updated_at, t.id LIMIT $2`
+
+func (s *Postgres) ListExpiredTasks(now int64, limit int) ([]store.Task, error) {
+	rows, err := s.DB.Query(taskSelect+expiredWhere, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *Postgres) DeleteTasks(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		"DELETE FROM node_runs WHERE task_id = ANY($1)",
+		"DELETE FROM task_events WHERE task_id = ANY($1)",
+		"DELETE FROM node_states WHERE task_id = ANY($1)",
+		"DELETE FROM task_shared WHERE task_id = ANY($1)",
+		"DELETE FROM task_queue WHERE task_id = ANY($1)",
+		"DELETE FROM tasks WHERE id = ANY($1)",
+	} {
+		if _, err := tx.Exec(q, pq.Array(ids)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Postgres) RestoreTask(t store.Task, runs []store.NodeRun, events []store.TaskEvent) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO tasks(id,flow_version_id,flow_id,status,params_json,current_node_key,last_action,step_count,retry_state_json,lease_owner,lease_expiry,request_id,created_at,updated_at,revision,shared_max_bytes,shared_max_key_bytes,namespace,next_run_at) VALUES($1,$2,COALESCE((SELECT flow_id FROM flow_versions WHERE id=$2),$3),$4,$5,$6,$7,$8,$9,'',0,$10,$11,$12,$13,$14,$15,COALESCE((SELECT f.namespace FROM flow_versions v JOIN flows f ON f.id = v.flow_id WHERE v.id=$2),$16),$17) ON CONFLICT (id) DO NOTHING",
+		t.ID, t.FlowVersionID, t.FlowID, t.Status, t.ParamsJSON, t.CurrentNodeKey, t.LastAction, t.StepCount, t.RetryStateJSON, t.RequestID, t.CreatedAt, t.UpdatedAt, t.Revision, t.SharedLimits.MaxBytes, t.SharedLimits.MaxKeyBytes, store.Namespace(t.Namespace), t.NextRunAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrConflict
+	}
+	if err := replaceShared(tx, t.ID, t.SharedJSON); err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if err := insertNodeRun(tx, r.Fields()); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		ev.TaskID = t.ID
+		if err := appendEvent(tx, ev); err != nil {
+			return err
+		}
+	}
+	if err := appendEvent(tx, store.TaskEvent{TaskID: t.ID, Type: "restore", FromStatus: t.Status, ToStatus: t.Status, NodeKey: t.CurrentNodeKey}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
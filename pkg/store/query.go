@@ -0,0 +1,248 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TaskQuery selects tasks for SearchTasks. Filters are ANDed together.
+type TaskQuery struct {
+	Filters []TaskFilter
+	// Sort is "created_at" or "updated_at", optionally prefixed with "-"
+	// for descending order. Empty means "-updated_at".
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+// TaskFilter compares one task field with a value.
+//
+// Field is one of namespace, status, flow_id, flow_version_id, request_id,
+// current_node_key, lease_owner, created_at, updated_at, or a JSON path into
+// params_json or shared_json written as $params.a.b / $shared.a.b.
+type TaskFilter struct {
+	Field string
+	Op    string
+	// Value is a string, int64 (time fields) or, for JSON paths, any value
+	// decoded from JSON: string, float64, bool or nil. nil matches a missing
+	// or null value. Comparing values of different JSON types is only
+	// defined for = and !=.
+	Value interface{}
+}
+
+// TaskPage is one page of SearchTasks results. NextCursor is empty on the
+// last page.
+type TaskPage struct {
+	Tasks      []Task `json:"data"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// ErrBadQuery is wrapped by errors from ParseTaskFilters and SearchTasks
+// for malformed filters, sorts or cursors.
+var ErrBadQuery = errors.New("bad task query")
+
+// TaskColumns maps filterable plain fields to tasks columns.
+var TaskColumns = map[string]string{
+	"namespace":        "namespace",
+	"status":           "status",
+	"flow_id":          "flow_id",
+	"flow_version_id":  "flow_version_id",
+	"request_id":       "request_id",
+	"current_node_key": "current_node_key",
+	"lease_owner":      "lease_owner",
+	"created_at":       "created_at",
+	"updated_at":       "updated_at",
+}
+
+var filterOps = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+var pathKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ParseTaskFilters parses a filter expression such as
+//
+//	status=running and $params.customer_id=42 and created_at>=1700000000
+//
+// Clauses are joined with "and". Values for JSON paths are read as JSON
+// (42, true, "text"); anything that is not valid JSON is taken as a string.
+func ParseTaskFilters(s string) ([]TaskFilter, error) {
+	out := []TaskFilter{}
+	if strings.TrimSpace(s) == "" {
+		return out, nil
+	}
+	for _, clause := range splitAnd(s) {
+		f, err := parseClause(strings.TrimSpace(clause))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// splitAnd splits on the keyword "and" outside double quotes.
+func splitAnd(s string) []string {
+	parts := []string{}
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && i+5 <= len(s) && strings.EqualFold(s[i:i+5], " and "):
+			parts = append(parts, s[start:i])
+			start = i + 5
+			i += 4
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseClause(c string) (TaskFilter, error) {
+	// The operator is the first one in the clause; on a tie the longer
+	// operator wins, which is why filterOps lists them first.
+	at, op := -1, ""
+	for _, o := range filterOps {
+		if i := strings.Index(c, o); i > 0 && (at < 0 || i < at) {
+			at, op = i, o
+		}
+	}
+	if at < 0 {
+		return TaskFilter{}, fmt.Errorf("%w: no operator in %q", ErrBadQuery, c)
+	}
+	f := TaskFilter{Field: strings.TrimSpace(c[:at]), Op: op}
+	if err := f.setValue(strings.TrimSpace(c[at+len(op):])); err != nil {
+		return TaskFilter{}, err
+	}
+	return f, f.Validate()
+}
+
+func (f *TaskFilter) setValue(raw string) error {
+	if _, _, ok := f.JSONPath(); ok {
+		var v interface{}
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			v = raw
+		}
+		f.Value = v
+		return nil
+	}
+	if s, err := strconv.Unquote(raw); err == nil {
+		raw = s
+	}
+	if f.Field == "created_at" || f.Field == "updated_at" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s needs a unix timestamp", ErrBadQuery, f.Field)
+		}
+		f.Value = n
+		return nil
+	}
+	f.Value = raw
+	return nil
+}
+
+// Validate reports whether the filter can be evaluated.
+func (f TaskFilter) Validate() error {
+	ok := false
+	for _, op := range filterOps {
+		if f.Op == op {
+			ok = true
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: unknown operator %q", ErrBadQuery, f.Op)
+	}
+	if doc, keys, isPath := f.JSONPath(); isPath {
+		if doc == "" || len(keys) == 0 {
+			return fmt.Errorf("%w: bad path %q", ErrBadQuery, f.Field)
+		}
+		for _, k := range keys {
+			if !pathKey.MatchString(k) {
+				return fmt.Errorf("%w: bad path %q", ErrBadQuery, f.Field)
+			}
+		}
+		if f.Value == nil && f.Op != "=" && f.Op != "!=" {
+			return fmt.Errorf("%w: null only supports = and !=", ErrBadQuery)
+		}
+		return nil
+	}
+	if _, ok := TaskColumns[f.Field]; !ok {
+		return fmt.Errorf("%w: unknown field %q", ErrBadQuery, f.Field)
+	}
+	return nil
+}
+
+// JSONPath splits a $params/$shared field into the column it reads and the
+// object keys to follow.
+func (f TaskFilter) JSONPath() (column string, keys []string, ok bool) {
+	for prefix, col := range map[string]string{"$params.": "params_json", "$shared.": "shared_json"} {
+		if strings.HasPrefix(f.Field, prefix) {
+			return col, strings.Split(strings.TrimPrefix(f.Field, prefix), "."), true
+		}
+	}
+	return "", nil, false
+}
+
+// JSONPathIndexer is implemented by stores that can index a JSON path so
+// SearchTasks filters on it need not scan every task.
+type JSONPathIndexer interface {
+	// IndexJSONPath creates the index for path, a $params.a.b or
+	// $shared.a.b field, unless it exists.
+	IndexJSONPath(path string) error
+}
+
+// IndexPath validates path for JSONPathIndexer and splits it like
+// TaskFilter.JSONPath.
+func IndexPath(path string) (column string, keys []string, err error) {
+	f := TaskFilter{Field: path, Op: "="}
+	column, keys, ok := f.JSONPath()
+	if !ok {
+		return "", nil, fmt.Errorf("%w: %q is not a JSON path", ErrBadQuery, path)
+	}
+	if err := f.Validate(); err != nil {
+		return "", nil, err
+	}
+	return column, keys, nil
+}
+
+// SortField returns the column to sort by and whether the order is
+// descending.
+func (q TaskQuery) SortField() (string, bool, error) {
+	s := q.Sort
+	if s == "" {
+		s = "-updated_at"
+	}
+	desc := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s != "created_at" && s != "updated_at" {
+		return "", false, fmt.Errorf("%w: cannot sort by %q", ErrBadQuery, s)
+	}
+	return s, desc, nil
+}
+
+// EncodeCursor returns an opaque cursor positioned after the task with the
+// given sort value and ID.
+func EncodeCursor(sortValue int64, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", sortValue, id)))
+}
+
+// DecodeCursor reverses EncodeCursor.
+func DecodeCursor(c string) (int64, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: bad cursor", ErrBadQuery)
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("%w: bad cursor", ErrBadQuery)
+	}
+	v, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: bad cursor", ErrBadQuery)
+	}
+	return v, parts[1], nil
+}
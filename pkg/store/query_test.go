@@ -0,0 +1,37 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseTaskFilters(t *testing.T) {
+	fs, err := ParseTaskFilters(`status=running AND $params.customer_id>=42 and $params.note="a and b" and created_at<10 and lease_owner!=`)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := []TaskFilter{
+		{Field: "status", Op: "=", Value: "running"},
+		{Field: "$params.customer_id", Op: ">=", Value: float64(42)},
+		{Field: "$params.note", Op: "=", Value: "a and b"},
+		{Field: "created_at", Op: "<", Value: int64(10)},
+		{Field: "lease_owner", Op: "!=", Value: ""},
+	}
+	if !reflect.DeepEqual(fs, want) {
+		t.Fatalf("got %+v", fs)
+	}
+
+	for _, bad := range []string{"status", "nope=1", "created_at>yesterday", "$params.a b=1", "$params.x>null"} {
+		if _, err := ParseTaskFilters(bad); !errors.Is(err, ErrBadQuery) {
+			t.Fatalf("%q: err %v", bad, err)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	v, id, err := DecodeCursor(EncodeCursor(1700000000, "task-a:b"))
+	if err != nil || v != 1700000000 || id != "task-a:b" {
+		t.Fatalf("%d %q %v", v, id, err)
+	}
+}
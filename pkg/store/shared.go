@@ -0,0 +1,236 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrBadShared is wrapped by errors for shared state that is not a JSON
+// object and for malformed SharedOps.
+var ErrBadShared = errors.New("bad shared state")
+
+// ErrSharedLimit is wrapped by errors from writes that would take a task's
+// shared state past its SharedLimits. Nothing is written in that case.
+var ErrSharedLimit = errors.New("shared state limit exceeded")
+
+// SharedLimitError reports which limit a shared state write exceeded.
+type SharedLimitError struct {
+	TaskID string
+	// Key is the offending key, or empty when the total is over MaxBytes.
+	Key   string
+	Size  int64
+	Limit int64
+}
+
+func (e *SharedLimitError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("%v: task %s key %q would be %d bytes, limit %d", ErrSharedLimit, e.TaskID, e.Key, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%v: task %s would hold %d bytes, limit %d", ErrSharedLimit, e.TaskID, e.Size, e.Limit)
+}
+
+func (e *SharedLimitError) Unwrap() error { return ErrSharedLimit }
+
+// SharedLimits caps the size of a task's shared state. Sizes are of the
+// stored JSON, so a value moved to the blob store counts as its reference.
+// Zero means unlimited.
+type SharedLimits struct {
+	// MaxBytes caps the sum of all keys and values.
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxKeyBytes caps any single value.
+	MaxKeyBytes int64 `json:"max_key_bytes"`
+}
+
+// CheckValue returns a *SharedLimitError if key may not hold value.
+func (l SharedLimits) CheckValue(taskID, key, value string) error {
+	if l.MaxKeyBytes > 0 && int64(len(value)) > l.MaxKeyBytes {
+		return &SharedLimitError{TaskID: taskID, Key: key, Size: int64(len(value)), Limit: l.MaxKeyBytes}
+	}
+	return nil
+}
+
+// CheckTotal returns a *SharedLimitError if total bytes, as summed by
+// SharedSize, are over MaxBytes.
+func (l SharedLimits) CheckTotal(taskID string, total int64) error {
+	if l.MaxBytes > 0 && total > l.MaxBytes {
+		return &SharedLimitError{TaskID: taskID, Size: total, Limit: l.MaxBytes}
+	}
+	return nil
+}
+
+// SharedSize is what one key counts toward SharedLimits.MaxBytes.
+func SharedSize(key, value string) int64 { return int64(len(key) + len(value)) }
+
+// ValueCodec converts JSON values between the form callers see and the
+// form that is stored, for example to encrypt them. Encoded values must
+// themselves be valid JSON.
+type ValueCodec interface {
+	Encode(plain string) (string, error)
+	Decode(stored string) (string, error)
+}
+
+// SharedOp is a partial update of one key of a task's shared state.
+type SharedOp struct {
+	// Op is "set", "delete" or "merge". Merge applies Value to the current
+	// value as a JSON merge patch (RFC 7386).
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// Codec, when set, is how the key's value is stored: Apply decodes the
+	// current value before merging and encodes the result. Value is
+	// always plain.
+	Codec ValueCodec `json:"-"`
+}
+
+// Apply returns the key's encoded value after op, given the current one
+// (empty if the key is unset). ok is false if the key is to be removed.
+func (op SharedOp) Apply(cur string) (value string, ok bool, err error) {
+	value, ok, err = op.apply(cur)
+	if err != nil || !ok || op.Codec == nil {
+		return value, ok, err
+	}
+	value, err = op.Codec.Encode(value)
+	return value, err == nil, err
+}
+
+func (op SharedOp) apply(cur string) (value string, ok bool, err error) {
+	if op.Key == "" {
+		return "", false, fmt.Errorf("%w: %s without key", ErrBadShared, op.Op)
+	}
+	switch op.Op {
+	case "delete":
+		return "", false, nil
+	case "set", "merge":
+	default:
+		return "", false, fmt.Errorf("%w: unknown op %q", ErrBadShared, op.Op)
+	}
+	if len(op.Value) == 0 {
+		return "", false, fmt.Errorf("%w: %s of %q without value", ErrBadShared, op.Op, op.Key)
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, op.Value); err != nil {
+		return "", false, fmt.Errorf("%w: %s of %q: %v", ErrBadShared, op.Op, op.Key, err)
+	}
+	if op.Op == "set" {
+		return b.String(), true, nil
+	}
+	var target interface{}
+	if cur != "" && op.Codec != nil {
+		if cur, err = op.Codec.Decode(cur); err != nil {
+			return "", false, err
+		}
+	}
+	if cur != "" {
+		target = decodeNumbers([]byte(cur))
+	}
+	out, err := json.Marshal(MergePatch(target, decodeNumbers(b.Bytes())))
+	return string(out), err == nil, err
+}
+
+// decodeNumbers decodes valid JSON keeping numbers exact.
+func decodeNumbers(b []byte) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	_ = dec.Decode(&v)
+	return v
+}
+
+// MergePatch applies patch to target as described in RFC 7386: objects are
+// merged member by member, null members are removed and anything else
+// replaces the target. target may be modified.
+func MergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = MergePatch(t[k], v)
+	}
+	return t
+}
+
+// SplitShared decodes a shared state document into its keys' compact
+// encoded values. Empty input and null are an empty state.
+func SplitShared(js string) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if js != "" {
+		if err := json.Unmarshal([]byte(js), &raw); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadShared, err)
+		}
+	}
+	out := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var b bytes.Buffer
+		if err := json.Compact(&b, v); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadShared, err)
+		}
+		out[k] = b.String()
+	}
+	return out, nil
+}
+
+// JoinShared assembles per-key encoded values into one document with the
+// keys in byte order, the way the SQL backends assemble it.
+func JoinShared(vals map[string]string) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range sortedKeys(vals) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(k)
+		b.Truncate(b.Len() - 1) // Encode appends a newline
+		b.WriteByte(':')
+		b.WriteString(vals[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// DiffShared returns the ops that turn shared state document from into to:
+// a set for every key added or changed and a delete for every key removed.
+func DiffShared(from, to string) ([]SharedOp, error) {
+	old, err := SplitShared(from)
+	if err != nil {
+		return nil, err
+	}
+	next, err := SplitShared(to)
+	if err != nil {
+		return nil, err
+	}
+	ops := []SharedOp{}
+	for _, k := range sortedKeys(next) {
+		if v, ok := old[k]; !ok || v != next[k] {
+			ops = append(ops, SharedOp{Op: "set", Key: k, Value: json.RawMessage(next[k])})
+		}
+	}
+	for _, k := range sortedKeys(old) {
+		if _, ok := next[k]; !ok {
+			ops = append(ops, SharedOp{Op: "delete", Key: k})
+		}
+	}
+	return ops, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
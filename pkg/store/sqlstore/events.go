@@ -0,0 +1,87 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// finishedIn lists the final task statuses for a NOT IN condition.
+var finishedIn = "('" + strings.Join(store.RetentionStatuses, "','") + "')"
+
+func appendEvent(db execer, ev store.TaskEvent) error {
+	if ev.CreatedAt == 0 {
+		ev.CreatedAt = nowUnix()
+	}
+	if ev.DataJSON == "" {
+		ev.DataJSON = "{}"
+	}
+	_, err := db.Exec("INSERT INTO task_events(task_id,type,from_status,to_status,node_key,actor,data_json,created_at) VALUES(?,?,?,?,?,?,?,?)",
+		ev.TaskID, ev.Type, ev.FromStatus, ev.ToStatus, ev.NodeKey, ev.Actor, ev.DataJSON, ev.CreatedAt)
+	return err
+}
+
+// journaledUpdate runs the task update q inside tx and, if it matched,
+// journals ev with the status before and after it. toStatus is empty when
+// q leaves the status alone. It reports whether a row matched; a missing
+// task is not an error here.
+func journaledUpdate(tx *sql.Tx, id string, toStatus string, ev store.TaskEvent, q string, args ...interface{}) (bool, error) {
+	var from, node string
+	err := tx.QueryRow("SELECT status, current_node_key FROM tasks WHERE id=?", id).Scan(&from, &node)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if toStatus == "" {
+		toStatus = from
+	}
+	if ev.Type == "" {
+		ev.Type = store.EventType(from, toStatus)
+	}
+	if ev.NodeKey == "" {
+		ev.NodeKey = node
+	}
+	ev.TaskID, ev.FromStatus, ev.ToStatus = id, from, toStatus
+	return true, appendEvent(tx, ev)
+}
+
+// inTx runs fn in a transaction, committing if it succeeds.
+func (s *SQLite) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) ListTaskEvents(taskID string) ([]store.TaskEvent, error) {
+	rows, err := s.DB.Query("SELECT seq,task_id,type,from_status,to_status,node_key,actor,data_json,created_at FROM task_events WHERE task_id=? ORDER BY seq", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.TaskEvent{}
+	for rows.Next() {
+		var ev store.TaskEvent
+		if err := rows.Scan(&ev.Seq, &ev.TaskID, &ev.Type, &ev.FromStatus, &ev.ToStatus, &ev.NodeKey, &ev.Actor, &ev.DataJSON, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,249 @@
+package sqlstore
+
+import (
+	"github.com/nuknal/PocketFlowGo/pkg/store/migrate"
+)
+
+// migrations is the ordered SQLite schema history. Append new entries;
+// never edit one that has shipped.
+var migrations = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS flows (id TEXT PRIMARY KEY, name TEXT, created_at INTEGER);",
+			"CREATE TABLE IF NOT EXISTS flow_versions (id TEXT PRIMARY KEY, flow_id TEXT, version INTEGER, definition_json TEXT, status TEXT, created_at INTEGER);",
+			"CREATE TABLE IF NOT EXISTS nodes (id TEXT PRIMARY KEY, flow_version_id TEXT, node_key TEXT, service TEXT, kind TEXT, config_json TEXT);",
+			"CREATE TABLE IF NOT EXISTS edges (id TEXT PRIMARY KEY, flow_version_id TEXT, from_node_key TEXT, action TEXT, to_node_key TEXT);",
+			"CREATE TABLE IF NOT EXISTS tasks (id TEXT PRIMARY KEY, flow_version_id TEXT, status TEXT, params_json TEXT, shared_json TEXT, current_node_key TEXT, last_action TEXT, step_count INTEGER, retry_state_json TEXT, lease_owner TEXT, lease_expiry INTEGER, request_id TEXT, created_at INTEGER, updated_at INTEGER);",
+			"CREATE TABLE IF NOT EXISTS node_runs (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, attempt_no INTEGER, status TEXT, prep_json TEXT, exec_input_json TEXT, exec_output_json TEXT, error_text TEXT, action TEXT, started_at INTEGER, finished_at INTEGER, worker_id TEXT, worker_url TEXT);",
+			"CREATE TABLE IF NOT EXISTS workers (id TEXT PRIMARY KEY, url TEXT, services_json TEXT, load INTEGER, last_heartbeat INTEGER, status TEXT);",
+			"CREATE TABLE IF NOT EXISTS task_queue (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, service TEXT, input_json TEXT, status TEXT, worker_id TEXT, created_at INTEGER, started_at INTEGER, timeout_at INTEGER);",
+			"CREATE INDEX IF NOT EXISTS idx_queue_service_status ON task_queue(service, status);",
+		),
+		Down: migrate.Exec(
+			"DROP TABLE IF EXISTS task_queue;",
+			"DROP TABLE IF EXISTS workers;",
+			"DROP TABLE IF EXISTS node_runs;",
+			"DROP TABLE IF EXISTS tasks;",
+			"DROP TABLE IF EXISTS edges;",
+			"DROP TABLE IF EXISTS nodes;",
+			"DROP TABLE IF EXISTS flow_versions;",
+			"DROP TABLE IF EXISTS flows;",
+		),
+	},
+	{
+		// Columns that used to be added by best-effort ALTER TABLEs in Init.
+		// Older databases may already have some of them.
+		Version: 2,
+		Name:    "flow_description_worker_type_node_run_branches",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.SQLite, "flows", "description", "TEXT"),
+			migrate.AddColumn(migrate.SQLite, "workers", "type", "TEXT"),
+			migrate.AddColumn(migrate.SQLite, "node_runs", "sub_status", "TEXT"),
+			migrate.AddColumn(migrate.SQLite, "node_runs", "branch_id", "TEXT"),
+			migrate.AddColumn(migrate.SQLite, "node_runs", "log_path", "TEXT"),
+		),
+		Down: migrate.Steps(
+			migrate.DropColumn(migrate.SQLite, "node_runs", "log_path"),
+			migrate.DropColumn(migrate.SQLite, "node_runs", "branch_id"),
+			migrate.DropColumn(migrate.SQLite, "node_runs", "sub_status"),
+			migrate.DropColumn(migrate.SQLite, "workers", "type"),
+			migrate.DropColumn(migrate.SQLite, "flows", "description"),
+		),
+	},
+	{
+		Version: 3,
+		Name:    "task_revision",
+		Up:      migrate.AddColumn(migrate.SQLite, "tasks", "revision", "INTEGER NOT NULL DEFAULT 1"),
+		Down:    migrate.DropColumn(migrate.SQLite, "tasks", "revision"),
+	},
+	{
+		// Idempotency keys (request_id) are unique per flow.
+		Version: 4,
+		Name:    "task_flow_request_id",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.SQLite, "tasks", "flow_id", "TEXT NOT NULL DEFAULT ''"),
+			migrate.Exec(
+				"UPDATE tasks SET flow_id=COALESCE((SELECT flow_id FROM flow_versions WHERE flow_versions.id=tasks.flow_version_id),'')",
+				"UPDATE tasks SET request_id='' WHERE request_id IS NULL",
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_tasks_flow_request ON tasks(flow_id, request_id) WHERE request_id <> ''",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_tasks_flow_request"),
+			migrate.DropColumn(migrate.SQLite, "tasks", "flow_id"),
+		),
+	},
+	{
+		// Indexes for SearchTasks. Empty params/shared documents become {}
+		// so JSON path filters never see malformed input.
+		Version: 5,
+		Name:    "task_search_indexes",
+		Up: migrate.Exec(
+			"UPDATE tasks SET params_json='{}' WHERE params_json IS NULL OR params_json=''",
+			"UPDATE tasks SET shared_json='{}' WHERE shared_json IS NULL OR shared_json=''",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_status_updated ON tasks(status, updated_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_flow_created ON tasks(flow_id, created_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_created ON tasks(created_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_updated ON tasks(updated_at, id)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_node ON tasks(current_node_key)",
+			"CREATE INDEX IF NOT EXISTS idx_tasks_lease_owner ON tasks(lease_owner)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_tasks_lease_owner",
+			"DROP INDEX IF EXISTS idx_tasks_node",
+			"DROP INDEX IF EXISTS idx_tasks_updated",
+			"DROP INDEX IF EXISTS idx_tasks_created",
+			"DROP INDEX IF EXISTS idx_tasks_flow_created",
+			"DROP INDEX IF EXISTS idx_tasks_status_updated",
+		),
+	},
+	{
+		Version: 6,
+		Name:    "retention_policies",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS retention_policies (flow_id TEXT NOT NULL, status TEXT NOT NULL, keep_sec INTEGER NOT NULL, updated_at INTEGER, PRIMARY KEY (flow_id, status))",
+			"CREATE INDEX IF NOT EXISTS idx_node_runs_task_id ON node_runs(task_id)",
+			"CREATE INDEX IF NOT EXISTS idx_queue_task ON task_queue(task_id)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_queue_task",
+			"DROP INDEX IF EXISTS idx_node_runs_task_id",
+			"DROP TABLE IF EXISTS retention_policies",
+		),
+	},
+	{
+		// Append-only journal of task state changes.
+		Version: 7,
+		Name:    "task_events",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS task_events (seq INTEGER PRIMARY KEY AUTOINCREMENT, task_id TEXT NOT NULL, type TEXT NOT NULL, from_status TEXT NOT NULL DEFAULT '', to_status TEXT NOT NULL DEFAULT '', node_key TEXT NOT NULL DEFAULT '', actor TEXT NOT NULL DEFAULT '', data_json TEXT NOT NULL DEFAULT '{}', created_at INTEGER NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS idx_task_events_task ON task_events(task_id, seq)",
+		),
+		Down: migrate.Exec(
+			"DROP INDEX IF EXISTS idx_task_events_task",
+			"DROP TABLE IF EXISTS task_events",
+		),
+	},
+	{
+		// Engine bookkeeping per task node, formerly kept under shared._rt.
+		Version: 8,
+		Name:    "node_states",
+		Up: migrate.Exec(
+			"CREATE TABLE IF NOT EXISTS node_states (task_id TEXT NOT NULL, node_key TEXT NOT NULL, kind TEXT NOT NULL DEFAULT '', version INTEGER NOT NULL DEFAULT 1, state_json TEXT NOT NULL, updated_at INTEGER NOT NULL, PRIMARY KEY (task_id, node_key))",
+		),
+		Down: migrate.Exec(
+			"DROP TABLE IF EXISTS node_states",
+		),
+	},
+	{
+		// Shared state moves from tasks.shared_json to one row per key, so
+		// writers of different keys no longer overwrite each other.
+		Version: 9,
+		Name:    "task_shared",
+		Up: migrate.Steps(
+			migrate.Exec(
+				"CREATE TABLE IF NOT EXISTS task_shared (task_id TEXT NOT NULL, key TEXT NOT NULL, value_json TEXT NOT NULL, size INTEGER NOT NULL, updated_at INTEGER NOT NULL, PRIMARY KEY (task_id, key))",
+				`INSERT OR IGNORE INTO task_shared(task_id,key,value_json,size,updated_at)
+				SELECT id, key, value_json, LENGTH(CAST(key AS BLOB)) + LENGTH(CAST(value_json AS BLOB)), updated_at FROM (
+					SELECT t.id, j.key,
+						CASE j.type WHEN 'object' THEN j.value WHEN 'array' THEN j.value WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' WHEN 'null' THEN 'null' ELSE json_quote(j.value) END AS value_json,
+						COALESCE(t.updated_at, 0) AS updated_at
+					FROM tasks t, json_each(CASE WHEN json_valid(t.shared_json) AND json_type(t.shared_json) = 'object' THEN t.shared_json ELSE '{}' END) j)`,
+			),
+			migrate.DropColumn(migrate.SQLite, "tasks", "shared_json"),
+			migrate.AddColumn(migrate.SQLite, "tasks", "shared_max_bytes", "INTEGER NOT NULL DEFAULT 0"),
+			migrate.AddColumn(migrate.SQLite, "tasks", "shared_max_key_bytes", "INTEGER NOT NULL DEFAULT 0"),
+		),
+		Down: migrate.Steps(
+			migrate.DropColumn(migrate.SQLite, "tasks", "shared_max_key_bytes"),
+			migrate.DropColumn(migrate.SQLite, "tasks", "shared_max_bytes"),
+			migrate.AddColumn(migrate.SQLite, "tasks", "shared_json", "TEXT NOT NULL DEFAULT '{}'"),
+			migrate.Exec(
+				"UPDATE tasks SET shared_json=COALESCE((SELECT '{' || group_concat(json_quote(s.key) || ':' || s.value_json, ',' ORDER BY s.key) || '}' FROM task_shared s WHERE s.task_id = tasks.id), '{}')",
+				"DROP TABLE IF EXISTS task_shared",
+			),
+		),
+	},
+	{
+		// Flows, tasks, workers and queue entries are grouped by namespace;
+		// existing rows land in the default one.
+		Version: 10,
+		Name:    "namespaces",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.SQLite, "flows", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.SQLite, "tasks", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.SQLite, "workers", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.AddColumn(migrate.SQLite, "task_queue", "namespace", "TEXT NOT NULL DEFAULT 'default'"),
+			migrate.Exec(
+				"CREATE INDEX IF NOT EXISTS idx_flows_namespace ON flows(namespace, created_at)",
+				"CREATE INDEX IF NOT EXISTS idx_tasks_namespace ON tasks(namespace, updated_at)",
+				"CREATE INDEX IF NOT EXISTS idx_queue_namespace ON task_queue(namespace, service, status)",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec(
+				"DROP INDEX IF EXISTS idx_queue_namespace",
+				"DROP INDEX IF EXISTS idx_tasks_namespace",
+				"DROP INDEX IF EXISTS idx_flows_namespace",
+			),
+			migrate.DropColumn(migrate.SQLite, "task_queue", "namespace"),
+			migrate.DropColumn(migrate.SQLite, "workers", "namespace"),
+			migrate.DropColumn(migrate.SQLite, "tasks", "namespace"),
+			migrate.DropColumn(migrate.SQLite, "flows", "namespace"),
+		),
+	},
+	{
+		// Tasks waiting to retry a node are not leased before next_run_at
+		// (unix milliseconds).
+		Version: 11,
+		Name:    "next_run_at",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.SQLite, "tasks", "next_run_at", "INTEGER NOT NULL DEFAULT 0"),
+			migrate.Exec("CREATE INDEX IF NOT EXISTS idx_tasks_next_run ON tasks(status, next_run_at)"),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_tasks_next_run"),
+			migrate.DropColumn(migrate.SQLite, "tasks", "next_run_at"),
+		),
+	},
+	{
+		// Node runs started in the same second (started_at has whole
+		// seconds) are listed in the order they were written. Existing runs keep
+		// their rowid order.
+		Version: 12,
+		Name:    "node_run_seq",
+		Up: migrate.Steps(
+			migrate.AddColumn(migrate.SQLite, "node_runs", "seq", "INTEGER NOT NULL DEFAULT 0"),
+			migrate.Exec(
+				"UPDATE node_runs SET seq=rowid",
+				"CREATE INDEX IF NOT EXISTS idx_node_runs_seq ON node_runs(task_id, seq)",
+			),
+		),
+		Down: migrate.Steps(
+			migrate.Exec("DROP INDEX IF EXISTS idx_node_runs_seq"),
+			migrate.DropColumn(migrate.SQLite, "node_runs", "seq"),
+		),
+	},
+	{
+		// Retention policies belong to a namespace, and one without a flow
+		// only covers that namespace. Flow policies move to their flow's
+		// namespace, the others to the default one.
+		Version: 13,
+		Name:    "retention_namespace",
+		Up: migrate.Exec(
+			"CREATE TABLE retention_policies_new (namespace TEXT NOT NULL DEFAULT 'default', flow_id TEXT NOT NULL, status TEXT NOT NULL, keep_sec INTEGER NOT NULL, updated_at INTEGER, PRIMARY KEY (namespace, flow_id, status))",
+			"INSERT INTO retention_policies_new(namespace,flow_id,status,keep_sec,updated_at) SELECT COALESCE((SELECT f.namespace FROM flows f WHERE f.id = p.flow_id), 'default'), p.flow_id, p.status, p.keep_sec, p.updated_at FROM retention_policies p",
+			"DROP TABLE retention_policies",
+			"ALTER TABLE retention_policies_new RENAME TO retention_policies",
+		),
+		// Only the default namespace's policies without a flow survive.
+		Down: migrate.Exec(
+			"CREATE TABLE retention_policies_old (flow_id TEXT NOT NULL, status TEXT NOT NULL, keep_sec INTEGER NOT NULL, updated_at INTEGER, PRIMARY KEY (flow_id, status))",
+			"INSERT OR IGNORE INTO retention_policies_old(flow_id,status,keep_sec,updated_at) SELECT flow_id, status, keep_sec, updated_at FROM retention_policies WHERE flow_id <> '' OR namespace = 'default'",
+			"DROP TABLE retention_policies",
+			"ALTER TABLE retention_policies_old RENAME TO retention_policies",
+		),
+	},
+}
@@ -0,0 +1,41 @@
+package sqlstore
+
+import (
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// saveNodeState upserts ns for task id, or deletes it when StateJSON is
+// empty.
+func saveNodeState(db execer, id string, ns store.NodeState) error {
+	if ns.StateJSON == "" {
+		_, err := db.Exec("DELETE FROM node_states WHERE task_id=? AND node_key=?", id, ns.NodeKey)
+		return err
+	}
+	_, err := db.Exec("INSERT INTO node_states(task_id,node_key,kind,version,state_json,updated_at) VALUES(?,?,?,?,?,?) ON CONFLICT(task_id,node_key) DO UPDATE SET kind=excluded.kind, version=excluded.version, state_json=excluded.state_json, updated_at=excluded.updated_at",
+		id, ns.NodeKey, ns.Kind, ns.Version, ns.StateJSON, nowUnix())
+	return err
+}
+
+func (s *SQLite) GetNodeState(taskID string, nodeKey string) (store.NodeState, error) {
+	var ns store.NodeState
+	err := s.DB.QueryRow("SELECT task_id,node_key,kind,version,state_json,updated_at FROM node_states WHERE task_id=? AND node_key=?", taskID, nodeKey).
+		Scan(&ns.TaskID, &ns.NodeKey, &ns.Kind, &ns.Version, &ns.StateJSON, &ns.UpdatedAt)
+	return ns, err
+}
+
+func (s *SQLite) ListNodeStates(taskID string) ([]store.NodeState, error) {
+	rows, err := s.DB.Query("SELECT task_id,node_key,kind,version,state_json,updated_at FROM node_states WHERE task_id=? ORDER BY node_key", taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.NodeState{}
+	for rows.Next() {
+		var ns store.NodeState
+		if err := rows.Scan(&ns.TaskID, &ns.NodeKey, &ns.Kind, &ns.Version, &ns.StateJSON, &ns.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, ns)
+	}
+	return out, rows.Err()
+}
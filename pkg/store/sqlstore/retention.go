@@ -0,0 +1,123 @@
+package sqlstore
+
+import (
+	"strings"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+func (s *SQLite) SetRetentionPolicy(p store.RetentionPolicy) error {
+	ns := store.Namespace(p.Namespace)
+	if p.KeepSec <= 0 {
+		_, err := s.DB.Exec("DELETE FROM retention_policies WHERE namespace=? AND flow_id=? AND status=?", ns, p.FlowID, p.Status)
+		return err
+	}
+	_, err := s.DB.Exec("INSERT INTO retention_policies(namespace,flow_id,status,keep_sec,updated_at) VALUES(?,?,?,?,?) ON CONFLICT(namespace,flow_id,status) DO UPDATE SET keep_sec=excluded.keep_sec, updated_at=excluded.updated_at", ns, p.FlowID, p.Status, p.KeepSec, nowUnix())
+	return err
+}
+
+func (s *SQLite) ListRetentionPolicies(namespace string) ([]store.RetentionPolicy, error) {
+	rows, err := s.DB.Query("SELECT namespace,flow_id,status,keep_sec,updated_at FROM retention_policies WHERE ?='' OR namespace=? ORDER BY namespace, flow_id, status", namespace, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.RetentionPolicy{}
+	for rows.Next() {
+		var p store.RetentionPolicy
+		if err := rows.Scan(&p.Namespace, &p.FlowID, &p.Status, &p.KeepSec, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// expiredWhere picks the flow's own policy for the task status, falling
+// back to the default policy of the task's namespace with an empty flow_id.
+const expiredWhere = `
+	LEFT JOIN retention_policies pf ON pf.namespace = t.namespace AND pf.flow_id = t.flow_id AND pf.flow_id <> '' AND pf.status = t.status
+	LEFT JOIN retention_policies pd ON pd.namespace = t.namespace AND pd.flow_id = '' AND pd.status = t.status
+	WHERE t.status IN ('completed','failed','canceled','compensated','compensation_failed')
+	AND t.updated_at + COALESCE(pf.keep_sec, pd.keep_sec) < ?
+	ORDER BY t.updated_at, t.id LIMIT ?`
+
+func (s *SQLite) ListExpiredTasks(now int64, limit int) ([]store.Task, error) {
+	rows, err := s.DB.Query(taskSelect+expiredWhere, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []store.Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) DeleteTasks(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ph := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"node_runs", "task_events", "node_states", "task_shared", "task_queue"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE task_id IN ("+ph+")", args...); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM tasks WHERE id IN ("+ph+")", args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) RestoreTask(t store.Task, runs []store.NodeRun, events []store.TaskEvent) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(1) FROM tasks WHERE id=?", t.ID).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return store.ErrConflict
+	}
+	_, err = tx.Exec("INSERT INTO tasks(id,flow_version_id,flow_id,namespace,status,params_json,current_node_key,last_action,step_count,retry_state_json,next_run_at,lease_owner,lease_expiry,request_id,created_at,updated_at,revision,shared_max_bytes,shared_max_key_bytes) VALUES(?,?,COALESCE((SELECT flow_id FROM flow_versions WHERE id=?),?),COALESCE((SELECT f.namespace FROM flow_versions v JOIN flows f ON f.id = v.flow_id WHERE v.id=?),?),?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		t.ID, t.FlowVersionID, t.FlowVersionID, t.FlowID, t.FlowVersionID, store.Namespace(t.Namespace), t.Status, t.ParamsJSON, t.CurrentNodeKey, t.LastAction, t.StepCount, t.RetryStateJSON, t.NextRunAt, "", 0, t.RequestID, t.CreatedAt, t.UpdatedAt, t.Revision, t.SharedLimits.MaxBytes, t.SharedLimits.MaxKeyBytes)
+	if err != nil {
+		return err
+	}
+	if err := replaceShared(tx, t.ID, t.SharedJSON); err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if err := insertNodeRun(tx, r.Fields()); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		ev.TaskID = t.ID
+		if err := appendEvent(tx, ev); err != nil {
+			return err
+		}
+	}
+	if err := appendEvent(tx, store.TaskEvent{TaskID: t.ID, Type: "restore", FromStatus: t.Status, ToStatus: t.Status, NodeKey: t.CurrentNodeKey}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,104 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// sharedDoc assembles the shared state of task t from task_shared, keys in
+// byte order as store.JoinShared does.
+const sharedDoc = `COALESCE((SELECT '{' || group_concat(json_quote(s.key) || ':' || s.value_json, ',' ORDER BY s.key) || '}' FROM task_shared s WHERE s.task_id = t.id), '{}')`
+
+// writeShared applies ops to the shared state of task id and checks the
+// result against the task's limits.
+func writeShared(tx *sql.Tx, id string, ops []store.SharedOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	var lim store.SharedLimits
+	if err := tx.QueryRow("SELECT shared_max_bytes, shared_max_key_bytes FROM tasks WHERE id=?", id).Scan(&lim.MaxBytes, &lim.MaxKeyBytes); err != nil {
+		return err
+	}
+	now := nowUnix()
+	grew := false
+	for _, op := range ops {
+		cur := ""
+		if op.Op == "merge" {
+			err := tx.QueryRow("SELECT value_json FROM task_shared WHERE task_id=? AND key=?", id, op.Key).Scan(&cur)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		v, ok, err := op.Apply(cur)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if _, err := tx.Exec("DELETE FROM task_shared WHERE task_id=? AND key=?", id, op.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := lim.CheckValue(id, op.Key, v); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO task_shared(task_id,key,value_json,size,updated_at) VALUES(?,?,?,?,?) ON CONFLICT(task_id,key) DO UPDATE SET value_json=excluded.value_json, size=excluded.size, updated_at=excluded.updated_at",
+			id, op.Key, v, store.SharedSize(op.Key, v), now); err != nil {
+			return err
+		}
+		grew = true
+	}
+	if !grew || lim.MaxBytes <= 0 {
+		return nil
+	}
+	var total int64
+	if err := tx.QueryRow("SELECT COALESCE(SUM(size),0) FROM task_shared WHERE task_id=?", id).Scan(&total); err != nil {
+		return err
+	}
+	return lim.CheckTotal(id, total)
+}
+
+// replaceShared makes sharedJSON the whole shared state of task id.
+func replaceShared(tx *sql.Tx, id string, sharedJSON string) error {
+	ops, err := store.DiffShared("", sharedJSON)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM task_shared WHERE task_id=?", id); err != nil {
+		return err
+	}
+	return writeShared(tx, id, ops)
+}
+
+func (s *SQLite) PatchTaskShared(id string, ops []store.SharedOp, ev store.TaskEvent) error {
+	if ev.Type == "" {
+		ev.Type = "shared"
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", ev, "UPDATE tasks SET updated_at=? WHERE id=?", nowUnix(), id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return sql.ErrNoRows
+		}
+		return writeShared(tx, id, ops)
+	})
+}
+
+func (s *SQLite) SetSharedLimits(id string, l store.SharedLimits) error {
+	data, _ := json.Marshal(l)
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", store.TaskEvent{Type: "limits", DataJSON: string(data)}, "UPDATE tasks SET shared_max_bytes=?, shared_max_key_bytes=?, revision=revision+1, updated_at=? WHERE id=?", l.MaxBytes, l.MaxKeyBytes, nowUnix(), id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
@@ -8,52 +8,47 @@ import (
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/migrate"
 )
 
 // SQLite implements the Store interface using a SQLite database.
 type SQLite struct{ DB *sql.DB }
 
-// OpenSQLite opens a connection to the SQLite database at the given path.
+// OpenSQLite opens a connection to the SQLite database at the given path
+// and migrates it to the latest schema version.
 func OpenSQLite(path string) (*SQLite, error) {
-	db, err := sql.Open("sqlite3", path)
+	s, err := ConnectSQLite(path)
 	if err != nil {
 		return nil, err
 	}
-	s := &SQLite{DB: db}
 	if err := s.Init(); err != nil {
+		s.DB.Close()
 		return nil, err
 	}
 	return s, nil
 }
 
-// Init initializes the database schema.
+// ConnectSQLite opens the database without touching its schema.
+func ConnectSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLite{DB: db}, nil
+}
+
+// Migrator returns the schema migrator for this database.
+func (s *SQLite) Migrator() *migrate.Migrator {
+	return migrate.New(s.DB, migrate.SQLite, migrations)
+}
+
+// Init initializes the database schema by applying pending migrations.
 func (s *SQLite) Init() error {
-	stmts := []string{
-		"PRAGMA foreign_keys = ON;",
-		"CREATE TABLE IF NOT EXISTS flows (id TEXT PRIMARY KEY, name TEXT, description TEXT, created_at INTEGER);",
-		"CREATE TABLE IF NOT EXISTS flow_versions (id TEXT PRIMARY KEY, flow_id TEXT, version INTEGER, definition_json TEXT, status TEXT, created_at INTEGER);",
-		"CREATE TABLE IF NOT EXISTS nodes (id TEXT PRIMARY KEY, flow_version_id TEXT, node_key TEXT, service TEXT, kind TEXT, config_json TEXT);",
-		"CREATE TABLE IF NOT EXISTS edges (id TEXT PRIMARY KEY, flow_version_id TEXT, from_node_key TEXT, action TEXT, to_node_key TEXT);",
-		"CREATE TABLE IF NOT EXISTS tasks (id TEXT PRIMARY KEY, flow_version_id TEXT, status TEXT, params_json TEXT, shared_json TEXT, current_node_key TEXT, last_action TEXT, step_count INTEGER, retry_state_json TEXT, lease_owner TEXT, lease_expiry INTEGER, request_id TEXT, created_at INTEGER, updated_at INTEGER);",
-		"CREATE TABLE IF NOT EXISTS node_runs (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, attempt_no INTEGER, status TEXT, sub_status TEXT, branch_id TEXT, prep_json TEXT, exec_input_json TEXT, exec_output_json TEXT, error_text TEXT, action TEXT, started_at INTEGER, finished_at INTEGER, worker_id TEXT, worker_url TEXT, log_path TEXT);",
-		"CREATE TABLE IF NOT EXISTS workers (id TEXT PRIMARY KEY, url TEXT, services_json TEXT, load INTEGER, last_heartbeat INTEGER, status TEXT, type TEXT);",
-		"CREATE TABLE IF NOT EXISTS task_queue (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, service TEXT, input_json TEXT, status TEXT, worker_id TEXT, created_at INTEGER, started_at INTEGER, timeout_at INTEGER);",
-		"CREATE INDEX IF NOT EXISTS idx_queue_service_status ON task_queue(service, status);",
-	}
-	for _, q := range stmts {
-		if _, err := s.DB.Exec(q); err != nil {
-			return err
-		}
+	if _, err := s.DB.Exec("PRAGMA foreign_keys = ON;"); err != nil {
+		return err
 	}
-	// Try to add description column if it doesn't exist (simplistic migration)
-	_, _ = s.DB.Exec("ALTER TABLE flows ADD COLUMN description TEXT")
-	// Add type column to workers if it doesn't exist
-	_, _ = s.DB.Exec("ALTER TABLE workers ADD COLUMN type TEXT")
-	// Add sub_status and branch_id to node_runs
-	_, _ = s.DB.Exec("ALTER TABLE node_runs ADD COLUMN sub_status TEXT")
-	_, _ = s.DB.Exec("ALTER TABLE node_runs ADD COLUMN branch_id TEXT")
-	_, _ = s.DB.Exec("ALTER TABLE node_runs ADD COLUMN log_path TEXT")
-	return nil
+	_, err := s.Migrator().Up(0)
+	return err
 }
 
 func nowUnix() int64 { return store.NowUnix() }
@@ -67,7 +62,7 @@ func (s *SQLite) RegisterWorker(w store.WorkerInfo) error {
 	if w.Type == "" {
 		w.Type = "http"
 	}
-	_, err := s.DB.Exec("INSERT INTO workers(id,url,services_json,load,last_heartbeat,status,type) VALUES(?,?,?,?,?,?,?) ON CONFLICT(id) DO UPDATE SET url=excluded.url, services_json=excluded.services_json, load=excluded.load, last_heartbeat=excluded.last_heartbeat, status=excluded.status, type=excluded.type", w.ID, w.URL, string(b), w.Load, nowUnix(), w.Status, w.Type)
+	_, err := s.DB.Exec("INSERT INTO workers(id,namespace,url,services_json,load,last_heartbeat,status,type) VALUES(?,?,?,?,?,?,?,?) ON CONFLICT(id) DO UPDATE SET namespace=excluded.namespace, url=excluded.url, services_json=excluded.services_json, load=excluded.load, last_heartbeat=excluded.last_heartbeat, status=excluded.status, type=excluded.type", w.ID, store.Namespace(w.Namespace), w.URL, string(b), w.Load, nowUnix(), w.Status, w.Type)
 	return err
 }
 
@@ -85,8 +80,8 @@ func (s *SQLite) RefreshWorkersStatus(ttl int64) error {
 	return err
 }
 
-func (s *SQLite) ListWorkers(service string, ttl int64) ([]store.WorkerInfo, error) {
-	rows, err := s.DB.Query("SELECT id,url,services_json,load,last_heartbeat,status,type FROM workers")
+func (s *SQLite) ListWorkers(namespace string, service string, ttl int64) ([]store.WorkerInfo, error) {
+	rows, err := s.DB.Query("SELECT id,namespace,url,services_json,load,last_heartbeat,status,type FROM workers WHERE ?='' OR namespace=?", namespace, namespace)
 	if err != nil {
 		return nil, err
 	}
@@ -94,11 +89,11 @@ func (s *SQLite) ListWorkers(service string, ttl int64) ([]store.WorkerInfo, err
 	out := []store.WorkerInfo{}
 	now := nowUnix()
 	for rows.Next() {
-		var id, url, sj, status string
+		var id, ns, url, sj, status string
 		var typeStr sql.NullString
 		var load int
 		var hb int64
-		if err := rows.Scan(&id, &url, &sj, &load, &hb, &status, &typeStr); err != nil {
+		if err := rows.Scan(&id, &ns, &url, &sj, &load, &hb, &status, &typeStr); err != nil {
 			return nil, err
 		}
 		if ttl > 0 && now-hb > ttl {
@@ -118,14 +113,14 @@ func (s *SQLite) ListWorkers(service string, ttl int64) ([]store.WorkerInfo, err
 				continue
 			}
 		}
-		out = append(out, store.WorkerInfo{ID: id, URL: url, Services: arr, Load: load, LastHeartbeat: hb, Status: status, Type: typeStr.String})
+		out = append(out, store.WorkerInfo{ID: id, Namespace: ns, URL: url, Services: arr, Load: load, LastHeartbeat: hb, Status: status, Type: typeStr.String})
 	}
 	return out, nil
 }
 
-func (s *SQLite) CreateFlow(name string, description string) (string, error) {
+func (s *SQLite) CreateFlow(namespace string, name string, description string) (string, error) {
 	id := genID("flow")
-	_, err := s.DB.Exec("INSERT INTO flows(id,name,description,created_at) VALUES(?,?,?,?)", id, name, description, nowUnix())
+	_, err := s.DB.Exec("INSERT INTO flows(id,namespace,name,description,created_at) VALUES(?,?,?,?,?)", id, store.Namespace(namespace), name, description, nowUnix())
 	if err != nil {
 		return "", err
 	}
@@ -141,18 +136,26 @@ func (s *SQLite) CreateFlowVersion(flowID string, version int, definitionJSON st
 	return id, nil
 }
 
-func (s *SQLite) ListFlows(limit, offset int) ([]store.Flow, int64, error) {
+func (s *SQLite) GetFlow(id string) (store.Flow, error) {
+	var f store.Flow
+	var desc sql.NullString
+	err := s.DB.QueryRow("SELECT id, namespace, name, description, created_at FROM flows WHERE id=?", id).Scan(&f.ID, &f.Namespace, &f.Name, &desc, &f.CreatedAt)
+	f.Description = desc.String
+	return f, err
+}
+
+func (s *SQLite) ListFlows(namespace string, limit, offset int) ([]store.Flow, int64, error) {
 	var count int64
-	if err := s.DB.QueryRow("SELECT COUNT(*) FROM flows").Scan(&count); err != nil {
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM flows WHERE ?='' OR namespace=?", namespace, namespace).Scan(&count); err != nil {
 		return nil, 0, err
 	}
 
-	q := "SELECT id, name, description, created_at FROM flows ORDER BY created_at DESC"
+	q := "SELECT id, namespace, name, description, created_at FROM flows WHERE ?='' OR namespace=? ORDER BY created_at DESC"
 	if limit > 0 {
 		q += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
 	}
 
-	rows, err := s.DB.Query(q)
+	rows, err := s.DB.Query(q, namespace, namespace)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -162,7 +165,7 @@ func (s *SQLite) ListFlows(limit, offset int) ([]store.Flow, int64, error) {
 		var f store.Flow
 		// Handle potential NULL description
 		var desc sql.NullString
-		if err := rows.Scan(&f.ID, &f.Name, &desc, &f.CreatedAt); err != nil {
+		if err := rows.Scan(&f.ID, &f.Namespace, &f.Name, &desc, &f.CreatedAt); err != nil {
 			return nil, 0, err
 		}
 		f.Description = desc.String
@@ -215,29 +218,56 @@ func (s *SQLite) GetFlowVersionByID(id string) (store.FlowVersion, error) {
 	return fv, nil
 }
 
+// flowNamespace is the namespace of the flow of the flow version bound to
+// the next parameter.
+const flowNamespace = "COALESCE((SELECT f.namespace FROM flow_versions v JOIN flows f ON f.id = v.flow_id WHERE v.id=?),'default')"
+
+const insertTask = "INSERT INTO tasks(id,flow_version_id,flow_id,namespace,status,params_json,current_node_key,last_action,step_count,retry_state_json,lease_owner,lease_expiry,request_id,created_at,updated_at,revision) VALUES(?,?,COALESCE((SELECT flow_id FROM flow_versions WHERE id=?),'')," + flowNamespace + ",?,COALESCE(NULLIF(?,''),'{}'),?,?,?,?,?,?,?,?,?,1)"
+
 func (s *SQLite) CreateTask(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, error) {
 	id := genID("task")
-	_, err := s.DB.Exec("INSERT INTO tasks(id,flow_version_id,status,params_json,shared_json,current_node_key,last_action,step_count,retry_state_json,lease_owner,lease_expiry,request_id,created_at,updated_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)", id, flowVersionID, "pending", paramsJSON, "{}", startNode, "", 0, "{}", "", 0, requestID, nowUnix(), nowUnix())
+	err := s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(insertTask, id, flowVersionID, flowVersionID, flowVersionID, "pending", paramsJSON, startNode, "", 0, "{}", "", 0, requestID, nowUnix(), nowUnix()); err != nil {
+			return err
+		}
+		return appendEvent(tx, store.TaskEvent{TaskID: id, Type: "create", ToStatus: "pending", NodeKey: startNode})
+	})
 	if err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
-func (s *SQLite) GetTask(id string) (store.Task, error) {
-	q := `SELECT 
-		t.id, t.flow_version_id, t.status, t.params_json, t.shared_json, t.current_node_key, t.last_action, t.step_count, t.retry_state_json, t.lease_owner, t.lease_expiry, t.request_id, t.created_at, t.updated_at,
-		COALESCE(f.id, ''), COALESCE(f.name, ''), COALESCE(fv.version, 0)
-	FROM tasks t
-	LEFT JOIN flow_versions fv ON t.flow_version_id = fv.id
-	LEFT JOIN flows f ON fv.flow_id = f.id
-	WHERE t.id=?`
-	row := s.DB.QueryRow(q, id)
-	var t store.Task
-	if err := row.Scan(&t.ID, &t.FlowVersionID, &t.Status, &t.ParamsJSON, &t.SharedJSON, &t.CurrentNodeKey, &t.LastAction, &t.StepCount, &t.RetryStateJSON, &t.LeaseOwner, &t.LeaseExpiry, &t.RequestID, &t.CreatedAt, &t.UpdatedAt, &t.FlowID, &t.FlowName, &t.FlowVersion); err != nil {
-		return store.Task{}, err
+func (s *SQLite) CreateTaskOnce(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, bool, error) {
+	if requestID == "" {
+		id, err := s.CreateTask(flowVersionID, paramsJSON, requestID, startNode)
+		return id, err == nil, err
 	}
-	return t, nil
+	id := genID("task")
+	created := false
+	err := s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(insertTask+" ON CONFLICT(flow_id, request_id) WHERE request_id <> '' DO NOTHING", id, flowVersionID, flowVersionID, flowVersionID, "pending", paramsJSON, startNode, "", 0, "{}", "", 0, requestID, nowUnix(), nowUnix())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		created = true
+		return appendEvent(tx, store.TaskEvent{TaskID: id, Type: "create", ToStatus: "pending", NodeKey: startNode})
+	})
+	if err != nil || created {
+		return id, created, err
+	}
+	err = s.DB.QueryRow("SELECT id FROM tasks WHERE flow_id=COALESCE((SELECT flow_id FROM flow_versions WHERE id=?),'') AND request_id=?", flowVersionID, requestID).Scan(&id)
+	if err != nil {
+		return "", false, err
+	}
+	return id, false, nil
+}
+
+func (s *SQLite) GetTask(id string) (store.Task, error) {
+	return scanTask(s.DB.QueryRow(taskSelect+" WHERE t.id=?", id))
 }
 
 func (s *SQLite) LeaseNextTask(owner string, ttlSec int64) (store.Task, error) {
@@ -245,27 +275,32 @@ func (s *SQLite) LeaseNextTask(owner string, ttlSec int64) (store.Task, error) {
 	if err != nil {
 		return store.Task{}, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
 	now := nowUnix()
-	row := tx.QueryRow("SELECT id FROM tasks WHERE status IN ('pending','running') AND (lease_expiry=0 OR lease_expiry<?) ORDER BY updated_at ASC LIMIT 1", now)
-	var id string
-	if err = row.Scan(&id); err != nil {
+	row := tx.QueryRow("SELECT id, status, current_node_key FROM tasks WHERE status IN ('pending','running','waiting_retry','compensating','canceling') AND (lease_expiry=0 OR lease_expiry<?) AND (next_run_at<=? OR status='canceling') ORDER BY updated_at ASC LIMIT 1", now, store.NowMillis())
+	var id, from, node string
+	if err := row.Scan(&id, &from, &node); err != nil {
+		tx.Rollback()
 		return store.Task{}, err
 	}
-	res, uerr := tx.Exec("UPDATE tasks SET lease_owner=?, lease_expiry=?, status='running' WHERE id=? AND (lease_expiry=0 OR lease_expiry<?)", owner, now+ttlSec, id, now)
-	if uerr != nil {
-		return store.Task{}, uerr
+	to := store.LeasedStatus(from)
+	res, err := tx.Exec("UPDATE tasks SET lease_owner=?, lease_expiry=?, status=?, revision=revision+1 WHERE id=? AND (lease_expiry=0 OR lease_expiry<?)", owner, now+ttlSec, to, id, now)
+	if err != nil {
+		tx.Rollback()
+		return store.Task{}, err
 	}
 	aff, _ := res.RowsAffected()
 	if aff == 0 {
+		tx.Rollback()
 		return store.Task{}, fmt.Errorf("lease_conflict")
 	}
+	if err := appendEvent(tx, store.TaskEvent{TaskID: id, Type: "lease", FromStatus: from, ToStatus: to, NodeKey: node, Actor: owner}); err != nil {
+		tx.Rollback()
+		return store.Task{}, err
+	}
+	// Commit before reading back so the returned task reflects the lease.
+	if err := tx.Commit(); err != nil {
+		return store.Task{}, err
+	}
 	return s.GetTask(id)
 }
 
@@ -275,13 +310,35 @@ func (s *SQLite) ExtendLease(id string, owner string, ttlSec int64) error {
 }
 
 func (s *SQLite) UpdateTaskStatus(id string, status string) error {
-	_, err := s.DB.Exec("UPDATE tasks SET status=?, updated_at=? WHERE id=?", status, nowUnix(), id)
-	return err
+	return s.SetTaskStatus(id, status, store.TaskEvent{})
+}
+
+func (s *SQLite) SetTaskStatus(id string, status string, ev store.TaskEvent) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := journaledUpdate(tx, id, status, ev, "UPDATE tasks SET status=?, revision=revision+1, updated_at=? WHERE id=?", status, nowUnix(), id)
+		return err
+	})
+}
+
+func (s *SQLite) RequestCancel(id string, ev store.TaskEvent) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "canceling", ev, "UPDATE tasks SET status='canceling', revision=revision+1, updated_at=? WHERE id=? AND status NOT IN "+finishedIn, nowUnix(), id)
+		if err != nil || ok {
+			return err
+		}
+		var status string
+		if err := tx.QueryRow("SELECT status FROM tasks WHERE id=?", id).Scan(&status); err != nil {
+			return err
+		}
+		return store.ErrFinished
+	})
 }
 
 func (s *SQLite) UpdateTaskStatusOwned(id string, owner string, status string) error {
-	_, err := s.DB.Exec("UPDATE tasks SET status=?, updated_at=? WHERE id=? AND lease_owner=? AND lease_expiry>?", status, nowUnix(), id, owner, nowUnix())
-	return err
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := journaledUpdate(tx, id, status, store.TaskEvent{Actor: owner}, "UPDATE tasks SET status=?, revision=revision+1, updated_at=? WHERE id=? AND lease_owner=? AND lease_expiry>?", status, nowUnix(), id, owner, nowUnix())
+		return err
+	})
 }
 
 func (s *SQLite) SaveNodeRun(nr map[string]interface{}) error {
@@ -291,6 +348,14 @@ func (s *SQLite) SaveNodeRun(nr map[string]interface{}) error {
 }
 
 func (s *SQLite) CreateNodeRun(nr map[string]interface{}) error {
+	return insertNodeRun(s.DB, nr)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertNodeRun(db execer, nr map[string]interface{}) error {
 	cols := []string{"id", "task_id", "node_key", "attempt_no", "status", "sub_status", "branch_id", "prep_json", "exec_input_json", "exec_output_json", "error_text", "action", "started_at", "finished_at", "worker_id", "worker_url", "log_path"}
 	vals := make([]interface{}, 0, len(cols))
 	for _, c := range cols {
@@ -300,9 +365,11 @@ func (s *SQLite) CreateNodeRun(nr map[string]interface{}) error {
 			vals = append(vals, nil)
 		}
 	}
-	ph := strings.Repeat("?,", len(cols))
-	ph = ph[:len(ph)-1]
-	_, err := s.DB.Exec("INSERT INTO node_runs("+strings.Join(cols, ",")+") VALUES("+ph+")", vals...)
+	// seq numbers the task's runs in the order they are written; writes
+	// are serialized, so the next number cannot be taken twice.
+	ph := strings.Repeat("?,", len(cols)) + "(SELECT COALESCE(MAX(seq),0)+1 FROM node_runs WHERE task_id=?)"
+	vals = append(vals, nr["task_id"])
+	_, err := db.Exec("INSERT INTO node_runs("+strings.Join(cols, ",")+",seq) VALUES("+ph+")", vals...)
 	return err
 }
 
@@ -323,19 +390,125 @@ func (s *SQLite) UpdateNodeRun(id string, updates map[string]interface{}) error
 }
 
 func (s *SQLite) UpdateTaskProgress(id string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
-	_, err := s.DB.Exec("UPDATE tasks SET current_node_key=?, last_action=?, shared_json=?, step_count=?, updated_at=? WHERE id=?", currentNode, lastAction, sharedJSON, stepCount, nowUnix(), id)
-	return err
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", store.TaskEvent{Type: "step", NodeKey: currentNode}, "UPDATE tasks SET current_node_key=?, last_action=?, step_count=?, revision=revision+1, updated_at=? WHERE id=?", currentNode, lastAction, stepCount, nowUnix(), id)
+		if err != nil || !ok {
+			return err
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
 }
 
 func (s *SQLite) UpdateTaskProgressOwned(id string, owner string, currentNode string, lastAction string, sharedJSON string, stepCount int) error {
-	_, err := s.DB.Exec("UPDATE tasks SET current_node_key=?, last_action=?, shared_json=?, step_count=?, updated_at=? WHERE id=? AND lease_owner=? AND lease_expiry>?", currentNode, lastAction, sharedJSON, stepCount, nowUnix(), id, owner, nowUnix())
-	return err
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", store.TaskEvent{Type: "step", NodeKey: currentNode, Actor: owner}, "UPDATE tasks SET current_node_key=?, last_action=?, step_count=?, revision=revision+1, updated_at=? WHERE id=? AND lease_owner=? AND lease_expiry>?", currentNode, lastAction, stepCount, nowUnix(), id, owner, nowUnix())
+		if err != nil || !ok {
+			return err
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
 }
 
-func (s *SQLite) ListTasks(status string, flowVersionID string, limit, offset int) ([]store.Task, int64, error) {
+func (s *SQLite) TransitionTask(id string, owner string, tr store.TaskTransition) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := nowUnix()
+	q := "UPDATE tasks SET status=?, current_node_key=?, last_action=?, step_count=?, retry_state_json=COALESCE(NULLIF(?,''),retry_state_json), next_run_at=?, revision=revision+1, updated_at=?"
+	if tr.NextRunAt != 0 {
+		q += ", lease_owner='', lease_expiry=0"
+	}
+	q += " WHERE id=?"
+	args := []interface{}{tr.Status, tr.CurrentNode, tr.LastAction, tr.StepCount, tr.RetryStateJSON, tr.NextRunAt, now, id}
+	if owner != "" {
+		q += " AND lease_owner=? AND lease_expiry>?"
+		args = append(args, owner, now)
+	}
+	if tr.Revision != 0 {
+		q += " AND revision=?"
+		args = append(args, tr.Revision)
+	}
+	ok, err := journaledUpdate(tx, id, tr.Status, store.TaskEvent{NodeKey: tr.CurrentNode, Actor: owner}, q, args...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return missReason(tx, id, owner, tr.Revision, now)
+	}
+	if tr.SharedJSON != "" {
+		if err := replaceShared(tx, id, tr.SharedJSON); err != nil {
+			return err
+		}
+	}
+	if err := writeShared(tx, id, tr.Shared); err != nil {
+		return err
+	}
+	for _, nr := range tr.NodeRuns {
+		if _, ok := nr["id"]; !ok {
+			nr["id"] = genID("run")
+		}
+		if err := insertNodeRun(tx, nr); err != nil {
+			return err
+		}
+	}
+	for _, ns := range tr.NodeStates {
+		if err := saveNodeState(tx, id, ns); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) UpdateTaskShared(id string, revision int64, sharedJSON string, ev store.TaskEvent) error {
+	now := nowUnix()
+	q := "UPDATE tasks SET revision=revision+1, updated_at=? WHERE id=?"
+	args := []interface{}{now, id}
+	if revision != 0 {
+		q += " AND revision=?"
+		args = append(args, revision)
+	}
+	if ev.Type == "" {
+		ev.Type = "shared"
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		ok, err := journaledUpdate(tx, id, "", ev, q, args...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return missReason(tx, id, "", revision, now)
+		}
+		return replaceShared(tx, id, sharedJSON)
+	})
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// missReason explains why a conditional task update matched no row.
+func missReason(db queryer, id string, owner string, revision int64, now int64) error {
+	var leaseOwner string
+	var leaseExpiry, rev int64
+	if err := db.QueryRow("SELECT lease_owner, lease_expiry, revision FROM tasks WHERE id=?", id).Scan(&leaseOwner, &leaseExpiry, &rev); err != nil {
+		return err
+	}
+	if owner != "" && (leaseOwner != owner || leaseExpiry <= now) {
+		return store.ErrLeaseLost
+	}
+	return store.ErrConflict
+}
+
+func (s *SQLite) ListTasks(namespace string, status string, flowVersionID string, limit, offset int) ([]store.Task, int64, error) {
 	// Count query
 	countQ := `SELECT COUNT(*) FROM tasks t WHERE 1=1`
 	countArgs := []interface{}{}
+	if namespace != "" {
+		countQ += " AND t.namespace=?"
+		countArgs = append(countArgs, namespace)
+	}
 	if status != "" {
 		countQ += " AND t.status=?"
 		countArgs = append(countArgs, status)
@@ -349,14 +522,12 @@ func (s *SQLite) ListTasks(status string, flowVersionID string, limit, offset in
 		return nil, 0, err
 	}
 
-	q := `SELECT 
-		t.id, t.flow_version_id, t.status, t.params_json, t.shared_json, t.current_node_key, t.last_action, t.step_count, t.retry_state_json, t.lease_owner, t.lease_expiry, t.request_id, t.created_at, t.updated_at,
-		COALESCE(f.id, ''), COALESCE(f.name, ''), COALESCE(fv.version, 0)
-	FROM tasks t
-	LEFT JOIN flow_versions fv ON t.flow_version_id = fv.id
-	LEFT JOIN flows f ON fv.flow_id = f.id
-	WHERE 1=1`
+	q := taskSelect + " WHERE 1=1"
 	args := []interface{}{}
+	if namespace != "" {
+		q += " AND t.namespace=?"
+		args = append(args, namespace)
+	}
 	if status != "" {
 		q += " AND t.status=?"
 		args = append(args, status)
@@ -377,8 +548,8 @@ func (s *SQLite) ListTasks(status string, flowVersionID string, limit, offset in
 	defer rows.Close()
 	out := []store.Task{}
 	for rows.Next() {
-		var t store.Task
-		if err := rows.Scan(&t.ID, &t.FlowVersionID, &t.Status, &t.ParamsJSON, &t.SharedJSON, &t.CurrentNodeKey, &t.LastAction, &t.StepCount, &t.RetryStateJSON, &t.LeaseOwner, &t.LeaseExpiry, &t.RequestID, &t.CreatedAt, &t.UpdatedAt, &t.FlowID, &t.FlowName, &t.FlowVersion); err != nil {
+		t, err := scanTask(rows)
+		if err != nil {
 			return nil, 0, err
 		}
 		out = append(out, t)
@@ -386,8 +557,154 @@ func (s *SQLite) ListTasks(status string, flowVersionID string, limit, offset in
 	return out, count, nil
 }
 
+// taskSelect reads the columns scanTask expects, joined with the flow and
+// the assembled shared state.
+const taskSelect = `SELECT
+		t.id, t.namespace, t.flow_version_id, t.status, t.params_json, ` + sharedDoc + `, t.current_node_key, t.last_action, t.step_count, t.retry_state_json, t.next_run_at, t.lease_owner, t.lease_expiry, t.request_id, t.created_at, t.updated_at, t.revision, t.shared_max_bytes, t.shared_max_key_bytes,
+		COALESCE(f.id, ''), COALESCE(f.name, ''), COALESCE(fv.version, 0)
+	FROM tasks t
+	LEFT JOIN flow_versions fv ON t.flow_version_id = fv.id
+	LEFT JOIN flows f ON fv.flow_id = f.id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTask(row scanner) (store.Task, error) {
+	var t store.Task
+	err := row.Scan(&t.ID, &t.Namespace, &t.FlowVersionID, &t.Status, &t.ParamsJSON, &t.SharedJSON, &t.CurrentNodeKey, &t.LastAction, &t.StepCount, &t.RetryStateJSON, &t.NextRunAt, &t.LeaseOwner, &t.LeaseExpiry, &t.RequestID, &t.CreatedAt, &t.UpdatedAt, &t.Revision, &t.SharedLimits.MaxBytes, &t.SharedLimits.MaxKeyBytes, &t.FlowID, &t.FlowName, &t.FlowVersion)
+	if err != nil {
+		return store.Task{}, err
+	}
+	return t, nil
+}
+
+// SearchTasks runs q with keyset pagination on (sort column, id).
+func (s *SQLite) SearchTasks(q store.TaskQuery) (store.TaskPage, error) {
+	query, args, col, limit, err := searchQuery(q)
+	if err != nil {
+		return store.TaskPage{}, err
+	}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return store.TaskPage{}, err
+	}
+	defer rows.Close()
+	page := store.TaskPage{Tasks: []store.Task{}}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return store.TaskPage{}, err
+		}
+		page.Tasks = append(page.Tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return store.TaskPage{}, err
+	}
+	if len(page.Tasks) > limit {
+		page.Tasks = page.Tasks[:limit]
+		last := page.Tasks[limit-1]
+		v := last.UpdatedAt
+		if col == "created_at" {
+			v = last.CreatedAt
+		}
+		page.NextCursor = store.EncodeCursor(v, last.ID)
+	}
+	return page, nil
+}
+
+// searchQuery compiles q for SearchTasks. JSON paths are validated, so they
+// are inlined: a $params path reads json_extract(t.params_json, '$.a.b'),
+// which an index from IndexJSONPath covers, and a $shared path selects the
+// tasks whose task_shared row for the first key matches on the rest.
+func searchQuery(q store.TaskQuery) (query string, args []interface{}, col string, limit int, err error) {
+	col, desc, err := q.SortField()
+	if err != nil {
+		return "", nil, "", 0, err
+	}
+	where := " WHERE 1=1"
+	for _, f := range q.Filters {
+		if err := f.Validate(); err != nil {
+			return "", nil, "", 0, err
+		}
+		expr := "t." + store.TaskColumns[f.Field]
+		v := f.Value
+		if doc, keys, ok := f.JSONPath(); ok {
+			expr = fmt.Sprintf("json_extract(t.%s, '$.%s')", doc, strings.Join(keys, "."))
+			if doc == "shared_json" {
+				expr = fmt.Sprintf("json_extract(s.value_json, '%s')", sharedPath(keys))
+			}
+			if v == nil {
+				is := " IS NULL"
+				if f.Op != "=" {
+					is = " IS NOT NULL"
+				}
+				if doc == "shared_json" {
+					// A missing key is null too, so look the key up for
+					// each task.
+					expr = fmt.Sprintf("(SELECT %s FROM task_shared s WHERE s.task_id = t.id AND s.key = '%s')", expr, keys[0])
+				}
+				where += " AND " + expr + is
+				continue
+			}
+			if b, isBool := v.(bool); isBool {
+				v = 0
+				if b {
+					v = 1
+				}
+			}
+			if doc == "shared_json" {
+				where += fmt.Sprintf(" AND t.id IN (SELECT s.task_id FROM task_shared s WHERE s.key = '%s' AND %s%s?)", keys[0], expr, f.Op)
+				args = append(args, v)
+				continue
+			}
+		}
+		where += " AND " + expr + f.Op + "?"
+		args = append(args, v)
+	}
+	cmp, order := ">", " ASC"
+	if desc {
+		cmp, order = "<", " DESC"
+	}
+	if q.Cursor != "" {
+		cv, cid, err := store.DecodeCursor(q.Cursor)
+		if err != nil {
+			return "", nil, "", 0, err
+		}
+		where += fmt.Sprintf(" AND (t.%s %s ? OR (t.%s = ? AND t.id %s ?))", col, cmp, col, cmp)
+		args = append(args, cv, cv, cid)
+	}
+	limit = q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	query = taskSelect + where + " ORDER BY t." + col + order + ", t.id" + order + " LIMIT ?"
+	return query, append(args, limit+1), col, limit, nil
+}
+
+// sharedPath is the json_extract path of keys[1:] inside the value of
+// shared key keys[0].
+func sharedPath(keys []string) string {
+	return strings.Join(append([]string{"$"}, keys[1:]...), ".")
+}
+
+// IndexJSONPath creates an expression index matching what SearchTasks
+// compiles path to: on tasks for $params, on task_shared by key for $shared.
+func (s *SQLite) IndexJSONPath(path string) error {
+	doc, keys, err := store.IndexPath(path)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "idx_tasks_%s" ON tasks(json_extract(params_json, '$.%s'))`, path, strings.Join(keys, "."))
+	if doc == "shared_json" {
+		q = fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "idx_task_shared_%s" ON task_shared(key, json_extract(value_json, '%[1]s'))`, sharedPath(keys))
+	}
+	_, err = s.DB.Exec(q)
+	return err
+}
+
 func (s *SQLite) ListNodeRuns(taskID string) ([]store.NodeRun, error) {
-	rows, err := s.DB.Query("SELECT id,task_id,node_key,attempt_no,status,sub_status,branch_id,prep_json,exec_input_json,exec_output_json,error_text,action,started_at,finished_at,worker_id,worker_url,log_path FROM node_runs WHERE task_id=? ORDER BY started_at ASC", taskID)
+	rows, err := s.DB.Query("SELECT id,task_id,node_key,attempt_no,status,sub_status,branch_id,prep_json,exec_input_json,exec_output_json,error_text,action,started_at,finished_at,worker_id,worker_url,log_path FROM node_runs WHERE task_id=? ORDER BY started_at ASC, seq ASC", taskID)
 	if err != nil {
 		return nil, err
 	}
@@ -423,8 +740,8 @@ func (s *SQLite) GetNodeRun(id string) (store.NodeRun, error) {
 // EnqueueTask adds a new task to the queue
 func (s *SQLite) EnqueueTask(taskID, nodeKey, service, inputJSON string) (string, error) {
 	id := genID("q")
-	_, err := s.DB.Exec("INSERT INTO task_queue(id,task_id,node_key,service,input_json,status,worker_id,created_at,started_at,timeout_at) VALUES(?,?,?,?,?,?,?,?,?,?)",
-		id, taskID, nodeKey, service, inputJSON, "pending", "", nowUnix(), 0, 0)
+	_, err := s.DB.Exec("INSERT INTO task_queue(id,namespace,task_id,node_key,service,input_json,status,worker_id,created_at,started_at,timeout_at) VALUES(?,COALESCE((SELECT namespace FROM tasks WHERE id=?),'default'),?,?,?,?,?,?,?,?,?)",
+		id, taskID, taskID, nodeKey, service, inputJSON, "pending", "", nowUnix(), 0, 0)
 	if err != nil {
 		return "", err
 	}
@@ -432,7 +749,7 @@ func (s *SQLite) EnqueueTask(taskID, nodeKey, service, inputJSON string) (string
 }
 
 // PollQueue attempts to claim a pending task for the given services
-func (s *SQLite) PollQueue(workerID string, services []string, timeoutSec int64) (store.QueueTask, error) {
+func (s *SQLite) PollQueue(namespace string, workerID string, services []string, timeoutSec int64) (store.QueueTask, error) {
 	if len(services) == 0 {
 		return store.QueueTask{}, nil
 	}
@@ -451,16 +768,16 @@ func (s *SQLite) PollQueue(workerID string, services []string, timeoutSec int64)
 
 	placeholders := strings.Repeat("?,", len(services))
 	placeholders = placeholders[:len(placeholders)-1]
-	args := make([]interface{}, len(services))
-	for i, svc := range services {
-		args[i] = svc
+	args := []interface{}{store.Namespace(namespace)}
+	for _, svc := range services {
+		args = append(args, svc)
 	}
 
 	// Find oldest pending task matching services
-	q := fmt.Sprintf("SELECT id, task_id, node_key, service, input_json FROM task_queue WHERE status='pending' AND service IN (%s) ORDER BY created_at ASC LIMIT 1", placeholders)
+	q := fmt.Sprintf("SELECT id, namespace, task_id, node_key, service, input_json FROM task_queue WHERE status='pending' AND namespace=? AND service IN (%s) ORDER BY created_at ASC LIMIT 1", placeholders)
 
 	var qt store.QueueTask
-	if err := tx.QueryRow(q, args...).Scan(&qt.ID, &qt.TaskID, &qt.NodeKey, &qt.Service, &qt.InputJSON); err != nil {
+	if err := tx.QueryRow(q, args...).Scan(&qt.ID, &qt.Namespace, &qt.TaskID, &qt.NodeKey, &qt.Service, &qt.InputJSON); err != nil {
 		if err == sql.ErrNoRows {
 			return store.QueueTask{}, nil
 		}
@@ -496,21 +813,36 @@ func (s *SQLite) PollQueue(workerID string, services []string, timeoutSec int64)
 // To keep it simple, we'll just mark status here, and let the caller handle the data persistence elsewhere or add columns if needed.
 // Wait, the design says Worker calls /queue/complete with result. So we need to return the TaskID so the API can update the flow.
 func (s *SQLite) CompleteQueueTask(queueID string) (string, error) {
-	var taskID string
-	err := s.DB.QueryRow("SELECT task_id FROM task_queue WHERE id=?", queueID).Scan(&taskID)
+	var taskID, status string
+	err := s.DB.QueryRow("SELECT task_id, status FROM task_queue WHERE id=?", queueID).Scan(&taskID, &status)
 	if err != nil {
 		return "", err
 	}
+	if status == "revoked" {
+		return "", store.ErrRevoked
+	}
 
-	_, err = s.DB.Exec("UPDATE task_queue SET status='completed' WHERE id=?", queueID)
+	res, err := s.DB.Exec("UPDATE task_queue SET status='completed' WHERE id=? AND status!='revoked'", queueID)
 	if err != nil {
 		return "", err
 	}
+	if aff, _ := res.RowsAffected(); aff == 0 {
+		return "", store.ErrRevoked
+	}
 	return taskID, nil
 }
 
 // FailQueueTask marks a queue task as failed
 func (s *SQLite) FailQueueTask(queueID string) error {
-	_, err := s.DB.Exec("UPDATE task_queue SET status='failed' WHERE id=?", queueID)
+	_, err := s.DB.Exec("UPDATE task_queue SET status='failed' WHERE id=? AND status!='revoked'", queueID)
 	return err
 }
+
+func (s *SQLite) RevokeQueueTasks(taskID string) (int, error) {
+	res, err := s.DB.Exec("UPDATE task_queue SET status='revoked' WHERE task_id=? AND status IN ('pending','claimed')", taskID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
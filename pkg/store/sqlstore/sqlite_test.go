@@ -0,0 +1,227 @@
+package sqlstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+	"github.com/nuknal/PocketFlowGo/pkg/store/storetest"
+)
+
+func openTestStore(t *testing.T) *SQLite {
+	s, err := OpenSQLite(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { s.DB.Close() })
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store { return openTestStore(t) })
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := t.TempDir() + "/legacy.db"
+	s, err := ConnectSQLite(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Schema as written by the pre-migration Init, including some of the
+	// columns it used to add with ALTER TABLE.
+	for _, q := range []string{
+		"CREATE TABLE flows (id TEXT PRIMARY KEY, name TEXT, description TEXT, created_at INTEGER)",
+		"CREATE TABLE workers (id TEXT PRIMARY KEY, url TEXT, services_json TEXT, load INTEGER, last_heartbeat INTEGER, status TEXT)",
+		"CREATE TABLE node_runs (id TEXT PRIMARY KEY, task_id TEXT, node_key TEXT, attempt_no INTEGER, status TEXT, sub_status TEXT, prep_json TEXT, exec_input_json TEXT, exec_output_json TEXT, error_text TEXT, action TEXT, started_at INTEGER, finished_at INTEGER, worker_id TEXT, worker_url TEXT)",
+		"INSERT INTO flows(id,name,description,created_at) VALUES('flow_1','legacy','kept',1)",
+	} {
+		if _, err := s.DB.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer s.DB.Close()
+
+	m := s.Migrator()
+	v, err := m.Version()
+	if err != nil || v != len(migrations) {
+		t.Fatalf("version %d err %v", v, err)
+	}
+	fs, _, err := s.ListFlows("", 10, 0)
+	if err != nil || len(fs) != 1 || fs[0].Description != "kept" {
+		t.Fatalf("flows %+v err %v", fs, err)
+	}
+	if err := s.SaveNodeRun(map[string]interface{}{"task_id": "t", "node_key": "n", "branch_id": "b", "log_path": "p"}); err != nil {
+		t.Fatalf("save node run: %v", err)
+	}
+
+	// Init is idempotent.
+	if err := s.Init(); err != nil {
+		t.Fatalf("re-init: %v", err)
+	}
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	s := openTestStore(t)
+	m := s.Migrator()
+	done, err := m.Down(len(migrations))
+	if err != nil || len(done) != len(migrations) {
+		t.Fatalf("down %d err %v", len(done), err)
+	}
+	var n int
+	if err := s.DB.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE type='table' AND name='tasks'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("tasks table still present: %d %v", n, err)
+	}
+	sts, err := m.Status()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, st := range sts {
+		if st.Applied {
+			t.Fatalf("migration %d still applied", st.Version)
+		}
+	}
+	if done, err = m.Up(1); err != nil || len(done) != 1 {
+		t.Fatalf("up to 1: %d err %v", len(done), err)
+	}
+	if v, _ := m.Version(); v != 1 {
+		t.Fatalf("version %d", v)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := s.CreateFlow("", "f", "d"); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestMigrateSharedToRows(t *testing.T) {
+	s := openTestStore(t)
+	m := s.Migrator()
+	// Roll back to just before task_shared (v9).
+	down := len(migrations) - 8
+	if _, err := m.Down(down); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	const legacy = `{"n":1.5,"s":"x","t":true,"f":false,"z":null,"o":{"a":[1,"b"]}}`
+	if _, err := s.DB.Exec("INSERT INTO tasks(id,flow_version_id,status,params_json,shared_json,current_node_key,last_action,step_count,retry_state_json,lease_owner,lease_expiry,request_id,created_at,updated_at) VALUES('t1','v','running','{}',?,'a','',0,'{}','',0,'',1,1)", legacy); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	tk, err := s.GetTask("t1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	const want = `{"f":false,"n":1.5,"o":{"a":[1,"b"]},"s":"x","t":true,"z":null}`
+	if tk.SharedJSON != want {
+		t.Fatalf("shared after up: %s", tk.SharedJSON)
+	}
+	if _, err := m.Down(down); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	var got string
+	if err := s.DB.QueryRow("SELECT shared_json FROM tasks WHERE id='t1'").Scan(&got); err != nil || got != want {
+		t.Fatalf("shared after down: %s %v", got, err)
+	}
+}
+
+func TestMigrateRetentionNamespace(t *testing.T) {
+	s := openTestStore(t)
+	fid, err := s.CreateFlow("acme", "f", "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	m := s.Migrator()
+	if _, err := m.Down(1); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	for _, q := range []string{
+		"INSERT INTO retention_policies(flow_id,status,keep_sec,updated_at) VALUES('','completed',10,1)",
+		"INSERT INTO retention_policies(flow_id,status,keep_sec,updated_at) VALUES('" + fid + "','completed',20,1)",
+	} {
+		if _, err := s.DB.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	if _, err := m.Up(0); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	ps, err := s.ListRetentionPolicies("")
+	if err != nil || len(ps) != 2 {
+		t.Fatalf("policies %+v %v", ps, err)
+	}
+	if ps[0].Namespace != "acme" || ps[0].FlowID != fid || ps[1].Namespace != "default" || ps[1].FlowID != "" {
+		t.Fatalf("policies %+v", ps)
+	}
+}
+
+func TestIndexJSONPath(t *testing.T) {
+	s := openTestStore(t)
+	for _, p := range []string{"$params.customer_id", "$shared.order.id"} {
+		if err := s.IndexJSONPath(p); err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if err := s.IndexJSONPath(p); err != nil {
+			t.Fatalf("%s again: %v", p, err)
+		}
+	}
+	for _, bad := range []string{"status", "$params.a'b"} {
+		if err := s.IndexJSONPath(bad); !errors.Is(err, store.ErrBadQuery) {
+			t.Fatalf("%s: err %v, want ErrBadQuery", bad, err)
+		}
+	}
+
+	fid, _ := s.CreateFlow("", "f", "")
+	vid, _ := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	ids := []string{}
+	for _, c := range []string{"41", "42"} {
+		id, err := s.CreateTask(vid, `{"customer_id":`+c+`}`, "", "a")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := s.PatchTaskShared(id, []store.SharedOp{{Op: "set", Key: "order", Value: []byte(`{"id":"o` + c + `"}`)}}, store.TaskEvent{}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, c := range []struct{ q, index string }{
+		{"$params.customer_id=42", "idx_tasks_$params.customer_id"},
+		{"$shared.order.id=o42", "idx_task_shared_$.id"},
+	} {
+		fs, err := store.ParseTaskFilters(c.q)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		page, err := s.SearchTasks(store.TaskQuery{Filters: fs})
+		if err != nil || len(page.Tasks) != 1 || page.Tasks[0].ID != ids[1] {
+			t.Fatalf("%s: %+v %v", c.q, page.Tasks, err)
+		}
+		query, args, _, _, err := searchQuery(store.TaskQuery{Filters: fs})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		rows, err := s.DB.Query("EXPLAIN QUERY PLAN "+query, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		plan := ""
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatalf("%v", err)
+			}
+			plan += detail + "\n"
+		}
+		rows.Close()
+		if !strings.Contains(plan, c.index) {
+			t.Fatalf("%s: plan does not use %s:\n%s", c.q, c.index, plan)
+		}
+	}
+}
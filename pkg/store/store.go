@@ -1,7 +1,9 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,51 +13,187 @@ func GenID(prefix string) string { return fmt.Sprintf("%s-%s", prefix, uuid.New(
 
 func NowUnix() int64 { return time.Now().Unix() }
 
+// NowMillis is the current time in unix milliseconds, the unit of
+// Task.NextRunAt.
+func NowMillis() int64 { return time.Now().UnixMilli() }
+
+// DefaultNamespace holds flows and workers created without a namespace.
+const DefaultNamespace = "default"
+
+// Namespace returns ns, or DefaultNamespace if ns is empty.
+func Namespace(ns string) string {
+	if ns == "" {
+		return DefaultNamespace
+	}
+	return ns
+}
+
+// ErrLeaseLost is returned by owned writes when the caller no longer holds
+// an unexpired lease on the task. Nothing is written in that case.
+var ErrLeaseLost = errors.New("lease lost")
+
+// ErrConflict is returned by compare-and-swap writes when the task's
+// revision changed since it was read. Re-read the task and retry.
+var ErrConflict = errors.New("revision conflict")
+
+// ErrRevoked is returned by CompleteQueueTask for a queue entry that was
+// revoked because its task was canceled.
+var ErrRevoked = errors.New("queue task revoked")
+
+// ErrFinished is returned by RequestCancel for a task that has already
+// reached a final status. Nothing is written in that case.
+var ErrFinished = errors.New("task already finished")
+
 // Store defines the interface for data persistence.
+//
+// Flows, tasks, workers and queue entries belong to a namespace. Tasks and
+// queue entries take theirs from the flow; workers and flows created with
+// an empty namespace are put in DefaultNamespace. List methods taking a
+// namespace return every namespace when it is empty.
 type Store interface {
 	// Worker Registry
 	RegisterWorker(w WorkerInfo) error
 	HeartbeatWorker(id string, url string, load int) error
 	RefreshWorkersStatus(ttl int64) error
-	ListWorkers(service string, ttl int64) ([]WorkerInfo, error)
+	ListWorkers(namespace string, service string, ttl int64) ([]WorkerInfo, error)
 
 	// Flow Management
-	CreateFlow(name string, description string) (string, error)
+	CreateFlow(namespace string, name string, description string) (string, error)
 	CreateFlowVersion(flowID string, version int, definitionJSON string, status string) (string, error)
-	ListFlows(limit, offset int) ([]Flow, int64, error)
+	GetFlow(id string) (Flow, error)
+	ListFlows(namespace string, limit, offset int) ([]Flow, int64, error)
 	ListFlowVersions(flowID string) ([]FlowVersion, error)
 	LatestPublishedVersion(flowID string) (FlowVersion, error)
 	GetFlowVersionByFlowIDAndVersion(flowID string, version int) (FlowVersion, error)
 	GetFlowVersionByID(id string) (FlowVersion, error)
+	// RestoreFlow and RestoreFlowVersion insert a flow or version with its
+	// ID as given, for backups. They return ErrConflict if the ID exists.
+	RestoreFlow(f Flow) error
+	RestoreFlowVersion(v FlowVersion) error
 
 	// Task Management
 	CreateTask(flowVersionID string, paramsJSON string, requestID string, startNode string) (string, error)
+	// CreateTaskOnce creates a task unless one with the same non-empty
+	// requestID already exists for the version's flow, in which case it
+	// returns that task's ID and created=false.
+	CreateTaskOnce(flowVersionID string, paramsJSON string, requestID string, startNode string) (id string, created bool, err error)
 	GetTask(id string) (Task, error)
+	// LeaseNextTask leases the oldest pending, running, waiting_retry,
+	// compensating or canceling task without a live lease whose NextRunAt
+	// has passed, and sets it running. Canceling tasks are leased at once;
+	// they and compensating tasks keep their status so the engine can
+	// finish canceling or compensating them.
 	LeaseNextTask(owner string, ttlSec int64) (Task, error)
 	ExtendLease(id string, owner string, ttlSec int64) error
 	UpdateTaskStatus(id string, status string) error
+	// SetTaskStatus is UpdateTaskStatus with the journal entry's type,
+	// actor and data supplied by the caller.
+	SetTaskStatus(id string, status string, ev TaskEvent) error
+	// RequestCancel sets the task canceling, journaling ev, unless it has
+	// finished (see Finished), in which case it returns ErrFinished. The
+	// check and the write are atomic.
+	RequestCancel(id string, ev TaskEvent) error
 	UpdateTaskStatusOwned(id string, owner string, status string) error
+	// UpdateTaskProgress and UpdateTaskProgressOwned replace the whole
+	// shared state with sharedJSON.
 	UpdateTaskProgress(id string, currentNode string, lastAction string, sharedJSON string, stepCount int) error
 	UpdateTaskProgressOwned(id string, owner string, currentNode string, lastAction string, sharedJSON string, stepCount int) error
-	ListTasks(status string, flowVersionID string, limit, offset int) ([]Task, int64, error)
+	// TransitionTask atomically writes status, cursor, shared state and the
+	// given node runs. With a non-empty owner it returns ErrLeaseLost unless
+	// owner holds an unexpired lease; with a non-zero tr.Revision it returns
+	// ErrConflict if the task was modified since that revision.
+	TransitionTask(id string, owner string, tr TaskTransition) error
+	// UpdateTaskShared replaces the whole shared state if the task is still
+	// at revision (0 skips the check), otherwise it returns ErrConflict. ev
+	// is journaled with the write; its Type defaults to "shared".
+	UpdateTaskShared(id string, revision int64, sharedJSON string, ev TaskEvent) error
+	// PatchTaskShared applies ops to the task's shared state in order, all
+	// or none. It leaves the revision alone, so writers of different keys
+	// never conflict. ev is journaled as for UpdateTaskShared.
+	PatchTaskShared(id string, ops []SharedOp, ev TaskEvent) error
+	// SetSharedLimits sets the limits later shared state writes of the task
+	// are checked against; those that would exceed them fail with an error
+	// wrapping ErrSharedLimit.
+	SetSharedLimits(id string, l SharedLimits) error
+	// RecodeTask passes the stored params, every shared value, the input
+	// and output of every node run, every node state and the input of
+	// every queue entry of task id through fn and saves the values it
+	// changed, in one transaction. It is meant for
+	// re-encryption, so revision, timestamps and the journal are left
+	// alone and shared limits are not checked.
+	RecodeTask(id string, fn func(stored string) (string, error)) error
+	ListTasks(namespace string, status string, flowVersionID string, limit, offset int) ([]Task, int64, error)
+	// SearchTasks returns tasks matching every filter in q, ordered by
+	// q.Sort with ties broken by ID. Pass the returned NextCursor back in
+	// q.Cursor for the following page.
+	SearchTasks(q TaskQuery) (TaskPage, error)
+
+	// Retention
+	// SetRetentionPolicy creates or replaces the policy for (Namespace,
+	// FlowID, Status); KeepSec <= 0 removes it.
+	SetRetentionPolicy(p RetentionPolicy) error
+	// ListRetentionPolicies lists the policies of namespace, or of every
+	// namespace if it is empty.
+	ListRetentionPolicies(namespace string) ([]RetentionPolicy, error)
+	// ListExpiredTasks returns up to limit finished tasks whose policy says
+	// they should be gone by now, oldest first.
+	ListExpiredTasks(now int64, limit int) ([]Task, error)
+	// DeleteTasks removes tasks together with their node runs, events, node
+	// states and queue entries.
+	DeleteTasks(ids []string) error
+	// RestoreTask re-inserts an archived task, its node runs and events as
+	// they were, and journals a "restore" event. It returns ErrConflict if
+	// the task already exists.
+	RestoreTask(t Task, runs []NodeRun, events []TaskEvent) error
+
+	// Task Journal
+	// ListTaskEvents returns a task's journal in the order it was written.
+	// Every write to a task except lease extension appends to it in the
+	// same transaction.
+	ListTaskEvents(taskID string) ([]TaskEvent, error)
+
+	// Node Runtime State
+	// GetNodeState returns the engine's bookkeeping for one node of a task,
+	// or sql.ErrNoRows if it has none. It is written by TransitionTask.
+	GetNodeState(taskID string, nodeKey string) (NodeState, error)
+	ListNodeStates(taskID string) ([]NodeState, error)
+	// RestoreNodeState saves ns as it was, including UpdatedAt.
+	RestoreNodeState(ns NodeState) error
 
 	// Node Execution History
 	SaveNodeRun(nr map[string]interface{}) error
 	CreateNodeRun(nr map[string]interface{}) error
 	UpdateNodeRun(id string, updates map[string]interface{}) error
+	// ListNodeRuns returns a task's runs by started_at, those started in
+	// the same second in the order they were written.
 	ListNodeRuns(taskID string) ([]NodeRun, error)
 	GetNodeRun(id string) (NodeRun, error)
 
 	// Queue Operations
 	EnqueueTask(taskID, nodeKey, service, inputJSON string) (string, error)
-	PollQueue(workerID string, services []string, timeoutSec int64) (QueueTask, error)
+	// PollQueue claims the oldest pending entry of namespace for one of
+	// services.
+	PollQueue(namespace string, workerID string, services []string, timeoutSec int64) (QueueTask, error)
+	// CompleteQueueTask marks an entry completed and returns its task ID,
+	// or ErrRevoked, changing nothing, if the entry was revoked.
 	CompleteQueueTask(queueID string) (string, error)
 	FailQueueTask(queueID string) error
+	// RevokeQueueTasks revokes a task's pending and claimed entries so
+	// they are neither handed out nor accepted back. It returns how many
+	// entries were revoked.
+	RevokeQueueTasks(taskID string) (int, error)
+	GetQueueTask(id string) (QueueTask, error)
+	// ListQueueTasks returns a task's queue entries, oldest first.
+	ListQueueTasks(taskID string) ([]QueueTask, error)
+	// RestoreQueueTask inserts a queue entry as it was. It returns
+	// ErrConflict if the ID exists.
+	RestoreQueueTask(q QueueTask) error
 }
 
 // WorkerInfo represents a registered worker node.
 type WorkerInfo struct {
 	ID            string   `json:"id"`
+	Namespace     string   `json:"namespace"`
 	URL           string   `json:"url"`
 	Services      []string `json:"services"`
 	Load          int      `json:"load"`
@@ -66,6 +204,7 @@ type WorkerInfo struct {
 
 type Flow struct {
 	ID          string `json:"id"`
+	Namespace   string `json:"namespace"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	CreatedAt   int64  `json:"created_at"`
@@ -80,23 +219,119 @@ type FlowVersion struct {
 }
 
 type Task struct {
-	ID             string `json:"id"`
-	FlowVersionID  string `json:"flow_version_id"`
-	FlowID         string `json:"flow_id,omitempty"`
-	FlowName       string `json:"flow_name,omitempty"`
-	FlowVersion    int    `json:"flow_version,omitempty"`
-	Status         string `json:"status"`
-	ParamsJSON     string `json:"params_json"`
+	ID            string `json:"id"`
+	Namespace     string `json:"namespace"`
+	FlowVersionID string `json:"flow_version_id"`
+	FlowID        string `json:"flow_id,omitempty"`
+	FlowName      string `json:"flow_name,omitempty"`
+	FlowVersion   int    `json:"flow_version,omitempty"`
+	Status        string `json:"status"`
+	ParamsJSON    string `json:"params_json"`
+	// SharedJSON is the shared state assembled from its per-key storage.
 	SharedJSON     string `json:"shared_json"`
 	CurrentNodeKey string `json:"current_node_key"`
 	LastAction     string `json:"last_action"`
 	StepCount      int    `json:"step_count"`
+	// RetryStateJSON is the engine's retry bookkeeping for the current
+	// node. NextRunAt, in unix milliseconds, is when the task may be
+	// leased again; 0 means at once.
 	RetryStateJSON string `json:"retry_state_json"`
+	NextRunAt      int64  `json:"next_run_at"`
 	LeaseOwner     string `json:"lease_owner"`
 	LeaseExpiry    int64  `json:"lease_expiry"`
 	RequestID      string `json:"request_id"`
 	CreatedAt      int64  `json:"created_at"`
 	UpdatedAt      int64  `json:"updated_at"`
+	// Revision increases with every write to the task row except lease
+	// extension and PatchTaskShared. It starts at 1.
+	Revision     int64        `json:"revision"`
+	SharedLimits SharedLimits `json:"shared_limits"`
+}
+
+// TaskTransition is one atomic step of a task: its new status and cursor,
+// shared state, and the node runs that explain the change.
+type TaskTransition struct {
+	// Revision, when non-zero, is the revision the caller read; the write
+	// fails with ErrConflict if the task has moved on.
+	Revision    int64
+	Status      string
+	CurrentNode string
+	LastAction  string
+	// SharedJSON, if not empty, replaces the whole shared state. Shared
+	// ops are applied after it.
+	SharedJSON string
+	Shared     []SharedOp
+	StepCount  int
+	NodeRuns   []map[string]interface{}
+	// NodeStates are saved with the step, replacing the stored state of
+	// the same node. An entry with an empty StateJSON deletes it.
+	NodeStates []NodeState
+	// RetryStateJSON, if not empty, replaces the task's retry state; "{}"
+	// clears it.
+	RetryStateJSON string
+	// NextRunAt is written by every transition. A non-zero time (unix
+	// milliseconds) keeps the task from being leased before then and
+	// releases the caller's lease.
+	NextRunAt int64
+}
+
+// NodeState is the engine's runtime bookkeeping for one node of a task,
+// such as finished parallel branches or a timer's start time. It is kept
+// apart from the task's shared state.
+type NodeState struct {
+	TaskID  string `json:"task_id"`
+	NodeKey string `json:"node_key"`
+	// Kind is the node kind that wrote the state; Version is the format
+	// of StateJSON for that kind.
+	Kind      string `json:"kind"`
+	Version   int    `json:"version"`
+	StateJSON string `json:"state_json"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// TaskEvent is one entry of a task's append-only journal.
+type TaskEvent struct {
+	Seq    int64  `json:"seq"`
+	TaskID string `json:"task_id"`
+	// Type is create, lease, step, suspend, resume, signal, cancel,
+	// complete, fail, status, shared, limits or restore.
+	Type       string `json:"type"`
+	FromStatus string `json:"from_status"`
+	ToStatus   string `json:"to_status"`
+	NodeKey    string `json:"node_key"`
+	Actor      string `json:"actor"`
+	DataJSON   string `json:"data_json"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// EventType names a status change for the journal when the writer did not.
+func EventType(from, to string) string {
+	switch {
+	case to == "completed":
+		return "complete"
+	case to == "failed":
+		return "fail"
+	case to == "canceling" || to == "canceled":
+		return "cancel"
+	case strings.HasPrefix(to, "compensat"):
+		return "compensate"
+	case strings.HasPrefix(to, "waiting"):
+		return "suspend"
+	case strings.HasPrefix(from, "waiting"):
+		return "resume"
+	case from == to:
+		return "step"
+	}
+	return "status"
+}
+
+// LeasedStatus is the status LeaseNextTask gives a task leased from status
+// from.
+func LeasedStatus(from string) string {
+	if from == "canceling" || from == "compensating" {
+		return from
+	}
+	return "running"
 }
 
 type NodeRun struct {
@@ -119,9 +354,47 @@ type NodeRun struct {
 	LogPath        string `json:"log_path"`
 }
 
+// Fields returns r keyed by node_runs column, as accepted by CreateNodeRun.
+func (r NodeRun) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"id": r.ID, "task_id": r.TaskID, "node_key": r.NodeKey, "attempt_no": r.AttemptNo,
+		"status": r.Status, "sub_status": r.SubStatus, "branch_id": r.BranchID,
+		"prep_json": r.PrepJSON, "exec_input_json": r.ExecInputJSON, "exec_output_json": r.ExecOutputJSON,
+		"error_text": r.ErrorText, "action": r.Action, "started_at": r.StartedAt, "finished_at": r.FinishedAt,
+		"worker_id": r.WorkerID, "worker_url": r.WorkerURL, "log_path": r.LogPath,
+	}
+}
+
+// RetentionPolicy keeps finished tasks of a flow in Status for KeepSec
+// seconds after their last update. An empty FlowID applies to every flow
+// of Namespace without its own policy for that status; an empty Namespace
+// is the default one.
+type RetentionPolicy struct {
+	Namespace string `json:"namespace"`
+	FlowID    string `json:"flow_id"`
+	Status    string `json:"status"`
+	KeepSec   int64  `json:"keep_sec"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// RetentionStatuses are the final task statuses, the ones a
+// RetentionPolicy may target.
+var RetentionStatuses = []string{"completed", "failed", "canceled", "compensated", "compensation_failed"}
+
+// Finished reports whether status is final: a task in it never runs again.
+func Finished(status string) bool {
+	for _, st := range RetentionStatuses {
+		if st == status {
+			return true
+		}
+	}
+	return false
+}
+
 // QueueTask represents a task in the persistent queue
 type QueueTask struct {
 	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
 	TaskID    string `json:"task_id"`
 	NodeKey   string `json:"node_key"`
 	Service   string `json:"service"`
@@ -0,0 +1,1227 @@
+// Package storetest provides a conformance suite that every store.Store
+// backend must pass.
+package storetest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nuknal/PocketFlowGo/pkg/store"
+)
+
+// Opener returns a fresh, empty store for a single test.
+type Opener func(t *testing.T) store.Store
+
+// Run executes the conformance suite against the backend returned by open.
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"Workers", testWorkers},
+		{"Flows", testFlows},
+		{"Tasks", testTasks},
+		{"Lease", testLease},
+		{"LeaseConcurrent", testLeaseConcurrent},
+		{"OwnedUpdates", testOwnedUpdates},
+		{"Transition", testTransition},
+		{"Revision", testRevision},
+		{"Idempotency", testIdempotency},
+		{"Search", testSearch},
+		{"Retention", testRetention},
+		{"Events", testEvents},
+		{"RequestCancel", testRequestCancel},
+		{"NodeStates", testNodeStates},
+		{"SharedPatch", testSharedPatch},
+		{"NodeRuns", testNodeRuns},
+		{"Queue", testQueue},
+		{"Restore", testRestore},
+		{"Namespaces", testNamespaces},
+		{"Recode", testRecode},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, open(t)) })
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func newVersion(t *testing.T, s store.Store) string {
+	t.Helper()
+	fid, err := s.CreateFlow("", "f", "d")
+	must(t, err)
+	vid, err := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	must(t, err)
+	return vid
+}
+
+func testWorkers(t *testing.T, s store.Store) {
+	must(t, s.RegisterWorker(store.WorkerInfo{ID: "w1", URL: "http://w1", Services: []string{"a", "b"}, Status: "online"}))
+	must(t, s.RegisterWorker(store.WorkerInfo{ID: "w2", URL: "http://w2", Services: []string{"b"}, Status: "online", Type: "async"}))
+
+	all, err := s.ListWorkers("", "", 0)
+	must(t, err)
+	if len(all) != 2 {
+		t.Fatalf("workers=%d want 2", len(all))
+	}
+	onlyA, err := s.ListWorkers("", "a", 60)
+	must(t, err)
+	if len(onlyA) != 1 || onlyA[0].ID != "w1" || onlyA[0].Type != "http" {
+		t.Fatalf("unexpected workers for a: %+v", onlyA)
+	}
+
+	must(t, s.HeartbeatWorker("w2", "", 7))
+	b, err := s.ListWorkers("", "b", 60)
+	must(t, err)
+	for _, w := range b {
+		if w.ID == "w2" && (w.Load != 7 || w.Status != "online") {
+			t.Fatalf("heartbeat not applied: %+v", w)
+		}
+	}
+
+	// Re-registering updates in place.
+	must(t, s.RegisterWorker(store.WorkerInfo{ID: "w1", URL: "http://w1b", Services: []string{"c"}, Status: "online"}))
+	c, err := s.ListWorkers("", "c", 60)
+	must(t, err)
+	if len(c) != 1 || c[0].URL != "http://w1b" {
+		t.Fatalf("re-register not applied: %+v", c)
+	}
+	must(t, s.RefreshWorkersStatus(60))
+}
+
+func testFlows(t *testing.T, s store.Store) {
+	fid, err := s.CreateFlow("", "flow", "desc")
+	must(t, err)
+	_, err = s.CreateFlow("", "other", "")
+	must(t, err)
+
+	flows, total, err := s.ListFlows("", 1, 0)
+	must(t, err)
+	if total != 2 || len(flows) != 1 {
+		t.Fatalf("flows=%d total=%d", len(flows), total)
+	}
+
+	v1, err := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	must(t, err)
+	_, err = s.CreateFlowVersion(fid, 2, `{"start":"b"}`, "draft")
+	must(t, err)
+
+	vs, err := s.ListFlowVersions(fid)
+	must(t, err)
+	if len(vs) != 2 || vs[0].Version != 2 {
+		t.Fatalf("versions not sorted desc: %+v", vs)
+	}
+	latest, err := s.LatestPublishedVersion(fid)
+	must(t, err)
+	if latest.ID != v1 {
+		t.Fatalf("latest published=%s want %s", latest.ID, v1)
+	}
+	byNum, err := s.GetFlowVersionByFlowIDAndVersion(fid, 2)
+	must(t, err)
+	if byNum.DefinitionJSON != `{"start":"b"}` || byNum.Status != "draft" {
+		t.Fatalf("unexpected version: %+v", byNum)
+	}
+	byID, err := s.GetFlowVersionByID(v1)
+	must(t, err)
+	if byID.FlowID != fid || byID.Version != 1 {
+		t.Fatalf("unexpected version: %+v", byID)
+	}
+	if _, err := s.GetFlowVersionByID("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing version err=%v want sql.ErrNoRows", err)
+	}
+	if _, err := s.LatestPublishedVersion("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing flow err=%v want sql.ErrNoRows", err)
+	}
+}
+
+func testTasks(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, `{"x":1}`, "req", "a")
+	must(t, err)
+	_, err = s.CreateTask(vid, `{}`, "", "a")
+	must(t, err)
+
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.Status != "pending" || tk.ParamsJSON != `{"x":1}` || tk.SharedJSON != "{}" || tk.CurrentNodeKey != "a" || tk.RequestID != "req" {
+		t.Fatalf("unexpected task: %+v", tk)
+	}
+	if tk.FlowID == "" || tk.FlowName != "f" || tk.FlowVersion != 1 {
+		t.Fatalf("flow columns not joined: %+v", tk)
+	}
+
+	must(t, s.UpdateTaskProgress(id, "b", "go", `{"k":"v"}`, 3))
+	must(t, s.UpdateTaskStatus(id, "completed"))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	if tk.Status != "completed" || tk.CurrentNodeKey != "b" || tk.LastAction != "go" || tk.SharedJSON != `{"k":"v"}` || tk.StepCount != 3 {
+		t.Fatalf("progress not applied: %+v", tk)
+	}
+
+	list, total, err := s.ListTasks("", "completed", "", 10, 0)
+	must(t, err)
+	if total != 1 || len(list) != 1 || list[0].ID != id {
+		t.Fatalf("status filter: total=%d list=%+v", total, list)
+	}
+	list, total, err = s.ListTasks("", "", vid, 1, 1)
+	must(t, err)
+	if total != 2 || len(list) != 1 {
+		t.Fatalf("version filter: total=%d len=%d", total, len(list))
+	}
+	if _, err := s.GetTask("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing task err=%v want sql.ErrNoRows", err)
+	}
+}
+
+func testLease(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+
+	tk, err := s.LeaseNextTask("a", 60)
+	must(t, err)
+	if tk.ID != id || tk.LeaseOwner != "a" || tk.Status != "running" {
+		t.Fatalf("unexpected lease: %+v", tk)
+	}
+	if _, err := s.LeaseNextTask("b", 60); err == nil {
+		t.Fatalf("leased a task that is already leased")
+	}
+
+	// An expired lease can be reclaimed by another owner.
+	must(t, s.ExtendLease(id, "a", -10))
+	tk, err = s.LeaseNextTask("b", 60)
+	must(t, err)
+	if tk.ID != id || tk.LeaseOwner != "b" {
+		t.Fatalf("expired lease not reclaimed: %+v", tk)
+	}
+
+	// ExtendLease only applies to the current owner.
+	must(t, s.ExtendLease(id, "a", 600))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	if tk.LeaseOwner != "b" {
+		t.Fatalf("foreign ExtendLease changed owner: %+v", tk)
+	}
+
+	// Finished tasks are never leased.
+	must(t, s.UpdateTaskStatus(id, "completed"))
+	must(t, s.ExtendLease(id, "b", -10))
+	if _, err := s.LeaseNextTask("c", 60); err == nil {
+		t.Fatalf("leased a completed task")
+	}
+
+	// Canceling tasks are leased so they can be canceled, and stay canceling.
+	id2, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(id2, "canceling"))
+	tk, err = s.LeaseNextTask("c", 60)
+	must(t, err)
+	if tk.ID != id2 || tk.LeaseOwner != "c" || tk.Status != "canceling" {
+		t.Fatalf("unexpected canceling lease: %+v", tk)
+	}
+
+	// A task rescheduled for later gives up its lease and is not leased
+	// again before its time.
+	id3, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	_, err = s.LeaseNextTask("d", 60)
+	must(t, err)
+	must(t, s.TransitionTask(id3, "d", store.TaskTransition{Status: "waiting_retry", CurrentNode: "a", RetryStateJSON: `{"attempt":1}`, NextRunAt: store.NowMillis() + 60000}))
+	tk, err = s.GetTask(id3)
+	must(t, err)
+	if tk.LeaseOwner != "" || tk.Status != "waiting_retry" || tk.RetryStateJSON != `{"attempt":1}` {
+		t.Fatalf("unexpected rescheduled task: %+v", tk)
+	}
+	if tk, err := s.LeaseNextTask("e", 60); err == nil {
+		t.Fatalf("leased a task before its next run: %+v", tk)
+	}
+	must(t, s.TransitionTask(id3, "", store.TaskTransition{Status: "waiting_retry", CurrentNode: "a", NextRunAt: store.NowMillis() - 1}))
+	tk, err = s.LeaseNextTask("e", 60)
+	must(t, err)
+	if tk.ID != id3 || tk.Status != "running" || tk.RetryStateJSON != `{"attempt":1}` {
+		t.Fatalf("unexpected lease of due task: %+v", tk)
+	}
+	must(t, s.TransitionTask(id3, "e", store.TaskTransition{Status: "completed", RetryStateJSON: "{}"}))
+	if tk, _ = s.GetTask(id3); tk.RetryStateJSON != "{}" || tk.NextRunAt != 0 {
+		t.Fatalf("retry state not cleared: %+v", tk)
+	}
+
+	// Compensating tasks stay compensating when leased.
+	id4, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(id4, "compensating"))
+	tk, err = s.LeaseNextTask("f", 60)
+	must(t, err)
+	if tk.ID != id4 || tk.Status != "compensating" {
+		t.Fatalf("unexpected compensating lease: %+v", tk)
+	}
+}
+
+func testLeaseConcurrent(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	const n = 10
+	for i := 0; i < n; i++ {
+		_, err := s.CreateTask(vid, "{}", "", "a")
+		must(t, err)
+	}
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(owner string) {
+			defer wg.Done()
+			// Stop after a few consecutive empty polls. Other errors are lost
+			// races or busy databases and are retried.
+			empty := 0
+			for i := 0; i < 1000 && empty < 3; i++ {
+				tk, err := s.LeaseNextTask(owner, 60)
+				if errors.Is(err, sql.ErrNoRows) {
+					empty++
+					continue
+				}
+				if err != nil {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				empty = 0
+				mu.Lock()
+				if seen[tk.ID] {
+					t.Errorf("task %s leased twice", tk.ID)
+				}
+				seen[tk.ID] = true
+				mu.Unlock()
+			}
+		}(string(rune('a' + w)))
+	}
+	wg.Wait()
+	if len(seen) != n {
+		t.Fatalf("leased %d tasks, want %d", len(seen), n)
+	}
+}
+
+func testOwnedUpdates(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	_, err = s.LeaseNextTask("owner", 60)
+	must(t, err)
+
+	must(t, s.UpdateTaskStatusOwned(id, "intruder", "failed"))
+	must(t, s.UpdateTaskProgressOwned(id, "intruder", "x", "", "{}", 9))
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.Status != "running" || tk.CurrentNodeKey != "a" || tk.StepCount != 0 {
+		t.Fatalf("update by non-owner was applied: %+v", tk)
+	}
+
+	must(t, s.UpdateTaskStatusOwned(id, "owner", "completed"))
+	must(t, s.UpdateTaskProgressOwned(id, "owner", "", "done", `{"r":1}`, 1))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	if tk.Status != "completed" || tk.LastAction != "done" || tk.StepCount != 1 {
+		t.Fatalf("update by owner was not applied: %+v", tk)
+	}
+}
+
+func testTransition(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	_, err = s.LeaseNextTask("owner", 60)
+	must(t, err)
+	run := func() map[string]interface{} {
+		now := time.Now().Unix()
+		return map[string]interface{}{"task_id": id, "node_key": "a", "attempt_no": 1, "status": "ok", "prep_json": "{}", "exec_input_json": "null", "exec_output_json": "null", "error_text": "", "action": "go", "started_at": now, "finished_at": now, "worker_id": "", "worker_url": ""}
+	}
+
+	err = s.TransitionTask(id, "intruder", store.TaskTransition{Status: "failed", CurrentNode: "x", SharedJSON: "{}", StepCount: 5, NodeRuns: []map[string]interface{}{run()}})
+	if !errors.Is(err, store.ErrLeaseLost) {
+		t.Fatalf("non-owner transition err=%v want ErrLeaseLost", err)
+	}
+	tk, err := s.GetTask(id)
+	must(t, err)
+	runs, err := s.ListNodeRuns(id)
+	must(t, err)
+	if tk.Status != "running" || tk.CurrentNodeKey != "a" || len(runs) != 0 {
+		t.Fatalf("rejected transition left changes: %+v runs=%d", tk, len(runs))
+	}
+
+	must(t, s.TransitionTask(id, "owner", store.TaskTransition{Status: "running", CurrentNode: "b", LastAction: "go", SharedJSON: `{"x":1}`, StepCount: 1, NodeRuns: []map[string]interface{}{run(), run()}}))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	runs, err = s.ListNodeRuns(id)
+	must(t, err)
+	if tk.Status != "running" || tk.CurrentNodeKey != "b" || tk.LastAction != "go" || tk.SharedJSON != `{"x":1}` || tk.StepCount != 1 || len(runs) != 2 {
+		t.Fatalf("transition not applied: %+v runs=%d", tk, len(runs))
+	}
+
+	// Unowned transitions are used by lease-less engines.
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Status: "completed", LastAction: "done", SharedJSON: "{}", StepCount: 2}))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	if tk.Status != "completed" || tk.CurrentNodeKey != "" {
+		t.Fatalf("unowned transition not applied: %+v", tk)
+	}
+	if err := s.TransitionTask("missing", "", store.TaskTransition{Status: "x"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing task err=%v want sql.ErrNoRows", err)
+	}
+}
+
+func testRevision(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	rev := func() int64 {
+		t.Helper()
+		tk, err := s.GetTask(id)
+		must(t, err)
+		return tk.Revision
+	}
+	if r := rev(); r != 1 {
+		t.Fatalf("new task revision=%d want 1", r)
+	}
+
+	must(t, s.UpdateTaskShared(id, 1, `{"sig":1}`, store.TaskEvent{}))
+	if err := s.UpdateTaskShared(id, 1, `{"sig":2}`, store.TaskEvent{}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale shared update err=%v want ErrConflict", err)
+	}
+	if r := rev(); r != 2 {
+		t.Fatalf("revision=%d want 2", r)
+	}
+
+	_, err = s.LeaseNextTask("owner", 60)
+	must(t, err)
+	leased := rev()
+	if leased != 3 {
+		t.Fatalf("lease revision=%d want 3", leased)
+	}
+	must(t, s.ExtendLease(id, "owner", 60))
+	if r := rev(); r != leased {
+		t.Fatalf("ExtendLease bumped revision to %d", r)
+	}
+
+	err = s.TransitionTask(id, "owner", store.TaskTransition{Revision: 2, Status: "running", CurrentNode: "b", SharedJSON: "{}"})
+	if !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale transition err=%v want ErrConflict", err)
+	}
+	err = s.TransitionTask(id, "intruder", store.TaskTransition{Revision: 2, Status: "running", CurrentNode: "b", SharedJSON: "{}"})
+	if !errors.Is(err, store.ErrLeaseLost) {
+		t.Fatalf("stale non-owner transition err=%v want ErrLeaseLost", err)
+	}
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.CurrentNodeKey != "a" || tk.SharedJSON != `{"sig":1}` {
+		t.Fatalf("rejected transition was applied: %+v", tk)
+	}
+	must(t, s.TransitionTask(id, "owner", store.TaskTransition{Revision: leased, Status: "running", CurrentNode: "b", SharedJSON: `{"sig":1}`}))
+
+	must(t, s.UpdateTaskStatus(id, "canceling"))
+	must(t, s.UpdateTaskProgress(id, "b", "", "{}", 1))
+	if r := rev(); r != leased+3 {
+		t.Fatalf("revision=%d want %d", r, leased+3)
+	}
+	if err := s.UpdateTaskShared("missing", 1, "{}", store.TaskEvent{}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing task err=%v want sql.ErrNoRows", err)
+	}
+}
+
+func testIdempotency(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	fid2, err := s.CreateFlow("", "g", "")
+	must(t, err)
+	vid2, err := s.CreateFlowVersion(fid2, 1, `{"start":"a"}`, "published")
+	must(t, err)
+
+	id, created, err := s.CreateTaskOnce(vid, `{"n":1}`, "key-1", "a")
+	must(t, err)
+	if !created || id == "" {
+		t.Fatalf("first create: id=%q created=%v", id, created)
+	}
+	again, created, err := s.CreateTaskOnce(vid, `{"n":2}`, "key-1", "a")
+	must(t, err)
+	if created || again != id {
+		t.Fatalf("retry: id=%q created=%v want %q, false", again, created, id)
+	}
+	if _, err := s.CreateTask(vid, "{}", "key-1", "a"); err == nil {
+		t.Fatalf("duplicate request_id accepted by CreateTask")
+	}
+
+	// Keys are scoped per flow, and an empty key never deduplicates.
+	other, created, err := s.CreateTaskOnce(vid2, "{}", "key-1", "a")
+	must(t, err)
+	if !created || other == id {
+		t.Fatalf("other flow: id=%q created=%v", other, created)
+	}
+	a, _, err := s.CreateTaskOnce(vid, "{}", "", "a")
+	must(t, err)
+	b, created, err := s.CreateTaskOnce(vid, "{}", "", "a")
+	must(t, err)
+	if !created || a == b {
+		t.Fatalf("empty key deduplicated: %q %q", a, b)
+	}
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.ParamsJSON != `{"n":1}` || tk.RequestID != "key-1" {
+		t.Fatalf("original task changed: %+v", tk)
+	}
+}
+
+func testSearch(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	fid2, err := s.CreateFlow("", "other", "")
+	must(t, err)
+	vid2, err := s.CreateFlowVersion(fid2, 1, `{"start":"a"}`, "published")
+	must(t, err)
+	v, err := s.GetFlowVersionByID(vid)
+	must(t, err)
+
+	ids := []string{}
+	for i, p := range []string{`{"customer_id":42,"tier":"gold"}`, `{"customer_id":7}`, `{"customer_id":42}`, ``, `{"nested":{"ok":true}}`, `{"tags":[42]}`} {
+		id, err := s.CreateTask(vid, p, fmt.Sprintf("r%d", i), "a")
+		must(t, err)
+		ids = append(ids, id)
+	}
+	other, err := s.CreateTask(vid2, `{"customer_id":42}`, "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(ids[1], "running"))
+	must(t, s.UpdateTaskShared(ids[2], 0, `{"region":"eu"}`, store.TaskEvent{}))
+	must(t, s.UpdateTaskShared(ids[5], 0, `{"region":["eu"]}`, store.TaskEvent{}))
+
+	search := func(q string) []string {
+		t.Helper()
+		fs, err := store.ParseTaskFilters(q)
+		must(t, err)
+		page, err := s.SearchTasks(store.TaskQuery{Filters: fs, Sort: "created_at"})
+		must(t, err)
+		out := []string{}
+		for _, tk := range page.Tasks {
+			out = append(out, tk.ID)
+		}
+		sort.Strings(out)
+		return out
+	}
+	expect := func(q string, want ...string) {
+		t.Helper()
+		sort.Strings(want)
+		if got := search(q); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: got %v want %v", q, got, want)
+		}
+	}
+	expect("$params.customer_id=42", ids[0], ids[2], other)
+	expect("$params.customer_id=42 and flow_id="+v.FlowID, ids[0], ids[2])
+	expect("$params.customer_id>10 AND flow_version_id="+vid, ids[0], ids[2])
+	expect(`$params.tier="gold"`, ids[0])
+	expect("$params.nested.ok=true", ids[4])
+	expect("$params.tier!=null", ids[0])
+	expect(`$shared.region=eu`, ids[2])
+	// An array holding the value is not equal to it.
+	expect("$params.tags=42")
+	expect("status=running", ids[1])
+	expect("request_id=r3 and current_node_key=a", ids[3])
+	expect("created_at>=0 and updated_at<=9999999999 and flow_id="+fid2, other)
+
+	// Walk the flow's tasks two at a time in both directions.
+	for _, order := range []string{"created_at", "-created_at", "-updated_at"} {
+		fs, _ := store.ParseTaskFilters("flow_id=" + v.FlowID)
+		seen := []string{}
+		q := store.TaskQuery{Filters: fs, Sort: order, Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("%s: cursor does not advance", order)
+			}
+			page, err := s.SearchTasks(q)
+			must(t, err)
+			for _, tk := range page.Tasks {
+				seen = append(seen, tk.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if len(seen) != len(ids) {
+			t.Fatalf("%s: paged %d tasks want %d: %v", order, len(seen), len(ids), seen)
+		}
+		uniq := map[string]bool{}
+		for _, id := range seen {
+			uniq[id] = true
+		}
+		if len(uniq) != len(ids) {
+			t.Fatalf("%s: duplicates across pages: %v", order, seen)
+		}
+	}
+
+	for _, bad := range []store.TaskQuery{
+		{Filters: []store.TaskFilter{{Field: "bogus", Op: "=", Value: "x"}}},
+		{Filters: []store.TaskFilter{{Field: "$params.a'b", Op: "=", Value: "x"}}},
+		{Sort: "status"},
+		{Cursor: "%%%"},
+	} {
+		if _, err := s.SearchTasks(bad); !errors.Is(err, store.ErrBadQuery) {
+			t.Fatalf("%+v: err %v, want ErrBadQuery", bad, err)
+		}
+	}
+}
+
+func testRetention(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	v, err := s.GetFlowVersionByID(vid)
+	must(t, err)
+	fid2, err := s.CreateFlow("", "kept", "")
+	must(t, err)
+	vid2, err := s.CreateFlowVersion(fid2, 1, `{"start":"a"}`, "published")
+	must(t, err)
+
+	must(t, s.SetRetentionPolicy(store.RetentionPolicy{Status: "completed", KeepSec: 10}))
+	must(t, s.SetRetentionPolicy(store.RetentionPolicy{FlowID: fid2, Status: "completed", KeepSec: 1000}))
+	must(t, s.SetRetentionPolicy(store.RetentionPolicy{Status: "failed", KeepSec: 5}))
+	must(t, s.SetRetentionPolicy(store.RetentionPolicy{Status: "failed", KeepSec: 0}))
+	ps, err := s.ListRetentionPolicies("default")
+	must(t, err)
+	if len(ps) != 2 || ps[0].FlowID != "" || ps[0].Namespace != "default" || ps[1].FlowID != fid2 || ps[1].KeepSec != 1000 {
+		t.Fatalf("policies %+v", ps)
+	}
+	// A policy without a flow only covers its own namespace.
+	must(t, s.SetRetentionPolicy(store.RetentionPolicy{Namespace: "acme", Status: "failed", KeepSec: 1}))
+	if ps, err := s.ListRetentionPolicies("acme"); err != nil || len(ps) != 1 || ps[0].Status != "failed" {
+		t.Fatalf("acme policies %+v %v", ps, err)
+	}
+	if ps, err := s.ListRetentionPolicies(""); err != nil || len(ps) != 3 {
+		t.Fatalf("all policies %+v %v", ps, err)
+	}
+	acmeFlow, err := s.CreateFlow("acme", "f", "")
+	must(t, err)
+	acmeVid, err := s.CreateFlowVersion(acmeFlow, 1, `{"start":"a"}`, "published")
+	must(t, err)
+	acmeFailed, err := s.CreateTask(acmeVid, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(acmeFailed, "failed"))
+
+	done, err := s.CreateTask(vid, `{"a":1}`, "req", "a")
+	must(t, err)
+	must(t, s.TransitionTask(done, "", store.TaskTransition{Status: "completed", CurrentNode: "b", SharedJSON: `{"x":1}`, StepCount: 2,
+		NodeRuns: []map[string]interface{}{{"id": "run-keep", "task_id": done, "node_key": "a", "attempt_no": 1, "status": "ok", "sub_status": "", "branch_id": "", "prep_json": "{}", "exec_input_json": "{}", "exec_output_json": "{}", "error_text": "", "action": "next", "started_at": 1, "finished_at": 2, "worker_id": "", "worker_url": "", "log_path": ""}}}))
+	_, err = s.EnqueueTask(done, "a", "svc", "{}")
+	must(t, err)
+	failed, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(failed, "failed"))
+	running, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(running, "running"))
+	other, err := s.CreateTask(vid2, "{}", "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskStatus(other, "completed"))
+
+	now := time.Now().Unix()
+	if exp, err := s.ListExpiredTasks(now, 10); err != nil || len(exp) != 0 {
+		t.Fatalf("expired too early: %+v %v", exp, err)
+	}
+	exp, err := s.ListExpiredTasks(now+60, 10)
+	must(t, err)
+	if len(exp) != 2 || exp[0].ID != done && exp[1].ID != done {
+		t.Fatalf("expired %+v", exp)
+	}
+	if exp[0].ID != done {
+		exp[0], exp[1] = exp[1], exp[0]
+	}
+	if exp[0].FlowID != v.FlowID || exp[1].ID != acmeFailed {
+		t.Fatalf("expired %+v", exp)
+	}
+	must(t, s.DeleteTasks([]string{acmeFailed}))
+	orig, err := s.GetTask(done)
+	must(t, err)
+	runs, err := s.ListNodeRuns(done)
+	must(t, err)
+	events, err := s.ListTaskEvents(done)
+	must(t, err)
+
+	must(t, s.DeleteTasks([]string{done}))
+	if _, err := s.GetTask(done); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("deleted task still readable: %v", err)
+	}
+	if rs, _ := s.ListNodeRuns(done); len(rs) != 0 {
+		t.Fatalf("node runs left: %d", len(rs))
+	}
+	if evs, _ := s.ListTaskEvents(done); len(evs) != 0 {
+		t.Fatalf("events left: %d", len(evs))
+	}
+	if q, err := s.PollQueue("", "w", []string{"svc"}, 10); err == nil && q.ID != "" {
+		t.Fatalf("queue entry left: %+v", q)
+	}
+
+	must(t, s.RestoreTask(orig, runs, events))
+	got, err := s.GetTask(done)
+	must(t, err)
+	if got.Status != "completed" || got.SharedJSON != `{"x":1}` || got.StepCount != 2 || got.RequestID != "req" || got.UpdatedAt != orig.UpdatedAt || got.Revision != orig.Revision {
+		t.Fatalf("restored %+v want %+v", got, orig)
+	}
+	if rs, _ := s.ListNodeRuns(done); len(rs) != 1 || rs[0].ID != "run-keep" {
+		t.Fatalf("restored runs %+v", rs)
+	}
+	if evs, _ := s.ListTaskEvents(done); len(evs) != len(events)+1 || evs[0].Type != "create" || evs[len(evs)-1].Type != "restore" {
+		t.Fatalf("restored events %+v", evs)
+	}
+	if err := s.RestoreTask(orig, nil, nil); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("double restore: %v", err)
+	}
+	// The restored task still belongs to its flow for idempotency.
+	if id, created, err := s.CreateTaskOnce(vid, "{}", "req", "a"); err != nil || created || id != done {
+		t.Fatalf("restored request_id: %s %v %v", id, created, err)
+	}
+}
+
+func testRequestCancel(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	must(t, s.RequestCancel(id, store.TaskEvent{Type: "cancel", Actor: "bob"}))
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.Status != "canceling" {
+		t.Fatalf("status %s", tk.Status)
+	}
+	for _, st := range store.RetentionStatuses {
+		must(t, s.UpdateTaskStatus(id, st))
+		before, err := s.ListTaskEvents(id)
+		must(t, err)
+		tk, err := s.GetTask(id)
+		must(t, err)
+		if err := s.RequestCancel(id, store.TaskEvent{Type: "cancel"}); !errors.Is(err, store.ErrFinished) {
+			t.Fatalf("cancel %s task: %v", st, err)
+		}
+		after, err := s.GetTask(id)
+		must(t, err)
+		evs, err := s.ListTaskEvents(id)
+		must(t, err)
+		if after.Status != st || after.Revision != tk.Revision || len(evs) != len(before) {
+			t.Fatalf("cancel %s task wrote %+v, %d events", st, after, len(evs)-len(before))
+		}
+	}
+	if err := s.RequestCancel("missing", store.TaskEvent{}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("cancel missing task: %v", err)
+	}
+}
+
+func testEvents(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	_, err = s.LeaseNextTask("w1", 30)
+	must(t, err)
+	must(t, s.TransitionTask(id, "w1", store.TaskTransition{Status: "running", CurrentNode: "b", SharedJSON: "{}", StepCount: 1}))
+	must(t, s.TransitionTask(id, "w1", store.TaskTransition{Status: "waiting_queue", CurrentNode: "b", SharedJSON: "{}", StepCount: 1}))
+	if err := s.TransitionTask(id, "w2", store.TaskTransition{Status: "failed"}); !errors.Is(err, store.ErrLeaseLost) {
+		t.Fatalf("foreign owner: %v", err)
+	}
+	must(t, s.UpdateTaskStatus(id, "pending"))
+	must(t, s.UpdateTaskShared(id, 0, `{"k":"v"}`, store.TaskEvent{Type: "signal", Actor: "alice", DataJSON: `{"key":"k"}`}))
+	if err := s.UpdateTaskShared(id, 1, "{}", store.TaskEvent{Type: "signal"}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale signal: %v", err)
+	}
+	must(t, s.SetTaskStatus(id, "canceling", store.TaskEvent{Type: "cancel", Actor: "bob"}))
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Status: "canceled", CurrentNode: "b", SharedJSON: `{"k":"v"}`, StepCount: 1}))
+
+	evs, err := s.ListTaskEvents(id)
+	must(t, err)
+	want := []struct{ typ, from, to, actor string }{
+		{"create", "", "pending", ""},
+		{"lease", "pending", "running", "w1"},
+		{"step", "running", "running", "w1"},
+		{"suspend", "running", "waiting_queue", "w1"},
+		{"resume", "waiting_queue", "pending", ""},
+		{"signal", "pending", "pending", "alice"},
+		{"cancel", "pending", "canceling", "bob"},
+		{"cancel", "canceling", "canceled", ""},
+	}
+	if len(evs) != len(want) {
+		t.Fatalf("got %d events: %+v", len(evs), evs)
+	}
+	for i, w := range want {
+		ev := evs[i]
+		if ev.TaskID != id || ev.Type != w.typ || ev.FromStatus != w.from || ev.ToStatus != w.to || ev.Actor != w.actor || ev.CreatedAt == 0 {
+			t.Fatalf("event %d: %+v want %+v", i, ev, w)
+		}
+		if i > 0 && (ev.Seq <= evs[i-1].Seq || ev.FromStatus != evs[i-1].ToStatus) {
+			t.Fatalf("event %d does not follow %d: %+v", i, i-1, evs)
+		}
+	}
+	if evs[2].NodeKey != "b" || evs[5].DataJSON != `{"key":"k"}` {
+		t.Fatalf("details: %+v", evs)
+	}
+	if evs, _ := s.ListTaskEvents("missing"); len(evs) != 0 {
+		t.Fatalf("events for missing task: %+v", evs)
+	}
+}
+
+func testNodeStates(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	if _, err := s.GetNodeState(id, "a"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("no state yet: %v", err)
+	}
+	st := func(node string, js string) store.NodeState {
+		return store.NodeState{NodeKey: node, Kind: "parallel", Version: 1, StateJSON: js}
+	}
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Status: "running", CurrentNode: "a", SharedJSON: "{}", StepCount: 1, NodeStates: []store.NodeState{st("a", `{"done":{}}`), st("b", `{"n":1}`)}}))
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Status: "running", CurrentNode: "a", SharedJSON: "{}", StepCount: 2, NodeStates: []store.NodeState{st("a", `{"done":{"x":1}}`)}}))
+	ns, err := s.GetNodeState(id, "a")
+	must(t, err)
+	if ns.TaskID != id || ns.Kind != "parallel" || ns.Version != 1 || ns.StateJSON != `{"done":{"x":1}}` || ns.UpdatedAt == 0 {
+		t.Fatalf("state a: %+v", ns)
+	}
+	if tk, _ := s.GetTask(id); tk.SharedJSON != "{}" {
+		t.Fatalf("state leaked into shared: %s", tk.SharedJSON)
+	}
+
+	// A transition that fails its revision check saves no state.
+	if err := s.TransitionTask(id, "", store.TaskTransition{Revision: 1, Status: "running", CurrentNode: "a", NodeStates: []store.NodeState{st("a", `{"stale":true}`)}}); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("stale transition: %v", err)
+	}
+	if ns, _ := s.GetNodeState(id, "a"); ns.StateJSON != `{"done":{"x":1}}` {
+		t.Fatalf("stale state written: %+v", ns)
+	}
+
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Status: "running", CurrentNode: "b", SharedJSON: "{}", StepCount: 3, NodeStates: []store.NodeState{{NodeKey: "a"}}}))
+	all, err := s.ListNodeStates(id)
+	must(t, err)
+	if len(all) != 1 || all[0].NodeKey != "b" {
+		t.Fatalf("states after delete: %+v", all)
+	}
+	must(t, s.DeleteTasks([]string{id}))
+	if all, _ := s.ListNodeStates(id); len(all) != 0 {
+		t.Fatalf("states of deleted task: %+v", all)
+	}
+}
+
+func testSharedPatch(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	id, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	shared := func() string {
+		t.Helper()
+		tk, err := s.GetTask(id)
+		must(t, err)
+		return tk.SharedJSON
+	}
+	set := func(k, v string) store.SharedOp { return store.SharedOp{Op: "set", Key: k, Value: []byte(v)} }
+
+	must(t, s.PatchTaskShared(id, []store.SharedOp{set("b", `{"x": 1, "y": 2}`), set("a", "1")}, store.TaskEvent{Type: "signal", Actor: "alice"}))
+	if got := shared(); got != `{"a":1,"b":{"x":1,"y":2}}` {
+		t.Fatalf("after set: %s", got)
+	}
+	must(t, s.PatchTaskShared(id, []store.SharedOp{{Op: "merge", Key: "b", Value: []byte(`{"y":null,"z":[1]}`)}, {Op: "delete", Key: "a"}}, store.TaskEvent{}))
+	if got := shared(); got != `{"b":{"x":1,"z":[1]}}` {
+		t.Fatalf("after merge and delete: %s", got)
+	}
+	for _, bad := range []store.SharedOp{{Op: "bogus", Key: "a"}, {Op: "set", Value: []byte("1")}, {Op: "set", Key: "a"}, set("a", "{")} {
+		if err := s.PatchTaskShared(id, []store.SharedOp{set("ok", "1"), bad}, store.TaskEvent{}); !errors.Is(err, store.ErrBadShared) {
+			t.Fatalf("%+v: err %v want ErrBadShared", bad, err)
+		}
+	}
+	if got := shared(); got != `{"b":{"x":1,"z":[1]}}` {
+		t.Fatalf("rejected patch was applied: %s", got)
+	}
+
+	// Patches leave the revision alone, so a transition based on an older
+	// read still succeeds and keeps keys it did not touch.
+	tk, err := s.GetTask(id)
+	must(t, err)
+	if tk.Revision != 1 {
+		t.Fatalf("patch bumped revision to %d", tk.Revision)
+	}
+	must(t, s.TransitionTask(id, "", store.TaskTransition{Revision: 1, Status: "running", CurrentNode: "a", StepCount: 1, Shared: []store.SharedOp{set("c", `"v"`)}}))
+	if got := shared(); got != `{"b":{"x":1,"z":[1]},"c":"v"}` {
+		t.Fatalf("after transition: %s", got)
+	}
+	fs, err := store.ParseTaskFilters(`$shared.b.x=1 and $shared.c=v`)
+	must(t, err)
+	page, err := s.SearchTasks(store.TaskQuery{Filters: fs})
+	must(t, err)
+	if len(page.Tasks) != 1 || page.Tasks[0].ID != id {
+		t.Fatalf("search by shared key: %+v", page.Tasks)
+	}
+
+	// b counts 1+15 bytes and c 1+3.
+	must(t, s.SetSharedLimits(id, store.SharedLimits{MaxBytes: 40, MaxKeyBytes: 10}))
+	tk, err = s.GetTask(id)
+	must(t, err)
+	if tk.SharedLimits != (store.SharedLimits{MaxBytes: 40, MaxKeyBytes: 10}) {
+		t.Fatalf("limits: %+v", tk.SharedLimits)
+	}
+	var le *store.SharedLimitError
+	err = s.PatchTaskShared(id, []store.SharedOp{set("big", `"0123456789"`)}, store.TaskEvent{})
+	if !errors.Is(err, store.ErrSharedLimit) || !errors.As(err, &le) || le.Key != "big" || le.Size != 12 || le.Limit != 10 {
+		t.Fatalf("oversized value: %v", err)
+	}
+	must(t, s.PatchTaskShared(id, []store.SharedOp{set("d", `"1234567"`)}, store.TaskEvent{}))
+	err = s.TransitionTask(id, "", store.TaskTransition{Status: "running", CurrentNode: "b", StepCount: 2, Shared: []store.SharedOp{set("e", `"12345678"`)}})
+	if !errors.As(err, &le) || le.Key != "" || le.Size != 41 || le.Limit != 40 {
+		t.Fatalf("oversized total: %v", err)
+	}
+	if tk, _ := s.GetTask(id); tk.CurrentNodeKey != "a" || tk.SharedJSON != `{"b":{"x":1,"z":[1]},"c":"v","d":"1234567"}` {
+		t.Fatalf("rejected transition was applied: %+v", tk)
+	}
+	// Shrinking is allowed even when limits were lowered below the state.
+	must(t, s.SetSharedLimits(id, store.SharedLimits{MaxBytes: 1}))
+	must(t, s.PatchTaskShared(id, []store.SharedOp{{Op: "delete", Key: "d"}}, store.TaskEvent{}))
+
+	if err := s.PatchTaskShared("missing", []store.SharedOp{set("a", "1")}, store.TaskEvent{}); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing task err=%v want sql.ErrNoRows", err)
+	}
+	evs, err := s.ListTaskEvents(id)
+	must(t, err)
+	if ev := evs[1]; ev.Type != "signal" || ev.Actor != "alice" {
+		t.Fatalf("patch journal entry: %+v", ev)
+	}
+}
+
+func testNodeRuns(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	tid, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	now := time.Now().Unix()
+	run := func(node string, started int64) map[string]interface{} {
+		return map[string]interface{}{
+			"task_id":          tid,
+			"node_key":         node,
+			"attempt_no":       1,
+			"status":           "ok",
+			"prep_json":        "{}",
+			"exec_input_json":  "null",
+			"exec_output_json": `{"v":1}`,
+			"error_text":       "",
+			"action":           "",
+			"started_at":       started,
+			"finished_at":      started,
+			"worker_id":        "w",
+			"worker_url":       "u",
+		}
+	}
+	must(t, s.SaveNodeRun(run("b", now+1)))
+	must(t, s.SaveNodeRun(run("a", now)))
+	queued := run("c", now+2)
+	queued["id"] = "run-fixed"
+	queued["status"] = "queued"
+	queued["sub_status"] = "waiting"
+	queued["branch_id"] = "x"
+	must(t, s.CreateNodeRun(queued))
+
+	runs, err := s.ListNodeRuns(tid)
+	must(t, err)
+	if len(runs) != 3 || runs[0].NodeKey != "a" || runs[2].NodeKey != "c" {
+		t.Fatalf("runs not ordered by started_at: %+v", runs)
+	}
+
+	must(t, s.UpdateNodeRun("run-fixed", map[string]interface{}{"status": "ok", "log_path": "/tmp/l", "exec_output_json": `"done"`}))
+	r, err := s.GetNodeRun("run-fixed")
+	must(t, err)
+	if r.Status != "ok" || r.LogPath != "/tmp/l" || r.ExecOutputJSON != `"done"` || r.SubStatus != "waiting" || r.BranchID != "x" || r.AttemptNo != 1 {
+		t.Fatalf("unexpected run: %+v", r)
+	}
+	if _, err := s.GetNodeRun("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing run err=%v want sql.ErrNoRows", err)
+	}
+
+	// Runs started in the same second keep the order they were written in.
+	other, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	for _, k := range []string{"t3", "t1", "t4", "t0", "t2"} {
+		r := run(k, now)
+		r["task_id"] = other
+		must(t, s.SaveNodeRun(r))
+	}
+	runs, err = s.ListNodeRuns(other)
+	must(t, err)
+	var keys []string
+	for _, r := range runs {
+		keys = append(keys, r.NodeKey)
+	}
+	if strings.Join(keys, ",") != "t3,t1,t4,t0,t2" {
+		t.Fatalf("runs started together out of write order: %v", keys)
+	}
+}
+
+func testQueue(t *testing.T, s store.Store) {
+	q1, err := s.EnqueueTask("t1", "n1", "svc-a", `{"i":1}`)
+	must(t, err)
+	_, err = s.EnqueueTask("t2", "n2", "svc-b", `{"i":2}`)
+	must(t, err)
+
+	none, err := s.PollQueue("", "w", []string{"svc-c"}, 60)
+	must(t, err)
+	if none.ID != "" {
+		t.Fatalf("claimed entry for unknown service: %+v", none)
+	}
+	empty, err := s.PollQueue("", "w", nil, 60)
+	must(t, err)
+	if empty.ID != "" {
+		t.Fatalf("claimed entry without services: %+v", empty)
+	}
+
+	got, err := s.PollQueue("", "w", []string{"svc-a", "svc-c"}, 60)
+	must(t, err)
+	if got.ID != q1 || got.TaskID != "t1" || got.NodeKey != "n1" || got.InputJSON != `{"i":1}` || got.Status != "claimed" || got.WorkerID != "w" || got.TimeoutAt < got.StartedAt+60 {
+		t.Fatalf("unexpected claim: %+v", got)
+	}
+	again, err := s.PollQueue("", "w2", []string{"svc-a"}, 60)
+	must(t, err)
+	if again.ID != "" {
+		t.Fatalf("entry claimed twice: %+v", again)
+	}
+
+	taskID, err := s.CompleteQueueTask(q1)
+	must(t, err)
+	if taskID != "t1" {
+		t.Fatalf("complete returned task %q", taskID)
+	}
+	if _, err := s.CompleteQueueTask("missing"); err == nil {
+		t.Fatalf("completing unknown entry should fail")
+	}
+
+	b, err := s.PollQueue("", "w", []string{"svc-b"}, 60)
+	must(t, err)
+	must(t, s.FailQueueTask(b.ID))
+
+	// Revoking takes back pending and claimed entries; they are not handed
+	// out again and cannot be completed or failed.
+	c1, err := s.EnqueueTask("t3", "n3", "svc-c", "{}")
+	must(t, err)
+	c2, err := s.EnqueueTask("t3", "n3", "svc-c", "{}")
+	must(t, err)
+	if got, _ := s.PollQueue("", "w", []string{"svc-c"}, 60); got.ID != c1 {
+		t.Fatalf("claimed %+v want %s", got, c1)
+	}
+	n, err := s.RevokeQueueTasks("t3")
+	must(t, err)
+	if n != 2 {
+		t.Fatalf("revoked %d want 2", n)
+	}
+	if got, _ := s.PollQueue("", "w", []string{"svc-c"}, 60); got.ID != "" {
+		t.Fatalf("revoked entry handed out: %+v", got)
+	}
+	if _, err := s.CompleteQueueTask(c1); !errors.Is(err, store.ErrRevoked) {
+		t.Fatalf("complete revoked err=%v want ErrRevoked", err)
+	}
+	must(t, s.FailQueueTask(c2))
+	for _, id := range []string{c1, c2} {
+		if q, err := s.GetQueueTask(id); err != nil || q.Status != "revoked" {
+			t.Fatalf("entry %s after revoke: %+v %v", id, q, err)
+		}
+	}
+	if n, err := s.RevokeQueueTasks("t1"); err != nil || n != 0 {
+		t.Fatalf("revoked %d finished entries: %v", n, err)
+	}
+}
+
+func testRestore(t *testing.T, s store.Store) {
+	f := store.Flow{ID: "flow-old", Namespace: store.DefaultNamespace, Name: "old", Description: "d", CreatedAt: 100}
+	must(t, s.RestoreFlow(f))
+	if err := s.RestoreFlow(f); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("duplicate flow: %v", err)
+	}
+	v := store.FlowVersion{ID: "ver-old", FlowID: f.ID, Version: 3, DefinitionJSON: `{"start":"a"}`, Status: "published"}
+	must(t, s.RestoreFlowVersion(v))
+	if err := s.RestoreFlowVersion(v); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("duplicate version: %v", err)
+	}
+	flows, _, err := s.ListFlows("", 0, 0)
+	must(t, err)
+	if len(flows) != 1 || flows[0] != f {
+		t.Fatalf("flows %+v", flows)
+	}
+	if got, err := s.GetFlowVersionByID(v.ID); err != nil || got != v {
+		t.Fatalf("version %+v %v", got, err)
+	}
+
+	must(t, s.RestoreTask(store.Task{ID: "task-old", FlowVersionID: v.ID, Status: "waiting_queue", ParamsJSON: "{}", SharedJSON: "{}", CurrentNodeKey: "a", CreatedAt: 100, UpdatedAt: 200, Revision: 4}, nil, nil))
+	ns := store.NodeState{TaskID: "task-old", NodeKey: "a", Kind: "parallel", Version: 1, StateJSON: `{"done":{}}`, UpdatedAt: 150}
+	must(t, s.RestoreNodeState(ns))
+	if got, err := s.GetNodeState("task-old", "a"); err != nil || got != ns {
+		t.Fatalf("node state %+v %v", got, err)
+	}
+
+	q := store.QueueTask{ID: "q-old", Namespace: store.DefaultNamespace, TaskID: "task-old", NodeKey: "a", Service: "svc", InputJSON: "{}", Status: "claimed", WorkerID: "w1", CreatedAt: 150, StartedAt: 160, TimeoutAt: 190}
+	must(t, s.RestoreQueueTask(q))
+	if err := s.RestoreQueueTask(q); !errors.Is(err, store.ErrConflict) {
+		t.Fatalf("duplicate queue entry: %v", err)
+	}
+	newer, err := s.EnqueueTask("task-old", "a", "svc", "{}")
+	must(t, err)
+	qs, err := s.ListQueueTasks("task-old")
+	must(t, err)
+	if len(qs) != 2 || qs[0] != q || qs[1].ID != newer || qs[1].Status != "pending" {
+		t.Fatalf("queue %+v", qs)
+	}
+	if qs, err := s.ListQueueTasks("nope"); err != nil || len(qs) != 0 {
+		t.Fatalf("queue of unknown task: %+v %v", qs, err)
+	}
+}
+
+func testNamespaces(t *testing.T, s store.Store) {
+	must(t, s.RegisterWorker(store.WorkerInfo{ID: "w1", URL: "http://w1", Services: []string{"svc"}}))
+	must(t, s.RegisterWorker(store.WorkerInfo{ID: "w2", Namespace: "acme", URL: "http://w2", Services: []string{"svc"}}))
+	if ws, err := s.ListWorkers("acme", "svc", 0); err != nil || len(ws) != 1 || ws[0].ID != "w2" || ws[0].Namespace != "acme" {
+		t.Fatalf("acme workers %+v %v", ws, err)
+	}
+	if ws, err := s.ListWorkers(store.DefaultNamespace, "svc", 0); err != nil || len(ws) != 1 || ws[0].ID != "w1" {
+		t.Fatalf("default workers %+v %v", ws, err)
+	}
+	if ws, _ := s.ListWorkers("", "svc", 0); len(ws) != 2 {
+		t.Fatalf("all workers %+v", ws)
+	}
+
+	def := newVersion(t, s)
+	fid, err := s.CreateFlow("acme", "f", "d")
+	must(t, err)
+	if f, err := s.GetFlow(fid); err != nil || f.Namespace != "acme" || f.Name != "f" {
+		t.Fatalf("flow %+v %v", f, err)
+	}
+	if _, err := s.GetFlow("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing flow: %v", err)
+	}
+	if fs, total, _ := s.ListFlows("acme", 0, 0); total != 1 || len(fs) != 1 || fs[0].ID != fid {
+		t.Fatalf("acme flows %+v", fs)
+	}
+	if _, total, _ := s.ListFlows("", 0, 0); total != 2 {
+		t.Fatalf("all flows %d", total)
+	}
+	vid, err := s.CreateFlowVersion(fid, 1, `{"start":"a"}`, "published")
+	must(t, err)
+
+	// Tasks and queue entries inherit the namespace of their flow.
+	t1, err := s.CreateTask(vid, "{}", "", "a")
+	must(t, err)
+	t2, err := s.CreateTask(def, "{}", "", "a")
+	must(t, err)
+	if tk, _ := s.GetTask(t1); tk.Namespace != "acme" {
+		t.Fatalf("task namespace %q", tk.Namespace)
+	}
+	if tk, _ := s.GetTask(t2); tk.Namespace != store.DefaultNamespace {
+		t.Fatalf("default task namespace %q", tk.Namespace)
+	}
+	if ts, total, _ := s.ListTasks("acme", "", "", 0, 0); total != 1 || len(ts) != 1 || ts[0].ID != t1 {
+		t.Fatalf("acme tasks %+v", ts)
+	}
+	if _, total, _ := s.ListTasks("", "", "", 0, 0); total != 2 {
+		t.Fatalf("all tasks %d", total)
+	}
+	page, err := s.SearchTasks(store.TaskQuery{Filters: []store.TaskFilter{{Field: "namespace", Op: "=", Value: store.DefaultNamespace}}})
+	must(t, err)
+	if len(page.Tasks) != 1 || page.Tasks[0].ID != t2 {
+		t.Fatalf("search by namespace %+v", page.Tasks)
+	}
+
+	q1, err := s.EnqueueTask(t1, "a", "svc", "{}")
+	must(t, err)
+	q2, err := s.EnqueueTask(t2, "a", "svc", "{}")
+	must(t, err)
+	if q, err := s.GetQueueTask(q1); err != nil || q.Namespace != "acme" {
+		t.Fatalf("queue entry %+v %v", q, err)
+	}
+	if _, err := s.GetQueueTask("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing queue entry: %v", err)
+	}
+	got, err := s.PollQueue("acme", "w2", []string{"svc"}, 60)
+	must(t, err)
+	if got.ID != q1 || got.Namespace != "acme" {
+		t.Fatalf("acme claim %+v", got)
+	}
+	if got, _ := s.PollQueue("acme", "w2", []string{"svc"}, 60); got.ID != "" {
+		t.Fatalf("claimed across namespaces: %+v", got)
+	}
+	if got, _ := s.PollQueue("", "w1", []string{"svc"}, 60); got.ID != q2 {
+		t.Fatalf("default claim %+v", got)
+	}
+}
+
+// boxCodec stores values wrapped in a one-element array.
+type boxCodec struct{}
+
+func (boxCodec) Encode(v string) (string, error) { return "[" + v + "]", nil }
+
+func (boxCodec) Decode(v string) (string, error) {
+	if len(v) < 2 || v[0] != '[' {
+		return "", fmt.Errorf("not boxed: %s", v)
+	}
+	return v[1 : len(v)-1], nil
+}
+
+func testRecode(t *testing.T, s store.Store) {
+	vid := newVersion(t, s)
+	tid, err := s.CreateTask(vid, `{"p":1}`, "", "a")
+	must(t, err)
+	must(t, s.UpdateTaskShared(tid, 0, `{"a":1,"b":{"x":1}}`, store.TaskEvent{}))
+	must(t, s.SaveNodeRun(map[string]interface{}{"task_id": tid, "node_key": "a", "attempt_no": 1, "status": "ok", "prep_json": "{}", "exec_input_json": `"in"`, "exec_output_json": `{"v":1}`, "error_text": "", "action": "", "started_at": int64(1), "finished_at": int64(1), "worker_id": "w", "worker_url": "u"}))
+	must(t, s.RestoreNodeState(store.NodeState{TaskID: tid, NodeKey: "a", Kind: "foreach", Version: 1, StateJSON: `{"done":[1]}`, UpdatedAt: 1}))
+	qid, err := s.EnqueueTask(tid, "a", "svc", `{"q":1}`)
+	must(t, err)
+	before, err := s.GetTask(tid)
+	must(t, err)
+	evs, _ := s.ListTaskEvents(tid)
+
+	box := boxCodec{}
+	must(t, s.RecodeTask(tid, box.Encode))
+	got, err := s.GetTask(tid)
+	must(t, err)
+	if got.ParamsJSON != `[{"p":1}]` || got.SharedJSON != `{"a":[1],"b":[{"x":1}]}` {
+		t.Fatalf("recoded task %+v", got)
+	}
+	if got.Revision != before.Revision || got.UpdatedAt != before.UpdatedAt {
+		t.Fatalf("recode touched revision or updated_at: %+v", got)
+	}
+	if after, _ := s.ListTaskEvents(tid); len(after) != len(evs) {
+		t.Fatalf("recode journaled: %+v", after)
+	}
+	runs, err := s.ListNodeRuns(tid)
+	must(t, err)
+	if len(runs) != 1 || runs[0].ExecInputJSON != `["in"]` || runs[0].ExecOutputJSON != `[{"v":1}]` {
+		t.Fatalf("recoded runs %+v", runs)
+	}
+	if ns, err := s.GetNodeState(tid, "a"); err != nil || ns.StateJSON != `[{"done":[1]}]` {
+		t.Fatalf("recoded node state %+v %v", ns, err)
+	}
+	if q, err := s.GetQueueTask(qid); err != nil || q.InputJSON != `[{"q":1}]` {
+		t.Fatalf("recoded queue entry %+v %v", q, err)
+	}
+
+	// Shared ops with a codec merge into the decoded value.
+	must(t, s.PatchTaskShared(tid, []store.SharedOp{
+		{Op: "merge", Key: "b", Value: []byte(`{"y":2}`), Codec: box},
+		{Op: "set", Key: "c", Value: []byte(`true`), Codec: box},
+	}, store.TaskEvent{}))
+	if got, _ := s.GetTask(tid); got.SharedJSON != `{"a":[1],"b":[{"x":1,"y":2}],"c":[true]}` {
+		t.Fatalf("shared after codec ops %s", got.SharedJSON)
+	}
+
+	// An error leaves everything as it was.
+	fail := func(v string) (string, error) {
+		if v == `[{"v":1}]` {
+			return "", errors.New("boom")
+		}
+		return box.Decode(v)
+	}
+	if err := s.RecodeTask(tid, fail); err == nil || err.Error() != "boom" {
+		t.Fatalf("want boom, got %v", err)
+	}
+	if got, _ := s.GetTask(tid); got.ParamsJSON != `[{"p":1}]` {
+		t.Fatalf("failed recode changed params: %s", got.ParamsJSON)
+	}
+	if err := s.RecodeTask("missing", box.Encode); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing task: %v", err)
+	}
+}